@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// runCheck fetches a URL once from a specific egress IP and prints the
+// response body, returning the exit code
+func runCheck(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	configPath := configFlag(fs)
+	timeout := fs.Duration("timeout", 30*time.Second, "timeout for the whole request")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: specificproxy check [flags] <ip> <url>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+	ip := net.ParseIP(fs.Arg(0))
+	if ip == nil {
+		fmt.Fprintf(os.Stderr, "invalid IP %q\n", fs.Arg(0))
+		return 2
+	}
+	target, err := url.Parse(fs.Arg(1))
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		fmt.Fprintf(os.Stderr, "invalid URL %q, expected http:// or https://\n", fs.Arg(1))
+		return 2
+	}
+
+	cfg, err := loadConfig(*configPath, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	iface, ok := cfg.InterfaceForIP(ip.String())
+	if !ok {
+		fmt.Fprintf(os.Stderr, "%s is not on an allowed interface\n", ip)
+		return 1
+	}
+
+	timeouts := cfg.TimeoutsFor(target.Hostname())
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				LocalAddr: &net.TCPAddr{IP: ip},
+				Timeout:   timeouts.Dial,
+			}).DialContext,
+			TLSHandshakeTimeout:   timeouts.TLSHandshake,
+			ResponseHeaderTimeout: timeouts.ResponseHeader,
+			DisableKeepAlives:     true,
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "request from %s (%s) failed: %v\n", ip, iface, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	fmt.Fprintf(os.Stderr, "%s from %s (%s) in %s\n", resp.Status, ip, iface, time.Since(start).Round(time.Millisecond))
+
+	if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read response: %v\n", err)
+		return 1
+	}
+	if resp.StatusCode >= 400 {
+		return 1
+	}
+	return 0
+}
@@ -1,20 +1,587 @@
 package config
 
 import (
+	"fmt"
 	"net"
 	"os"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/danthegoodman1/specificproxy/gologger"
 	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/parser"
 )
 
 var logger = gologger.NewLogger()
 
 // Config holds the application configuration
 type Config struct {
+	// ListenAddr is the proxy listen address, defaults to DefaultListenAddr
+	ListenAddr string `yaml:"listen_addr"`
+	// ShutdownSleep is how long to keep running after a shutdown signal while
+	// health checks already fail, e.g. for load balancer deregistration
+	ShutdownSleep time.Duration `yaml:"shutdown_sleep"`
+	// DrainTimeout is how long open tunnels may finish during shutdown,
+	// defaults to DefaultDrainTimeout
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+	// Server configures the proxy and admin listeners
+	Server ServerConfig `yaml:"server"`
+	// HTTP3 serves CONNECT-UDP over HTTP/3
+	HTTP3 HTTP3Config `yaml:"http3"`
+	// Transparent accepts redirected connections from clients without proxy support
+	Transparent TransparentConfig `yaml:"transparent"`
+	// Forwards relay local ports to fixed destinations through egress IPs
+	Forwards []Forward `yaml:"forwards"`
+	// Ports opens extra proxy listeners bound to egress IPs, for clients that
+	// can't set X-Egress-IP
+	Ports PortsConfig `yaml:"ports"`
+	// Log configures logging
+	Log LogConfig `yaml:"log"`
+
+	// RateLimit sets defaults for X-Rate-Limit, and a limit for requests without one
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	// RateLimitPolicies are named limits selected with the ratelimit username option
+	RateLimitPolicies map[string]RateLimitConfig `yaml:"rate_limit_policies"`
+	// Sessions configures sticky sessions from the session username option
+	Sessions SessionConfig `yaml:"sessions"`
+	// Fetch limits batch fetches
+	Fetch FetchConfig `yaml:"fetch"`
+
 	// AllowedInterfaces is the list of network interface names that can be used for egress
 	AllowedInterfaces []string `yaml:"allowed_interfaces"`
+
+	// MITM configures opt-in TLS interception for CONNECT tunnels
+	MITM MITMConfig `yaml:"mitm"`
+
+	// HeaderRules rewrite headers on proxied requests and responses, applied in order
+	HeaderRules []HeaderRule `yaml:"header_rules"`
+	// ProxyHeaders adds Via and Forwarded headers, off by default to stay invisible
+	ProxyHeaders ProxyHeadersConfig `yaml:"proxy_headers"`
+
+	// Timeouts are the global proxy timeouts, unset values use DefaultTimeouts
+	Timeouts Timeouts `yaml:"timeouts"`
+	// TimeoutOverrides override Timeouts for matching destinations, first match wins
+	TimeoutOverrides []TimeoutOverride `yaml:"timeout_overrides"`
+
+	// Bandwidth limits throughput per egress IP and per user
+	Bandwidth BandwidthConfig `yaml:"bandwidth"`
+
+	// Concurrency limits the number of simultaneously active proxy connections
+	Concurrency ConcurrencyConfig `yaml:"concurrency"`
+
+	// Health configures egress IP health tracking and quarantine
+	Health HealthConfig `yaml:"health"`
+
+	// Retry configures retrying failed unpinned requests through a different egress IP
+	Retry RetryConfig `yaml:"retry"`
+
+	// DisableEgressHeaders stops reporting the egress IP and interface used in responses
+	DisableEgressHeaders bool `yaml:"disable_egress_headers"`
+
+	// Admin configures the admin API
+	Admin AdminConfig `yaml:"admin"`
+	// Egress overrides the state and weight of egress IPs and interfaces
+	Egress EgressConfig `yaml:"egress"`
+
+	// mu guards AllowedInterfaces and Egress, which the admin API changes at runtime
+	mu sync.RWMutex
+	// path is the file the config was loaded from
+	path string
+	// source is the YAML the config was loaded from, used to locate validation errors
+	source []byte
+}
+
+const (
+	// DefaultListenAddr is the proxy listen address if ListenAddr is unset
+	DefaultListenAddr = ":8080"
+	// DefaultDrainTimeout is the shutdown drain timeout if DrainTimeout is unset
+	DefaultDrainTimeout = 30 * time.Second
+)
+
+// GetListenAddr returns the listen address, defaulting to DefaultListenAddr
+func (c *Config) GetListenAddr() string {
+	if c.ListenAddr == "" {
+		return DefaultListenAddr
+	}
+	return c.ListenAddr
+}
+
+// GetDrainTimeout returns the drain timeout, defaulting to DefaultDrainTimeout
+func (c *Config) GetDrainTimeout() time.Duration {
+	if c.DrainTimeout <= 0 {
+		return DefaultDrainTimeout
+	}
+	return c.DrainTimeout
+}
+
+// ServerConfig holds the timeouts of the proxy and admin listeners, and the
+// TLS settings of the proxy listeners
+type ServerConfig struct {
+	// ReadHeaderTimeout bounds reading client request headers, defaults to 5s.
+	// Request bodies use the request_body timeout instead.
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	// IdleTimeout closes idle client keep-alive connections, defaults to 120s
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// TLSCert and TLSKey serve the proxy and port listeners over TLS, with
+	// HTTP/2 negotiated by ALPN. Without them HTTP/2 is h2c with prior knowledge.
+	TLSCert string `yaml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key"`
+	// Hostnames are public names of the proxy, such as the name of a load
+	// balancer in front of it. HTTP/2 requests for them, like those for the
+	// listen address or the TLS certificate's names, reach its own endpoints.
+	Hostnames []string `yaml:"hostnames"`
+}
+
+// TLSEnabled reports if the proxy listeners serve TLS
+func (c *ServerConfig) TLSEnabled() bool {
+	return c.TLSCert != "" && c.TLSKey != ""
+}
+
+// GetReadHeaderTimeout returns the read header timeout, defaulting to 5s
+func (c *ServerConfig) GetReadHeaderTimeout() time.Duration {
+	if c.ReadHeaderTimeout <= 0 {
+		return 5 * time.Second
+	}
+	return c.ReadHeaderTimeout
+}
+
+// GetIdleTimeout returns the idle timeout, defaulting to 120s
+func (c *ServerConfig) GetIdleTimeout() time.Duration {
+	if c.IdleTimeout <= 0 {
+		return 120 * time.Second
+	}
+	return c.IdleTimeout
+}
+
+// HTTP3Config configures the HTTP/3 listener for CONNECT-UDP (RFC 9298). It
+// uses the TLS certificate of the server config.
+type HTTP3Config struct {
+	// ListenAddr is the UDP address of the HTTP/3 listener, empty disables it
+	ListenAddr string `yaml:"listen_addr"`
+}
+
+// DefaultPerIPMax caps the number of per IP ports if PerIPMax is unset
+const DefaultPerIPMax = 256
+
+// DefaultPortsRefresh is how often per IP ports are updated if Refresh is unset
+const DefaultPortsRefresh = 30 * time.Second
+
+// PortsConfig configures proxy listeners that choose the egress IP by the
+// port the client connected to
+type PortsConfig struct {
+	// Host is the address the port listeners bind to, defaults to the host of
+	// ListenAddr. Use 0.0.0.0 or :: for all addresses.
+	Host string `yaml:"host"`
+	// PerIPBase maps port PerIPBase+N to the Nth address from GetAvailableIPs, 0 disables it
+	PerIPBase int `yaml:"per_ip_base"`
+	// PerIPMax caps the number of per IP ports, defaults to DefaultPerIPMax
+	PerIPMax int `yaml:"per_ip_max"`
+	// Refresh is how often the available IPs are re-read to update the per IP
+	// ports, defaults to DefaultPortsRefresh
+	Refresh time.Duration `yaml:"refresh"`
+	// Pools bind single ports to an egress IP or a selection of them
+	Pools []PortPool `yaml:"pools"`
+}
+
+// GetPortsHost returns the address the port listeners bind to, defaulting
+// to the host of the listen address
+func (c *Config) GetPortsHost() string {
+	if c.Ports.Host != "" {
+		return c.Ports.Host
+	}
+	host, _, err := net.SplitHostPort(c.GetListenAddr())
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// GetPerIPMax returns the per IP port cap, defaulting to DefaultPerIPMax
+func (c *PortsConfig) GetPerIPMax() int {
+	if c.PerIPMax <= 0 {
+		return DefaultPerIPMax
+	}
+	return c.PerIPMax
+}
+
+// GetRefresh returns the refresh interval, defaulting to DefaultPortsRefresh
+func (c *PortsConfig) GetRefresh() time.Duration {
+	if c.Refresh <= 0 {
+		return DefaultPortsRefresh
+	}
+	return c.Refresh
+}
+
+// PortPool binds a port to the egress IPs matching all of its non-empty
+// filters. Without an IP, one is picked per request like for unpinned requests.
+type PortPool struct {
+	Port int `yaml:"port" json:"port"`
+	// IP pins the port to a single egress IP
+	IP string `yaml:"ip" json:"ip,omitempty"`
+	// Interfaces limits selection to IPs on these interfaces
+	Interfaces []string `yaml:"interfaces" json:"interfaces,omitempty"`
+	// Version limits selection to IPv4 (4) or IPv6 (6) addresses
+	Version int `yaml:"version" json:"version,omitempty"`
+}
+
+// Matches checks if an available IP belongs to the pool
+func (p *PortPool) Matches(info IPInfo) bool {
+	if p.IP != "" && !net.ParseIP(p.IP).Equal(net.ParseIP(info.IP)) {
+		return false
+	}
+	if len(p.Interfaces) > 0 && !slices.Contains(p.Interfaces, info.Interface) {
+		return false
+	}
+	return p.Version == 0 || p.Version == info.Version
+}
+
+// LogConfig configures the log level and format
+type LogConfig struct {
+	// Level is trace, debug, info (default), warn or error
+	Level string `yaml:"level"`
+	// Format is json (default) or pretty
+	Format string `yaml:"format"`
+}
+
+// RateLimitConfig holds rate limit defaults. Fields missing from X-Rate-Limit
+// fall back to these, and if Rate is set requests without the header are
+// limited too.
+type RateLimitConfig struct {
+	// Method is token_bucket (default) or fixed_window
+	Method string `yaml:"method"`
+	// Rate is the number of requests allowed per Period
+	Rate int `yaml:"rate"`
+	// Period is the rate limit window, in whole seconds
+	Period time.Duration `yaml:"period"`
+	// TTL is how long an unused limiter is kept, defaults to 5m
+	TTL time.Duration `yaml:"ttl"`
+	// Resource is how requests are keyed, domain or domain_path
+	Resource string `yaml:"resource"`
+}
+
+// DefaultSessionTTL is how long an unused sticky session is kept if TTL is unset
+const DefaultSessionTTL = 10 * time.Minute
+
+// SessionConfig configures sticky sessions
+type SessionConfig struct {
+	// TTL is how long a session keeps its egress IP after its last request,
+	// defaults to DefaultSessionTTL
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// GetTTL returns the session TTL, defaulting to DefaultSessionTTL
+func (c *SessionConfig) GetTTL() time.Duration {
+	if c.TTL <= 0 {
+		return DefaultSessionTTL
+	}
+	return c.TTL
+}
+
+// Batch fetch defaults
+const (
+	// DefaultMaxBatchJobs is the most jobs a batch may have if MaxBatchJobs is unset
+	DefaultMaxBatchJobs = 1000
+	// DefaultMaxBatchConcurrency is the highest batch concurrency if MaxBatchConcurrency is unset
+	DefaultMaxBatchConcurrency = 64
+)
+
+// FetchConfig limits batch fetches
+type FetchConfig struct {
+	// MaxBatchJobs limits the jobs of a batch, defaults to DefaultMaxBatchJobs
+	MaxBatchJobs int `yaml:"max_batch_jobs"`
+	// MaxBatchConcurrency limits the jobs a batch runs at once, defaults to
+	// DefaultMaxBatchConcurrency
+	MaxBatchConcurrency int `yaml:"max_batch_concurrency"`
+}
+
+// GetMaxBatchJobs returns MaxBatchJobs, defaulting to DefaultMaxBatchJobs
+func (c *FetchConfig) GetMaxBatchJobs() int {
+	if c.MaxBatchJobs <= 0 {
+		return DefaultMaxBatchJobs
+	}
+	return c.MaxBatchJobs
+}
+
+// GetMaxBatchConcurrency returns MaxBatchConcurrency, defaulting to DefaultMaxBatchConcurrency
+func (c *FetchConfig) GetMaxBatchConcurrency() int {
+	if c.MaxBatchConcurrency <= 0 {
+		return DefaultMaxBatchConcurrency
+	}
+	return c.MaxBatchConcurrency
+}
+
+// DefaultPseudonym names the proxy in Via headers if Pseudonym is unset
+const DefaultPseudonym = "specificproxy"
+
+// ProxyHeadersConfig configures the headers announcing the proxy on
+// forwarded requests
+type ProxyHeadersConfig struct {
+	// Via adds the proxy to the Via header of requests and responses, and
+	// rejects requests that already passed through it
+	Via bool `yaml:"via"`
+	// Forwarded adds the client address to the Forwarded header of requests
+	Forwarded bool `yaml:"forwarded"`
+	// Pseudonym names the proxy in Via, defaults to DefaultPseudonym. Chained
+	// proxies need different pseudonyms.
+	Pseudonym string `yaml:"pseudonym"`
+}
+
+// GetPseudonym returns Pseudonym, defaulting to DefaultPseudonym
+func (c *ProxyHeadersConfig) GetPseudonym() string {
+	if c.Pseudonym == "" {
+		return DefaultPseudonym
+	}
+	return c.Pseudonym
+}
+
+// RetryConfig configures retries of unpinned GET, HEAD and CONNECT requests
+// through a different egress IP. Retries are disabled unless MaxAttempts is above 1.
+type RetryConfig struct {
+	// MaxAttempts is the total number of attempts including the first one
+	MaxAttempts int `yaml:"max_attempts"`
+	// Backoff is the wait before the first retry, doubled on every further retry
+	Backoff time.Duration `yaml:"backoff"`
+	// StatusCodes are upstream responses treated as blocked and retried, e.g. 403, 429
+	StatusCodes []int `yaml:"status_codes"`
+}
+
+// BackoffFor returns the wait before the given retry, starting at 1
+func (c *RetryConfig) BackoffFor(retry int) time.Duration {
+	if c.Backoff <= 0 || retry < 1 {
+		return 0
+	}
+	return c.Backoff << (min(retry, 16) - 1)
+}
+
+// HealthConfig configures when egress IPs are quarantined from selection.
+// Tracking is disabled unless FailureThreshold is set.
+type HealthConfig struct {
+	// FailureThreshold is the number of consecutive failures before quarantine
+	FailureThreshold int `yaml:"failure_threshold"`
+	// Quarantine is the first quarantine duration, doubled on every repeat
+	Quarantine time.Duration `yaml:"quarantine"`
+	// MaxQuarantine caps the quarantine duration
+	MaxQuarantine time.Duration `yaml:"max_quarantine"`
+	// StatusCodes are upstream response codes counted as failures, e.g. 403, 429, 503
+	StatusCodes []int `yaml:"status_codes"`
+}
+
+// ConcurrencyMode is what happens to requests over a concurrency limit
+type ConcurrencyMode string
+
+const (
+	// ConcurrencyModeReject rejects requests over the limit immediately
+	ConcurrencyModeReject ConcurrencyMode = "reject"
+	// ConcurrencyModeQueue waits for a free slot up to QueueTimeout
+	ConcurrencyModeQueue ConcurrencyMode = "queue"
+)
+
+// DefaultQueueTimeout is how long queued requests wait if QueueTimeout is unset
+const DefaultQueueTimeout = 30 * time.Second
+
+// ConcurrencyConfig holds limits on active connections, 0 is unlimited
+type ConcurrencyConfig struct {
+	// PerEgressIP limits active connections per egress IP
+	PerEgressIP int `yaml:"per_egress_ip"`
+	// PerDestination limits active connections per egress IP and destination host
+	PerDestination int `yaml:"per_destination"`
+	// PerClient limits active connections per client address
+	PerClient int `yaml:"per_client"`
+
+	// Mode is reject (default) or queue
+	Mode ConcurrencyMode `yaml:"mode"`
+	// QueueTimeout is how long a queued request waits, defaults to DefaultQueueTimeout
+	QueueTimeout time.Duration `yaml:"queue_timeout"`
+	// RejectStatus is the status for requests over the limit, 429 (default) or 503
+	RejectStatus int `yaml:"reject_status"`
+}
+
+// GetQueueTimeout returns the queue timeout, defaulting to DefaultQueueTimeout
+func (c *ConcurrencyConfig) GetQueueTimeout() time.Duration {
+	if c.QueueTimeout <= 0 {
+		return DefaultQueueTimeout
+	}
+	return c.QueueTimeout
+}
+
+// GetRejectStatus returns the reject status, defaulting to 429
+func (c *ConcurrencyConfig) GetRejectStatus() int {
+	if c.RejectStatus == 0 {
+		return 429
+	}
+	return c.RejectStatus
+}
+
+// BandwidthConfig holds byte rate limits in bytes per second, 0 is unlimited.
+// Limits are shared by every connection using the same egress IP or user.
+type BandwidthConfig struct {
+	// PerEgressIP is the default limit for each egress IP
+	PerEgressIP int64 `yaml:"per_egress_ip"`
+	// PerUser is the default limit for each proxy user
+	PerUser int64 `yaml:"per_user"`
+	// EgressIPs overrides PerEgressIP for specific IPs
+	EgressIPs map[string]int64 `yaml:"egress_ips"`
+	// Users overrides PerUser for specific users
+	Users map[string]int64 `yaml:"users"`
+}
+
+// LimitForEgressIP returns the byte rate limit for an egress IP
+func (b *BandwidthConfig) LimitForEgressIP(ip string) int64 {
+	parsed := net.ParseIP(ip)
+	for configured, limit := range b.EgressIPs {
+		if net.ParseIP(configured).Equal(parsed) {
+			return limit
+		}
+	}
+	return b.PerEgressIP
+}
+
+// LimitForUser returns the byte rate limit for a proxy user, requests
+// without a user are not limited per user
+func (b *BandwidthConfig) LimitForUser(user string) int64 {
+	if user == "" {
+		return 0
+	}
+	if limit, ok := b.Users[user]; ok {
+		return limit
+	}
+	return b.PerUser
+}
+
+// Timeouts configures how long proxied connections may take. Zero values
+// are unset and fall back to the next level.
+type Timeouts struct {
+	// Dial is the timeout for connecting to the destination
+	Dial time.Duration `yaml:"dial"`
+	// TLSHandshake is the timeout for the TLS handshake with the destination
+	TLSHandshake time.Duration `yaml:"tls_handshake"`
+	// ResponseHeader is how long to wait for the destination's response headers
+	ResponseHeader time.Duration `yaml:"response_header"`
+	// RequestBody is how long the client may take to send a request body
+	RequestBody time.Duration `yaml:"request_body"`
+	// ExpectContinue is how long a request with Expect: 100-continue waits
+	// for the destination's 100 Continue before its body is sent anyway
+	ExpectContinue time.Duration `yaml:"expect_continue"`
+	// TunnelIdle closes tunnels with no traffic in either direction for this long
+	TunnelIdle time.Duration `yaml:"tunnel_idle"`
+	// TunnelMaxLifetime closes tunnels open for longer than this
+	TunnelMaxLifetime time.Duration `yaml:"tunnel_max_lifetime"`
+}
+
+// DefaultTimeouts are used for anything not configured. Zero means no timeout.
+var DefaultTimeouts = Timeouts{
+	Dial:           10 * time.Second,
+	TLSHandshake:   10 * time.Second,
+	ExpectContinue: time.Second,
+}
+
+// TimeoutOverride applies timeouts to destinations matching Domains
+type TimeoutOverride struct {
+	Domains  []string `yaml:"domains"`
+	Timeouts `yaml:",inline"`
+}
+
+// merge returns t with every set value of other applied on top
+func (t Timeouts) merge(other Timeouts) Timeouts {
+	if other.Dial > 0 {
+		t.Dial = other.Dial
+	}
+	if other.TLSHandshake > 0 {
+		t.TLSHandshake = other.TLSHandshake
+	}
+	if other.ResponseHeader > 0 {
+		t.ResponseHeader = other.ResponseHeader
+	}
+	if other.RequestBody > 0 {
+		t.RequestBody = other.RequestBody
+	}
+	if other.ExpectContinue > 0 {
+		t.ExpectContinue = other.ExpectContinue
+	}
+	if other.TunnelIdle > 0 {
+		t.TunnelIdle = other.TunnelIdle
+	}
+	if other.TunnelMaxLifetime > 0 {
+		t.TunnelMaxLifetime = other.TunnelMaxLifetime
+	}
+	return t
+}
+
+// TimeoutsFor resolves the timeouts for a destination host: defaults, then
+// global timeouts, then the first matching override
+func (c *Config) TimeoutsFor(host string) Timeouts {
+	t := DefaultTimeouts.merge(c.Timeouts)
+	for _, override := range c.TimeoutOverrides {
+		if slices.ContainsFunc(override.Domains, func(pattern string) bool {
+			return MatchDomain(pattern, host)
+		}) {
+			return t.merge(override.Timeouts)
+		}
+	}
+	return t
+}
+
+// HeaderRule rewrites headers for requests matching all of its non-empty scopes
+type HeaderRule struct {
+	// Domains scopes the rule to destination hosts, see MatchDomain
+	Domains []string `yaml:"domains"`
+	// Users scopes the rule to proxy users from Proxy-Authorization
+	Users []string `yaml:"users"`
+	// EgressIPs scopes the rule to the selected egress IPs
+	EgressIPs []string `yaml:"egress_ips"`
+
+	// Request actions are applied to the outgoing request
+	Request []HeaderAction `yaml:"request"`
+	// Response actions are applied to the response sent to the client
+	Response []HeaderAction `yaml:"response"`
+}
+
+// HeaderActionKind is the operation a HeaderAction performs
+type HeaderActionKind string
+
+const (
+	HeaderActionAdd    HeaderActionKind = "add"
+	HeaderActionSet    HeaderActionKind = "set"
+	HeaderActionRemove HeaderActionKind = "remove"
+)
+
+// HeaderAction is a single header modification. Value is a Go template,
+// see the README for the available fields.
+type HeaderAction struct {
+	Action HeaderActionKind `yaml:"action"`
+	Name   string           `yaml:"name"`
+	Value  string           `yaml:"value"`
+}
+
+// Matches checks if the rule applies to a request to host from user via egressIP
+func (r *HeaderRule) Matches(host, user, egressIP string) bool {
+	if len(r.Domains) > 0 && !slices.ContainsFunc(r.Domains, func(pattern string) bool {
+		return MatchDomain(pattern, host)
+	}) {
+		return false
+	}
+	if len(r.Users) > 0 && !slices.Contains(r.Users, user) {
+		return false
+	}
+	if len(r.EgressIPs) > 0 && !slices.ContainsFunc(r.EgressIPs, func(ip string) bool {
+		return net.ParseIP(ip).Equal(net.ParseIP(egressIP))
+	}) {
+		return false
+	}
+	return true
+}
+
+// MITMConfig configures TLS interception. Only CONNECT tunnels to the listed
+// domains are terminated, everything else is tunneled untouched.
+type MITMConfig struct {
+	// Domains to intercept, either exact hostnames or "*.example.com" wildcards
+	Domains []string `yaml:"domains"`
+	// CACert and CAKey are paths to the PEM encoded CA used to sign leaf
+	// certificates. Both are generated on first start if missing.
+	CACert string `yaml:"ca_cert"`
+	CAKey  string `yaml:"ca_key"`
 }
 
 var (
@@ -22,17 +589,30 @@ var (
 	configMu     sync.RWMutex
 )
 
-// LoadConfig reads and parses the config file
+// LoadConfig reads and parses the config file, interpolating ${VAR}
+// references. Unknown fields are errors, call Validate to check the values.
 func LoadConfig(path string) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
+	file, err := parser.ParseBytes(data, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, yaml.FormatError(err, false, true))
+	}
+	if err := expandEnv(file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
 
 	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return nil, err
+	if len(file.Docs) > 0 && file.Docs[0].Body != nil {
+		if err := yaml.NodeToValue(file.Docs[0].Body, &cfg, yaml.Strict()); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, yaml.FormatError(err, false, true))
+		}
 	}
+	cfg.path = path
+	cfg.source = data
+	cfg.Transparent.compileLabels()
 
 	configMu.Lock()
 	globalConfig = &cfg
@@ -52,19 +632,18 @@ func GetConfig() *Config {
 
 // IPInfo represents an available IP address
 type IPInfo struct {
-	Interface string `json:"interface"`
-	IP        string `json:"ip"`
-	Version   int    `json:"version"` // 4 or 6
+	Interface string      `json:"interface"`
+	IP        string      `json:"ip"`
+	Version   int         `json:"version"` // 4 or 6
+	State     EgressState `json:"state"`
+	Weight    int         `json:"weight"`
 }
 
 // GetAvailableIPs returns all non-link-local IPs from allowed interfaces
 func (c *Config) GetAvailableIPs() ([]IPInfo, error) {
 	var result []IPInfo
 
-	allowedSet := make(map[string]bool)
-	for _, iface := range c.AllowedInterfaces {
-		allowedSet[iface] = true
-	}
+	allowedSet := c.allowedInterfaces()
 
 	interfaces, err := net.Interfaces()
 	if err != nil {
@@ -114,10 +693,13 @@ func (c *Config) GetAvailableIPs() ([]IPInfo, error) {
 				version = 6
 			}
 
+			override := c.EgressOverrideFor(ip.String(), iface.Name)
 			result = append(result, IPInfo{
 				Interface: iface.Name,
 				IP:        ip.String(),
 				Version:   version,
+				State:     override.State,
+				Weight:    override.Weight,
 			})
 		}
 	}
@@ -125,21 +707,25 @@ func (c *Config) GetAvailableIPs() ([]IPInfo, error) {
 	return result, nil
 }
 
-// IsIPAllowed checks if the given IP belongs to an allowed interface
+// IsIPAllowed checks if the given IP belongs to an allowed interface and is
+// enabled for new requests
 func (c *Config) IsIPAllowed(ipStr string) bool {
+	iface, ok := c.InterfaceForIP(ipStr)
+	return ok && c.EgressOverrideFor(ipStr, iface).State == EgressEnabled
+}
+
+// InterfaceForIP returns the name of the allowed interface the given IP belongs to
+func (c *Config) InterfaceForIP(ipStr string) (string, bool) {
 	ip := net.ParseIP(ipStr)
 	if ip == nil {
-		return false
+		return "", false
 	}
 
-	allowedSet := make(map[string]bool)
-	for _, iface := range c.AllowedInterfaces {
-		allowedSet[iface] = true
-	}
+	allowedSet := c.allowedInterfaces()
 
 	interfaces, err := net.Interfaces()
 	if err != nil {
-		return false
+		return "", false
 	}
 
 	for _, iface := range interfaces {
@@ -164,10 +750,37 @@ func (c *Config) IsIPAllowed(ipStr string) bool {
 			}
 
 			if ifaceIP.Equal(ip) {
-				return true
+				return iface.Name, true
 			}
 		}
 	}
 
+	return "", false
+}
+
+// ShouldIntercept checks if CONNECT tunnels to the given host (with or without
+// port) should be terminated with a locally issued certificate
+func (c *Config) ShouldIntercept(host string) bool {
+	for _, pattern := range c.MITM.Domains {
+		if MatchDomain(pattern, host) {
+			return true
+		}
+	}
 	return false
 }
+
+// MatchDomain checks if host matches the pattern. Patterns are either exact
+// hostnames or "*.example.com" which matches any subdomain of example.com
+// (but not example.com itself). Ports on host are ignored.
+func MatchDomain(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
+}
@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -115,6 +116,22 @@ func TestIsIPAllowed_NonExistent(t *testing.T) {
 	}
 }
 
+func TestInterfaceForIP(t *testing.T) {
+	cfg := &Config{
+		AllowedInterfaces: []string{"lo"},
+	}
+
+	if iface, ok := cfg.InterfaceForIP("127.0.0.1"); !ok || iface != "lo" {
+		t.Errorf("expected lo, got %q (%v)", iface, ok)
+	}
+	if _, ok := cfg.InterfaceForIP("10.255.255.255"); ok {
+		t.Error("should not find an interface for a non-existent IP")
+	}
+	if _, ok := (&Config{}).InterfaceForIP("127.0.0.1"); ok {
+		t.Error("should not find an interface that isn't allowed")
+	}
+}
+
 func TestIsIPAllowed_EmptyInterfaces(t *testing.T) {
 	cfg := &Config{
 		AllowedInterfaces: []string{},
@@ -125,3 +142,193 @@ func TestIsIPAllowed_EmptyInterfaces(t *testing.T) {
 		t.Error("should not allow any IP with empty interface list")
 	}
 }
+
+func TestMatchDomain(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		host     string
+		expected bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "example.com:443", true},
+		{"example.com", "EXAMPLE.com.", true},
+		{"example.com", "api.example.com", false},
+		{"*.example.com", "api.example.com:443", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "badexample.com", false},
+		{"::1", "[::1]:443", true},
+	}
+
+	for _, tt := range tests {
+		result := MatchDomain(tt.pattern, tt.host)
+		if result != tt.expected {
+			t.Errorf("MatchDomain(%q, %q) = %v, want %v", tt.pattern, tt.host, result, tt.expected)
+		}
+	}
+}
+
+func TestShouldIntercept(t *testing.T) {
+	cfg := &Config{
+		MITM: MITMConfig{Domains: []string{"api.github.com", "*.example.com"}},
+	}
+
+	if !cfg.ShouldIntercept("api.github.com:443") {
+		t.Error("expected api.github.com to be intercepted")
+	}
+	if !cfg.ShouldIntercept("www.example.com:443") {
+		t.Error("expected www.example.com to be intercepted")
+	}
+	if cfg.ShouldIntercept("github.com:443") {
+		t.Error("expected github.com to be tunneled")
+	}
+}
+
+func TestTimeoutsFor(t *testing.T) {
+	cfg := &Config{
+		Timeouts: Timeouts{
+			Dial:       5 * time.Second,
+			TunnelIdle: time.Minute,
+		},
+		TimeoutOverrides: []TimeoutOverride{
+			{
+				Domains:  []string{"*.slow.example.com"},
+				Timeouts: Timeouts{Dial: 30 * time.Second},
+			},
+		},
+	}
+
+	t.Run("global", func(t *testing.T) {
+		timeouts := cfg.TimeoutsFor("example.com:443")
+		if timeouts.Dial != 5*time.Second {
+			t.Errorf("expected dial 5s, got %v", timeouts.Dial)
+		}
+		if timeouts.TLSHandshake != DefaultTimeouts.TLSHandshake {
+			t.Errorf("expected default TLS handshake, got %v", timeouts.TLSHandshake)
+		}
+		if timeouts.TunnelIdle != time.Minute {
+			t.Errorf("expected tunnel idle 1m, got %v", timeouts.TunnelIdle)
+		}
+	})
+
+	t.Run("override", func(t *testing.T) {
+		timeouts := cfg.TimeoutsFor("api.slow.example.com:443")
+		if timeouts.Dial != 30*time.Second {
+			t.Errorf("expected dial 30s, got %v", timeouts.Dial)
+		}
+		if timeouts.TunnelIdle != time.Minute {
+			t.Errorf("expected global tunnel idle to be kept, got %v", timeouts.TunnelIdle)
+		}
+	})
+}
+
+func TestLoadConfig_Timeouts(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.yaml")
+
+	content := `allowed_interfaces:
+  - eth0
+timeouts:
+  dial: 3s
+  tunnel_idle: 5m
+timeout_overrides:
+  - domains: ["*.example.com"]
+    response_header: 30s
+`
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	if cfg.Timeouts.Dial != 3*time.Second {
+		t.Errorf("expected dial 3s, got %v", cfg.Timeouts.Dial)
+	}
+	if cfg.Timeouts.TunnelIdle != 5*time.Minute {
+		t.Errorf("expected tunnel idle 5m, got %v", cfg.Timeouts.TunnelIdle)
+	}
+	if len(cfg.TimeoutOverrides) != 1 || cfg.TimeoutOverrides[0].ResponseHeader != 30*time.Second {
+		t.Errorf("expected override with response header 30s, got %+v", cfg.TimeoutOverrides)
+	}
+}
+
+func TestRetryConfig_BackoffFor(t *testing.T) {
+	cfg := RetryConfig{Backoff: 100 * time.Millisecond}
+	tests := []struct {
+		retry    int
+		expected time.Duration
+	}{
+		{0, 0},
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := cfg.BackoffFor(tt.retry); got != tt.expected {
+			t.Errorf("BackoffFor(%d) = %v, expected %v", tt.retry, got, tt.expected)
+		}
+	}
+
+	if got := (&RetryConfig{}).BackoffFor(3); got != 0 {
+		t.Errorf("expected no backoff when unset, got %v", got)
+	}
+}
+
+func TestServeDefaults(t *testing.T) {
+	cfg := &Config{}
+	if cfg.GetListenAddr() != DefaultListenAddr {
+		t.Errorf("expected default listen address, got %q", cfg.GetListenAddr())
+	}
+	if cfg.GetDrainTimeout() != DefaultDrainTimeout {
+		t.Errorf("expected default drain timeout, got %v", cfg.GetDrainTimeout())
+	}
+
+	cfg = &Config{ListenAddr: "127.0.0.1:3128", DrainTimeout: 5 * time.Second}
+	if cfg.GetListenAddr() != "127.0.0.1:3128" {
+		t.Errorf("expected configured listen address, got %q", cfg.GetListenAddr())
+	}
+	if cfg.GetDrainTimeout() != 5*time.Second {
+		t.Errorf("expected configured drain timeout, got %v", cfg.GetDrainTimeout())
+	}
+}
+
+func TestGetPortsHost(t *testing.T) {
+	tests := []struct {
+		cfg      *Config
+		expected string
+	}{
+		{&Config{}, ""},
+		{&Config{ListenAddr: "127.0.0.1:3128"}, "127.0.0.1"},
+		{&Config{ListenAddr: "[::1]:3128"}, "::1"},
+		{&Config{ListenAddr: "127.0.0.1:3128", Ports: PortsConfig{Host: "0.0.0.0"}}, "0.0.0.0"},
+	}
+	for _, tt := range tests {
+		if got := tt.cfg.GetPortsHost(); got != tt.expected {
+			t.Errorf("%q, %q: expected %q, got %q", tt.cfg.ListenAddr, tt.cfg.Ports.Host, tt.expected, got)
+		}
+	}
+}
+
+func TestPortPool_Matches(t *testing.T) {
+	v4 := IPInfo{Interface: "eth0", IP: "192.0.2.1", Version: 4}
+	v6 := IPInfo{Interface: "eth1", IP: "2001:db8::1", Version: 6}
+
+	tests := []struct {
+		pool     PortPool
+		expected [2]bool
+	}{
+		{PortPool{}, [2]bool{true, true}},
+		{PortPool{IP: "2001:0db8::1"}, [2]bool{false, true}},
+		{PortPool{Interfaces: []string{"eth0"}}, [2]bool{true, false}},
+		{PortPool{Version: 6}, [2]bool{false, true}},
+		{PortPool{Interfaces: []string{"eth0"}, Version: 6}, [2]bool{false, false}},
+	}
+	for _, tt := range tests {
+		if got := [2]bool{tt.pool.Matches(v4), tt.pool.Matches(v6)}; got != tt.expected {
+			t.Errorf("%+v: expected %v, got %v", tt.pool, tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package config
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/goccy/go-yaml"
+)
+
+// EgressState is the admin state of an egress IP or interface
+type EgressState string
+
+const (
+	// EgressEnabled IPs are used for new requests
+	EgressEnabled EgressState = "enabled"
+	// EgressDisabled IPs are not used, and their tunnels are closed
+	EgressDisabled EgressState = "disabled"
+	// EgressDraining IPs are not used for new requests, existing tunnels finish
+	EgressDraining EgressState = "draining"
+)
+
+// EgressOverride changes the state or selection weight of an egress IP or interface
+type EgressOverride struct {
+	State EgressState `yaml:"state,omitempty" json:"state,omitempty"`
+	// Weight is the relative chance of random selection, defaults to 1
+	Weight int `yaml:"weight,omitempty" json:"weight,omitempty"`
+}
+
+// EgressConfig holds egress IP and interface overrides, usually managed
+// through the admin API. IP overrides take precedence over interface ones.
+type EgressConfig struct {
+	IPs        map[string]EgressOverride `yaml:"ips,omitempty"`
+	Interfaces map[string]EgressOverride `yaml:"interfaces,omitempty"`
+}
+
+// AdminConfig configures the admin API, which is disabled unless ListenAddr is set
+type AdminConfig struct {
+	// ListenAddr is the address of the admin API, separate from the proxy
+	ListenAddr string `yaml:"listen_addr"`
+	// Token is the bearer token required for every admin request
+	Token string `yaml:"token"`
+	// Persist writes changes made through the admin API back to the config file
+	Persist bool `yaml:"persist"`
+}
+
+// ipKey normalizes an IP so different spellings share an override
+func ipKey(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return parsed.String()
+	}
+	return ip
+}
+
+// EgressOverrideFor returns the effective state and weight of ip on iface
+func (c *Config) EgressOverrideFor(ip, iface string) EgressOverride {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.egressOverrideFor(ip, iface)
+}
+
+func (c *Config) egressOverrideFor(ip, iface string) EgressOverride {
+	ipOverride := c.Egress.IPs[ipKey(ip)]
+	ifaceOverride := c.Egress.Interfaces[iface]
+
+	effective := EgressOverride{State: EgressEnabled, Weight: 1}
+	if ipOverride.State != "" {
+		effective.State = ipOverride.State
+	} else if ifaceOverride.State != "" {
+		effective.State = ifaceOverride.State
+	}
+	if ipOverride.Weight > 0 {
+		effective.Weight = ipOverride.Weight
+	} else if ifaceOverride.Weight > 0 {
+		effective.Weight = ifaceOverride.Weight
+	}
+	return effective
+}
+
+// UpdateEgressIP applies update to the override of ip
+func (c *Config) UpdateEgressIP(ip string, update func(*EgressOverride)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Egress.IPs == nil {
+		c.Egress.IPs = make(map[string]EgressOverride)
+	}
+	key := ipKey(ip)
+	override := c.Egress.IPs[key]
+	update(&override)
+	if override == (EgressOverride{}) {
+		delete(c.Egress.IPs, key)
+	} else {
+		c.Egress.IPs[key] = override
+	}
+}
+
+// UpdateEgressInterface applies update to the override of an interface. Enabling
+// an interface that isn't in AllowedInterfaces adds it.
+func (c *Config) UpdateEgressInterface(name string, update func(*EgressOverride)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Egress.Interfaces == nil {
+		c.Egress.Interfaces = make(map[string]EgressOverride)
+	}
+	override := c.Egress.Interfaces[name]
+	update(&override)
+
+	if override.State == EgressEnabled {
+		if !slices.Contains(c.AllowedInterfaces, name) {
+			c.AllowedInterfaces = append(slices.Clone(c.AllowedInterfaces), name)
+		}
+		// Enabled is the default for allowed interfaces
+		override.State = ""
+	}
+	if override == (EgressOverride{}) {
+		delete(c.Egress.Interfaces, name)
+	} else {
+		c.Egress.Interfaces[name] = override
+	}
+}
+
+// IsInterfaceAllowed checks if name is in AllowedInterfaces
+func (c *Config) IsInterfaceAllowed(name string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return slices.Contains(c.AllowedInterfaces, name)
+}
+
+// allowedInterfaces returns the allowed interface names as a set
+func (c *Config) allowedInterfaces() map[string]bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	allowedSet := make(map[string]bool, len(c.AllowedInterfaces))
+	for _, iface := range c.AllowedInterfaces {
+		allowedSet[iface] = true
+	}
+	return allowedSet
+}
+
+// Save writes the allowed interfaces and egress overrides back to the file
+// the config was loaded from, keeping every other setting. Comments are not kept.
+func (c *Config) Save() error {
+	if c.path == "" {
+		return errors.New("config was not loaded from a file")
+	}
+
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	c.mu.RLock()
+	doc = setMapItem(doc, "allowed_interfaces", slices.Clone(c.AllowedInterfaces))
+	if len(c.Egress.IPs) > 0 || len(c.Egress.Interfaces) > 0 {
+		doc = setMapItem(doc, "egress", c.Egress)
+	} else {
+		doc = slices.DeleteFunc(doc, func(item yaml.MapItem) bool { return item.Key == "egress" })
+	}
+	out, err := yaml.Marshal(doc)
+	c.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a failed write can't corrupt the config
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), ".config-*.yaml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(out); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if info, err := os.Stat(c.path); err == nil {
+		os.Chmod(tmp.Name(), info.Mode())
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
+
+// setMapItem replaces the value of key in doc, appending it if missing
+func setMapItem(doc yaml.MapSlice, key string, value any) yaml.MapSlice {
+	for i, item := range doc {
+		if item.Key == key {
+			doc[i].Value = value
+			return doc
+		}
+	}
+	return append(doc, yaml.MapItem{Key: key, Value: value})
+}
@@ -0,0 +1,111 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEgressOverrideFor(t *testing.T) {
+	cfg := &Config{Egress: EgressConfig{
+		IPs: map[string]EgressOverride{
+			"10.0.0.1": {State: EgressEnabled},
+			"10.0.0.2": {Weight: 4},
+		},
+		Interfaces: map[string]EgressOverride{
+			"eth0": {State: EgressDraining, Weight: 2},
+		},
+	}}
+
+	tests := []struct {
+		ip, iface string
+		expected  EgressOverride
+	}{
+		{"10.0.0.1", "eth0", EgressOverride{State: EgressEnabled, Weight: 2}},
+		{"10.0.0.2", "eth0", EgressOverride{State: EgressDraining, Weight: 4}},
+		{"10.0.0.3", "eth0", EgressOverride{State: EgressDraining, Weight: 2}},
+		{"10.0.0.3", "eth1", EgressOverride{State: EgressEnabled, Weight: 1}},
+	}
+	for _, tt := range tests {
+		if got := cfg.EgressOverrideFor(tt.ip, tt.iface); got != tt.expected {
+			t.Errorf("%s on %s: expected %+v, got %+v", tt.ip, tt.iface, tt.expected, got)
+		}
+	}
+}
+
+func TestUpdateEgressIP(t *testing.T) {
+	cfg := &Config{}
+
+	cfg.UpdateEgressIP("2001:0db8::1", func(o *EgressOverride) { o.State = EgressDisabled })
+	if cfg.EgressOverrideFor("2001:db8::1", "").State != EgressDisabled {
+		t.Error("expected override to match any spelling of the IP")
+	}
+
+	// Clearing every field removes the override
+	cfg.UpdateEgressIP("2001:db8::1", func(o *EgressOverride) { o.State = "" })
+	if len(cfg.Egress.IPs) != 0 {
+		t.Errorf("expected empty override to be removed, got %v", cfg.Egress.IPs)
+	}
+}
+
+func TestUpdateEgressInterface(t *testing.T) {
+	cfg := &Config{AllowedInterfaces: []string{"eth0"}}
+
+	cfg.UpdateEgressInterface("eth1", func(o *EgressOverride) { o.State = EgressEnabled })
+	if !cfg.IsInterfaceAllowed("eth1") {
+		t.Error("expected enabling an interface to allow it")
+	}
+	if len(cfg.Egress.Interfaces) != 0 {
+		t.Errorf("expected enabled state to be the default, got %v", cfg.Egress.Interfaces)
+	}
+
+	cfg.UpdateEgressInterface("eth0", func(o *EgressOverride) { o.State = EgressDisabled })
+	if cfg.EgressOverrideFor("10.0.0.1", "eth0").State != EgressDisabled {
+		t.Error("expected interface to be disabled")
+	}
+}
+
+func TestSave(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	content := `allowed_interfaces:
+  - eth0
+timeouts:
+  dial: 3s
+`
+	if err := os.WriteFile(configPath, []byte(content), 0640); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.UpdateEgressIP("10.0.0.1", func(o *EgressOverride) { o.Weight = 3 })
+	cfg.UpdateEgressInterface("eth1", func(o *EgressOverride) { o.State = EgressEnabled })
+	if err := cfg.Save(); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	saved, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("failed to load saved config: %v", err)
+	}
+	if saved.Timeouts.Dial != 3*time.Second {
+		t.Errorf("expected other settings to be kept, got dial timeout %v", saved.Timeouts.Dial)
+	}
+	if len(saved.AllowedInterfaces) != 2 || saved.AllowedInterfaces[1] != "eth1" {
+		t.Errorf("expected eth1 to be added, got %v", saved.AllowedInterfaces)
+	}
+	if saved.EgressOverrideFor("10.0.0.1", "eth0").Weight != 3 {
+		t.Errorf("expected saved weight, got %+v", saved.Egress)
+	}
+	if info, err := os.Stat(configPath); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("expected file mode to be kept, got %v (%v)", info.Mode(), err)
+	}
+
+	// Unloaded configs can't be saved
+	if err := (&Config{}).Save(); err == nil {
+		t.Error("expected error saving a config without a file")
+	}
+}
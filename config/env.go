@@ -0,0 +1,144 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-yaml/ast"
+	"github.com/goccy/go-yaml/parser"
+	"github.com/goccy/go-yaml/token"
+)
+
+// envRef matches ${VAR}, ${VAR:-default} and the $${VAR} escape
+var envRef = regexp.MustCompile(`\$(\$?)\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// expandEnv replaces ${VAR} references in the scalar values of a parsed
+// config with environment variables. ${VAR:-default} falls back to default
+// if VAR is unset or empty, and $${VAR} is kept as a literal ${VAR}. Other
+// uses of $ are left alone so header templates keep working. Comments and
+// keys aren't expanded, and values can't add structure to the config.
+func expandEnv(file *ast.File) error {
+	var missing []error
+	for _, doc := range file.Docs {
+		doc.Body = expandNode(doc.Body, &missing)
+	}
+	return errors.Join(missing...)
+}
+
+// expandNode expands the scalar values under node, returning the node to
+// use in its place
+func expandNode(node ast.Node, missing *[]error) ast.Node {
+	switch n := node.(type) {
+	case *ast.MappingNode:
+		for _, value := range n.Values {
+			value.Value = expandNode(value.Value, missing)
+		}
+	case *ast.MappingValueNode:
+		n.Value = expandNode(n.Value, missing)
+	case *ast.SequenceNode:
+		for i, value := range n.Values {
+			n.Values[i] = expandNode(value, missing)
+		}
+	case *ast.AnchorNode:
+		n.Value = expandNode(n.Value, missing)
+	case *ast.TagNode:
+		n.Value = expandNode(n.Value, missing)
+	case *ast.LiteralNode:
+		n.Value.Value = expandString(n.Value.Value, missing)
+	case *ast.StringNode:
+		return expandScalar(n, missing)
+	}
+	return node
+}
+
+// expandScalar expands a string scalar. Quoted values stay strings, plain
+// values are typed like they were written in the config, so port: ${PORT}
+// is a number. Values that would parse as anything but a scalar stay
+// strings.
+func expandScalar(n *ast.StringNode, missing *[]error) ast.Node {
+	if !envRef.MatchString(n.Value) {
+		return n
+	}
+	n.Value = expandString(n.Value, missing)
+	if n.Token.Type == token.SingleQuoteType || n.Token.Type == token.DoubleQuoteType {
+		return n
+	}
+
+	src := n.Value
+	if strings.TrimSpace(src) == "" {
+		// An empty plain value is null, like a key without a value
+		src = "null"
+	}
+	file, err := parser.ParseBytes([]byte(src), 0)
+	if err != nil || strings.ContainsAny(src, "\r\n") || len(file.Docs) != 1 {
+		return n
+	}
+	scalar, ok := file.Docs[0].Body.(ast.ScalarNode)
+	if !ok {
+		return n
+	}
+	if _, ok := scalar.(*ast.StringNode); ok {
+		return n
+	}
+	// Errors about the value point at the reference in the config
+	scalar.GetToken().Position = n.Token.Position
+	return scalar
+}
+
+// expandString replaces the ${VAR} references in s, adding an error to
+// missing for every unset variable without a default
+func expandString(s string, missing *[]error) string {
+	return envRef.ReplaceAllStringFunc(s, func(ref string) string {
+		match := envRef.FindStringSubmatch(ref)
+		if match[1] != "" {
+			return ref[1:]
+		}
+		name := match[2]
+		value, ok := os.LookupEnv(name)
+		// The default group is empty both when unmatched and when empty,
+		// so check for the :- separator
+		if value == "" && strings.Contains(ref, ":-") {
+			return match[3]
+		}
+		if !ok {
+			*missing = append(*missing, fmt.Errorf("environment variable %s is not set", name))
+		}
+		return value
+	})
+}
+
+// ApplyEnv applies the environment variables that override the config file
+func (c *Config) ApplyEnv() error {
+	if addr := os.Getenv("LISTEN_ADDR"); addr != "" {
+		c.ListenAddr = addr
+	}
+	for key, target := range map[string]*time.Duration{
+		"SHUTDOWN_SLEEP_SEC": &c.ShutdownSleep,
+		"DRAIN_TIMEOUT_SEC":  &c.DrainTimeout,
+	} {
+		if val := os.Getenv(key); val != "" {
+			secs, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", key, err)
+			}
+			*target = time.Duration(secs) * time.Second
+		}
+	}
+
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		c.Log.Level = level
+	} else if os.Getenv("TRACE") == "1" {
+		c.Log.Level = "trace"
+	} else if os.Getenv("DEBUG") == "1" {
+		c.Log.Level = "debug"
+	}
+	if os.Getenv("PRETTY") == "1" {
+		c.Log.Format = "pretty"
+	}
+	return nil
+}
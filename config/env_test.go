@@ -0,0 +1,130 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/parser"
+)
+
+// expandTestYAML expands the references in a YAML document and decodes it
+func expandTestYAML(in string) (map[string]any, error) {
+	file, err := parser.ParseBytes([]byte(in), 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := expandEnv(file); err != nil {
+		return nil, err
+	}
+	var out map[string]any
+	err = yaml.NodeToValue(file.Docs[0].Body, &out)
+	return out, err
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("PROXY_TOKEN", "s3cret")
+	t.Setenv("EMPTY_VAR", "")
+	t.Setenv("PROXY_PORT", "8080")
+	t.Setenv("PROXY_INJECT", "x\nadmin:\n  token: evil")
+	t.Setenv("PROXY_COLON", "a: b")
+
+	tests := []struct {
+		in       string
+		expected any
+	}{
+		{"v: ${PROXY_TOKEN}", "s3cret"},
+		{"v: ${UNSET_PROXY_ADDR:-:8080}", ":8080"},
+		{"v: ${EMPTY_VAR:-:8080}", ":8080"},
+		{"v: ${EMPTY_VAR}", nil},
+		{"v: ${UNSET_PROXY_ADDR:-}", nil},
+		{"v: $${PROXY_TOKEN}", "${PROXY_TOKEN}"},
+		{`v: "{{ $user := .User }}$HOME"`, "{{ $user := .User }}$HOME"},
+		{"v: http://${PROXY_TOKEN}@host", "http://s3cret@host"},
+		// Plain values are typed, quoted ones stay strings
+		{"v: ${PROXY_PORT}", uint64(8080)},
+		{`v: "${PROXY_PORT}"`, "8080"},
+		{"v:\n  - ${PROXY_PORT}\n  - '${PROXY_TOKEN}'", []any{uint64(8080), "s3cret"}},
+		// Values can't add structure
+		{"v: ${PROXY_INJECT}", "x\nadmin:\n  token: evil"},
+		{"v: ${PROXY_COLON}", "a: b"},
+		{"v: |\n  token ${PROXY_TOKEN}\n", "token s3cret\n"},
+		// Comments and keys aren't expanded
+		{"# ${UNSET_PROXY_COMMENT}\nv: x", "x"},
+	}
+	for _, tt := range tests {
+		out, err := expandTestYAML(tt.in)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tt.in, err)
+			continue
+		}
+		if len(out) != 1 || !reflect.DeepEqual(out["v"], tt.expected) {
+			t.Errorf("%q: expected v = %#v, got %#v", tt.in, tt.expected, out)
+		}
+	}
+
+	if _, err := expandTestYAML("a: ${UNSET_PROXY_A}\nb:\n  - ${UNSET_PROXY_B}"); err == nil ||
+		!strings.Contains(err.Error(), "UNSET_PROXY_A is not set") || !strings.Contains(err.Error(), "UNSET_PROXY_B is not set") {
+		t.Errorf("expected errors for every unset variable, got %v", err)
+	}
+}
+
+func TestLoadConfig_Interpolation(t *testing.T) {
+	t.Setenv("PROXY_IFACE", "lo")
+	t.Setenv("PROXY_TOKEN", "s3cret")
+
+	cfg, err := loadTestConfig(t, `allowed_interfaces: ["${PROXY_IFACE}"]
+admin:
+  listen_addr: 127.0.0.1:9090
+  token: ${PROXY_TOKEN}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.AllowedInterfaces[0] != "lo" || cfg.Admin.Token != "s3cret" {
+		t.Errorf("expected interpolated values, got %v and %q", cfg.AllowedInterfaces, cfg.Admin.Token)
+	}
+
+	// Plain values are typed after expansion
+	t.Setenv("PROXY_VIA", "true")
+	cfg, err = loadTestConfig(t, "proxy_headers:\n  via: ${PROXY_VIA}\n")
+	if err != nil || !cfg.ProxyHeaders.Via {
+		t.Errorf("expected via to be true, got %v", err)
+	}
+
+	if _, err := loadTestConfig(t, "allowed_interfaces: [\"${UNSET_PROXY_IFACE}\"]\n"); err == nil {
+		t.Error("expected error for unset variable")
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	cfg := &Config{ListenAddr: ":3128", DrainTimeout: time.Minute, Log: LogConfig{Level: "warn"}}
+
+	t.Setenv("LISTEN_ADDR", "127.0.0.1:8080")
+	t.Setenv("DRAIN_TIMEOUT_SEC", "5")
+	t.Setenv("DEBUG", "1")
+	t.Setenv("PRETTY", "1")
+	if err := cfg.ApplyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ListenAddr != "127.0.0.1:8080" || cfg.DrainTimeout != 5*time.Second {
+		t.Errorf("expected env overrides, got %q and %v", cfg.ListenAddr, cfg.DrainTimeout)
+	}
+	if cfg.Log.Level != "debug" || cfg.Log.Format != "pretty" {
+		t.Errorf("expected debug pretty logs, got %+v", cfg.Log)
+	}
+
+	// LOG_LEVEL wins over DEBUG
+	t.Setenv("LOG_LEVEL", "error")
+	cfg.ApplyEnv()
+	if cfg.Log.Level != "error" {
+		t.Errorf("expected LOG_LEVEL override, got %q", cfg.Log.Level)
+	}
+
+	t.Setenv("SHUTDOWN_SLEEP_SEC", "soon")
+	if err := cfg.ApplyEnv(); err == nil {
+		t.Error("expected error for invalid seconds")
+	}
+}
@@ -0,0 +1,33 @@
+package config
+
+import "net/netip"
+
+// Forward relays connections on a local listener to a fixed destination
+// through an egress IP, for clients that can't use a proxy
+type Forward struct {
+	// Name identifies the forward in logs, the admin API and across reloads
+	Name       string `yaml:"name" json:"name"`
+	ListenAddr string `yaml:"listen_addr" json:"listen_addr"`
+	// Target is the destination host:port
+	Target string `yaml:"target" json:"target"`
+
+	// IP pins the forward to a single egress IP
+	IP string `yaml:"ip" json:"ip,omitempty"`
+	// Interfaces limits selection to IPs on these interfaces
+	Interfaces []string `yaml:"interfaces" json:"interfaces,omitempty"`
+	// Version limits selection to IPv4 (4) or IPv6 (6) addresses
+	Version int `yaml:"version" json:"version,omitempty"`
+
+	// Allow limits clients to these IPs or CIDRs, all clients are allowed if empty
+	Allow []string `yaml:"allow" json:"allow,omitempty"`
+}
+
+// Pool returns the egress selection of the forward
+func (f *Forward) Pool() PortPool {
+	return PortPool{IP: f.IP, Interfaces: f.Interfaces, Version: f.Version}
+}
+
+// Allows checks if a client may use the forward
+func (f *Forward) Allows(client netip.Addr) bool {
+	return len(f.Allow) == 0 || containsAddr(f.Allow, client)
+}
@@ -0,0 +1,27 @@
+package config
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestForward_Allows(t *testing.T) {
+	tests := []struct {
+		allow    []string
+		client   string
+		expected bool
+	}{
+		{nil, "192.0.2.1", true},
+		{[]string{"10.0.0.0/8"}, "10.1.2.3", true},
+		{[]string{"10.0.0.0/8"}, "::ffff:10.1.2.3", true},
+		{[]string{"10.0.0.0/8", "192.0.2.1"}, "192.0.2.1", true},
+		{[]string{"10.0.0.0/8"}, "192.0.2.1", false},
+		{[]string{"2001:db8::/32"}, "2001:db8::1", true},
+	}
+	for _, tt := range tests {
+		f := Forward{Allow: tt.allow}
+		if got := f.Allows(netip.MustParseAddr(tt.client)); got != tt.expected {
+			t.Errorf("%v allows %s: expected %v, got %v", tt.allow, tt.client, tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package config
+
+import (
+	"maps"
+	"net/netip"
+	"regexp"
+	"slices"
+)
+
+// Transparent proxy modes
+const (
+	// TransparentRedirect recovers the destination of connections redirected
+	// with iptables REDIRECT from SO_ORIGINAL_DST
+	TransparentRedirect = "redirect"
+	// TransparentTProxy accepts connections diverted with iptables TPROXY,
+	// whose local address is the destination
+	TransparentTProxy = "tproxy"
+)
+
+// TransparentConfig configures the transparent listener for clients that
+// can't be configured to use a proxy. It is disabled unless ListenAddr is set.
+type TransparentConfig struct {
+	ListenAddr string `yaml:"listen_addr"`
+	// Mode is redirect (default) or tproxy
+	Mode string `yaml:"mode"`
+	// Labels derive labels from the cgroup of local clients for rules to match
+	Labels []CgroupLabel `yaml:"labels"`
+	// Rules select the egress IPs of connections, first match wins.
+	// Connections matching no rule use any egress IP.
+	Rules []TransparentRule `yaml:"rules"`
+}
+
+// GetMode returns the mode, defaulting to TransparentRedirect
+func (c *TransparentConfig) GetMode() string {
+	if c.Mode == "" {
+		return TransparentRedirect
+	}
+	return c.Mode
+}
+
+// UsesLabels reports if any rule matches on labels, which requires looking
+// up the process of every connection
+func (c *TransparentConfig) UsesLabels() bool {
+	return slices.ContainsFunc(c.Rules, func(rule TransparentRule) bool { return len(rule.Labels) > 0 })
+}
+
+// compileLabels compiles the cgroup expressions of the labels, so they
+// aren't compiled for every connection. Invalid ones are left to Validate.
+func (c *TransparentConfig) compileLabels() {
+	for i := range c.Labels {
+		c.Labels[i].re, _ = regexp.Compile(c.Labels[i].Cgroup)
+	}
+}
+
+// LabelsFor returns the labels of a cgroup path. Later matches override
+// earlier ones.
+func (c *TransparentConfig) LabelsFor(cgroup string) map[string]string {
+	labels := make(map[string]string)
+	for _, label := range c.Labels {
+		re := label.re
+		if re == nil {
+			// Configs that weren't loaded from a file aren't compiled
+			var err error
+			if re, err = regexp.Compile(label.Cgroup); err != nil {
+				continue
+			}
+		}
+		match := re.FindStringSubmatch(cgroup)
+		if match == nil {
+			continue
+		}
+		maps.Copy(labels, label.Labels)
+		for i, name := range re.SubexpNames() {
+			if name != "" {
+				labels[name] = match[i]
+			}
+		}
+	}
+	return labels
+}
+
+// Rule returns the first rule matching a connection, or nil
+func (c *TransparentConfig) Rule(src, dst netip.AddrPort, labels map[string]string) *TransparentRule {
+	for i := range c.Rules {
+		if c.Rules[i].Matches(src, dst, labels) {
+			return &c.Rules[i]
+		}
+	}
+	return nil
+}
+
+// CgroupLabel sets labels on clients whose cgroup path matches
+type CgroupLabel struct {
+	// Cgroup is a regular expression matched against the cgroup path, e.g.
+	// /system.slice/crawler.service. Named groups become labels.
+	Cgroup string `yaml:"cgroup"`
+	// Labels are set on matching clients
+	Labels map[string]string `yaml:"labels"`
+
+	re *regexp.Regexp
+}
+
+// TransparentRule matches connections by all of its non-empty conditions
+// and selects their egress IPs like a port pool
+type TransparentRule struct {
+	// Sources are client IPs or CIDRs
+	Sources []string `yaml:"sources"`
+	// Destinations are destination IPs or CIDRs
+	Destinations []string `yaml:"destinations"`
+	// Ports are destination ports
+	Ports []int `yaml:"ports"`
+	// Labels must all be set to these values by the cgroup labels
+	Labels map[string]string `yaml:"labels"`
+
+	// IP pins matching connections to a single egress IP
+	IP string `yaml:"ip"`
+	// Interfaces limits selection to IPs on these interfaces
+	Interfaces []string `yaml:"interfaces"`
+	// Version limits selection to IPv4 (4) or IPv6 (6) addresses
+	Version int `yaml:"version"`
+	// RateLimit names a policy from rate_limit_policies
+	RateLimit string `yaml:"rate_limit"`
+}
+
+// Matches checks if a connection matches the rule
+func (r *TransparentRule) Matches(src, dst netip.AddrPort, labels map[string]string) bool {
+	if len(r.Sources) > 0 && !containsAddr(r.Sources, src.Addr()) {
+		return false
+	}
+	if len(r.Destinations) > 0 && !containsAddr(r.Destinations, dst.Addr()) {
+		return false
+	}
+	if len(r.Ports) > 0 && !slices.Contains(r.Ports, int(dst.Port())) {
+		return false
+	}
+	for name, value := range r.Labels {
+		if labels[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Pool returns the egress selection of the rule
+func (r *TransparentRule) Pool() PortPool {
+	return PortPool{IP: r.IP, Interfaces: r.Interfaces, Version: r.Version}
+}
+
+// containsAddr checks if addr is one of the IPs or in one of the CIDRs
+func containsAddr(prefixes []string, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, s := range prefixes {
+		prefix, err := parsePrefix(s)
+		if err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrefix parses a CIDR, or a single IP as a full length prefix
+func parsePrefix(s string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	return prefix.Masked(), err
+}
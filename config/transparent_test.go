@@ -0,0 +1,113 @@
+package config
+
+import (
+	"maps"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTransparentRule_Matches(t *testing.T) {
+	src := netip.MustParseAddrPort("10.0.0.5:40000")
+	dst := netip.MustParseAddrPort("192.0.2.10:443")
+	labels := map[string]string{"service": "crawler"}
+
+	tests := []struct {
+		rule     TransparentRule
+		expected bool
+	}{
+		{TransparentRule{}, true},
+		{TransparentRule{Sources: []string{"10.0.0.0/24"}}, true},
+		{TransparentRule{Sources: []string{"10.0.1.0/24", "10.0.0.5"}}, true},
+		{TransparentRule{Sources: []string{"10.0.1.0/24"}}, false},
+		{TransparentRule{Destinations: []string{"192.0.2.0/24"}, Ports: []int{80, 443}}, true},
+		{TransparentRule{Destinations: []string{"192.0.2.0/24"}, Ports: []int{80}}, false},
+		{TransparentRule{Labels: map[string]string{"service": "crawler"}}, true},
+		{TransparentRule{Labels: map[string]string{"service": "api"}}, false},
+		{TransparentRule{Labels: map[string]string{"team": ""}, Sources: []string{"10.0.0.0/8"}}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.Matches(src, dst, labels); got != tt.expected {
+			t.Errorf("%+v: expected %v, got %v", tt.rule, tt.expected, got)
+		}
+	}
+
+	// IPv4 clients of dual stack listeners arrive as mapped addresses
+	mapped := netip.MustParseAddrPort("[::ffff:10.0.0.5]:40000")
+	if !(&TransparentRule{Sources: []string{"10.0.0.0/24"}}).Matches(mapped, dst, nil) {
+		t.Error("expected a mapped IPv4 source to match an IPv4 CIDR")
+	}
+}
+
+func TestTransparentConfig_Rule(t *testing.T) {
+	cfg := TransparentConfig{Rules: []TransparentRule{
+		{Ports: []int{25}, IP: "192.0.2.1"},
+		{Sources: []string{"10.0.0.0/8"}, IP: "192.0.2.2"},
+		{IP: "192.0.2.3"},
+	}}
+	src := netip.MustParseAddrPort("10.0.0.5:40000")
+
+	if rule := cfg.Rule(src, netip.MustParseAddrPort("192.0.2.10:25"), nil); rule == nil || rule.IP != "192.0.2.1" {
+		t.Errorf("expected the first matching rule, got %+v", rule)
+	}
+	if rule := cfg.Rule(src, netip.MustParseAddrPort("192.0.2.10:443"), nil); rule == nil || rule.IP != "192.0.2.2" {
+		t.Errorf("expected the source rule, got %+v", rule)
+	}
+	if rule := (&TransparentConfig{}).Rule(src, netip.MustParseAddrPort("192.0.2.10:443"), nil); rule != nil {
+		t.Errorf("expected no rule, got %+v", rule)
+	}
+}
+
+func TestTransparentConfig_LabelsFor(t *testing.T) {
+	cfg := TransparentConfig{Labels: []CgroupLabel{
+		{Cgroup: `^/system\.slice/(?P<service>[^/]+)\.service$`},
+		{Cgroup: `^/system\.slice/crawler`, Labels: map[string]string{"team": "data", "service": "override"}},
+		{Cgroup: `^/user\.slice/`, Labels: map[string]string{"team": "users"}},
+	}}
+
+	tests := []struct {
+		cgroup   string
+		expected map[string]string
+	}{
+		{"/system.slice/nginx.service", map[string]string{"service": "nginx"}},
+		{"/system.slice/crawler.service", map[string]string{"service": "override", "team": "data"}},
+		{"/user.slice/user-1000.slice", map[string]string{"team": "users"}},
+		{"/kubepods/pod1", map[string]string{}},
+	}
+	for _, tt := range tests {
+		if got := cfg.LabelsFor(tt.cgroup); !maps.Equal(got, tt.expected) {
+			t.Errorf("LabelsFor(%q) = %v, want %v", tt.cgroup, got, tt.expected)
+		}
+	}
+
+	if !(&TransparentConfig{Rules: []TransparentRule{{}, {Labels: map[string]string{"team": "data"}}}}).UsesLabels() {
+		t.Error("expected UsesLabels with a label rule")
+	}
+}
+
+func TestTransparentConfig_LabelsCompiledOnLoad(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	content := `transparent:
+  labels:
+    - cgroup: '^/system\.slice/(?P<service>[^/]+)\.service$'
+    - cgroup: '('
+`
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Transparent.Labels[0].re == nil {
+		t.Fatal("expected the cgroup expression to be compiled on load")
+	}
+	if cfg.Transparent.Labels[1].re != nil {
+		t.Error("expected the invalid expression to be left for Validate")
+	}
+	if got := cfg.Transparent.LabelsFor("/system.slice/nginx.service"); got["service"] != "nginx" {
+		t.Errorf("expected the service label, got %v", got)
+	}
+}
@@ -0,0 +1,503 @@
+package config
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/ratelimit"
+	"github.com/goccy/go-yaml"
+	"github.com/rs/zerolog"
+)
+
+// FieldError is an invalid config value
+type FieldError struct {
+	// File is the config file, if the config was loaded from one
+	File string
+	// Path is the YAML path of the value, e.g. $.allowed_interfaces[0]
+	Path string
+	// Line and Column locate the value in File, 0 if unknown
+	Line, Column int
+	Message      string
+}
+
+func (e *FieldError) Error() string {
+	field := strings.TrimPrefix(e.Path, "$.")
+	switch {
+	case e.File != "" && e.Line > 0:
+		return fmt.Sprintf("%s:%d:%d: %s: %s", e.File, e.Line, e.Column, field, e.Message)
+	case e.File != "":
+		return fmt.Sprintf("%s: %s: %s", e.File, field, e.Message)
+	default:
+		return fmt.Sprintf("%s: %s", field, e.Message)
+	}
+}
+
+// validator collects FieldErrors, locating them in the source the config was loaded from
+type validator struct {
+	file   string
+	source []byte
+	errs   []error
+}
+
+// errorf records an error for the value at path
+func (v *validator) errorf(path, format string, args ...any) {
+	fieldErr := &FieldError{File: v.file, Path: path, Message: fmt.Sprintf(format, args...)}
+	if p, err := yaml.PathString(path); err == nil && len(v.source) > 0 {
+		if node, err := p.ReadNode(bytes.NewReader(v.source)); err == nil && node != nil {
+			pos := node.GetToken().Position
+			fieldErr.Line, fieldErr.Column = pos.Line, pos.Column
+		}
+	}
+	v.errs = append(v.errs, fieldErr)
+}
+
+// mapKey quotes a map key for use in a YAML path
+func mapKey(key string) string {
+	return "'" + strings.ReplaceAll(key, "'", `\'`) + "'"
+}
+
+// Validate checks that the config makes sense on this machine: interfaces
+// exist, IPs parse, and enums and status codes are known. Every problem is
+// returned joined, each as a *FieldError.
+func (c *Config) Validate() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	v := &validator{file: c.path, source: c.source}
+
+	if c.ListenAddr != "" {
+		if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+			v.errorf("$.listen_addr", "invalid listen address: %v", err)
+		}
+	}
+	v.duration("$.shutdown_sleep", c.ShutdownSleep)
+	v.duration("$.drain_timeout", c.DrainTimeout)
+	v.duration("$.server.read_header_timeout", c.Server.ReadHeaderTimeout)
+	v.duration("$.server.idle_timeout", c.Server.IdleTimeout)
+	if (c.Server.TLSCert == "") != (c.Server.TLSKey == "") {
+		v.errorf("$.server", "tls_cert and tls_key must be set together")
+	} else if c.Server.TLSEnabled() {
+		if _, err := tls.LoadX509KeyPair(c.Server.TLSCert, c.Server.TLSKey); err != nil {
+			v.errorf("$.server.tls_cert", "failed to load certificate: %v", err)
+		}
+	}
+	for i, hostname := range c.Server.Hostnames {
+		if hostname == "" || strings.ContainsAny(hostname, ":/ ") {
+			v.errorf(fmt.Sprintf("$.server.hostnames[%d]", i), "invalid hostname %q", hostname)
+		}
+	}
+	if c.HTTP3.ListenAddr != "" {
+		if _, _, err := net.SplitHostPort(c.HTTP3.ListenAddr); err != nil {
+			v.errorf("$.http3.listen_addr", "invalid listen address: %v", err)
+		}
+		if !c.Server.TLSEnabled() {
+			v.errorf("$.http3", "server.tls_cert and server.tls_key are required for HTTP/3")
+		}
+	}
+	c.validatePorts(v)
+	c.validateTransparent(v)
+	c.validateForwards(v)
+
+	if c.Log.Level != "" {
+		if _, err := zerolog.ParseLevel(c.Log.Level); err != nil {
+			v.errorf("$.log.level", "unknown level %q, expected trace, debug, info, warn or error", c.Log.Level)
+		}
+	}
+	switch c.Log.Format {
+	case "", "json", "pretty":
+	default:
+		v.errorf("$.log.format", "unknown format %q, expected json or pretty", c.Log.Format)
+	}
+
+	v.rateLimit("$.rate_limit", c.RateLimit)
+	for name, policy := range c.RateLimitPolicies {
+		path := "$.rate_limit_policies." + mapKey(name)
+		if name == "" || strings.Contains(name, "-") {
+			v.errorf(path, "invalid policy name %q, names can't be empty or contain -", name)
+		}
+		if policy.Rate <= 0 {
+			v.errorf(path+".rate", "a rate is required")
+		}
+		v.rateLimit(path, policy)
+	}
+	v.duration("$.sessions.ttl", c.Sessions.TTL)
+	v.nonNegative("$.fetch.max_batch_jobs", int64(c.Fetch.MaxBatchJobs))
+	v.nonNegative("$.fetch.max_batch_concurrency", int64(c.Fetch.MaxBatchConcurrency))
+
+	if len(c.AllowedInterfaces) == 0 {
+		v.errorf("$.allowed_interfaces", "at least one interface is required")
+	}
+	for i, name := range c.AllowedInterfaces {
+		path := fmt.Sprintf("$.allowed_interfaces[%d]", i)
+		if slices.Index(c.AllowedInterfaces, name) != i {
+			v.errorf(path, "duplicate interface %q", name)
+		} else if _, err := net.InterfaceByName(name); err != nil {
+			v.errorf(path, "interface %q does not exist", name)
+		}
+	}
+
+	if len(c.MITM.Domains) > 0 && (c.MITM.CACert == "" || c.MITM.CAKey == "") {
+		v.errorf("$.mitm", "ca_cert and ca_key are required to intercept domains")
+	}
+	for i, domain := range c.MITM.Domains {
+		v.domain(fmt.Sprintf("$.mitm.domains[%d]", i), domain)
+	}
+
+	for i, rule := range c.HeaderRules {
+		path := fmt.Sprintf("$.header_rules[%d]", i)
+		for j, domain := range rule.Domains {
+			v.domain(fmt.Sprintf("%s.domains[%d]", path, j), domain)
+		}
+		for j, ip := range rule.EgressIPs {
+			v.ip(fmt.Sprintf("%s.egress_ips[%d]", path, j), ip)
+		}
+		for j, action := range rule.Request {
+			v.headerAction(fmt.Sprintf("%s.request[%d]", path, j), action)
+		}
+		for j, action := range rule.Response {
+			v.headerAction(fmt.Sprintf("%s.response[%d]", path, j), action)
+		}
+	}
+	if !isToken(c.ProxyHeaders.GetPseudonym()) {
+		v.errorf("$.proxy_headers.pseudonym", "invalid pseudonym %q", c.ProxyHeaders.Pseudonym)
+	}
+
+	v.timeouts("$.timeouts", c.Timeouts)
+	for i, override := range c.TimeoutOverrides {
+		path := fmt.Sprintf("$.timeout_overrides[%d]", i)
+		if len(override.Domains) == 0 {
+			v.errorf(path, "domains are required")
+		}
+		for j, domain := range override.Domains {
+			v.domain(fmt.Sprintf("%s.domains[%d]", path, j), domain)
+		}
+		v.timeouts(path, override.Timeouts)
+	}
+
+	v.nonNegative("$.bandwidth.per_egress_ip", c.Bandwidth.PerEgressIP)
+	v.nonNegative("$.bandwidth.per_user", c.Bandwidth.PerUser)
+	for ip, limit := range c.Bandwidth.EgressIPs {
+		path := "$.bandwidth.egress_ips." + mapKey(ip)
+		v.ip(path, ip)
+		v.nonNegative(path, limit)
+	}
+	for user, limit := range c.Bandwidth.Users {
+		v.nonNegative("$.bandwidth.users."+mapKey(user), limit)
+	}
+
+	v.nonNegative("$.concurrency.per_egress_ip", int64(c.Concurrency.PerEgressIP))
+	v.nonNegative("$.concurrency.per_destination", int64(c.Concurrency.PerDestination))
+	v.nonNegative("$.concurrency.per_client", int64(c.Concurrency.PerClient))
+	switch c.Concurrency.Mode {
+	case "", ConcurrencyModeReject, ConcurrencyModeQueue:
+	default:
+		v.errorf("$.concurrency.mode", "unknown mode %q, expected reject or queue", c.Concurrency.Mode)
+	}
+	v.duration("$.concurrency.queue_timeout", c.Concurrency.QueueTimeout)
+	switch c.Concurrency.RejectStatus {
+	case 0, 429, 503:
+	default:
+		v.errorf("$.concurrency.reject_status", "reject status must be 429 or 503, got %d", c.Concurrency.RejectStatus)
+	}
+
+	v.nonNegative("$.health.failure_threshold", int64(c.Health.FailureThreshold))
+	v.duration("$.health.quarantine", c.Health.Quarantine)
+	v.duration("$.health.max_quarantine", c.Health.MaxQuarantine)
+	v.statusCodes("$.health.status_codes", c.Health.StatusCodes)
+
+	v.nonNegative("$.retry.max_attempts", int64(c.Retry.MaxAttempts))
+	v.duration("$.retry.backoff", c.Retry.Backoff)
+	v.statusCodes("$.retry.status_codes", c.Retry.StatusCodes)
+
+	if c.Admin.ListenAddr != "" {
+		if _, _, err := net.SplitHostPort(c.Admin.ListenAddr); err != nil {
+			v.errorf("$.admin.listen_addr", "invalid listen address: %v", err)
+		}
+		if c.Admin.Token == "" {
+			v.errorf("$.admin.token", "a token is required to enable the admin API")
+		}
+	}
+
+	for ip, override := range c.Egress.IPs {
+		path := "$.egress.ips." + mapKey(ip)
+		v.ip(path, ip)
+		v.egressOverride(path, override)
+	}
+	for name, override := range c.Egress.Interfaces {
+		path := "$.egress.interfaces." + mapKey(name)
+		if _, err := net.InterfaceByName(name); err != nil {
+			v.errorf(path, "interface %q does not exist", name)
+		}
+		v.egressOverride(path, override)
+	}
+
+	// Map iteration order is random, keep the output stable with unlocated errors last
+	slices.SortFunc(v.errs, func(a, b error) int {
+		fa, fb := a.(*FieldError), b.(*FieldError)
+		lineA, lineB := fa.Line, fb.Line
+		if lineA == 0 {
+			lineA = math.MaxInt
+		}
+		if lineB == 0 {
+			lineB = math.MaxInt
+		}
+		return cmp.Or(cmp.Compare(lineA, lineB), strings.Compare(fa.Path, fb.Path))
+	})
+	return errors.Join(v.errs...)
+}
+
+// validatePorts checks that port listeners don't overlap each other or the proxy
+func (c *Config) validatePorts(v *validator) {
+	ports := c.Ports
+	used := make(map[int]string)
+	if _, port, err := net.SplitHostPort(c.GetListenAddr()); err == nil {
+		if n, err := strconv.Atoi(port); err == nil {
+			used[n] = "listen_addr"
+		}
+	}
+
+	if ports.PerIPBase != 0 {
+		last := ports.PerIPBase + ports.GetPerIPMax() - 1
+		if ports.PerIPBase < 1 || last > 65535 {
+			v.errorf("$.ports.per_ip_base", "per IP ports %d-%d are out of range", ports.PerIPBase, last)
+		}
+		for port, name := range used {
+			if port >= ports.PerIPBase && port <= last {
+				v.errorf("$.ports.per_ip_base", "per IP ports %d-%d overlap %s", ports.PerIPBase, last, name)
+			}
+		}
+	}
+	v.nonNegative("$.ports.per_ip_max", int64(ports.PerIPMax))
+	v.duration("$.ports.refresh", ports.Refresh)
+
+	for i, pool := range ports.Pools {
+		path := fmt.Sprintf("$.ports.pools[%d]", i)
+		switch {
+		case pool.Port < 1 || pool.Port > 65535:
+			v.errorf(path+".port", "invalid port %d", pool.Port)
+		case used[pool.Port] != "":
+			v.errorf(path+".port", "port %d is already used by %s", pool.Port, used[pool.Port])
+		case ports.PerIPBase != 0 && pool.Port >= ports.PerIPBase && pool.Port < ports.PerIPBase+ports.GetPerIPMax():
+			v.errorf(path+".port", "port %d overlaps the per IP ports", pool.Port)
+		}
+		used[pool.Port] = fmt.Sprintf("ports.pools[%d]", i)
+
+		if pool.IP != "" {
+			v.ip(path+".ip", pool.IP)
+		}
+		for j, name := range pool.Interfaces {
+			if !slices.Contains(c.AllowedInterfaces, name) {
+				v.errorf(fmt.Sprintf("%s.interfaces[%d]", path, j), "interface %q is not in allowed_interfaces", name)
+			}
+		}
+		if pool.Version != 0 && pool.Version != 4 && pool.Version != 6 {
+			v.errorf(path+".version", "version must be 4 or 6, got %d", pool.Version)
+		}
+	}
+}
+
+// validateTransparent checks the transparent listener and its rules
+func (c *Config) validateTransparent(v *validator) {
+	t := c.Transparent
+	if t.ListenAddr != "" {
+		if _, _, err := net.SplitHostPort(t.ListenAddr); err != nil {
+			v.errorf("$.transparent.listen_addr", "invalid listen address: %v", err)
+		}
+	}
+	switch t.Mode {
+	case "", TransparentRedirect, TransparentTProxy:
+	default:
+		v.errorf("$.transparent.mode", "unknown mode %q, expected redirect or tproxy", t.Mode)
+	}
+
+	for i, label := range t.Labels {
+		if _, err := regexp.Compile(label.Cgroup); err != nil {
+			v.errorf(fmt.Sprintf("$.transparent.labels[%d].cgroup", i), "invalid regular expression: %v", err)
+		}
+	}
+
+	for i, rule := range t.Rules {
+		path := fmt.Sprintf("$.transparent.rules[%d]", i)
+		for j, s := range rule.Sources {
+			if _, err := parsePrefix(s); err != nil {
+				v.errorf(fmt.Sprintf("%s.sources[%d]", path, j), "invalid IP or CIDR %q", s)
+			}
+		}
+		for j, s := range rule.Destinations {
+			if _, err := parsePrefix(s); err != nil {
+				v.errorf(fmt.Sprintf("%s.destinations[%d]", path, j), "invalid IP or CIDR %q", s)
+			}
+		}
+		for j, port := range rule.Ports {
+			if port < 1 || port > 65535 {
+				v.errorf(fmt.Sprintf("%s.ports[%d]", path, j), "invalid port %d", port)
+			}
+		}
+		if rule.IP != "" {
+			v.ip(path+".ip", rule.IP)
+		}
+		for j, name := range rule.Interfaces {
+			if !slices.Contains(c.AllowedInterfaces, name) {
+				v.errorf(fmt.Sprintf("%s.interfaces[%d]", path, j), "interface %q is not in allowed_interfaces", name)
+			}
+		}
+		if rule.Version != 0 && rule.Version != 4 && rule.Version != 6 {
+			v.errorf(path+".version", "version must be 4 or 6, got %d", rule.Version)
+		}
+		if _, ok := c.RateLimitPolicies[rule.RateLimit]; rule.RateLimit != "" && !ok {
+			v.errorf(path+".rate_limit", "unknown policy %q", rule.RateLimit)
+		}
+	}
+}
+
+// validateForwards checks the forwards have unique names and listeners and
+// valid targets and egress filters
+func (c *Config) validateForwards(v *validator) {
+	names := make(map[string]int)
+	listeners := make(map[string]int)
+	for i, f := range c.Forwards {
+		path := fmt.Sprintf("$.forwards[%d]", i)
+		if f.Name == "" {
+			v.errorf(path+".name", "a name is required")
+		} else if j, ok := names[f.Name]; ok {
+			v.errorf(path+".name", "name %q is already used by forwards[%d]", f.Name, j)
+		} else {
+			names[f.Name] = i
+		}
+
+		if _, _, err := net.SplitHostPort(f.ListenAddr); err != nil {
+			v.errorf(path+".listen_addr", "invalid listen address: %v", err)
+		} else if j, ok := listeners[f.ListenAddr]; ok {
+			v.errorf(path+".listen_addr", "listen address %q is already used by forwards[%d]", f.ListenAddr, j)
+		} else {
+			listeners[f.ListenAddr] = i
+		}
+
+		host, port, err := net.SplitHostPort(f.Target)
+		if n, perr := strconv.Atoi(port); err != nil || host == "" || perr != nil || n < 1 || n > 65535 {
+			v.errorf(path+".target", "invalid target %q, expected host:port", f.Target)
+		}
+
+		if f.IP != "" {
+			v.ip(path+".ip", f.IP)
+		}
+		for j, name := range f.Interfaces {
+			if !slices.Contains(c.AllowedInterfaces, name) {
+				v.errorf(fmt.Sprintf("%s.interfaces[%d]", path, j), "interface %q is not in allowed_interfaces", name)
+			}
+		}
+		if f.Version != 0 && f.Version != 4 && f.Version != 6 {
+			v.errorf(path+".version", "version must be 4 or 6, got %d", f.Version)
+		}
+		for j, s := range f.Allow {
+			if _, err := parsePrefix(s); err != nil {
+				v.errorf(fmt.Sprintf("%s.allow[%d]", path, j), "invalid IP or CIDR %q", s)
+			}
+		}
+	}
+}
+
+func (v *validator) rateLimit(path string, rl RateLimitConfig) {
+	switch ratelimit.Method(rl.Method) {
+	case "", ratelimit.MethodTokenBucket, ratelimit.MethodFixedWindow:
+	default:
+		v.errorf(path+".method", "unknown method %q, expected token_bucket or fixed_window", rl.Method)
+	}
+	switch ratelimit.ResourceKind(rl.Resource) {
+	case "", ratelimit.ResourceKindDomain, ratelimit.ResourceKindDomainPath:
+	default:
+		v.errorf(path+".resource", "unknown resource %q, expected domain or domain_path", rl.Resource)
+	}
+	v.nonNegative(path+".rate", int64(rl.Rate))
+	if rl.Period < 0 || rl.Period%time.Second != 0 {
+		v.errorf(path+".period", "must be a whole number of seconds, got %s", rl.Period)
+	} else if rl.Rate > 0 && rl.Period == 0 {
+		v.errorf(path+".period", "a period is required with a rate")
+	}
+	v.duration(path+".ttl", rl.TTL)
+}
+
+func (v *validator) domain(path, pattern string) {
+	if strings.TrimPrefix(pattern, "*.") == "" || strings.Contains(strings.TrimPrefix(pattern, "*."), "*") {
+		v.errorf(path, "invalid domain pattern %q, expected a hostname or *.example.com", pattern)
+	}
+}
+
+func (v *validator) ip(path, ip string) {
+	if net.ParseIP(ip) == nil {
+		v.errorf(path, "invalid IP %q", ip)
+	}
+}
+
+func (v *validator) nonNegative(path string, n int64) {
+	if n < 0 {
+		v.errorf(path, "must not be negative, got %d", n)
+	}
+}
+
+func (v *validator) duration(path string, d time.Duration) {
+	if d < 0 {
+		v.errorf(path, "must not be negative, got %s", d)
+	}
+}
+
+func (v *validator) statusCodes(path string, codes []int) {
+	for i, code := range codes {
+		if code < 100 || code > 599 {
+			v.errorf(fmt.Sprintf("%s[%d]", path, i), "invalid status code %d", code)
+		}
+	}
+}
+
+func (v *validator) timeouts(path string, t Timeouts) {
+	v.duration(path+".dial", t.Dial)
+	v.duration(path+".tls_handshake", t.TLSHandshake)
+	v.duration(path+".response_header", t.ResponseHeader)
+	v.duration(path+".request_body", t.RequestBody)
+	v.duration(path+".expect_continue", t.ExpectContinue)
+	v.duration(path+".tunnel_idle", t.TunnelIdle)
+	v.duration(path+".tunnel_max_lifetime", t.TunnelMaxLifetime)
+}
+
+func (v *validator) headerAction(path string, action HeaderAction) {
+	switch action.Action {
+	case HeaderActionAdd, HeaderActionSet:
+		if _, err := template.New("header").Parse(action.Value); err != nil {
+			v.errorf(path+".value", "invalid template: %v", err)
+		}
+	case HeaderActionRemove:
+	default:
+		v.errorf(path+".action", "unknown action %q, expected add, set or remove", action.Action)
+	}
+	if !isToken(action.Name) {
+		v.errorf(path+".name", "invalid header name %q", action.Name)
+	}
+}
+
+func (v *validator) egressOverride(path string, override EgressOverride) {
+	switch override.State {
+	case "", EgressEnabled, EgressDisabled, EgressDraining:
+	default:
+		v.errorf(path+".state", "unknown state %q, expected enabled, disabled or draining", override.State)
+	}
+	v.nonNegative(path+".weight", int64(override.Weight))
+}
+
+// isToken reports whether s is an HTTP token, as header names and Via
+// pseudonyms must be
+func isToken(s string) bool {
+	return s != "" && !strings.ContainsFunc(s, func(r rune) bool {
+		return r <= ' ' || r >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r)
+	})
+}
@@ -0,0 +1,358 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadTestConfig writes content to a temporary config.yaml and loads it
+func loadTestConfig(t *testing.T, content string) (*Config, error) {
+	t.Helper()
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadConfig(configPath)
+}
+
+func TestLoadConfig_UnknownField(t *testing.T) {
+	_, err := loadTestConfig(t, `allowed_interface:
+  - lo
+`)
+	if err == nil {
+		t.Fatal("expected error for unknown field")
+	}
+	if !strings.Contains(err.Error(), `[1:1] unknown field "allowed_interface"`) {
+		t.Errorf("expected line numbered error, got %v", err)
+	}
+
+	// Nested and inlined structs are strict too
+	_, err = loadTestConfig(t, `allowed_interfaces: [lo]
+timeout_overrides:
+  - domains: [example.com]
+    dail: 1s
+`)
+	if err == nil || !strings.Contains(err.Error(), `[4:5] unknown field "dail"`) {
+		t.Errorf("expected unknown field error in override, got %v", err)
+	}
+}
+
+func TestValidate_Valid(t *testing.T) {
+	cfg, err := loadTestConfig(t, `allowed_interfaces: [lo]
+header_rules:
+  - domains: ["*.example.com"]
+    egress_ips: ["127.0.0.1"]
+    request:
+      - action: set
+        name: X-Egress
+        value: "{{.EgressIP}}"
+timeout_overrides:
+  - domains: [example.com]
+    dial: 1s
+concurrency:
+  mode: queue
+  reject_status: 503
+server:
+  read_header_timeout: 10s
+log:
+  level: debug
+  format: pretty
+rate_limit:
+  method: fixed_window
+  rate: 100
+  period: 1m
+  resource: domain_path
+retry:
+  status_codes: [403, 429]
+admin:
+  listen_addr: 127.0.0.1:9090
+  token: secret
+egress:
+  ips:
+    127.0.0.1: {state: draining, weight: 2}
+  interfaces:
+    lo: {weight: 3}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("expected valid config, got %v", err)
+	}
+}
+
+func TestValidate_Invalid(t *testing.T) {
+	cfg, err := loadTestConfig(t, `allowed_interfaces:
+  - lo
+  - does-not-exist0
+  - lo
+mitm:
+  domains: ["*"]
+header_rules:
+  - egress_ips: [nope]
+    response:
+      - action: replace
+        name: "X Bad"
+      - action: add
+        name: X-Ok
+        value: "{{.Unclosed"
+concurrency:
+  mode: wait
+  reject_status: 500
+health:
+  status_codes: [42]
+retry:
+  backoff: -1s
+admin:
+  listen_addr: 9090
+log:
+  level: loud
+rate_limit:
+  method: leaky_bucket
+  rate: 10
+  period: 1500ms
+fetch:
+  max_batch_jobs: -1
+proxy_headers:
+  pseudonym: "my proxy"
+egress:
+  ips:
+    not-an-ip: {state: off}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cfg.Validate()
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	expected := []string{
+		`config.yaml:3:5: allowed_interfaces[1]: interface "does-not-exist0" does not exist`,
+		`config.yaml:4:5: allowed_interfaces[2]: duplicate interface "lo"`,
+		`mitm: ca_cert and ca_key are required`,
+		`mitm.domains[0]: invalid domain pattern "*"`,
+		`header_rules[0].egress_ips[0]: invalid IP "nope"`,
+		`header_rules[0].response[0].action: unknown action "replace"`,
+		`header_rules[0].response[0].name: invalid header name "X Bad"`,
+		`header_rules[0].response[1].value: invalid template`,
+		`concurrency.mode: unknown mode "wait"`,
+		`concurrency.reject_status: reject status must be 429 or 503, got 500`,
+		`health.status_codes[0]: invalid status code 42`,
+		`retry.backoff: must not be negative`,
+		`admin.listen_addr: invalid listen address`,
+		`admin.token: a token is required`,
+		`log.level: unknown level "loud"`,
+		`rate_limit.method: unknown method "leaky_bucket"`,
+		`rate_limit.period: must be a whole number of seconds`,
+		`fetch.max_batch_jobs: must not be negative`,
+		`proxy_headers.pseudonym: invalid pseudonym "my proxy"`,
+		`egress.ips.'not-an-ip': invalid IP "not-an-ip"`,
+		`egress.ips.'not-an-ip'.state: unknown state "off"`,
+	}
+	for _, msg := range expected {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("expected %q in:\n%v", msg, err)
+		}
+	}
+
+	var fieldErr *FieldError
+	if !errors.As(err, &fieldErr) || fieldErr.Line != 3 {
+		t.Errorf("expected the first error to be a *FieldError on line 3, got %+v", fieldErr)
+	}
+}
+
+func TestValidate_NoInterfaces(t *testing.T) {
+	cfg := &Config{}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "at least one interface is required") {
+		t.Errorf("expected missing interfaces error, got %v", err)
+	}
+}
+
+func TestValidate_Ports(t *testing.T) {
+	cfg, err := loadTestConfig(t, `allowed_interfaces: [lo]
+listen_addr: ":10001"
+ports:
+  per_ip_base: 10000
+  per_ip_max: 10
+  pools:
+    - port: 10005
+    - port: 11000
+      interfaces: [eth9]
+      version: 5
+    - port: 11000
+      ip: nope
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cfg.Validate()
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, msg := range []string{
+		`ports.per_ip_base: per IP ports 10000-10009 overlap listen_addr`,
+		`ports.pools[0].port: port 10005 overlaps the per IP ports`,
+		`ports.pools[1].interfaces[0]: interface "eth9" is not in allowed_interfaces`,
+		`ports.pools[1].version: version must be 4 or 6, got 5`,
+		`ports.pools[2].port: port 11000 is already used by ports.pools[1]`,
+		`ports.pools[2].ip: invalid IP "nope"`,
+	} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("expected %q in:\n%v", msg, err)
+		}
+	}
+}
+
+func TestValidate_RateLimitPolicies(t *testing.T) {
+	cfg, err := loadTestConfig(t, `allowed_interfaces: [lo]
+rate_limit_policies:
+  github:
+    rate: 10
+    period: 1m
+  my-policy:
+    rate: 10
+    period: 1m
+  empty:
+    method: leaky_bucket
+sessions:
+  ttl: -1m
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cfg.Validate()
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, msg := range []string{
+		`rate_limit_policies.'my-policy': invalid policy name "my-policy"`,
+		`rate_limit_policies.'empty'.rate: a rate is required`,
+		`rate_limit_policies.'empty'.method: unknown method "leaky_bucket"`,
+		`sessions.ttl: must not be negative`,
+	} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("expected %q in:\n%v", msg, err)
+		}
+	}
+	if strings.Contains(err.Error(), "github") {
+		t.Errorf("expected the github policy to be valid, got:\n%v", err)
+	}
+}
+
+func TestValidate_HTTP3(t *testing.T) {
+	cfg, err := loadTestConfig(t, `allowed_interfaces: [lo]
+server:
+  tls_key: proxy.key
+  hostnames: [proxy.example.com, "proxy.example.com:443"]
+http3:
+  listen_addr: ":8443"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cfg.Validate()
+	for _, msg := range []string{
+		`server: tls_cert and tls_key must be set together`,
+		`http3: server.tls_cert and server.tls_key are required for HTTP/3`,
+		`server.hostnames[1]: invalid hostname "proxy.example.com:443"`,
+	} {
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("expected %q in:\n%v", msg, err)
+		}
+	}
+}
+
+func TestValidate_Transparent(t *testing.T) {
+	cfg, err := loadTestConfig(t, `allowed_interfaces: [lo]
+transparent:
+  listen_addr: "12345"
+  mode: nat
+  labels:
+    - cgroup: "([a-z"
+  rules:
+    - sources: [10.0.0.0/33]
+      destinations: [nope]
+      ports: [0]
+      ip: 300.0.0.1
+      interfaces: [eth9]
+      version: 5
+      rate_limit: missing
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cfg.Validate()
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, msg := range []string{
+		`transparent.listen_addr: invalid listen address`,
+		`transparent.mode: unknown mode "nat", expected redirect or tproxy`,
+		`transparent.labels[0].cgroup: invalid regular expression`,
+		`transparent.rules[0].sources[0]: invalid IP or CIDR "10.0.0.0/33"`,
+		`transparent.rules[0].destinations[0]: invalid IP or CIDR "nope"`,
+		`transparent.rules[0].ports[0]: invalid port 0`,
+		`transparent.rules[0].ip: invalid IP "300.0.0.1"`,
+		`transparent.rules[0].interfaces[0]: interface "eth9" is not in allowed_interfaces`,
+		`transparent.rules[0].version: version must be 4 or 6, got 5`,
+		`transparent.rules[0].rate_limit: unknown policy "missing"`,
+	} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("expected %q in:\n%v", msg, err)
+		}
+	}
+}
+
+func TestValidate_Forwards(t *testing.T) {
+	cfg, err := loadTestConfig(t, `allowed_interfaces: [lo]
+forwards:
+  - name: db
+    listen_addr: "127.0.0.1:15432"
+    target: db.example.com:5432
+  - name: db
+    listen_addr: "127.0.0.1:15432"
+    target: db.example.com
+    ip: nope
+    interfaces: [eth9]
+    version: 5
+    allow: [10.0.0.0/33]
+  - listen_addr: "2525"
+    target: ":25"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cfg.Validate()
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, msg := range []string{
+		`forwards[1].name: name "db" is already used by forwards[0]`,
+		`forwards[1].listen_addr: listen address "127.0.0.1:15432" is already used by forwards[0]`,
+		`forwards[1].target: invalid target "db.example.com", expected host:port`,
+		`forwards[1].ip: invalid IP "nope"`,
+		`forwards[1].interfaces[0]: interface "eth9" is not in allowed_interfaces`,
+		`forwards[1].version: version must be 4 or 6, got 5`,
+		`forwards[1].allow[0]: invalid IP or CIDR "10.0.0.0/33"`,
+		`forwards[2].name: a name is required`,
+		`forwards[2].listen_addr: invalid listen address`,
+		`forwards[2].target: invalid target ":25", expected host:port`,
+	} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("expected %q in:\n%v", msg, err)
+		}
+	}
+	if strings.Contains(err.Error(), "forwards[0]:") || strings.Contains(err.Error(), "forwards[0].") {
+		t.Errorf("expected the first forward to be valid:\n%v", err)
+	}
+}
@@ -0,0 +1,302 @@
+package egress
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/gologger"
+)
+
+var logger = gologger.NewLogger()
+
+const (
+	// DefaultQuarantine is the first quarantine duration if none is configured
+	DefaultQuarantine = 30 * time.Second
+	// DefaultMaxQuarantine caps the exponential backoff if none is configured
+	DefaultMaxQuarantine = 30 * time.Minute
+)
+
+// Policy configures when egress IPs are quarantined
+type Policy struct {
+	// FailureThreshold is the number of consecutive failures before quarantine
+	FailureThreshold int
+	// Quarantine is the first quarantine duration, doubled on every repeat
+	Quarantine time.Duration
+	// MaxQuarantine caps the quarantine duration
+	MaxQuarantine time.Duration
+}
+
+// Status is the health of an egress IP, or of an egress IP for one destination
+type Status struct {
+	Failures         int        `json:"failures"`
+	Strikes          int        `json:"strikes"`
+	LastFailure      *time.Time `json:"last_failure,omitempty"`
+	LastReason       string     `json:"last_reason,omitempty"`
+	QuarantinedUntil *time.Time `json:"quarantined_until,omitempty"`
+	Manual           bool       `json:"manual,omitempty"`
+}
+
+// entry tracks consecutive failures for one key
+type entry struct {
+	failures         int
+	strikes          int
+	lastFailure      time.Time
+	lastReason       string
+	quarantinedUntil time.Time
+	manual           bool
+	// hosts are the destinations that failed since the last success or
+	// quarantine, for IP entries
+	hosts map[string]struct{}
+}
+
+// Tracker records failures per egress IP and per egress IP and destination,
+// quarantining keys that fail FailureThreshold times in a row. A nil Tracker
+// tracks nothing and never quarantines.
+type Tracker struct {
+	policy    Policy
+	mu        sync.Mutex
+	entries   map[string]*entry
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+// NewTracker creates a tracker with the given policy
+func NewTracker(policy Policy) *Tracker {
+	if policy.Quarantine <= 0 {
+		policy.Quarantine = DefaultQuarantine
+	}
+	if policy.MaxQuarantine <= 0 {
+		policy.MaxQuarantine = DefaultMaxQuarantine
+	}
+	return &Tracker{
+		policy:  policy,
+		entries: make(map[string]*entry),
+		now:     time.Now,
+	}
+}
+
+// ipKey normalizes an IP so different spellings share an entry
+func ipKey(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return parsed.String()
+	}
+	return ip
+}
+
+// destinationKey keys an egress IP and destination host, ignoring the port
+func destinationKey(ip, host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return ipKey(ip) + "|" + strings.ToLower(host)
+}
+
+// RecordFailure records a failure of ip reaching host, like a refused or
+// timed out connection or a blocking status. It counts against ip for host,
+// and against ip itself only once FailureThreshold different destinations
+// failed in a row, so one unreachable destination can't quarantine the IP.
+// Failures are only tracked if the policy has a FailureThreshold.
+func (t *Tracker) RecordFailure(ip, host, reason string) {
+	if t == nil || t.policy.FailureThreshold <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	t.maybePrune(now)
+	t.fail(destinationKey(ip, host), reason, now)
+
+	e := t.get(ipKey(ip))
+	dest := destinationKey("", host)
+	if _, ok := e.hosts[dest]; ok {
+		return
+	}
+	if e.hosts == nil {
+		e.hosts = make(map[string]struct{})
+	}
+	e.hosts[dest] = struct{}{}
+	t.fail(ipKey(ip), reason, now)
+}
+
+// RecordEgressFailure records a failure of ip itself, like a local address
+// that can't be bound or routed, counting against ip for every destination
+func (t *Tracker) RecordEgressFailure(ip, host, reason string) {
+	if t == nil || t.policy.FailureThreshold <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	t.maybePrune(now)
+	t.fail(ipKey(ip), reason, now)
+	t.fail(destinationKey(ip, host), reason, now)
+}
+
+// fail counts a failure of key, quarantining it at the threshold
+func (t *Tracker) fail(key, reason string, now time.Time) {
+	e := t.get(key)
+	e.failures++
+	e.lastFailure = now
+	e.lastReason = reason
+
+	if e.failures >= t.policy.FailureThreshold && !now.Before(e.quarantinedUntil) {
+		e.strikes++
+		e.quarantinedUntil = now.Add(t.backoff(e.strikes))
+		e.manual = false
+		// After the quarantine one more failure is enough to go back in
+		e.failures = t.policy.FailureThreshold - 1
+		e.hosts = nil
+		logger.Warn().Str("key", key).Str("reason", reason).Int("strikes", e.strikes).
+			Time("until", e.quarantinedUntil).Msg("quarantined egress IP")
+	}
+}
+
+// RecordSuccess records that ip reached host, resetting failures and backoff
+func (t *Tracker) RecordSuccess(ip, host string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	for _, key := range []string{ipKey(ip), destinationKey(ip, host)} {
+		e, ok := t.entries[key]
+		if !ok || now.Before(e.quarantinedUntil) {
+			continue
+		}
+		delete(t.entries, key)
+	}
+}
+
+// IsQuarantined checks if ip is quarantined, either entirely or for host
+func (t *Tracker) IsQuarantined(ip, host string) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	for _, key := range []string{ipKey(ip), destinationKey(ip, host)} {
+		if e, ok := t.entries[key]; ok && now.Before(e.quarantinedUntil) {
+			return true
+		}
+	}
+	return false
+}
+
+// Quarantine manually quarantines ip for d, or only for host if not empty
+func (t *Tracker) Quarantine(ip, host string, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := ipKey(ip)
+	if host != "" {
+		key = destinationKey(ip, host)
+	}
+	e := t.get(key)
+	e.quarantinedUntil = t.now().Add(d)
+	e.manual = true
+}
+
+// Release clears the quarantine and failures of ip, or only for host if not empty
+func (t *Tracker) Release(ip, host string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := ipKey(ip)
+	if host != "" {
+		key = destinationKey(ip, host)
+	}
+	delete(t.entries, key)
+}
+
+// Status returns the health of ip and of ip for every tracked destination
+func (t *Tracker) Status(ip string) (*Status, map[string]*Status) {
+	if t == nil {
+		return nil, nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	key := ipKey(ip)
+
+	var ipStatus *Status
+	if e, ok := t.entries[key]; ok {
+		ipStatus = e.status(now)
+	}
+
+	destinations := make(map[string]*Status)
+	prefix := key + "|"
+	for k, e := range t.entries {
+		if host, ok := strings.CutPrefix(k, prefix); ok {
+			destinations[host] = e.status(now)
+		}
+	}
+	return ipStatus, destinations
+}
+
+// backoff returns the quarantine duration for the given strike
+func (t *Tracker) backoff(strikes int) time.Duration {
+	d := t.policy.Quarantine
+	for i := 1; i < strikes && d < t.policy.MaxQuarantine; i++ {
+		d *= 2
+	}
+	return min(d, t.policy.MaxQuarantine)
+}
+
+// maybePrune prunes at most once a minute
+func (t *Tracker) maybePrune(now time.Time) {
+	if now.Sub(t.lastPrune) > time.Minute {
+		t.prune(now)
+	}
+}
+
+// prune removes entries that are not quarantined and haven't failed for a while
+func (t *Tracker) prune(now time.Time) {
+	t.lastPrune = now
+	for key, e := range t.entries {
+		if !now.Before(e.quarantinedUntil) && now.Sub(e.lastFailure) > t.policy.MaxQuarantine {
+			delete(t.entries, key)
+		}
+	}
+}
+
+func (t *Tracker) get(key string) *entry {
+	e, ok := t.entries[key]
+	if !ok {
+		e = &entry{}
+		t.entries[key] = e
+	}
+	return e
+}
+
+func (e *entry) status(now time.Time) *Status {
+	s := &Status{
+		Failures:   e.failures,
+		Strikes:    e.strikes,
+		LastReason: e.lastReason,
+		Manual:     e.manual,
+	}
+	if !e.lastFailure.IsZero() {
+		lastFailure := e.lastFailure
+		s.LastFailure = &lastFailure
+	}
+	if now.Before(e.quarantinedUntil) {
+		until := e.quarantinedUntil
+		s.QuarantinedUntil = &until
+	}
+	return s
+}
@@ -0,0 +1,200 @@
+package egress
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestTracker creates a tracker with a controllable clock
+func newTestTracker(policy Policy) (*Tracker, *time.Time) {
+	now := time.Unix(1700000000, 0)
+	t := NewTracker(policy)
+	t.now = func() time.Time { return now }
+	return t, &now
+}
+
+func TestTracker_Threshold(t *testing.T) {
+	tracker, _ := newTestTracker(Policy{FailureThreshold: 3})
+
+	tracker.RecordFailure("10.0.0.1", "example.com:443", "dial")
+	tracker.RecordFailure("10.0.0.1", "example.com:443", "dial")
+	if tracker.IsQuarantined("10.0.0.1", "example.com") {
+		t.Fatal("expected no quarantine below threshold")
+	}
+
+	tracker.RecordFailure("10.0.0.1", "example.com:443", "dial")
+	if !tracker.IsQuarantined("10.0.0.1", "example.com") {
+		t.Fatal("expected quarantine at threshold")
+	}
+	if tracker.IsQuarantined("10.0.0.1", "other.com") {
+		t.Error("expected one failing destination not to quarantine the whole IP")
+	}
+	if tracker.IsQuarantined("10.0.0.2", "example.com") {
+		t.Error("expected other IPs not to be quarantined")
+	}
+}
+
+func TestTracker_SpreadAcrossDestinations(t *testing.T) {
+	tracker, _ := newTestTracker(Policy{FailureThreshold: 3})
+
+	// Repeated failures of one destination only count once against the IP
+	for range 5 {
+		tracker.RecordFailure("10.0.0.1", "a.com", "refused")
+	}
+	tracker.RecordFailure("10.0.0.1", "b.com", "refused")
+	if tracker.IsQuarantined("10.0.0.1", "c.com") {
+		t.Fatal("expected two failing destinations not to quarantine the IP")
+	}
+
+	tracker.RecordFailure("10.0.0.1", "c.com:443", "timeout")
+	if !tracker.IsQuarantined("10.0.0.1", "d.com") {
+		t.Error("expected three failing destinations to quarantine the IP")
+	}
+	status, _ := tracker.Status("10.0.0.1")
+	if status == nil || status.LastReason != "timeout" {
+		t.Errorf("expected the IP status to have the last reason, got %+v", status)
+	}
+}
+
+func TestTracker_EgressFailure(t *testing.T) {
+	tracker, _ := newTestTracker(Policy{FailureThreshold: 2})
+
+	tracker.RecordEgressFailure("10.0.0.1", "a.com", "bind")
+	tracker.RecordEgressFailure("10.0.0.1", "a.com", "bind")
+	if !tracker.IsQuarantined("10.0.0.1", "other.com") {
+		t.Error("expected egress failures to quarantine the whole IP")
+	}
+}
+
+func TestTracker_Disabled(t *testing.T) {
+	tracker, _ := newTestTracker(Policy{})
+	for range 10 {
+		tracker.RecordFailure("10.0.0.1", "example.com", "dial")
+	}
+	if tracker.IsQuarantined("10.0.0.1", "example.com") {
+		t.Error("expected no quarantine without a threshold")
+	}
+}
+
+func TestTracker_Backoff(t *testing.T) {
+	tracker, now := newTestTracker(Policy{
+		FailureThreshold: 1,
+		Quarantine:       10 * time.Second,
+		MaxQuarantine:    25 * time.Second,
+	})
+
+	for i, want := range []time.Duration{10 * time.Second, 20 * time.Second, 25 * time.Second} {
+		tracker.RecordFailure("10.0.0.1", "example.com", "dial")
+		status, _ := tracker.Status("10.0.0.1")
+		if status == nil || status.QuarantinedUntil == nil {
+			t.Fatalf("strike %d: expected quarantine", i+1)
+		}
+		if got := status.QuarantinedUntil.Sub(*now); got != want {
+			t.Errorf("strike %d: expected quarantine %s, got %s", i+1, want, got)
+		}
+
+		*now = status.QuarantinedUntil.Add(time.Second)
+		if tracker.IsQuarantined("10.0.0.1", "example.com") {
+			t.Errorf("strike %d: expected quarantine to expire", i+1)
+		}
+	}
+}
+
+func TestTracker_SuccessResets(t *testing.T) {
+	tracker, now := newTestTracker(Policy{FailureThreshold: 2, Quarantine: 10 * time.Second})
+
+	tracker.RecordFailure("10.0.0.1", "example.com", "dial")
+	tracker.RecordSuccess("10.0.0.1", "example.com")
+	tracker.RecordFailure("10.0.0.1", "example.com", "dial")
+	if tracker.IsQuarantined("10.0.0.1", "example.com") {
+		t.Fatal("expected success to reset the failure count")
+	}
+
+	tracker.RecordFailure("10.0.0.1", "example.com", "dial")
+	if !tracker.IsQuarantined("10.0.0.1", "example.com") {
+		t.Fatal("expected quarantine")
+	}
+
+	// Successes during quarantine don't release it
+	tracker.RecordSuccess("10.0.0.1", "example.com")
+	if !tracker.IsQuarantined("10.0.0.1", "example.com") {
+		t.Error("expected quarantine to hold")
+	}
+
+	*now = now.Add(11 * time.Second)
+	tracker.RecordSuccess("10.0.0.1", "example.com")
+	if status, destinations := tracker.Status("10.0.0.1"); status != nil || len(destinations) != 0 {
+		t.Errorf("expected success after quarantine to clear state, got %+v %+v", status, destinations)
+	}
+}
+
+func TestTracker_PerDestination(t *testing.T) {
+	tracker, _ := newTestTracker(Policy{FailureThreshold: 2})
+
+	tracker.RecordFailure("10.0.0.1", "a.com", "status 403")
+	tracker.RecordFailure("10.0.0.1", "b.com", "status 403")
+	if !tracker.IsQuarantined("10.0.0.1", "c.com") {
+		t.Error("expected failures across destinations to quarantine the IP")
+	}
+
+	tracker.Release("10.0.0.1", "")
+	if tracker.IsQuarantined("10.0.0.1", "c.com") {
+		t.Fatal("expected release to clear the IP quarantine")
+	}
+
+	tracker.Release("10.0.0.1", "a.com")
+	tracker.RecordFailure("10.0.0.1", "b.com:443", "status 403")
+	if !tracker.IsQuarantined("10.0.0.1", "B.com") {
+		t.Error("expected the destination to be quarantined")
+	}
+
+	_, destinations := tracker.Status("10.0.0.1")
+	if destinations["b.com"] == nil || destinations["b.com"].QuarantinedUntil == nil {
+		t.Errorf("expected b.com quarantine in status, got %+v", destinations)
+	}
+	if destinations["b.com"].LastReason != "status 403" {
+		t.Errorf("expected last reason, got %q", destinations["b.com"].LastReason)
+	}
+}
+
+func TestTracker_Manual(t *testing.T) {
+	tracker, now := newTestTracker(Policy{})
+
+	tracker.Quarantine("10.0.0.1", "example.com", time.Minute)
+	if !tracker.IsQuarantined("10.0.0.1", "example.com:443") {
+		t.Fatal("expected manual destination quarantine")
+	}
+	if tracker.IsQuarantined("10.0.0.1", "other.com") {
+		t.Error("expected other destinations to be unaffected")
+	}
+	_, destinations := tracker.Status("10.0.0.1")
+	if !destinations["example.com"].Manual {
+		t.Error("expected quarantine to be marked manual")
+	}
+
+	tracker.Release("10.0.0.1", "example.com")
+	if tracker.IsQuarantined("10.0.0.1", "example.com") {
+		t.Error("expected release to clear the quarantine")
+	}
+
+	tracker.Quarantine("10.0.0.1", "", time.Minute)
+	*now = now.Add(2 * time.Minute)
+	if tracker.IsQuarantined("10.0.0.1", "example.com") {
+		t.Error("expected manual quarantine to expire")
+	}
+}
+
+func TestTracker_Nil(t *testing.T) {
+	var tracker *Tracker
+	tracker.RecordFailure("10.0.0.1", "example.com", "dial")
+	tracker.RecordEgressFailure("10.0.0.1", "example.com", "bind")
+	tracker.RecordSuccess("10.0.0.1", "example.com")
+	tracker.Quarantine("10.0.0.1", "", time.Minute)
+	tracker.Release("10.0.0.1", "")
+	if tracker.IsQuarantined("10.0.0.1", "example.com") {
+		t.Error("expected nil tracker to never quarantine")
+	}
+	if status, destinations := tracker.Status("10.0.0.1"); status != nil || destinations != nil {
+		t.Error("expected nil tracker to have no status")
+	}
+}
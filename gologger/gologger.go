@@ -3,10 +3,13 @@ package gologger
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"os"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -59,13 +62,9 @@ func NewLogger() zerolog.Logger {
 
 	zerolog.TimestampFieldName = "time"
 
-	logger := zerolog.New(os.Stdout).With().Timestamp().Logger()
+	logger := zerolog.New(output).With().Timestamp().Logger()
 
 	logger = logger.Hook(CallerHook{})
-
-	if os.Getenv("PRETTY") == "1" {
-		logger = logger.Output(zerolog.ConsoleWriter{Out: os.Stderr})
-	}
 	if os.Getenv("TRACE") == "1" {
 		zerolog.SetGlobalLevel(zerolog.TraceLevel)
 	} else if os.Getenv("DEBUG") == "1" {
@@ -77,6 +76,55 @@ func NewLogger() zerolog.Logger {
 	return logger
 }
 
+// output is shared by every logger so Configure can change the format of
+// loggers that already exist
+var output = newOutputWriter()
+
+type outputWriter struct {
+	w atomic.Pointer[io.Writer]
+}
+
+func newOutputWriter() *outputWriter {
+	o := &outputWriter{}
+	if os.Getenv("PRETTY") == "1" {
+		o.set(zerolog.ConsoleWriter{Out: os.Stderr})
+	} else {
+		o.set(os.Stdout)
+	}
+	return o
+}
+
+func (o *outputWriter) set(w io.Writer) {
+	o.w.Store(&w)
+}
+
+func (o *outputWriter) Write(p []byte) (int, error) {
+	return (*o.w.Load()).Write(p)
+}
+
+// Configure sets the global log level (trace, debug, info, warn, error) and
+// the format (json or pretty). Empty values are left unchanged.
+func Configure(level, format string) error {
+	if level != "" {
+		lvl, err := zerolog.ParseLevel(level)
+		if err != nil {
+			return err
+		}
+		zerolog.SetGlobalLevel(lvl)
+	}
+
+	switch format {
+	case "":
+	case "json":
+		output.set(os.Stdout)
+	case "pretty":
+		output.set(zerolog.ConsoleWriter{Out: os.Stderr})
+	default:
+		return fmt.Errorf("unknown log format %q, expected json or pretty", format)
+	}
+	return nil
+}
+
 type CallerHook struct{}
 
 func (h CallerHook) Run(e *zerolog.Event, _ zerolog.Level, _ string) {
@@ -0,0 +1,226 @@
+package http_server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/danthegoodman1/specificproxy/config"
+)
+
+// startAdminServer starts the admin API on its own listen address, if configured
+func (hs *HTTPServer) startAdminServer() {
+	if hs.config == nil || hs.config.Admin.ListenAddr == "" {
+		return
+	}
+	if hs.config.Admin.Token == "" {
+		logger.Fatal().Msg("admin API requires a token")
+	}
+
+	hs.admin = &http.Server{
+		Addr:              hs.config.Admin.ListenAddr,
+		Handler:           hs.newAdminHandler(),
+		ReadHeaderTimeout: hs.config.Server.GetReadHeaderTimeout(),
+		IdleTimeout:       hs.config.Server.GetIdleTimeout(),
+	}
+
+	go func() {
+		logger.Info().Str("addr", hs.admin.Addr).Msg("starting admin server")
+		if err := hs.admin.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error().Err(err).Msg("admin server error")
+		}
+	}()
+}
+
+// newAdminHandler returns the handler for the admin API, which requires the
+// configured bearer token on every request
+func (hs *HTTPServer) newAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /ips", hs.handleListIPs)
+	mux.HandleFunc("POST /ips/{ip}/enable", hs.handleSetIPState(config.EgressEnabled))
+	mux.HandleFunc("POST /ips/{ip}/disable", hs.handleSetIPState(config.EgressDisabled))
+	mux.HandleFunc("POST /ips/{ip}/drain", hs.handleSetIPState(config.EgressDraining))
+	mux.HandleFunc("POST /ips/{ip}/weight", hs.handleSetIPWeight)
+
+	mux.HandleFunc("GET /interfaces", hs.handleListInterfaces)
+	mux.HandleFunc("POST /interfaces/{name}/enable", hs.handleSetInterfaceState(config.EgressEnabled))
+	mux.HandleFunc("POST /interfaces/{name}/disable", hs.handleSetInterfaceState(config.EgressDisabled))
+	mux.HandleFunc("POST /interfaces/{name}/drain", hs.handleSetInterfaceState(config.EgressDraining))
+	mux.HandleFunc("POST /interfaces/{name}/weight", hs.handleSetInterfaceWeight)
+
+	mux.HandleFunc("GET /forwards", hs.handleListForwards)
+	mux.HandleFunc("GET /bandwidth", hs.handleBandwidth)
+
+	// Manual quarantine overrides
+	mux.HandleFunc("POST /ips/{ip}/quarantine", hs.handleQuarantine)
+	mux.HandleFunc("DELETE /ips/{ip}/quarantine", hs.handleReleaseQuarantine)
+
+	token := []byte("Bearer " + hs.config.Admin.Token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), token) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="specificproxy admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// handleSetIPState sets the admin state of an egress IP
+func (hs *HTTPServer) handleSetIPState(state config.EgressState) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := r.PathValue("ip")
+		if net.ParseIP(ip) == nil {
+			http.Error(w, "invalid IP", http.StatusBadRequest)
+			return
+		}
+
+		hs.config.UpdateEgressIP(ip, func(o *config.EgressOverride) { o.State = state })
+		logger.Info().Str("egress_ip", ip).Str("state", string(state)).Msg("changed egress IP state")
+		hs.applyEgressChange(w)
+	}
+}
+
+// handleSetIPWeight sets the random selection weight of an egress IP
+func (hs *HTTPServer) handleSetIPWeight(w http.ResponseWriter, r *http.Request) {
+	ip := r.PathValue("ip")
+	if net.ParseIP(ip) == nil {
+		http.Error(w, "invalid IP", http.StatusBadRequest)
+		return
+	}
+	weight, ok := parseWeight(w, r)
+	if !ok {
+		return
+	}
+
+	hs.config.UpdateEgressIP(ip, func(o *config.EgressOverride) { o.Weight = weight })
+	logger.Info().Str("egress_ip", ip).Int("weight", weight).Msg("changed egress IP weight")
+	hs.applyEgressChange(w)
+}
+
+// handleSetInterfaceState sets the admin state of every IP on an interface
+func (hs *HTTPServer) handleSetInterfaceState(state config.EgressState) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if _, err := net.InterfaceByName(name); err != nil {
+			http.Error(w, "unknown interface", http.StatusNotFound)
+			return
+		}
+
+		hs.config.UpdateEgressInterface(name, func(o *config.EgressOverride) { o.State = state })
+		logger.Info().Str("interface", name).Str("state", string(state)).Msg("changed interface state")
+		hs.applyEgressChange(w)
+	}
+}
+
+// handleSetInterfaceWeight sets the random selection weight of every IP on an interface
+func (hs *HTTPServer) handleSetInterfaceWeight(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, err := net.InterfaceByName(name); err != nil {
+		http.Error(w, "unknown interface", http.StatusNotFound)
+		return
+	}
+	weight, ok := parseWeight(w, r)
+	if !ok {
+		return
+	}
+
+	hs.config.UpdateEgressInterface(name, func(o *config.EgressOverride) { o.Weight = weight })
+	logger.Info().Str("interface", name).Int("weight", weight).Msg("changed interface weight")
+	hs.applyEgressChange(w)
+}
+
+// parseWeight reads the weight query parameter, 0 resets it to the default
+func parseWeight(w http.ResponseWriter, r *http.Request) (int, bool) {
+	weight, err := strconv.Atoi(r.URL.Query().Get("weight"))
+	if err != nil || weight < 0 {
+		http.Error(w, "invalid weight", http.StatusBadRequest)
+		return 0, false
+	}
+	return weight, true
+}
+
+// applyEgressChange closes tunnels of newly disabled IPs and persists the
+// change if configured. The change is live even if persisting fails.
+func (hs *HTTPServer) applyEgressChange(w http.ResponseWriter) {
+	closed := hs.tunnels.closeWhere(func(t *tunnel) bool {
+		iface, ok := hs.config.InterfaceForIP(t.egressIP)
+		return ok && hs.config.EgressOverrideFor(t.egressIP, iface).State == config.EgressDisabled
+	})
+	for _, t := range closed {
+		logger.Warn().Str("host", t.host).Str("egress_ip", t.egressIP).Msg("closed tunnel of disabled egress IP")
+	}
+
+	if hs.config.Admin.Persist {
+		if err := hs.config.Save(); err != nil {
+			logger.Error().Err(err).Msg("failed to persist egress change")
+			http.Error(w, fmt.Sprintf("applied, but failed to write config: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// interfaceStatus is a network interface as returned by /interfaces
+type interfaceStatus struct {
+	Name    string             `json:"name"`
+	Allowed bool               `json:"allowed"`
+	State   config.EgressState `json:"state"`
+	Weight  int                `json:"weight"`
+	IPs     []string           `json:"ips"`
+}
+
+// handleListInterfaces lists every network interface with its admin state
+func (hs *HTTPServer) handleListInterfaces(w http.ResponseWriter, r *http.Request) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to list interfaces")
+		http.Error(w, "failed to list interfaces", http.StatusInternalServerError)
+		return
+	}
+
+	statuses := make([]interfaceStatus, 0, len(interfaces))
+	for _, iface := range interfaces {
+		override := hs.config.EgressOverrideFor("", iface.Name)
+		status := interfaceStatus{
+			Name:    iface.Name,
+			Allowed: hs.config.IsInterfaceAllowed(iface.Name),
+			State:   override.State,
+			Weight:  override.Weight,
+			IPs:     []string{},
+		}
+		if addrs, err := iface.Addrs(); err == nil {
+			for _, addr := range addrs {
+				if ipNet, ok := addr.(*net.IPNet); ok {
+					status.IPs = append(status.IPs, ipNet.IP.String())
+				}
+			}
+		}
+		statuses = append(statuses, status)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"interfaces": statuses,
+	})
+}
+
+// handleListForwards returns the running forwards with their connection and byte counts
+func (hs *HTTPServer) handleListForwards(w http.ResponseWriter, r *http.Request) {
+	statuses := []forwardStatus{}
+	if hs.forwards != nil {
+		for _, f := range hs.forwards.list() {
+			statuses = append(statuses, f.status())
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"forwards": statuses,
+	})
+}
@@ -0,0 +1,255 @@
+package http_server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/config"
+)
+
+// adminRequest builds an admin API request carrying the test token
+func adminRequest(method, target string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	return r
+}
+
+func newAdminTestServer(t *testing.T) (*HTTPServer, http.Handler) {
+	t.Helper()
+
+	hs := &HTTPServer{config: &config.Config{
+		AllowedInterfaces: []string{"lo"},
+		Admin:             config.AdminConfig{Token: "secret"},
+	}}
+	return hs, hs.newAdminHandler()
+}
+
+// serveAdmin sends an admin request, failing the test on an unexpected status
+func serveAdmin(t *testing.T, handler http.Handler, method, target string, expected int) *httptest.ResponseRecorder {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, adminRequest(method, target))
+	if w.Code != expected {
+		t.Fatalf("%s %s: expected %d, got %d: %s", method, target, expected, w.Code, w.Body.String())
+	}
+	return w
+}
+
+func TestAdmin_Unauthorized(t *testing.T) {
+	_, handler := newAdminTestServer(t)
+
+	for _, auth := range []string{"", "Bearer wrong", "secret"} {
+		r := httptest.NewRequest("GET", "/ips", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("auth %q: expected 401, got %d", auth, w.Code)
+		}
+	}
+}
+
+func TestAdmin_IPState(t *testing.T) {
+	hs, handler := newAdminTestServer(t)
+
+	serveAdmin(t, handler, "POST", "/ips/127.0.0.1/disable", http.StatusNoContent)
+	if hs.config.IsIPAllowed("127.0.0.1") {
+		t.Error("expected disabled IP to be rejected")
+	}
+
+	// Pinned requests to a disabled IP are refused
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("X-Egress-IP", "127.0.0.1")
+	w := httptest.NewRecorder()
+	hs.handleProxy(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", w.Code)
+	}
+
+	serveAdmin(t, handler, "POST", "/ips/127.0.0.1/drain", http.StatusNoContent)
+	if hs.config.IsIPAllowed("127.0.0.1") {
+		t.Error("expected draining IP to be rejected")
+	}
+
+	serveAdmin(t, handler, "POST", "/ips/127.0.0.1/enable", http.StatusNoContent)
+	if !hs.config.IsIPAllowed("127.0.0.1") {
+		t.Error("expected enabled IP to be allowed")
+	}
+
+	serveAdmin(t, handler, "POST", "/ips/nope/disable", http.StatusBadRequest)
+}
+
+func TestAdmin_Weight(t *testing.T) {
+	hs, handler := newAdminTestServer(t)
+
+	serveAdmin(t, handler, "POST", "/ips/127.0.0.1/weight?weight=3", http.StatusNoContent)
+	if weight := hs.config.EgressOverrideFor("127.0.0.1", "lo").Weight; weight != 3 {
+		t.Errorf("expected weight 3, got %d", weight)
+	}
+
+	serveAdmin(t, handler, "POST", "/interfaces/lo/weight?weight=5", http.StatusNoContent)
+	if weight := hs.config.EgressOverrideFor("127.0.0.2", "lo").Weight; weight != 5 {
+		t.Errorf("expected interface weight 5, got %d", weight)
+	}
+
+	for _, target := range []string{"/ips/127.0.0.1/weight", "/ips/127.0.0.1/weight?weight=-1", "/ips/127.0.0.1/weight?weight=x"} {
+		serveAdmin(t, handler, "POST", target, http.StatusBadRequest)
+	}
+}
+
+func TestAdmin_Interfaces(t *testing.T) {
+	hs, handler := newAdminTestServer(t)
+
+	w := serveAdmin(t, handler, "GET", "/interfaces", http.StatusOK)
+	var resp struct {
+		Interfaces []interfaceStatus `json:"interfaces"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	var lo *interfaceStatus
+	for i := range resp.Interfaces {
+		if resp.Interfaces[i].Name == "lo" {
+			lo = &resp.Interfaces[i]
+		}
+	}
+	if lo == nil || !lo.Allowed || lo.State != config.EgressEnabled {
+		t.Fatalf("expected lo to be allowed and enabled, got %+v", lo)
+	}
+
+	serveAdmin(t, handler, "POST", "/interfaces/lo/disable", http.StatusNoContent)
+	if hs.config.IsIPAllowed("127.0.0.1") {
+		t.Error("expected IPs of a disabled interface to be rejected")
+	}
+
+	// IP overrides win over the interface
+	serveAdmin(t, handler, "POST", "/ips/127.0.0.1/enable", http.StatusNoContent)
+	if !hs.config.IsIPAllowed("127.0.0.1") {
+		t.Error("expected enabled IP on a disabled interface to be allowed")
+	}
+
+	serveAdmin(t, handler, "POST", "/interfaces/does-not-exist0/disable", http.StatusNotFound)
+}
+
+func TestAdmin_EnableInterfaceAddsIt(t *testing.T) {
+	hs := &HTTPServer{config: &config.Config{Admin: config.AdminConfig{Token: "secret"}}}
+	handler := hs.newAdminHandler()
+
+	if hs.config.IsIPAllowed("127.0.0.1") {
+		t.Fatal("expected IP to be rejected before the interface is enabled")
+	}
+	serveAdmin(t, handler, "POST", "/interfaces/lo/enable", http.StatusNoContent)
+	if !hs.config.IsIPAllowed("127.0.0.1") {
+		t.Error("expected enabling the interface to allow its IPs")
+	}
+}
+
+func TestAdmin_DrainAndDisableTunnels(t *testing.T) {
+	hs, handler := newAdminTestServer(t)
+	proxy := httptest.NewServer(hs.newHandler())
+	t.Cleanup(proxy.Close)
+	echo := startEchoListener(t)
+	header := http.Header{"X-Egress-Ip": {"127.0.0.1"}}
+
+	conn, reader, resp := openConnectTunnel(t, proxy.Listener.Addr().String(), echo.Addr().String(), header)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	// Draining refuses new tunnels but keeps the open one
+	serveAdmin(t, handler, "POST", "/ips/127.0.0.1/drain", http.StatusNoContent)
+	_, _, resp = openConnectTunnel(t, proxy.Listener.Addr().String(), echo.Addr().String(), header)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected new tunnel to be refused, got %d", resp.StatusCode)
+	}
+	conn.Write([]byte("ping\n"))
+	if line, err := reader.ReadString('\n'); err != nil || line != "ping\n" {
+		t.Fatalf("expected draining tunnel to keep working, got %q (%v)", line, err)
+	}
+
+	// Disabling closes it
+	serveAdmin(t, handler, "POST", "/ips/127.0.0.1/disable", http.StatusNoContent)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("expected disabled tunnel to be closed, got %v", err)
+	}
+}
+
+func TestAdmin_Persist(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	content := `allowed_interfaces:
+  - lo
+admin:
+  token: secret
+  persist: true
+timeouts:
+  dial: 3s
+`
+	if err := os.WriteFile(configPath, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := &HTTPServer{config: cfg}
+	handler := hs.newAdminHandler()
+
+	serveAdmin(t, handler, "POST", "/ips/127.0.0.1/drain", http.StatusNoContent)
+
+	reloaded, err := config.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("failed to reload persisted config: %v", err)
+	}
+	if state := reloaded.EgressOverrideFor("127.0.0.1", "lo").State; state != config.EgressDraining {
+		t.Errorf("expected persisted draining state, got %q", state)
+	}
+	if reloaded.Timeouts.Dial != 3*time.Second || reloaded.Admin.Token != "secret" {
+		t.Errorf("expected other settings to be kept, got %+v", reloaded)
+	}
+
+	data, _ := os.ReadFile(configPath)
+	if !strings.Contains(string(data), "draining") {
+		t.Errorf("expected state in config file, got:\n%s", data)
+	}
+}
+
+func TestPickHealthyIP_SkipsDisabled(t *testing.T) {
+	hs := newHealthTestServer(config.HealthConfig{})
+	ips := []config.IPInfo{
+		{IP: "192.0.2.1", State: config.EgressDisabled, Weight: 1},
+		{IP: "192.0.2.2", State: config.EgressDraining, Weight: 1},
+		{IP: "192.0.2.3", State: config.EgressEnabled, Weight: 1},
+	}
+	for range 20 {
+		if picked, _ := hs.pickHealthyIP(ips, "example.com"); picked != "192.0.2.3" {
+			t.Fatalf("expected only the enabled IP, got %s", picked)
+		}
+	}
+}
+
+func TestPickWeighted(t *testing.T) {
+	ips := []config.IPInfo{
+		{IP: "192.0.2.1", Weight: 1},
+		{IP: "192.0.2.2", Weight: 9},
+	}
+	heavy := 0
+	for range 1000 {
+		if pickWeighted(ips) == "192.0.2.2" {
+			heavy++
+		}
+	}
+	if heavy < 800 || heavy > 980 {
+		t.Errorf("expected about 900 picks of the heavier IP, got %d", heavy)
+	}
+}
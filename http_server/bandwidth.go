@@ -0,0 +1,120 @@
+package http_server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/danthegoodman1/specificproxy/ratelimit"
+)
+
+const (
+	egressIPCounterPrefix = "egress_ip:"
+	userCounterPrefix     = "user:"
+)
+
+// throttle applies bandwidth limits and counts bytes for one proxied request
+// or tunnel. A nil throttle passes everything through.
+type throttle struct {
+	buckets  []*ratelimit.ByteBucket
+	counters []*ratelimit.ByteCounters
+}
+
+type throttleKey struct{}
+
+// withThrottle stores the throttle on the context, so requests inside an
+// intercepted tunnel share the limits of the CONNECT request
+func withThrottle(ctx context.Context, t *throttle) context.Context {
+	return context.WithValue(ctx, throttleKey{}, t)
+}
+
+// throttleFrom returns the throttle stored on the context, if any
+func throttleFrom(ctx context.Context) *throttle {
+	t, _ := ctx.Value(throttleKey{}).(*throttle)
+	return t
+}
+
+// newThrottle builds the throttle for a request from the configured egress
+// IP and user limits, plus a per request limit from X-Bandwidth-Limit
+func (hs *HTTPServer) newThrottle(r *http.Request, egressIP string, requestLimit int64) *throttle {
+	store := ratelimit.GetBandwidthStore()
+	user := proxyUser(r)
+
+	t := &throttle{
+		counters: []*ratelimit.ByteCounters{store.Counters(egressIPCounterPrefix + egressIP)},
+	}
+	if user != "" {
+		t.counters = append(t.counters, store.Counters(userCounterPrefix+user))
+	}
+
+	if hs.config != nil {
+		if limit := hs.config.Bandwidth.LimitForEgressIP(egressIP); limit > 0 {
+			t.buckets = append(t.buckets, store.Bucket(egressIPCounterPrefix+egressIP, limit))
+		}
+		if limit := hs.config.Bandwidth.LimitForUser(user); limit > 0 {
+			t.buckets = append(t.buckets, store.Bucket(userCounterPrefix+user, limit))
+		}
+	}
+	if requestLimit > 0 {
+		t.buckets = append(t.buckets, ratelimit.NewByteBucket(requestLimit))
+	}
+	return t
+}
+
+// reader throttles and counts reads from r. up is true for bytes flowing
+// from the client to the destination.
+func (t *throttle) reader(ctx context.Context, r io.Reader, up bool) io.Reader {
+	if t == nil {
+		return r
+	}
+	return ratelimit.NewReader(ctx, r, t.buckets, func(n int) {
+		for _, c := range t.counters {
+			if up {
+				c.Up.Add(int64(n))
+			} else {
+				c.Down.Add(int64(n))
+			}
+		}
+	})
+}
+
+// conn throttles and counts reads from conn, see reader
+func (t *throttle) conn(ctx context.Context, conn net.Conn, up bool) net.Conn {
+	if t == nil {
+		return conn
+	}
+	return &throttledConn{Conn: conn, reader: t.reader(ctx, conn, up)}
+}
+
+// throttledConn is a net.Conn reading through a throttled reader
+type throttledConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *throttledConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// handleBandwidth returns the throughput counters per egress IP and per user
+func (hs *HTTPServer) handleBandwidth(w http.ResponseWriter, r *http.Request) {
+	egressIPs := make(map[string]ratelimit.CounterSnapshot)
+	users := make(map[string]ratelimit.CounterSnapshot)
+
+	for key, snapshot := range ratelimit.GetBandwidthStore().Snapshot() {
+		if ip, ok := strings.CutPrefix(key, egressIPCounterPrefix); ok {
+			egressIPs[ip] = snapshot
+		} else if user, ok := strings.CutPrefix(key, userCounterPrefix); ok {
+			users[user] = snapshot
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"egress_ips": egressIPs,
+		"users":      users,
+	})
+}
@@ -0,0 +1,126 @@
+package http_server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/config"
+	"github.com/danthegoodman1/specificproxy/ratelimit"
+)
+
+// startBlobListener starts a TCP server that writes size bytes and closes
+func startBlobListener(t *testing.T, size int) net.Listener {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write(bytes.Repeat([]byte("x"), size))
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestBandwidth_TunnelHeaderLimit(t *testing.T) {
+	hs := &HTTPServer{config: &config.Config{AllowedInterfaces: []string{"lo"}}}
+	proxy := httptest.NewServer(hs.newHandler())
+	defer proxy.Close()
+
+	blob := startBlobListener(t, 128*1024)
+
+	_, reader, resp := openConnectTunnel(t, proxy.Listener.Addr().String(), blob.Addr().String(), http.Header{
+		"X-Egress-Ip":       {"127.0.0.1"},
+		"X-Bandwidth-Limit": {"65536"},
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected CONNECT 200, got %d", resp.StatusCode)
+	}
+
+	start := time.Now()
+	n, _ := io.Copy(io.Discard, reader)
+	elapsed := time.Since(start)
+
+	if n != 128*1024 {
+		t.Errorf("expected 128KB, got %d bytes", n)
+	}
+	// 64KB burst, then 64KB at 64KB/s
+	if elapsed < 700*time.Millisecond {
+		t.Errorf("expected throttled tunnel to take ~1s, took %v", elapsed)
+	}
+}
+
+func TestBandwidth_HTTPProxyCounters(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write(bytes.Repeat([]byte("x"), 1000))
+	}))
+	defer upstream.Close()
+
+	hs, admin := newAdminTestServer(t)
+
+	before := ratelimit.GetBandwidthStore().Counters(egressIPCounterPrefix + "127.0.0.1").Snapshot()
+
+	req := httptest.NewRequest("POST", upstream.URL, bytes.NewReader(make([]byte, 500)))
+	req.Header.Set("X-Egress-IP", "127.0.0.1")
+	w := httptest.NewRecorder()
+	hs.handleProxy(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	statsResp := serveAdmin(t, admin, "GET", "/bandwidth", http.StatusOK)
+	var stats struct {
+		EgressIPs map[string]ratelimit.CounterSnapshot `json:"egress_ips"`
+	}
+	if err := json.NewDecoder(statsResp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+
+	// The counters reveal who uses the proxy, so they're only on the admin API
+	w = httptest.NewRecorder()
+	hs.newHandler().ServeHTTP(w, httptest.NewRequest("GET", "/bandwidth", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected no /bandwidth on the proxy listener, got %d", w.Code)
+	}
+
+	after := stats.EgressIPs["127.0.0.1"]
+	if after.UpBytes-before.UpBytes < 500 {
+		t.Errorf("expected at least 500 up bytes, got %d", after.UpBytes-before.UpBytes)
+	}
+	if after.DownBytes-before.DownBytes < 1000 {
+		t.Errorf("expected at least 1000 down bytes, got %d", after.DownBytes-before.DownBytes)
+	}
+}
+
+func TestBandwidth_InvalidHeader(t *testing.T) {
+	hs := &HTTPServer{config: nil}
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("X-Egress-IP", "127.0.0.1")
+	req.Header.Set("X-Bandwidth-Limit", "fast")
+	w := httptest.NewRecorder()
+	hs.handleProxy(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", w.Code)
+	}
+}
@@ -0,0 +1,94 @@
+package http_server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/danthegoodman1/specificproxy/config"
+	"github.com/danthegoodman1/specificproxy/ratelimit"
+)
+
+// errConcurrencyLimited is returned when a concurrency slot can't be acquired
+var errConcurrencyLimited = errors.New("concurrency limit exceeded")
+
+// concurrencySlot is a limit to acquire for a request
+type concurrencySlot struct {
+	key   string
+	limit int
+}
+
+// concurrencySlots returns the configured limits that apply to the request,
+// in the order they must be acquired
+func (hs *HTTPServer) concurrencySlots(r *http.Request, egressIP string) []concurrencySlot {
+	if hs.config == nil {
+		return nil
+	}
+	cfg := &hs.config.Concurrency
+
+	var slots []concurrencySlot
+	if cfg.PerClient > 0 {
+		clientIP := r.RemoteAddr
+		if h, _, err := net.SplitHostPort(clientIP); err == nil {
+			clientIP = h
+		}
+		slots = append(slots, concurrencySlot{key: "client:" + clientIP, limit: cfg.PerClient})
+	}
+	if cfg.PerEgressIP > 0 {
+		slots = append(slots, concurrencySlot{key: "egress_ip:" + egressIP, limit: cfg.PerEgressIP})
+	}
+	if cfg.PerDestination > 0 {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		slots = append(slots, concurrencySlot{
+			key:   "destination:" + egressIP + "|" + strings.ToLower(host),
+			limit: cfg.PerDestination,
+		})
+	}
+	return slots
+}
+
+// acquireConcurrency takes every concurrency slot for the request, either
+// failing fast or queuing depending on the configured mode. The returned
+// func releases all slots and must be called once the request or tunnel is done.
+func (hs *HTTPServer) acquireConcurrency(r *http.Request, egressIP string) (func(), error) {
+	slots := hs.concurrencySlots(r, egressIP)
+	if len(slots) == 0 {
+		return func() {}, nil
+	}
+
+	limiter := ratelimit.GetConcurrencyLimiter()
+	cfg := &hs.config.Concurrency
+
+	ctx := r.Context()
+	if cfg.Mode == config.ConcurrencyModeQueue {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.GetQueueTimeout())
+		defer cancel()
+	}
+
+	acquired := make([]string, 0, len(slots))
+	release := func() {
+		for _, key := range acquired {
+			limiter.Release(key)
+		}
+	}
+
+	for _, slot := range slots {
+		if cfg.Mode == config.ConcurrencyModeQueue {
+			if err := limiter.Acquire(ctx, slot.key, slot.limit); err != nil {
+				release()
+				return nil, errConcurrencyLimited
+			}
+		} else if !limiter.TryAcquire(slot.key, slot.limit) {
+			release()
+			return nil, errConcurrencyLimited
+		}
+		acquired = append(acquired, slot.key)
+	}
+	return release, nil
+}
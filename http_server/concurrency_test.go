@@ -0,0 +1,134 @@
+package http_server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/config"
+	"github.com/danthegoodman1/specificproxy/ratelimit"
+)
+
+func newConcurrencyTestServer(t *testing.T, concurrency config.ConcurrencyConfig) *httptest.Server {
+	t.Helper()
+
+	hs := &HTTPServer{config: &config.Config{
+		AllowedInterfaces: []string{"lo"},
+		Concurrency:       concurrency,
+	}}
+	proxy := httptest.NewServer(hs.newHandler())
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+// waitForNoActive waits until no slots are held for key
+func waitForNoActive(t *testing.T, key string) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for ratelimit.GetConcurrencyLimiter().Active(key) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected slots for %s to be released", key)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConcurrency_RejectPerEgressIP(t *testing.T) {
+	proxy := newConcurrencyTestServer(t, config.ConcurrencyConfig{PerEgressIP: 1})
+	echo := startEchoListener(t)
+	header := http.Header{"X-Egress-Ip": {"127.0.0.1"}}
+
+	conn, _, resp := openConnectTunnel(t, proxy.Listener.Addr().String(), echo.Addr().String(), header)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected first CONNECT 200, got %d", resp.StatusCode)
+	}
+
+	_, _, resp = openConnectTunnel(t, proxy.Listener.Addr().String(), echo.Addr().String(), header)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected second CONNECT 429, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("X-RateLimit-Source") != "specificproxy" {
+		t.Error("expected X-RateLimit-Source header")
+	}
+
+	// Closing the tunnel frees the slot
+	conn.Close()
+	waitForNoActive(t, "egress_ip:127.0.0.1")
+
+	conn, _, resp = openConnectTunnel(t, proxy.Listener.Addr().String(), echo.Addr().String(), header)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected CONNECT after close 200, got %d", resp.StatusCode)
+	}
+	conn.Close()
+	waitForNoActive(t, "egress_ip:127.0.0.1")
+}
+
+func TestConcurrency_RejectStatus(t *testing.T) {
+	proxy := newConcurrencyTestServer(t, config.ConcurrencyConfig{
+		PerDestination: 1,
+		RejectStatus:   http.StatusServiceUnavailable,
+	})
+	echo := startEchoListener(t)
+	header := http.Header{"X-Egress-Ip": {"127.0.0.1"}}
+
+	conn, _, _ := openConnectTunnel(t, proxy.Listener.Addr().String(), echo.Addr().String(), header)
+	_, _, resp := openConnectTunnel(t, proxy.Listener.Addr().String(), echo.Addr().String(), header)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", resp.StatusCode)
+	}
+
+	conn.Close()
+	waitForNoActive(t, "destination:127.0.0.1|127.0.0.1")
+}
+
+func TestConcurrency_Queue(t *testing.T) {
+	proxy := newConcurrencyTestServer(t, config.ConcurrencyConfig{
+		PerClient:    1,
+		Mode:         config.ConcurrencyModeQueue,
+		QueueTimeout: 2 * time.Second,
+	})
+	echo := startEchoListener(t)
+	header := http.Header{"X-Egress-Ip": {"127.0.0.1"}}
+
+	conn, _, resp := openConnectTunnel(t, proxy.Listener.Addr().String(), echo.Addr().String(), header)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected first CONNECT 200, got %d", resp.StatusCode)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		conn.Close()
+	}()
+
+	start := time.Now()
+	conn2, _, resp := openConnectTunnel(t, proxy.Listener.Addr().String(), echo.Addr().String(), header)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected queued CONNECT 200, got %d", resp.StatusCode)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("expected queued CONNECT to wait for the first tunnel")
+	}
+	conn2.Close()
+	waitForNoActive(t, "client:127.0.0.1")
+}
+
+func TestConcurrency_QueueTimeout(t *testing.T) {
+	proxy := newConcurrencyTestServer(t, config.ConcurrencyConfig{
+		PerClient:    1,
+		Mode:         config.ConcurrencyModeQueue,
+		QueueTimeout: 100 * time.Millisecond,
+	})
+	echo := startEchoListener(t)
+	header := http.Header{"X-Egress-Ip": {"127.0.0.1"}}
+
+	conn, _, _ := openConnectTunnel(t, proxy.Listener.Addr().String(), echo.Addr().String(), header)
+	_, _, resp := openConnectTunnel(t, proxy.Listener.Addr().String(), echo.Addr().String(), header)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected 429 after queue timeout, got %d", resp.StatusCode)
+	}
+
+	conn.Close()
+	waitForNoActive(t, "client:127.0.0.1")
+}
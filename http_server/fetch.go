@@ -0,0 +1,236 @@
+package http_server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/config"
+)
+
+// maxFetchBody bounds the JSON body of fetches and base64 encoded responses
+const maxFetchBody = 32 << 20
+
+// Fetch response modes
+const (
+	// fetchStream returns the upstream response as the fetch response
+	fetchStream = "stream"
+	// fetchBase64 returns the upstream response as JSON with a base64 body
+	fetchBase64 = "base64"
+)
+
+// fetchRequest is the body of POST /fetch
+type fetchRequest struct {
+	URL     string      `json:"url"`
+	Method  string      `json:"method"`
+	Headers http.Header `json:"headers"`
+	// Body is sent as is, BodyBase64 is decoded first
+	Body       string `json:"body"`
+	BodyBase64 string `json:"body_base64"`
+
+	// EgressIP pins the request, otherwise an IP matching Interfaces and
+	// Version is picked
+	EgressIP   string   `json:"egress_ip"`
+	Interfaces []string `json:"interfaces"`
+	Version    int      `json:"version"`
+	Session    string   `json:"session"`
+	// RateLimit names a policy from rate_limit_policies
+	RateLimit string `json:"rate_limit"`
+	// Timeout bounds the whole fetch including the response body, e.g. 30s
+	Timeout string `json:"timeout"`
+	// Response is stream (default) or base64
+	Response string `json:"response"`
+}
+
+// fetchResponse is the response of POST /fetch in base64 mode
+type fetchResponse struct {
+	Status  int         `json:"status"`
+	Headers http.Header `json:"headers"`
+	Body    string      `json:"body"`
+}
+
+// handleFetch performs the request described by the JSON body from an egress
+// IP, for clients that can't use a proxy. It's proxied through handleProxy
+// like a plain HTTP proxy request.
+func (hs *HTTPServer) handleFetch(w http.ResponseWriter, r *http.Request) {
+	var req fetchRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFetchBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid fetch request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Response == fetchBase64 {
+		rec, err := hs.fetchBuffered(&req, r)
+		if errors.Is(err, errFetchTooLarge) {
+			http.Error(w, fmt.Sprintf("%v, use the stream response", err), http.StatusBadGateway)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("invalid fetch request: %v", err), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Request-Id", rec.header.Get("X-Request-Id"))
+		json.NewEncoder(w).Encode(rec.response())
+		return
+	}
+
+	outReq, cancel, err := req.newRequest(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid fetch request: %v", err), http.StatusBadRequest)
+		return
+	}
+	defer cancel()
+	withRequestTracing(hs.handleProxy)(w, outReq)
+}
+
+// errFetchTooLarge is returned for buffered responses over maxFetchBody
+var errFetchTooLarge = fmt.Errorf("response body exceeds %d bytes", maxFetchBody)
+
+// fetchBuffered performs a fetch, buffering the response. Errors are
+// invalid fetches or errFetchTooLarge, proxy errors are responses.
+func (hs *HTTPServer) fetchBuffered(req *fetchRequest, r *http.Request) (*fetchRecorder, error) {
+	outReq, cancel, err := req.newRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	rec := &fetchRecorder{header: make(http.Header)}
+	outReq = outReq.WithContext(withProxyLimit(outReq.Context(), &rec.limit))
+	withRequestTracing(hs.handleProxy)(rec, outReq)
+	if rec.overflow {
+		return nil, errFetchTooLarge
+	}
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec, nil
+}
+
+// newRequest validates the fetch and returns it as a proxy request, with
+// its options set up front. cancel releases the timeout.
+func (req *fetchRequest) newRequest(r *http.Request) (*http.Request, func(), error) {
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid url: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, nil, fmt.Errorf("url must be an absolute http or https URL, got %q", req.URL)
+	}
+
+	var body io.Reader
+	switch {
+	case req.Body != "" && req.BodyBase64 != "":
+		return nil, nil, errors.New("body and body_base64 can't both be set")
+	case req.BodyBase64 != "":
+		decoded, err := base64.StdEncoding.DecodeString(req.BodyBase64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid body_base64: %w", err)
+		}
+		body = bytes.NewReader(decoded)
+	case req.Body != "":
+		body = strings.NewReader(req.Body)
+	}
+
+	if req.EgressIP != "" && net.ParseIP(req.EgressIP) == nil {
+		return nil, nil, fmt.Errorf("invalid egress_ip %q", req.EgressIP)
+	}
+	if req.Version != 0 && req.Version != 4 && req.Version != 6 {
+		return nil, nil, fmt.Errorf("version must be 4 or 6, got %d", req.Version)
+	}
+	if req.Response != "" && req.Response != fetchStream && req.Response != fetchBase64 {
+		return nil, nil, fmt.Errorf("unknown response %q, expected stream or base64", req.Response)
+	}
+	var timeout time.Duration
+	if req.Timeout != "" {
+		timeout, err = time.ParseDuration(req.Timeout)
+		if err != nil || timeout <= 0 {
+			return nil, nil, fmt.Errorf("invalid timeout %q", req.Timeout)
+		}
+	}
+
+	ctx := withProxyOptions(r.Context(), proxyOptions{
+		EgressIP:        req.EgressIP,
+		Session:         req.Session,
+		RateLimitPolicy: req.RateLimit,
+	})
+	ctx = withEgressPool(ctx, config.PortPool{Interfaces: req.Interfaces, Version: req.Version})
+	cancel := func() {}
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	outReq, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	if req.Headers != nil {
+		outReq.Header = req.Headers.Clone()
+	}
+	// Tunnels need a connection of their own, fetches only have a response
+	if method == http.MethodConnect || isUpgradeRequest(outReq) {
+		cancel()
+		return nil, nil, errors.New("CONNECT and upgrade requests need a proxy")
+	}
+	// Keep the caller's request ID and trace
+	for _, name := range []string{"X-Request-Id", "Traceparent", "Tracestate"} {
+		if outReq.Header.Get(name) == "" && r.Header.Get(name) != "" {
+			outReq.Header.Set(name, r.Header.Get(name))
+		}
+	}
+	outReq.RemoteAddr = r.RemoteAddr
+	outReq.RequestURI = u.String()
+	return outReq, cancel, nil
+}
+
+// fetchRecorder buffers the response of a base64 fetch
+type fetchRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	// overflow is set once the body exceeded maxFetchBody
+	overflow bool
+	// limit is set if a rate or concurrency limit of the proxy rejected the fetch
+	limit proxyLimit
+}
+
+func (rec *fetchRecorder) Header() http.Header { return rec.header }
+
+// response returns the recorded response with a base64 body
+func (rec *fetchRecorder) response() fetchResponse {
+	return fetchResponse{
+		Status:  rec.status,
+		Headers: rec.header,
+		Body:    base64.StdEncoding.EncodeToString(rec.body.Bytes()),
+	}
+}
+
+func (rec *fetchRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *fetchRecorder) Write(p []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+	if rec.body.Len()+len(p) > maxFetchBody {
+		rec.overflow = true
+		return 0, errors.New("fetch response body too large")
+	}
+	return rec.body.Write(p)
+}
@@ -0,0 +1,203 @@
+package http_server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBatchConcurrency is how many jobs of a batch run at once if unset
+const DefaultBatchConcurrency = 8
+
+// maxBatchBackoff caps the wait before retrying a job over a concurrency
+// limit, which has no known time a slot frees up
+const maxBatchBackoff = 5 * time.Second
+
+// batchRequest is the body of POST /fetch/batch
+type batchRequest struct {
+	Jobs []batchJob `json:"jobs"`
+	// Concurrency is how many jobs run at once, defaults to DefaultBatchConcurrency
+	Concurrency int `json:"concurrency"`
+}
+
+// batchJob is a fetch with an optional ID echoed in its result
+type batchJob struct {
+	ID string `json:"id"`
+	fetchRequest
+}
+
+// batchResult is a line of the NDJSON response of a batch
+type batchResult struct {
+	Index int    `json:"index"`
+	ID    string `json:"id,omitempty"`
+	*fetchResponse
+	Error string `json:"error,omitempty"`
+	// Attempts counts the runs of the job, rate limited runs are repeated
+	Attempts int `json:"attempts"`
+}
+
+// handleFetchBatch runs fetch jobs concurrently, streaming their results as
+// NDJSON in the order they finish. Jobs over a rate or concurrency limit of
+// the proxy wait and run again. Jobs still queued or running when the client
+// goes away are canceled.
+func (hs *HTTPServer) handleFetchBatch(w http.ResponseWriter, r *http.Request) {
+	var req batchRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFetchBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid batch request: %v", err), http.StatusBadRequest)
+		return
+	}
+	maxJobs, maxConcurrency := hs.config.Fetch.GetMaxBatchJobs(), hs.config.Fetch.GetMaxBatchConcurrency()
+	if len(req.Jobs) == 0 || len(req.Jobs) > maxJobs {
+		http.Error(w, fmt.Sprintf("a batch must have 1 to %d jobs, got %d", maxJobs, len(req.Jobs)), http.StatusBadRequest)
+		return
+	}
+	concurrency := req.Concurrency
+	if concurrency == 0 {
+		concurrency = min(DefaultBatchConcurrency, maxConcurrency)
+	}
+	if concurrency < 1 || concurrency > maxConcurrency {
+		http.Error(w, fmt.Sprintf("concurrency must be between 1 and %d, got %d", maxConcurrency, concurrency), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	rc.Flush()
+
+	ctx := r.Context()
+	indexes := make(chan int)
+	results := make(chan batchResult)
+	go func() {
+		defer close(indexes)
+		for i := range req.Jobs {
+			select {
+			case indexes <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for range min(concurrency, len(req.Jobs)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results <- hs.runBatchJob(r, i, &req.Jobs[i])
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	enc := json.NewEncoder(w)
+	for result := range results {
+		// Keep draining after a failed write so the workers can finish
+		if ctx.Err() == nil {
+			enc.Encode(result)
+			rc.Flush()
+		}
+	}
+}
+
+// runBatchJob runs a job until it isn't limited by the proxy. Rate limited
+// jobs wait for the limiter's next free slot, as long as the job's timeout
+// and the client allow.
+func (hs *HTTPServer) runBatchJob(r *http.Request, index int, job *batchJob) batchResult {
+	result := batchResult{Index: index, ID: job.ID}
+	if job.Response == fetchStream {
+		result.Error = "batch jobs can't stream responses"
+		return result
+	}
+
+	// The timeout bounds the whole job, waits included. Invalid timeouts
+	// fail in fetchBuffered.
+	ctx := r.Context()
+	if timeout, err := time.ParseDuration(job.Timeout); err == nil && timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	backoffs := 0
+	for {
+		result.Attempts++
+		rec, err := hs.fetchBuffered(&job.fetchRequest, r)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		// Upstream responses may carry any header, so only the flag set by
+		// the proxy's own limits counts
+		if !rec.limit.limited.Load() {
+			response := rec.response()
+			result.fetchResponse = &response
+			return result
+		}
+
+		wait := time.Duration(rec.limit.retryAfter.Load())
+		if wait == 0 {
+			// Concurrency slots free up as other requests finish
+			wait = min(100*time.Millisecond<<min(backoffs, 10), maxBatchBackoff)
+			backoffs++
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			// The job can't run again in time, the limited response is its result
+			response := rec.response()
+			result.fetchResponse = &response
+			return result
+		}
+		if !sleepContext(ctx, wait) {
+			result.Error = ctx.Err().Error()
+			return result
+		}
+	}
+}
+
+// proxyLimit records a rejection by one of the proxy's own limits
+type proxyLimit struct {
+	limited atomic.Bool
+	// retryAfter is how long until the rate limit frees a slot, in
+	// nanoseconds. It's 0 for concurrency limits.
+	retryAfter atomic.Int64
+}
+
+type proxyLimitKey struct{}
+
+// withProxyLimit stores limit on the context, to be set if the proxy rejects
+// the request over one of its own rate or concurrency limits
+func withProxyLimit(ctx context.Context, limit *proxyLimit) context.Context {
+	return context.WithValue(ctx, proxyLimitKey{}, limit)
+}
+
+// markProxyLimited records that the request of ctx hit a limit of the
+// proxy, which frees a slot after retryAfter if known
+func markProxyLimited(ctx context.Context, retryAfter time.Duration) {
+	if limit, ok := ctx.Value(proxyLimitKey{}).(*proxyLimit); ok {
+		limit.retryAfter.Store(int64(retryAfter))
+		limit.limited.Store(true)
+	}
+}
+
+// sleepContext waits for d, returning false if ctx is done first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,253 @@
+package http_server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/config"
+)
+
+// batchLine is a decoded line of a batch response
+type batchLine struct {
+	Index    int         `json:"index"`
+	ID       string      `json:"id"`
+	Status   int         `json:"status"`
+	Headers  http.Header `json:"headers"`
+	Body     string      `json:"body"`
+	Error    string      `json:"error"`
+	Attempts int         `json:"attempts"`
+}
+
+// postBatch sends a batch and reads its NDJSON results
+func postBatch(t *testing.T, ctx context.Context, proxy *httptest.Server, batch map[string]any) (*http.Response, []batchLine) {
+	t.Helper()
+
+	body, _ := json.Marshal(batch)
+	req, _ := http.NewRequestWithContext(ctx, "POST", proxy.URL+"/fetch/batch", strings.NewReader(string(body)))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var results []batchLine
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var result batchLine
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			t.Fatalf("invalid result line %q: %v", scanner.Text(), err)
+		}
+		results = append(results, result)
+	}
+	return resp, results
+}
+
+func TestFetchBatch(t *testing.T) {
+	upstream, proxy := newFetchTestServers(t, &config.Config{})
+
+	jobs := []map[string]any{
+		{"id": "a", "url": upstream.URL, "method": "POST", "body": "first", "egress_ip": "127.0.0.1"},
+		{"id": "b", "url": upstream.URL, "egress_ip": "192.0.2.1"},
+		{"id": "c", "url": "ftp://example.com"},
+		{"id": "d", "url": upstream.URL, "egress_ip": "127.0.0.1", "response": "stream"},
+	}
+	resp, results := postBatch(t, context.Background(), proxy, map[string]any{"jobs": jobs, "concurrency": 2})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("expected an NDJSON response, got %d %v", resp.StatusCode, resp.Header)
+	}
+	if len(results) != len(jobs) {
+		t.Fatalf("expected %d results, got %+v", len(jobs), results)
+	}
+
+	byID := make(map[string]batchLine)
+	for _, result := range results {
+		if result.ID != jobs[result.Index]["id"] {
+			t.Errorf("result %d has ID %q, expected %q", result.Index, result.ID, jobs[result.Index]["id"])
+		}
+		byID[result.ID] = result
+	}
+	if a := byID["a"]; a.Status != http.StatusCreated || a.Body != "Zmlyc3Q=" || a.Attempts != 1 {
+		t.Errorf("expected the upstream response for a, got %+v", a)
+	}
+	if b := byID["b"]; b.Status != http.StatusForbidden {
+		t.Errorf("expected the proxy's 403 for b, got %+v", b)
+	}
+	if c := byID["c"]; c.Status != 0 || !strings.Contains(c.Error, "absolute http or https URL") {
+		t.Errorf("expected an invalid fetch error for c, got %+v", c)
+	}
+	if d := byID["d"]; d.Status != 0 || d.Error == "" {
+		t.Errorf("expected streaming to be refused for d, got %+v", d)
+	}
+}
+
+func TestFetchBatch_QueuesRateLimited(t *testing.T) {
+	upstream, proxy := newFetchTestServers(t, &config.Config{
+		RateLimitPolicies: map[string]config.RateLimitConfig{
+			"burst": {Method: "fixed_window", Rate: 2, Period: time.Second},
+		},
+	})
+
+	var jobs []map[string]any
+	for range 5 {
+		jobs = append(jobs, map[string]any{"url": upstream.URL + "/queued", "egress_ip": "127.0.0.1", "rate_limit": "burst"})
+	}
+	_, results := postBatch(t, context.Background(), proxy, map[string]any{"jobs": jobs, "concurrency": 5})
+	if len(results) != len(jobs) {
+		t.Fatalf("expected %d results, got %+v", len(jobs), results)
+	}
+	retried := 0
+	for _, result := range results {
+		if result.Status != http.StatusCreated {
+			t.Errorf("expected every job to succeed eventually, got %+v", result)
+		}
+		if result.Attempts > 1 {
+			retried++
+		}
+	}
+	if retried < 3 {
+		t.Errorf("expected at least 3 jobs to wait for the rate limit, got %d", retried)
+	}
+}
+
+func TestFetchBatch_UpstreamLimitNotRetried(t *testing.T) {
+	upstream, proxy := newFetchTestServers(t, &config.Config{})
+
+	jobs := []map[string]any{{"url": upstream.URL + "/limited", "egress_ip": "127.0.0.1"}}
+	_, results := postBatch(t, context.Background(), proxy, map[string]any{"jobs": jobs})
+	if len(results) != 1 || results[0].Status != http.StatusTooManyRequests || results[0].Attempts != 1 {
+		t.Errorf("expected the upstream's 429 after one attempt, got %+v", results)
+	}
+}
+
+func TestFetchBatch_WaitsForLongPeriod(t *testing.T) {
+	// A token every 1.5s, with a period longer than any fixed backoff
+	upstream, proxy := newFetchTestServers(t, &config.Config{
+		RateLimitPolicies: map[string]config.RateLimitConfig{
+			"slow": {Method: "token_bucket", Rate: 20, Period: 30 * time.Second},
+		},
+	})
+
+	var jobs []map[string]any
+	for range 21 {
+		jobs = append(jobs, map[string]any{"url": upstream.URL + "/long-period", "egress_ip": "127.0.0.1", "rate_limit": "slow"})
+	}
+	_, results := postBatch(t, context.Background(), proxy, map[string]any{"jobs": jobs, "concurrency": 21})
+	if len(results) != len(jobs) {
+		t.Fatalf("expected %d results, got %+v", len(jobs), results)
+	}
+	for _, result := range results {
+		if result.Status != http.StatusCreated {
+			t.Errorf("expected every job to succeed, got %+v", result)
+		}
+	}
+	// The limited job sleeps until the next token instead of polling
+	if last := results[len(results)-1]; last.Attempts != 2 {
+		t.Errorf("expected the last job to run again once, when a token was free, got %+v", last)
+	}
+}
+
+func TestFetchBatch_LimitPastTimeout(t *testing.T) {
+	upstream, proxy := newFetchTestServers(t, &config.Config{
+		RateLimitPolicies: map[string]config.RateLimitConfig{
+			"strict": {Method: "fixed_window", Rate: 1, Period: time.Hour},
+		},
+	})
+
+	var jobs []map[string]any
+	for range 2 {
+		jobs = append(jobs, map[string]any{"url": upstream.URL + "/past-timeout", "egress_ip": "127.0.0.1", "rate_limit": "strict", "timeout": "5s"})
+	}
+	start := time.Now()
+	_, results := postBatch(t, context.Background(), proxy, map[string]any{"jobs": jobs, "concurrency": 1})
+	if len(results) != len(jobs) {
+		t.Fatalf("expected %d results, got %+v", len(jobs), results)
+	}
+	if results[0].Status != http.StatusCreated {
+		t.Errorf("expected the first job to succeed, got %+v", results[0])
+	}
+	// The next window starts after the timeout, so there's no point waiting
+	if last := results[1]; last.Status != http.StatusTooManyRequests || last.Attempts != 1 {
+		t.Errorf("expected the second job to end with the proxy's 429, got %+v", last)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the job to end without waiting out its timeout, took %v", elapsed)
+	}
+}
+
+func TestFetchBatch_Cancel(t *testing.T) {
+	var started, canceled atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started.Add(1)
+		<-r.Context().Done()
+		canceled.Add(1)
+	}))
+	t.Cleanup(upstream.Close)
+	hs := &HTTPServer{config: &config.Config{AllowedInterfaces: []string{"lo"}}}
+	proxy := httptest.NewServer(hs.newHandler())
+	t.Cleanup(proxy.Close)
+
+	var jobs []map[string]any
+	for range 5 {
+		jobs = append(jobs, map[string]any{"url": upstream.URL, "egress_ip": "127.0.0.1"})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for started.Load() < 2 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		cancel()
+	}()
+	body, _ := json.Marshal(map[string]any{"jobs": jobs, "concurrency": 2})
+	req, _ := http.NewRequestWithContext(ctx, "POST", proxy.URL+"/fetch/batch", strings.NewReader(string(body)))
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for canceled.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if canceled.Load() != 2 {
+		t.Errorf("expected the running jobs to be canceled, got %d", canceled.Load())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := started.Load(); n != 2 {
+		t.Errorf("expected the queued jobs not to start, got %d started", n)
+	}
+}
+
+func TestFetchBatch_Invalid(t *testing.T) {
+	upstream, proxy := newFetchTestServers(t, &config.Config{Fetch: config.FetchConfig{MaxBatchJobs: 2, MaxBatchConcurrency: 4}})
+	job := map[string]any{"url": upstream.URL}
+
+	tests := []struct {
+		batch    map[string]any
+		expected string
+	}{
+		{map[string]any{"jobs": []any{}}, "a batch must have 1 to 2 jobs, got 0"},
+		{map[string]any{"jobs": []any{job, job, job}}, "a batch must have 1 to 2 jobs, got 3"},
+		{map[string]any{"jobs": []any{job}, "concurrency": 5}, "concurrency must be between 1 and 4, got 5"},
+		{map[string]any{"jobs": []any{job}, "concurrency": -1}, "concurrency must be between 1 and 4, got -1"},
+		{map[string]any{"jobs": []any{map[string]any{"uri": "x"}}}, `unknown field "uri"`},
+	}
+	for _, tt := range tests {
+		body, _ := json.Marshal(tt.batch)
+		resp, err := http.Post(proxy.URL+"/fetch/batch", "application/json", strings.NewReader(string(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := new(strings.Builder)
+		bufio.NewReader(resp.Body).WriteTo(msg)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest || !strings.Contains(msg.String(), tt.expected) {
+			t.Errorf("%v: expected 400 with %q, got %d %q", tt.batch, tt.expected, resp.StatusCode, msg)
+		}
+	}
+}
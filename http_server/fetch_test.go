@@ -0,0 +1,171 @@
+package http_server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/config"
+)
+
+// newFetchTestServers starts an upstream echoing the request and a proxy
+// serving /fetch
+func newFetchTestServers(t *testing.T, cfg *config.Config) (*httptest.Server, *httptest.Server) {
+	t.Helper()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(time.Second)
+		}
+		if r.URL.Path == "/limited" {
+			// Looks like a limit of the proxy, but comes from the upstream
+			w.Header().Set("X-RateLimit-Source", "specificproxy")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Method", r.Method)
+		w.Header().Set("X-Seen", r.Header.Get("X-Custom"))
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	}))
+	t.Cleanup(upstream.Close)
+
+	cfg.AllowedInterfaces = []string{"lo"}
+	hs := &HTTPServer{config: cfg}
+	proxy := httptest.NewServer(hs.newHandler())
+	t.Cleanup(proxy.Close)
+	return upstream, proxy
+}
+
+// postFetch sends a fetch request
+func postFetch(t *testing.T, proxy *httptest.Server, req map[string]any) *http.Response {
+	t.Helper()
+
+	body, _ := json.Marshal(req)
+	resp, err := http.Post(proxy.URL+"/fetch", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestFetch_Stream(t *testing.T) {
+	upstream, proxy := newFetchTestServers(t, &config.Config{})
+
+	resp := postFetch(t, proxy, map[string]any{
+		"url":       upstream.URL + "/echo",
+		"method":    "PUT",
+		"headers":   map[string][]string{"X-Custom": {"yes"}},
+		"body":      "hello",
+		"egress_ip": "127.0.0.1",
+	})
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusCreated || string(body) != "hello" {
+		t.Errorf("expected the upstream response, got %d %q", resp.StatusCode, body)
+	}
+	if resp.Header.Get("X-Method") != "PUT" || resp.Header.Get("X-Seen") != "yes" {
+		t.Errorf("expected the method and headers to be sent, got %v", resp.Header)
+	}
+	if resp.Header.Get("X-Egress-IP-Used") != "127.0.0.1" || resp.Header.Get("X-Request-Id") == "" {
+		t.Errorf("expected egress and request ID headers, got %v", resp.Header)
+	}
+}
+
+func TestFetch_Base64(t *testing.T) {
+	upstream, proxy := newFetchTestServers(t, &config.Config{})
+
+	resp := postFetch(t, proxy, map[string]any{
+		"url":         upstream.URL,
+		"method":      "POST",
+		"body_base64": base64.StdEncoding.EncodeToString([]byte{0, 1, 2, 255}),
+		"egress_ip":   "127.0.0.1",
+		"response":    "base64",
+	})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("expected a JSON response, got %d %v", resp.StatusCode, resp.Header)
+	}
+	var fetched fetchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&fetched); err != nil {
+		t.Fatal(err)
+	}
+	body, _ := base64.StdEncoding.DecodeString(fetched.Body)
+	if fetched.Status != http.StatusCreated || string(body) != "\x00\x01\x02\xff" {
+		t.Errorf("expected the upstream status and body, got %d %q", fetched.Status, body)
+	}
+	if fetched.Headers.Get("X-Method") != "POST" || fetched.Headers.Get("X-Egress-IP-Used") != "127.0.0.1" {
+		t.Errorf("expected upstream and egress headers, got %v", fetched.Headers)
+	}
+}
+
+func TestFetch_EgressRules(t *testing.T) {
+	upstream, proxy := newFetchTestServers(t, &config.Config{
+		RateLimitPolicies: map[string]config.RateLimitConfig{
+			"strict": {Method: "fixed_window", Rate: 1, Period: time.Hour},
+		},
+	})
+
+	tests := []struct {
+		name     string
+		req      map[string]any
+		expected int
+	}{
+		{"disallowed IP", map[string]any{"egress_ip": "192.0.2.1"}, http.StatusForbidden},
+		{"no IP matches the filter", map[string]any{"version": 6}, http.StatusInternalServerError},
+		{"within rate limit", map[string]any{"egress_ip": "127.0.0.1", "rate_limit": "strict"}, http.StatusCreated},
+		{"over rate limit", map[string]any{"egress_ip": "127.0.0.1", "rate_limit": "strict"}, http.StatusTooManyRequests},
+		{"unknown policy", map[string]any{"egress_ip": "127.0.0.1", "rate_limit": "unknown"}, http.StatusBadRequest},
+		{"timeout", map[string]any{"egress_ip": "127.0.0.1", "url": upstream.URL + "/slow", "timeout": "100ms"}, http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		if _, ok := tt.req["url"]; !ok {
+			tt.req["url"] = upstream.URL
+		}
+		if resp := postFetch(t, proxy, tt.req); resp.StatusCode != tt.expected {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.expected, resp.StatusCode)
+		}
+	}
+}
+
+func TestFetch_Invalid(t *testing.T) {
+	upstream, proxy := newFetchTestServers(t, &config.Config{})
+
+	tests := []struct {
+		req      map[string]any
+		expected string
+	}{
+		{map[string]any{"url": "/relative"}, "absolute http or https URL"},
+		{map[string]any{"url": "ftp://example.com"}, "absolute http or https URL"},
+		{map[string]any{"url": upstream.URL, "body": "a", "body_base64": "YQ=="}, "can't both be set"},
+		{map[string]any{"url": upstream.URL, "body_base64": "!"}, "invalid body_base64"},
+		{map[string]any{"url": upstream.URL, "egress_ip": "nope"}, `invalid egress_ip "nope"`},
+		{map[string]any{"url": upstream.URL, "version": 5}, "version must be 4 or 6"},
+		{map[string]any{"url": upstream.URL, "timeout": "soon"}, `invalid timeout "soon"`},
+		{map[string]any{"url": upstream.URL, "response": "json"}, `unknown response "json"`},
+		{map[string]any{"url": upstream.URL, "method": "CONNECT"}, "need a proxy"},
+		{map[string]any{"url": upstream.URL, "headers": map[string][]string{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}}}, "need a proxy"},
+		{map[string]any{"url": upstream.URL, "egress": "127.0.0.1"}, `unknown field "egress"`},
+	}
+	for _, tt := range tests {
+		resp := postFetch(t, proxy, tt.req)
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), tt.expected) {
+			t.Errorf("%v: expected 400 with %q, got %d %q", tt.req, tt.expected, resp.StatusCode, body)
+		}
+	}
+
+	resp, err := http.Get(proxy.URL + "/fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for GET /fetch, got %d", resp.StatusCode)
+	}
+}
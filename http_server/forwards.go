@@ -0,0 +1,279 @@
+package http_server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/config"
+	"github.com/rs/zerolog"
+)
+
+// forwardListeners runs the configured forwards, keyed by name
+type forwardListeners struct {
+	// handle relays a connection accepted by a forward
+	handle func(*forwarder, net.Conn)
+
+	mu       sync.Mutex
+	forwards map[string]*forwarder
+	closed   bool
+}
+
+// forwarder is a running forward
+type forwarder struct {
+	cfg   config.Forward
+	ln    net.Listener
+	stats *forwardStats
+}
+
+// forwardStats count the connections and bytes of a forward. They are kept
+// across reloads for as long as the forward exists.
+type forwardStats struct {
+	Active  atomic.Int64
+	Total   atomic.Int64
+	Refused atomic.Int64
+	Failed  atomic.Int64
+	// BytesSent were sent by clients to the target
+	BytesSent atomic.Int64
+	// BytesReceived were sent by the target to clients
+	BytesReceived atomic.Int64
+}
+
+func newForwardListeners(handle func(*forwarder, net.Conn)) *forwardListeners {
+	return &forwardListeners{
+		handle:   handle,
+		forwards: make(map[string]*forwarder),
+	}
+}
+
+// apply starts new forwards, stops removed ones and restarts changed ones.
+// Open connections of stopped forwards are left running. Forwards that fail
+// to listen are returned as errors, the others keep running.
+func (fl *forwardListeners) apply(forwards []config.Forward) error {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if fl.closed {
+		return net.ErrClosed
+	}
+
+	wanted := make(map[string]config.Forward, len(forwards))
+	for _, f := range forwards {
+		wanted[f.Name] = f
+	}
+
+	// Stop first, so changed forwards can listen on their address again
+	kept := make(map[string]*forwardStats)
+	for name, f := range fl.forwards {
+		cfg, ok := wanted[name]
+		if ok && reflect.DeepEqual(cfg, f.cfg) {
+			continue
+		}
+		f.ln.Close()
+		delete(fl.forwards, name)
+		if ok {
+			kept[name] = f.stats
+			logger.Info().Str("forward", name).Msg("restarting changed forward")
+		} else {
+			logger.Info().Str("forward", name).Str("addr", f.cfg.ListenAddr).Msg("stopped removed forward")
+		}
+	}
+
+	var errs []error
+	for _, cfg := range forwards {
+		if _, ok := fl.forwards[cfg.Name]; ok {
+			continue
+		}
+		ln, err := net.Listen("tcp", cfg.ListenAddr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("forward %q: %w", cfg.Name, err))
+			continue
+		}
+		stats := kept[cfg.Name]
+		if stats == nil {
+			stats = new(forwardStats)
+		}
+		f := &forwarder{cfg: cfg, ln: ln, stats: stats}
+		fl.forwards[cfg.Name] = f
+
+		logger.Info().Str("forward", cfg.Name).Str("addr", ln.Addr().String()).Str("target", cfg.Target).
+			Str("egress_ip", cfg.IP).Strs("interfaces", cfg.Interfaces).Int("version", cfg.Version).Msg("starting forward")
+		go fl.serve(f)
+	}
+	return errors.Join(errs...)
+}
+
+// serve accepts connections of a forward until it's stopped
+func (fl *forwardListeners) serve(f *forwarder) {
+	for {
+		conn, err := f.ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			logger.Error().Err(err).Str("forward", f.cfg.Name).Msg("forward accept failed")
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go fl.handle(f, conn)
+	}
+}
+
+// list returns the running forwards sorted by name
+func (fl *forwardListeners) list() []*forwarder {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	forwards := make([]*forwarder, 0, len(fl.forwards))
+	for _, f := range fl.forwards {
+		forwards = append(forwards, f)
+	}
+	slices.SortFunc(forwards, func(a, b *forwarder) int { return strings.Compare(a.cfg.Name, b.cfg.Name) })
+	return forwards
+}
+
+// close stops every forward
+func (fl *forwardListeners) close() {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	fl.closed = true
+	for name, f := range fl.forwards {
+		f.ln.Close()
+		delete(fl.forwards, name)
+	}
+}
+
+// ReloadForwards replaces the running forwards with forwards, keeping the
+// unchanged ones and their connections running
+func (hs *HTTPServer) ReloadForwards(forwards []config.Forward) error {
+	return hs.forwards.apply(forwards)
+}
+
+// handleForward relays a forward connection to its target through an
+// egress IP picked like for a CONNECT to the target
+func (hs *HTTPServer) handleForward(f *forwarder, conn net.Conn) {
+	defer conn.Close()
+	cfg := &f.cfg
+	client := addrPort(conn.RemoteAddr())
+	log := logger.With().Str("forward", cfg.Name).Str("client", client.String()).Str("target", cfg.Target).Logger()
+
+	if !cfg.Allows(client.Addr()) {
+		f.stats.Refused.Add(1)
+		log.Warn().Msg("client is not allowed to use forward")
+		return
+	}
+	if hs.draining.Load() {
+		return
+	}
+	f.stats.Total.Add(1)
+	f.stats.Active.Add(1)
+	defer f.stats.Active.Add(-1)
+
+	ctx := withEgressPool(log.WithContext(context.Background()), cfg.Pool())
+	timeouts := hs.timeoutsFor(cfg.Target)
+	localIP, targetConn, err := hs.dialForward(ctx, cfg, timeouts)
+	if err != nil {
+		f.stats.Failed.Add(1)
+		log.Error().Err(err).Msg("forward failed to connect to target")
+		return
+	}
+	defer targetConn.Close()
+	defer hs.tunnels.track(conn, cfg.Target, localIP)()
+	log.Debug().Str("egress_ip", localIP.String()).Msg("forwarding connection")
+
+	ctx, cancel := tunnelContext(ctx, timeouts)
+	defer cancel()
+	idle := newIdleTracker(timeouts.TunnelIdle)
+	target := &resetConn{Conn: targetConn}
+	relay(ctx,
+		&countingReadWriter{ReadWriter: idle.wrap(conn), n: &f.stats.BytesSent},
+		&countingReadWriter{ReadWriter: idle.wrap(target), n: &f.stats.BytesReceived},
+	)
+
+	if target.reset.Load() {
+		hs.egressHealth.RecordFailure(localIP.String(), cfg.Target, "reset")
+	}
+}
+
+// dialForward connects to the target of a forward. Unpinned forwards retry
+// failed dials through other egress IPs like CONNECT tunnels.
+func (hs *HTTPServer) dialForward(ctx context.Context, cfg *config.Forward, timeouts config.Timeouts) (net.IP, net.Conn, error) {
+	attempts := 1
+	if cfg.IP == "" && hs.config.Retry.MaxAttempts > 1 {
+		attempts = hs.config.Retry.MaxAttempts
+	}
+
+	var tried []string
+	var err error
+	for attempt := range attempts {
+		if attempt > 0 && !hs.waitBackoff(ctx, attempt) {
+			break
+		}
+		egressIP := cfg.IP
+		if egressIP == "" {
+			egressIP, err = hs.pickEgressIP(ctx, cfg.Target, tried...)
+			if err != nil {
+				break
+			}
+		} else if !hs.config.IsIPAllowed(egressIP) {
+			return nil, nil, fmt.Errorf("egress IP %s is not allowed", egressIP)
+		}
+		tried = append(tried, egressIP)
+
+		localIP := net.ParseIP(egressIP)
+		var conn net.Conn
+		conn, err = tracedDial(ctx, newDialer(localIP, timeouts), cfg.Target)
+		if err == nil {
+			hs.egressHealth.RecordSuccess(egressIP, cfg.Target)
+			return localIP, conn, nil
+		}
+		hs.recordError(localIP, cfg.Target, err)
+		zerolog.Ctx(ctx).Warn().Err(err).Str("egress_ip", egressIP).Int("attempt", attempt+1).Msg("forward dial failed")
+		if !isRetryableError(err) {
+			break
+		}
+	}
+	return nil, nil, err
+}
+
+// countingReadWriter adds the bytes read to n
+type countingReadWriter struct {
+	io.ReadWriter
+	n *atomic.Int64
+}
+
+func (c *countingReadWriter) Read(p []byte) (int, error) {
+	n, err := c.ReadWriter.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// forwardStatus is a running forward with its stats, as returned by /forwards
+type forwardStatus struct {
+	config.Forward
+	Addr          string `json:"addr"`
+	Active        int64  `json:"active"`
+	Total         int64  `json:"total"`
+	Refused       int64  `json:"refused"`
+	Failed        int64  `json:"failed"`
+	BytesSent     int64  `json:"bytes_sent"`
+	BytesReceived int64  `json:"bytes_received"`
+}
+
+func (f *forwarder) status() forwardStatus {
+	return forwardStatus{
+		Forward:       f.cfg,
+		Addr:          f.ln.Addr().String(),
+		Active:        f.stats.Active.Load(),
+		Total:         f.stats.Total.Load(),
+		Refused:       f.stats.Refused.Load(),
+		Failed:        f.stats.Failed.Load(),
+		BytesSent:     f.stats.BytesSent.Load(),
+		BytesReceived: f.stats.BytesReceived.Load(),
+	}
+}
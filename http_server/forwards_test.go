@@ -0,0 +1,161 @@
+package http_server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/config"
+)
+
+// startForwardTestServer starts forwards like StartHTTPServer
+func startForwardTestServer(t *testing.T, forwards ...config.Forward) *HTTPServer {
+	t.Helper()
+
+	hs := &HTTPServer{config: &config.Config{
+		AllowedInterfaces: []string{"lo"},
+		Admin:             config.AdminConfig{Token: "secret"},
+	}}
+	hs.forwards = newForwardListeners(hs.handleForward)
+	if err := hs.forwards.apply(forwards); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(hs.forwards.close)
+	return hs
+}
+
+// forwardAddr returns the listen address of a running forward
+func forwardAddr(t *testing.T, hs *HTTPServer, name string) string {
+	t.Helper()
+
+	for _, f := range hs.forwards.list() {
+		if f.cfg.Name == name {
+			return f.ln.Addr().String()
+		}
+	}
+	t.Fatalf("forward %q is not running", name)
+	return ""
+}
+
+// dialForward connects to a forward
+func dialForward(t *testing.T, addr string) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func TestForward_Relay(t *testing.T) {
+	echo := startEchoListener(t)
+	hs := startForwardTestServer(t, config.Forward{
+		Name: "echo", ListenAddr: "127.0.0.1:0", Target: echo.Addr().String(), IP: "127.0.0.1",
+	})
+
+	conn := dialForward(t, forwardAddr(t, hs, "echo"))
+	echoThrough(t, conn, conn, "replicate")
+	if hs.tunnels.Len() != 1 {
+		t.Errorf("expected the forward to be tracked as a tunnel, got %d", hs.tunnels.Len())
+	}
+	conn.Close()
+
+	// Stats are listed on the admin API
+	deadline := time.Now().Add(5 * time.Second)
+	for hs.tunnels.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	w := serveAdmin(t, hs.newAdminHandler(), "GET", "/forwards", http.StatusOK)
+	var resp struct {
+		Forwards []forwardStatus `json:"forwards"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Forwards) != 1 {
+		t.Fatalf("expected 1 forward, got %+v", resp.Forwards)
+	}
+	status := resp.Forwards[0]
+	if status.Name != "echo" || status.Total != 1 || status.Active != 0 || status.BytesSent != 9 || status.BytesReceived != 9 {
+		t.Errorf("unexpected forward status %+v", status)
+	}
+}
+
+func TestForward_Refused(t *testing.T) {
+	echo := startEchoListener(t)
+	hs := startForwardTestServer(t,
+		config.Forward{Name: "acl", ListenAddr: "127.0.0.1:0", Target: echo.Addr().String(), IP: "127.0.0.1", Allow: []string{"192.0.2.0/24"}},
+		config.Forward{Name: "disallowed", ListenAddr: "127.0.0.1:0", Target: echo.Addr().String(), IP: "192.0.2.1"},
+		// Loopback isn't an available IP to pick from
+		config.Forward{Name: "unpinned", ListenAddr: "127.0.0.1:0", Target: echo.Addr().String()},
+	)
+
+	for _, name := range []string{"acl", "disallowed", "unpinned"} {
+		expectClosed(t, dialForward(t, forwardAddr(t, hs, name)))
+	}
+	stats := make(map[string]forwardStatus)
+	for _, f := range hs.forwards.list() {
+		stats[f.cfg.Name] = f.status()
+	}
+	if stats["acl"].Refused != 1 || stats["acl"].Total != 0 {
+		t.Errorf("expected the ACL to refuse the client, got %+v", stats["acl"])
+	}
+	if stats["disallowed"].Failed != 1 || stats["unpinned"].Failed != 1 {
+		t.Errorf("expected failed connections, got %+v and %+v", stats["disallowed"], stats["unpinned"])
+	}
+}
+
+func TestForward_Reload(t *testing.T) {
+	echo := startEchoListener(t)
+	keep := config.Forward{Name: "keep", ListenAddr: "127.0.0.1:0", Target: echo.Addr().String(), IP: "127.0.0.1"}
+	change := config.Forward{Name: "change", ListenAddr: "127.0.0.1:0", Target: echo.Addr().String(), IP: "192.0.2.1"}
+	remove := config.Forward{Name: "remove", ListenAddr: "127.0.0.1:0", Target: echo.Addr().String(), IP: "127.0.0.1"}
+	hs := startForwardTestServer(t, keep, change, remove)
+
+	keepAddr := forwardAddr(t, hs, "keep")
+	removeAddr := forwardAddr(t, hs, "remove")
+	open := dialForward(t, removeAddr)
+	echoThrough(t, open, open, "before")
+	expectClosed(t, dialForward(t, forwardAddr(t, hs, "change")))
+
+	change.IP = "127.0.0.1"
+	added := config.Forward{Name: "added", ListenAddr: "127.0.0.1:0", Target: echo.Addr().String(), IP: "127.0.0.1"}
+	if err := hs.ReloadForwards([]config.Forward{keep, change, added}); err != nil {
+		t.Fatal(err)
+	}
+
+	if addr := forwardAddr(t, hs, "keep"); addr != keepAddr {
+		t.Errorf("expected the unchanged forward to keep listening on %s, got %s", keepAddr, addr)
+	}
+	for _, name := range []string{"change", "added"} {
+		conn := dialForward(t, forwardAddr(t, hs, name))
+		echoThrough(t, conn, conn, name)
+	}
+	for _, f := range hs.forwards.list() {
+		if f.cfg.Name == "change" && (f.stats.Failed.Load() != 1 || f.stats.Total.Load() != 2) {
+			t.Errorf("expected the stats of the changed forward to be kept, got failed %d total %d", f.stats.Failed.Load(), f.stats.Total.Load())
+		}
+		if f.cfg.Name == "remove" {
+			t.Error("expected the removed forward to be stopped")
+		}
+	}
+	if _, err := net.Dial("tcp", removeAddr); err == nil {
+		t.Error("expected the removed forward to stop listening")
+	}
+
+	// Connections of removed forwards keep running
+	echoThrough(t, open, open, "after")
+
+	// Forwards that can't listen are reported, the rest keep running
+	taken := config.Forward{Name: "taken", ListenAddr: keepAddr, Target: echo.Addr().String()}
+	if err := hs.ReloadForwards([]config.Forward{keep, taken}); err == nil {
+		t.Error("expected an error for a listen address in use")
+	}
+	conn := dialForward(t, keepAddr)
+	echoThrough(t, conn, conn, "still up")
+}
@@ -0,0 +1,154 @@
+package http_server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/danthegoodman1/specificproxy/config"
+	"github.com/rs/zerolog"
+)
+
+// controlHeaderRule strips the proxy's own control headers from outgoing
+// requests so the proxy stays invisible. New control headers must be added here.
+var controlHeaderRule = config.HeaderRule{
+	Request: []config.HeaderAction{
+		{Action: config.HeaderActionRemove, Name: "X-Egress-IP"},
+		{Action: config.HeaderActionRemove, Name: "X-Rate-Limit"},
+		{Action: config.HeaderActionRemove, Name: "X-Bandwidth-Limit"},
+		{Action: config.HeaderActionRemove, Name: "Proxy-Connection"},
+		{Action: config.HeaderActionRemove, Name: "Proxy-Authorization"},
+	},
+}
+
+// setEgressHeaders reports the egress IP and interface used back to the client
+func (hs *HTTPServer) setEgressHeaders(h http.Header, localIP net.IP) {
+	if hs.config == nil || hs.config.DisableEgressHeaders {
+		return
+	}
+	h.Set("X-Egress-IP-Used", localIP.String())
+	if iface, ok := hs.config.InterfaceForIP(localIP.String()); ok {
+		h.Set("X-Egress-Interface", iface)
+	} else {
+		h.Del("X-Egress-Interface")
+	}
+}
+
+// headerTemplateData is available to header rule value templates
+type headerTemplateData struct {
+	EgressIP string
+	Host     string
+	User     string
+	Method   string
+	Path     string
+}
+
+type proxyUserKey struct{}
+
+// withProxyUser stores the proxy user on the context, so requests inside an
+// intercepted tunnel keep the user of the CONNECT request
+func withProxyUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, proxyUserKey{}, user)
+}
+
+// proxyUser returns the proxy user for the request, either from the context
+// or the username of a Basic Proxy-Authorization header without its options
+func proxyUser(r *http.Request) string {
+	if user, ok := r.Context().Value(proxyUserKey{}).(string); ok {
+		return user
+	}
+
+	username := proxyUsername(r)
+	if user, _, err := parseUsername(username); err == nil {
+		return user
+	}
+	return username
+}
+
+// matchingHeaderRules returns the rules that apply to the request, starting
+// with the built-in control header rule
+func (hs *HTTPServer) matchingHeaderRules(r *http.Request, localIP net.IP) []*config.HeaderRule {
+	rules := []*config.HeaderRule{&controlHeaderRule}
+	if hs.config == nil {
+		return rules
+	}
+
+	user := proxyUser(r)
+	for i := range hs.config.HeaderRules {
+		rule := &hs.config.HeaderRules[i]
+		if rule.Matches(r.Host, user, localIP.String()) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// applyHeaderActions applies actions in order to h, logging to the logger of ctx
+func applyHeaderActions(ctx context.Context, h http.Header, actions []config.HeaderAction, data *headerTemplateData) {
+	for _, action := range actions {
+		switch action.Action {
+		case config.HeaderActionRemove:
+			h.Del(action.Name)
+		case config.HeaderActionAdd, config.HeaderActionSet:
+			value, err := renderHeaderValue(action.Value, data)
+			if err != nil {
+				zerolog.Ctx(ctx).Warn().Err(err).Str("header", action.Name).Msg("failed to render header template")
+				continue
+			}
+			if action.Action == config.HeaderActionAdd {
+				h.Add(action.Name, value)
+			} else {
+				h.Set(action.Name, value)
+			}
+		default:
+			zerolog.Ctx(ctx).Warn().Str("action", string(action.Action)).Str("header", action.Name).Msg("unknown header action")
+		}
+	}
+}
+
+// headerTemplates caches parsed header value templates by source
+var headerTemplates sync.Map
+
+// renderHeaderValue executes value as a template, values without actions
+// are returned as is
+func renderHeaderValue(value string, data *headerTemplateData) (string, error) {
+	if !strings.Contains(value, "{{") {
+		return value, nil
+	}
+
+	var tmpl *template.Template
+	if cached, ok := headerTemplates.Load(value); ok {
+		tmpl = cached.(*template.Template)
+	} else {
+		parsed, err := template.New("header").Option("missingkey=error").Parse(value)
+		if err != nil {
+			return "", err
+		}
+		headerTemplates.Store(value, parsed)
+		tmpl = parsed
+	}
+
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, data); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// newHeaderTemplateData builds the template data for a proxied request
+func newHeaderTemplateData(r *http.Request, localIP net.IP) *headerTemplateData {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return &headerTemplateData{
+		EgressIP: localIP.String(),
+		Host:     host,
+		User:     proxyUser(r),
+		Method:   r.Method,
+		Path:     r.URL.Path,
+	}
+}
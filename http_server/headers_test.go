@@ -0,0 +1,243 @@
+package http_server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/danthegoodman1/specificproxy/config"
+)
+
+// newHeaderTestServers starts an upstream echoing request headers as JSON and
+// a proxy applying the given rules
+func newHeaderTestServers(t *testing.T, rules []config.HeaderRule) (*httptest.Server, *httptest.Server) {
+	t.Helper()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "upstream")
+		w.Header().Set("X-Upstream", "yes")
+		json.NewEncoder(w).Encode(r.Header)
+	}))
+	t.Cleanup(upstream.Close)
+
+	hs := &HTTPServer{
+		config: &config.Config{
+			AllowedInterfaces: []string{"lo"},
+			HeaderRules:       rules,
+		},
+	}
+	proxy := httptest.NewServer(http.HandlerFunc(hs.handleProxy))
+	t.Cleanup(proxy.Close)
+
+	return upstream, proxy
+}
+
+// doProxyRequest sends a GET to target through proxy with the given headers,
+// returning the response and the headers the upstream saw
+func doProxyRequest(t *testing.T, proxy *httptest.Server, target string, header http.Header) (*http.Response, http.Header) {
+	t.Helper()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	req, _ := http.NewRequest("GET", target, nil)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var seen http.Header
+	if err := json.NewDecoder(resp.Body).Decode(&seen); err != nil {
+		t.Fatalf("failed to decode upstream headers: %v", err)
+	}
+	return resp, seen
+}
+
+func TestHeaderRules_ControlHeadersStripped(t *testing.T) {
+	upstream, proxy := newHeaderTestServers(t, nil)
+
+	_, seen := doProxyRequest(t, proxy, upstream.URL, http.Header{
+		"X-Egress-Ip":         {"127.0.0.1"},
+		"X-Rate-Limit":        {`{"method":"token_bucket","rate":100,"period":1}`},
+		"Proxy-Authorization": {"Basic dXNlcjpwYXNz"},
+		"X-Custom":            {"kept"},
+	})
+
+	for _, hdr := range []string{"X-Egress-Ip", "X-Rate-Limit", "Proxy-Authorization"} {
+		if seen.Get(hdr) != "" {
+			t.Errorf("expected %s to be stripped", hdr)
+		}
+	}
+	if seen.Get("X-Custom") != "kept" {
+		t.Error("expected X-Custom to be forwarded")
+	}
+}
+
+func TestHeaderRules_Rewrite(t *testing.T) {
+	upstream, proxy := newHeaderTestServers(t, []config.HeaderRule{
+		{
+			Request: []config.HeaderAction{
+				{Action: config.HeaderActionSet, Name: "User-Agent", Value: "bot/{{.EgressIP}}"},
+				{Action: config.HeaderActionAdd, Name: "X-Tag", Value: "a"},
+				{Action: config.HeaderActionAdd, Name: "X-Tag", Value: "b"},
+				{Action: config.HeaderActionRemove, Name: "Via"},
+				{Action: config.HeaderActionRemove, Name: "X-Forwarded-For"},
+			},
+			Response: []config.HeaderAction{
+				{Action: config.HeaderActionRemove, Name: "Server"},
+				{Action: config.HeaderActionSet, Name: "X-Proxied-Host", Value: "{{.Host}}"},
+			},
+		},
+	})
+
+	resp, seen := doProxyRequest(t, proxy, upstream.URL, http.Header{
+		"X-Egress-Ip":     {"127.0.0.1"},
+		"User-Agent":      {"curl/8.0"},
+		"Via":             {"1.1 other-proxy"},
+		"X-Forwarded-For": {"10.0.0.1"},
+	})
+
+	if seen.Get("User-Agent") != "bot/127.0.0.1" {
+		t.Errorf("expected templated User-Agent, got %q", seen.Get("User-Agent"))
+	}
+	if len(seen.Values("X-Tag")) != 2 {
+		t.Errorf("expected 2 X-Tag values, got %v", seen.Values("X-Tag"))
+	}
+	if seen.Get("Via") != "" || seen.Get("X-Forwarded-For") != "" {
+		t.Error("expected Via and X-Forwarded-For to be removed")
+	}
+	if resp.Header.Get("Server") != "" {
+		t.Error("expected Server response header to be removed")
+	}
+	if resp.Header.Get("X-Proxied-Host") != "127.0.0.1" {
+		t.Errorf("expected X-Proxied-Host 127.0.0.1, got %q", resp.Header.Get("X-Proxied-Host"))
+	}
+	if resp.Header.Get("X-Upstream") != "yes" {
+		t.Error("expected other response headers to be kept")
+	}
+}
+
+func TestHeaderRules_Scoped(t *testing.T) {
+	upstream, proxy := newHeaderTestServers(t, []config.HeaderRule{
+		{
+			Users:   []string{"alice"},
+			Request: []config.HeaderAction{{Action: config.HeaderActionSet, Name: "X-User", Value: "{{.User}}"}},
+		},
+		{
+			Domains: []string{"other.example.com"},
+			Request: []config.HeaderAction{{Action: config.HeaderActionSet, Name: "X-Other", Value: "1"}},
+		},
+	})
+
+	// alice:secret
+	_, seen := doProxyRequest(t, proxy, upstream.URL, http.Header{
+		"X-Egress-Ip":         {"127.0.0.1"},
+		"Proxy-Authorization": {"Basic YWxpY2U6c2VjcmV0"},
+	})
+	if seen.Get("X-User") != "alice" {
+		t.Errorf("expected X-User alice, got %q", seen.Get("X-User"))
+	}
+	if seen.Get("X-Other") != "" {
+		t.Error("expected domain scoped rule not to apply")
+	}
+
+	// bob:secret
+	_, seen = doProxyRequest(t, proxy, upstream.URL, http.Header{
+		"X-Egress-Ip":         {"127.0.0.1"},
+		"Proxy-Authorization": {"Basic Ym9iOnNlY3JldA=="},
+	})
+	if seen.Get("X-User") != "" {
+		t.Error("expected user scoped rule not to apply to bob")
+	}
+}
+
+func TestProxyUser(t *testing.T) {
+	tests := []struct {
+		auth     string
+		expected string
+	}{
+		{"Basic YWxpY2U6c2VjcmV0", "alice"},
+		{"Basic bm9wYXNz", "nopass"},
+		{"Bearer token", ""},
+		{"Basic !!!", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		if tt.auth != "" {
+			r.Header.Set("Proxy-Authorization", tt.auth)
+		}
+		if user := proxyUser(r); user != tt.expected {
+			t.Errorf("proxyUser(%q) = %q, want %q", tt.auth, user, tt.expected)
+		}
+	}
+}
+
+func TestEgressHeaders_HTTPProxy(t *testing.T) {
+	upstream, proxy := newHeaderTestServers(t, nil)
+
+	resp, _ := doProxyRequest(t, proxy, upstream.URL, http.Header{"X-Egress-Ip": {"127.0.0.1"}})
+	if resp.Header.Get("X-Egress-IP-Used") != "127.0.0.1" {
+		t.Errorf("expected X-Egress-IP-Used 127.0.0.1, got %q", resp.Header.Get("X-Egress-IP-Used"))
+	}
+	if resp.Header.Get("X-Egress-Interface") != "lo" {
+		t.Errorf("expected X-Egress-Interface lo, got %q", resp.Header.Get("X-Egress-Interface"))
+	}
+}
+
+func TestEgressHeaders_Connect(t *testing.T) {
+	hs := &HTTPServer{config: &config.Config{AllowedInterfaces: []string{"lo"}}}
+	proxy := httptest.NewServer(hs.newHandler())
+	t.Cleanup(proxy.Close)
+	echo := startEchoListener(t)
+
+	conn, reader, resp := openConnectTunnel(t, proxy.Listener.Addr().String(), echo.Addr().String(), http.Header{"X-Egress-Ip": {"127.0.0.1"}})
+	defer conn.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("X-Egress-IP-Used") != "127.0.0.1" || resp.Header.Get("X-Egress-Interface") != "lo" {
+		t.Errorf("expected egress headers on CONNECT response, got %v", resp.Header)
+	}
+
+	// The tunnel still works after the headers
+	conn.Write([]byte("ping\n"))
+	line, err := reader.ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Errorf("expected echo through tunnel, got %q (%v)", line, err)
+	}
+}
+
+func TestEgressHeaders_Disabled(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	hs := &HTTPServer{config: &config.Config{
+		AllowedInterfaces:    []string{"lo"},
+		DisableEgressHeaders: true,
+	}}
+	proxy := httptest.NewServer(hs.newHandler())
+	t.Cleanup(proxy.Close)
+
+	resp, _ := doProxyRequest(t, proxy, upstream.URL, http.Header{"X-Egress-Ip": {"127.0.0.1"}})
+	if resp.Header.Get("X-Egress-IP-Used") != "" || resp.Header.Get("X-Egress-Interface") != "" {
+		t.Errorf("expected no egress headers, got %v", resp.Header)
+	}
+
+	echo := startEchoListener(t)
+	conn, _, connectResp := openConnectTunnel(t, proxy.Listener.Addr().String(), echo.Addr().String(), http.Header{"X-Egress-Ip": {"127.0.0.1"}})
+	defer conn.Close()
+	if connectResp.Header.Get("X-Egress-IP-Used") != "" {
+		t.Errorf("expected no egress headers on CONNECT response, got %v", connectResp.Header)
+	}
+}
@@ -0,0 +1,225 @@
+package http_server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/config"
+	"github.com/danthegoodman1/specificproxy/egress"
+)
+
+// errNoHealthyIPs is returned when every available egress IP is quarantined or disabled
+var errNoHealthyIPs = errors.New("no enabled and healthy egress IPs")
+
+// pickEgressIP randomly selects an available egress IP that isn't quarantined
+// for host, skipping the excluded IPs and IPs outside the pool of the port
+// the request came in on
+func (hs *HTTPServer) pickEgressIP(ctx context.Context, host string, exclude ...string) (string, error) {
+	ips, err := hs.candidateIPs(ctx)
+	if err != nil {
+		return "", err
+	}
+	ips = slices.DeleteFunc(ips, func(info config.IPInfo) bool {
+		return slices.Contains(exclude, info.IP)
+	})
+	if len(ips) == 0 {
+		return "", errors.New("no untried egress IPs")
+	}
+	return hs.pickHealthyIP(ips, host)
+}
+
+// egressPoolKey is the context key of the egress filter of requests that
+// don't come from a proxy client
+type egressPoolKey struct{}
+
+// withEgressPool limits random egress selection to the IPs matching pool
+func withEgressPool(ctx context.Context, pool config.PortPool) context.Context {
+	return context.WithValue(ctx, egressPoolKey{}, pool)
+}
+
+// candidateIPs returns the available egress IPs, limited to the pool of the
+// port the request came in on or to its egress filter
+func (hs *HTTPServer) candidateIPs(ctx context.Context) ([]config.IPInfo, error) {
+	ips, err := hs.config.GetAvailableIPs()
+	if err != nil || len(ips) == 0 {
+		return nil, errors.New("no available egress IPs")
+	}
+	// Pool ports only use their own IPs
+	if pool, ok := hs.portBinding(ctx); ok {
+		ips = slices.DeleteFunc(ips, func(info config.IPInfo) bool { return !pool.Matches(info) })
+		if len(ips) == 0 {
+			return nil, errors.New("no available egress IPs in this port's pool")
+		}
+	}
+	// Transparent rules, forwards and fetches only use the IPs of their filter
+	if pool, ok := ctx.Value(egressPoolKey{}).(config.PortPool); ok {
+		ips = slices.DeleteFunc(ips, func(info config.IPInfo) bool { return !pool.Matches(info) })
+		if len(ips) == 0 {
+			return nil, errors.New("no available egress IPs match the egress filter")
+		}
+	}
+	return ips, nil
+}
+
+// pickHealthyIP randomly selects one of ips that is enabled and isn't
+// quarantined for host, honoring weights
+func (hs *HTTPServer) pickHealthyIP(ips []config.IPInfo, host string) (string, error) {
+	healthy := slices.DeleteFunc(slices.Clone(ips), func(info config.IPInfo) bool {
+		return info.State != config.EgressEnabled || hs.egressHealth.IsQuarantined(info.IP, host)
+	})
+	if len(healthy) == 0 {
+		return "", errNoHealthyIPs
+	}
+	return pickWeighted(healthy), nil
+}
+
+// pickWeighted randomly selects one of ips in proportion to their weights
+func pickWeighted(ips []config.IPInfo) string {
+	total := 0
+	for _, info := range ips {
+		total += max(info.Weight, 1)
+	}
+	n := rand.Intn(total)
+	for _, info := range ips {
+		n -= max(info.Weight, 1)
+		if n < 0 {
+			return info.IP
+		}
+	}
+	return ips[len(ips)-1].IP
+}
+
+// classifyFailure classifies a dial or upstream error for health tracking.
+// It returns "" for errors that don't reflect on the egress IP, like DNS
+// failures, and sets egress for local errors of the egress IP itself, which
+// fail for every destination.
+func classifyFailure(err error) (reason string, egress bool) {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, context.Canceled):
+		// The client went away
+		return "", false
+	case errors.As(err, &dnsErr):
+		// The name doesn't resolve from any egress IP
+		return "", false
+	case errors.Is(err, syscall.EADDRNOTAVAIL):
+		return "bind", true
+	case errors.Is(err, syscall.ENETUNREACH):
+		return "route", true
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset", false
+	}
+
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "dial" {
+		return "", false
+	}
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused", false
+	case opErr.Timeout():
+		return "timeout", false
+	}
+	return "dial", false
+}
+
+// recordError records err against localIP if it reflects on the egress IP.
+// Only local errors count against the IP for every destination, others
+// count for host.
+func (hs *HTTPServer) recordError(localIP net.IP, host string, err error) {
+	reason, egress := classifyFailure(err)
+	switch {
+	case egress:
+		hs.egressHealth.RecordEgressFailure(localIP.String(), host, reason)
+	case reason != "":
+		hs.egressHealth.RecordFailure(localIP.String(), host, reason)
+	}
+}
+
+// recordStatus records an upstream response, counting configured status
+// codes as failures and anything else as success
+func (hs *HTTPServer) recordStatus(localIP net.IP, host string, status int) {
+	if hs.config != nil && slices.Contains(hs.config.Health.StatusCodes, status) {
+		hs.egressHealth.RecordFailure(localIP.String(), host, fmt.Sprintf("status %d", status))
+		return
+	}
+	hs.egressHealth.RecordSuccess(localIP.String(), host)
+}
+
+// resetConn remembers if the connection was reset by the peer
+type resetConn struct {
+	net.Conn
+	reset atomic.Bool
+}
+
+func (c *resetConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if errors.Is(err, syscall.ECONNRESET) {
+		c.reset.Store(true)
+	}
+	return n, err
+}
+
+func (c *resetConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if errors.Is(err, syscall.ECONNRESET) {
+		c.reset.Store(true)
+	}
+	return n, err
+}
+
+// handleQuarantine manually quarantines an egress IP, optionally only for
+// one destination, overriding health tracking
+func (hs *HTTPServer) handleQuarantine(w http.ResponseWriter, r *http.Request) {
+	ip := r.PathValue("ip")
+	if net.ParseIP(ip) == nil {
+		http.Error(w, "invalid IP", http.StatusBadRequest)
+		return
+	}
+	if hs.egressHealth == nil {
+		http.Error(w, "health tracking not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	duration := egress.DefaultQuarantine
+	if d := r.URL.Query().Get("duration"); d != "" {
+		parsed, err := time.ParseDuration(d)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "invalid duration", http.StatusBadRequest)
+			return
+		}
+		duration = parsed
+	}
+
+	destination := r.URL.Query().Get("destination")
+	hs.egressHealth.Quarantine(ip, destination, duration)
+	logger.Info().Str("egress_ip", ip).Str("destination", destination).Dur("duration", duration).Msg("manually quarantined egress IP")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleReleaseQuarantine clears the quarantine of an egress IP, optionally
+// only for one destination
+func (hs *HTTPServer) handleReleaseQuarantine(w http.ResponseWriter, r *http.Request) {
+	ip := r.PathValue("ip")
+	if net.ParseIP(ip) == nil {
+		http.Error(w, "invalid IP", http.StatusBadRequest)
+		return
+	}
+	if hs.egressHealth == nil {
+		http.Error(w, "health tracking not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	destination := r.URL.Query().Get("destination")
+	hs.egressHealth.Release(ip, destination)
+	logger.Info().Str("egress_ip", ip).Str("destination", destination).Msg("released egress IP from quarantine")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,241 @@
+package http_server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/config"
+	"github.com/danthegoodman1/specificproxy/egress"
+)
+
+func newHealthTestServer(health config.HealthConfig) *HTTPServer {
+	return &HTTPServer{
+		config: &config.Config{
+			AllowedInterfaces: []string{"lo"},
+			Health:            health,
+		},
+		egressHealth: egress.NewTracker(egress.Policy{
+			FailureThreshold: health.FailureThreshold,
+			Quarantine:       health.Quarantine,
+			MaxQuarantine:    health.MaxQuarantine,
+		}),
+	}
+}
+
+// testIPs are fixed egress IPs, the loopback ones are never listed as available
+var testIPs = []config.IPInfo{
+	{Interface: "eth0", IP: "192.0.2.1", Version: 4, State: config.EgressEnabled, Weight: 1},
+	{Interface: "eth0", IP: "192.0.2.2", Version: 4, State: config.EgressEnabled, Weight: 1},
+	{Interface: "eth1", IP: "2001:db8::1", Version: 6, State: config.EgressEnabled, Weight: 1},
+}
+
+// ipStatusByIP returns the /ips entries for ips keyed by IP
+func ipStatusByIP(hs *HTTPServer, ips []config.IPInfo) map[string]ipStatus {
+	statuses := make(map[string]ipStatus)
+	for _, status := range hs.ipStatuses(ips) {
+		statuses[status.IP] = status
+	}
+	return statuses
+}
+
+func TestPickHealthyIP_SkipsQuarantined(t *testing.T) {
+	hs := newHealthTestServer(config.HealthConfig{})
+
+	// Quarantine every IP but the last
+	for _, info := range testIPs[:len(testIPs)-1] {
+		hs.egressHealth.Quarantine(info.IP, "", time.Minute)
+	}
+	healthy := testIPs[len(testIPs)-1].IP
+	for range 20 {
+		picked, err := hs.pickHealthyIP(testIPs, "example.com:443")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if picked != healthy {
+			t.Fatalf("expected %s, picked quarantined %s", healthy, picked)
+		}
+	}
+
+	// A destination quarantine only affects that destination
+	hs.egressHealth.Quarantine(healthy, "example.com", time.Minute)
+	if _, err := hs.pickHealthyIP(testIPs, "example.com:443"); !errors.Is(err, errNoHealthyIPs) {
+		t.Errorf("expected errNoHealthyIPs, got %v", err)
+	}
+	if _, err := hs.pickHealthyIP(testIPs, "other.com:443"); err != nil {
+		t.Errorf("expected other destinations to be unaffected, got %v", err)
+	}
+	if len(testIPs) != 3 {
+		t.Error("expected the IP list not to be modified")
+	}
+}
+
+func TestIPStatuses(t *testing.T) {
+	hs := newHealthTestServer(config.HealthConfig{FailureThreshold: 1})
+	hs.egressHealth.RecordFailure("192.0.2.1", "example.com:443", "dial")
+
+	// The JSON shape keeps the IP fields at the top level
+	body, _ := json.Marshal(hs.ipStatuses(testIPs[:1]))
+	var decoded []map[string]any
+	json.Unmarshal(body, &decoded)
+	if decoded[0]["ip"] != "192.0.2.1" || decoded[0]["health"] == nil {
+		t.Errorf("unexpected /ips entry: %s", body)
+	}
+
+	statuses := ipStatusByIP(hs, testIPs)
+	health := statuses["192.0.2.1"].Health
+	if health == nil || health.QuarantinedUntil == nil || health.LastReason != "dial" {
+		t.Errorf("expected quarantine, got %+v", health)
+	}
+	if statuses["192.0.2.1"].Destinations["example.com"] == nil {
+		t.Errorf("expected destination status, got %+v", statuses["192.0.2.1"].Destinations)
+	}
+	if statuses["192.0.2.2"].Health != nil || statuses["192.0.2.2"].Destinations != nil {
+		t.Errorf("expected healthy IP without status, got %+v", statuses["192.0.2.2"])
+	}
+}
+
+func TestHealth_StatusCodes(t *testing.T) {
+	status := http.StatusTooManyRequests
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	hs := newHealthTestServer(config.HealthConfig{
+		FailureThreshold: 2,
+		StatusCodes:      []int{http.StatusTooManyRequests},
+	})
+	proxy := httptest.NewServer(hs.newHandler())
+	t.Cleanup(proxy.Close)
+	header := http.Header{"X-Egress-Ip": {"127.0.0.1"}}
+
+	doProxyRequest(t, proxy, upstream.URL, header)
+	if hs.egressHealth.IsQuarantined("127.0.0.1", upstream.Listener.Addr().String()) {
+		t.Fatal("expected no quarantine below threshold")
+	}
+	doProxyRequest(t, proxy, upstream.URL, header)
+	if !hs.egressHealth.IsQuarantined("127.0.0.1", upstream.Listener.Addr().String()) {
+		t.Fatal("expected quarantine after repeated 429s")
+	}
+
+	health, _ := hs.egressHealth.Status("127.0.0.1")
+	if health == nil || health.LastReason != "status 429" {
+		t.Errorf("expected last reason 'status 429', got %+v", health)
+	}
+
+	// Other responses count as success once the quarantine is over
+	status = http.StatusOK
+	hs.egressHealth.Release("127.0.0.1", "")
+	hs.egressHealth.Release("127.0.0.1", upstream.Listener.Addr().String())
+	doProxyRequest(t, proxy, upstream.URL, header)
+	if health, _ := hs.egressHealth.Status("127.0.0.1"); health != nil {
+		t.Errorf("expected success to clear failures, got %+v", health)
+	}
+}
+
+func TestHealth_DialFailure(t *testing.T) {
+	hs := newHealthTestServer(config.HealthConfig{FailureThreshold: 2})
+	proxy := httptest.NewServer(hs.newHandler())
+	t.Cleanup(proxy.Close)
+
+	// Nothing listens on the closed port
+	closed := startEchoListener(t)
+	target := closed.Addr().String()
+	closed.Close()
+
+	for range 3 {
+		_, _, resp := openConnectTunnel(t, proxy.Listener.Addr().String(), target, http.Header{"X-Egress-Ip": {"127.0.0.1"}})
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Fatalf("expected 502, got %d", resp.StatusCode)
+		}
+	}
+	if !hs.egressHealth.IsQuarantined("127.0.0.1", target) {
+		t.Error("expected refusals to quarantine the IP for the destination")
+	}
+	if hs.egressHealth.IsQuarantined("127.0.0.1", "example.com:443") {
+		t.Error("expected one refusing destination not to quarantine the whole IP")
+	}
+
+	// Names that don't resolve don't reflect on the IP at all
+	_, _, resp := openConnectTunnel(t, proxy.Listener.Addr().String(), "does-not-exist.invalid:443", http.Header{"X-Egress-Ip": {"127.0.0.1"}})
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d", resp.StatusCode)
+	}
+	if _, destinations := hs.egressHealth.Status("127.0.0.1"); destinations["does-not-exist.invalid"] != nil {
+		t.Errorf("expected DNS failures not to be recorded, got %+v", destinations["does-not-exist.invalid"])
+	}
+}
+
+func TestClassifyFailure(t *testing.T) {
+	closed := startEchoListener(t)
+	target := closed.Addr().String()
+	closed.Close()
+	_, refused := net.Dial("tcp", target)
+
+	// 192.0.2.1 isn't assigned, so binding to it fails locally
+	dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}}
+	_, bind := dialer.Dial("tcp", target)
+
+	tests := []struct {
+		name   string
+		err    error
+		reason string
+		egress bool
+	}{
+		{"refused", refused, "refused", false},
+		{"bind", bind, "bind", true},
+		{"dns", &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "x.invalid", IsNotFound: true}}, "", false},
+		{"timeout", &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, "timeout", false},
+		{"unreachable network", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, "route", true},
+		{"reset", &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, "reset", false},
+		{"canceled", context.Canceled, "", false},
+	}
+	for _, tt := range tests {
+		reason, egress := classifyFailure(tt.err)
+		if reason != tt.reason || egress != tt.egress {
+			t.Errorf("%s: expected %q %v, got %q %v for %v", tt.name, tt.reason, tt.egress, reason, egress, tt.err)
+		}
+	}
+}
+
+func TestHealth_AdminOverride(t *testing.T) {
+	hs := newHealthTestServer(config.HealthConfig{})
+	hs.config.Admin.Token = "secret"
+	handler := hs.newAdminHandler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, adminRequest("POST", "/ips/127.0.0.1/quarantine?duration=1m"))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+	health, _ := hs.egressHealth.Status("127.0.0.1")
+	if health == nil || health.QuarantinedUntil == nil || !health.Manual {
+		t.Fatalf("expected manual quarantine, got %+v", health)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, adminRequest("DELETE", "/ips/127.0.0.1/quarantine"))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+	if health, _ := hs.egressHealth.Status("127.0.0.1"); health != nil {
+		t.Errorf("expected quarantine to be released, got %+v", health)
+	}
+
+	for _, target := range []string{"/ips/nope/quarantine", "/ips/127.0.0.1/quarantine?duration=soon"} {
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, adminRequest("POST", target))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", target, w.Code)
+		}
+	}
+}
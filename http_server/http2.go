@@ -0,0 +1,335 @@
+package http_server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtocols returns the protocols of the proxy listeners. HTTP/2 is
+// negotiated by ALPN over TLS, cleartext listeners also accept h2c with
+// prior knowledge.
+func proxyProtocols() *http.Protocols {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	return protocols
+}
+
+// serve serves the proxy on ln, over TLS if configured
+func (hs *HTTPServer) serve(ln net.Listener) error {
+	if hs.config != nil && hs.config.Server.TLSEnabled() {
+		return hs.server.ServeTLS(ln, hs.config.Server.TLSCert, hs.config.Server.TLSKey)
+	}
+	return hs.server.Serve(ln)
+}
+
+// proxiedAuthority reports whether an HTTP/2 request is for another host,
+// setting its URL to the target. HTTP/2 has no absolute form, proxied
+// requests carry the target as :authority, which the server keeps in r.Host
+// only. Requests for one of the proxy's names go to its own endpoints, as do
+// ones that may be meant for the listener they arrived on.
+func (hs *HTTPServer) proxiedAuthority(r *http.Request) bool {
+	if r.ProtoMajor != 2 || r.Method == http.MethodConnect || r.Host == "" {
+		return false
+	}
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host, port = r.Host, "80"
+		if r.TLS != nil {
+			port = "443"
+		}
+	}
+	host = strings.Trim(host, "[]")
+	if hs.isProxyName(r, host, port) {
+		return false
+	}
+
+	// Clients using the proxy over TLS connect with its name, so another
+	// authority is for an upstream. Otherwise only another port tells.
+	if r.TLS == nil || r.TLS.ServerName == "" {
+		local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		if !ok {
+			return false
+		}
+		if _, localPort, err := net.SplitHostPort(local.String()); err != nil || port == localPort {
+			return false
+		}
+	}
+	// The server drops :scheme, https targets are reached with CONNECT
+	r.URL.Scheme = "http"
+	r.URL.Host = r.Host
+	return true
+}
+
+// isProxyName reports whether host:port addresses the proxy, by the server
+// name the client connected with, the TLS certificate's names, the configured
+// hostnames or a listen address
+func (hs *HTTPServer) isProxyName(r *http.Request, host, port string) bool {
+	if r.TLS != nil && strings.EqualFold(r.TLS.ServerName, host) {
+		return true
+	}
+	for _, name := range hs.certNames {
+		if matchesCertName(name, host) {
+			return true
+		}
+	}
+	if hs.config == nil {
+		return false
+	}
+	for _, name := range hs.config.Server.Hostnames {
+		if strings.EqualFold(name, host) {
+			return true
+		}
+	}
+	for _, listenAddr := range hs.listenAddrs() {
+		listenHost, listenPort, err := net.SplitHostPort(listenAddr)
+		if err == nil && listenPort == port && isLocalHost(host, listenHost) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesCertName reports whether host is covered by a certificate name,
+// which may be a wildcard for one label
+func matchesCertName(name, host string) bool {
+	if strings.EqualFold(name, host) {
+		return true
+	}
+	suffix, ok := strings.CutPrefix(name, "*.")
+	if !ok {
+		return false
+	}
+	label, rest, ok := strings.Cut(host, ".")
+	return ok && label != "" && strings.EqualFold(rest, suffix)
+}
+
+// loadCertNames returns the DNS names and IPs of the leaf certificate in
+// certFile
+func loadCertNames(certFile, keyFile string) ([]string, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	leaf := pair.Leaf
+	if leaf == nil {
+		if leaf, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %w", err)
+		}
+	}
+	names := slices.Clone(leaf.DNSNames)
+	for _, ip := range leaf.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names, nil
+}
+
+// acceptTunnel answers a CONNECT with 200 and the headers set on w, and
+// returns the client side of the tunnel. HTTP/1 connections are hijacked,
+// HTTP/2 tunnels are the request stream, so other streams on the connection
+// keep working.
+func acceptTunnel(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	// Transparent connections are the tunnel already, without a response
+	if tw, ok := w.(*transparentWriter); ok {
+		tw.accepted = true
+		return tw.conn, nil
+	}
+	if r.ProtoMajor == 2 {
+		w.WriteHeader(http.StatusOK)
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			return nil, fmt.Errorf("failed to send connection established response: %w", err)
+		}
+		return newStreamConn(w, r), nil
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return nil, fmt.Errorf("hijacking not supported")
+	}
+	clientConn, _, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to hijack connection: %v", err), http.StatusInternalServerError)
+		return nil, fmt.Errorf("failed to hijack connection: %w", err)
+	}
+
+	// Send 200 Connection Established with the egress headers
+	if err := writeResponseHeader(clientConn, "200 Connection Established", w.Header()); err != nil {
+		clientConn.Close()
+		return nil, fmt.Errorf("failed to send connection established response: %w", err)
+	}
+	return clientConn, nil
+}
+
+// streamConn is a net.Conn over an HTTP/2 CONNECT stream, reading the request
+// body and writing the response. Read deadlines are kept locally, since an
+// expired HTTP/2 read deadline resets the stream and idle tunnels wait on them.
+type streamConn struct {
+	body   io.ReadCloser
+	w      http.ResponseWriter
+	rc     *http.ResponseController
+	local  net.Addr
+	remote net.Addr
+
+	chunks  chan streamChunk
+	pending []byte
+	readErr error
+
+	// mu guards the read deadline
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+
+	// writeMu is held during writes, so Close can wait for them to finish
+	// before the handler returns
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+type streamChunk struct {
+	data []byte
+	err  error
+}
+
+func newStreamConn(w http.ResponseWriter, r *http.Request) *streamConn {
+	c := &streamConn{
+		body:   r.Body,
+		w:      w,
+		rc:     http.NewResponseController(w),
+		local:  streamAddr("local"),
+		remote: streamAddr(r.RemoteAddr),
+		chunks: make(chan streamChunk),
+		closed: make(chan struct{}),
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		c.local = addr
+	}
+	go c.readLoop()
+	return c
+}
+
+// readLoop reads the request body until it ends or the conn is closed
+func (c *streamConn) readLoop() {
+	for {
+		buf := make([]byte, 32*1024)
+		n, err := c.body.Read(buf)
+		select {
+		case c.chunks <- streamChunk{data: buf[:n], err: err}:
+		case <-c.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		c.mu.Lock()
+		expired := c.expired
+		c.mu.Unlock()
+
+		select {
+		case chunk := <-c.chunks:
+			c.pending, c.readErr = chunk.data, chunk.err
+		case <-expired:
+			return 0, os.ErrDeadlineExceeded
+		case <-c.closed:
+			return 0, net.ErrClosed
+		}
+		if len(c.pending) == 0 {
+			return 0, c.readErr
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	n, err := c.w.Write(p)
+	if err == nil {
+		err = c.rc.Flush()
+	}
+	return n, err
+}
+
+// Close stops reading and writing the stream. It must be called before the
+// handler returns, the stream ends once it does.
+func (c *streamConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.body.Close()
+		if !c.writeMu.TryLock() {
+			// A write is blocked, most likely on flow control. Reset the
+			// stream to unblock it.
+			c.rc.SetWriteDeadline(time.Now())
+			c.writeMu.Lock()
+		}
+		c.writeMu.Unlock()
+	})
+	return nil
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.local }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.expired = nil
+	if t.IsZero() {
+		return nil
+	}
+	expired := make(chan struct{})
+	c.expired = expired
+	if d := time.Until(t); d > 0 {
+		c.timer = time.AfterFunc(d, func() { close(expired) })
+	} else {
+		close(expired)
+	}
+	return nil
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	return c.rc.SetWriteDeadline(t)
+}
+
+// streamAddr is the address of a stream's client, as reported by the server
+type streamAddr string
+
+func (a streamAddr) Network() string { return "tcp" }
+func (a streamAddr) String() string  { return string(a) }
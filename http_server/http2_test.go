@@ -0,0 +1,386 @@
+package http_server
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/config"
+)
+
+// newH2Proxy starts the proxy handler with the listener protocols, over TLS if requested
+func newH2Proxy(t *testing.T, useTLS bool) (*HTTPServer, *httptest.Server) {
+	t.Helper()
+
+	hs := &HTTPServer{config: &config.Config{AllowedInterfaces: []string{"lo"}}}
+	proxy := httptest.NewUnstartedServer(hs.newHandler())
+	proxy.Config.Protocols = proxyProtocols()
+	if useTLS {
+		proxy.EnableHTTP2 = true
+		proxy.StartTLS()
+	} else {
+		proxy.Start()
+	}
+	t.Cleanup(proxy.Close)
+	return hs, proxy
+}
+
+// newH2CClient returns a client speaking h2c with prior knowledge
+func newH2CClient() *http.Client {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: &http.Transport{Protocols: protocols}}
+}
+
+// openStreamTunnel sends a CONNECT for target as an HTTP/2 stream, returning
+// the writer of the tunnel and the response with the reader
+func openStreamTunnel(t *testing.T, client *http.Client, proxyURL, target string, header http.Header) (io.WriteCloser, *http.Response) {
+	t.Helper()
+
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest(http.MethodConnect, proxyURL, pr)
+	req.Host = target
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("CONNECT failed: %v", err)
+	}
+	t.Cleanup(func() {
+		pw.Close()
+		resp.Body.Close()
+	})
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("expected HTTP/2, got %s", resp.Proto)
+	}
+	return pw, resp
+}
+
+// echoThrough writes msg into the tunnel and reads it back
+func echoThrough(t *testing.T, w io.Writer, r io.Reader, msg string) {
+	t.Helper()
+
+	if _, err := w.Write([]byte(msg)); err != nil {
+		t.Errorf("write failed: %v", err)
+		return
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Errorf("read failed: %v", err)
+		return
+	}
+	if string(buf) != msg {
+		t.Errorf("expected %q echoed, got %q", msg, buf)
+	}
+}
+
+func TestHTTP2_ConnectStreams(t *testing.T) {
+	echo := startEchoListener(t)
+	hs, proxy := newH2Proxy(t, false)
+	client := newH2CClient()
+
+	// Tunnels share one connection and run at the same time
+	var wg sync.WaitGroup
+	for i := range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w, resp := openStreamTunnel(t, client, proxy.URL, echo.Addr().String(), http.Header{"X-Egress-IP": {"127.0.0.1"}})
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("expected 200, got %d", resp.StatusCode)
+				return
+			}
+			if resp.Header.Get("X-Egress-IP-Used") != "127.0.0.1" {
+				t.Errorf("expected egress headers, got %v", resp.Header)
+			}
+			for j := range 3 {
+				echoThrough(t, w, resp.Body, string(rune('a'+i))+string(rune('0'+j)))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := hs.tunnels.Len(); n != 5 {
+		t.Errorf("expected 5 tracked tunnels, got %d", n)
+	}
+}
+
+func TestHTTP2_ConnectTLS(t *testing.T) {
+	echo := startEchoListener(t)
+	_, proxy := newH2Proxy(t, true)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+
+	w, resp := openStreamTunnel(t, client, proxy.URL, echo.Addr().String(), proxyAuth("alice-ip-127.0.0.1"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	echoThrough(t, w, resp.Body, "over tls")
+}
+
+func TestHTTP2_ProxyRequest(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream " + r.URL.Path))
+	}))
+	t.Cleanup(upstream.Close)
+	_, proxy := newH2Proxy(t, false)
+	client := newH2CClient()
+	t.Cleanup(client.CloseIdleConnections)
+
+	// The target is the :authority, the proxy is only where the client connects
+	req, _ := http.NewRequest("GET", proxy.URL+"/path", nil)
+	req.Host = upstream.Listener.Addr().String()
+	req.Header.Set("X-Egress-IP", "127.0.0.1")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK || string(body) != "upstream /path" {
+		t.Errorf("expected the upstream response over HTTP/2, got %s %d %q", resp.Proto, resp.StatusCode, body)
+	}
+
+	// Requests for the proxy's own address reach its endpoints
+	resp, err = client.Get(proxy.URL + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("expected the health endpoint, got %d %q", resp.StatusCode, body)
+	}
+
+	// An unknown name on the listener's port may be the proxy too
+	_, port, _ := net.SplitHostPort(proxy.Listener.Addr().String())
+	req, _ = http.NewRequest("GET", proxy.URL+"/health", nil)
+	req.Host = "proxy.internal:" + port
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("expected the health endpoint for the listener's port, got %d %q", resp.StatusCode, body)
+	}
+}
+
+// writeServerCert writes a self-signed certificate for names and its key,
+// returning their paths with a pool trusting the certificate
+func writeServerCert(t *testing.T, names ...string) (string, string, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "proxy.crt"), filepath.Join(dir, "proxy.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600)
+
+	cert, _ := x509.ParseCertificate(der)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return certFile, keyFile, roots
+}
+
+func TestHTTP2_ProxyNames(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream " + r.URL.Path))
+	}))
+	t.Cleanup(upstream.Close)
+
+	certFile, keyFile, roots := writeServerCert(t, "proxy.example.test", "*.proxy.example.test")
+	cfg := &config.Config{
+		AllowedInterfaces: []string{"lo"},
+		Server: config.ServerConfig{
+			TLSCert:   certFile,
+			TLSKey:    keyFile,
+			Hostnames: []string{"public.example.test"},
+		},
+	}
+	hs := &HTTPServer{config: cfg}
+	names, err := loadCertNames(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs.certNames = names
+	hs.server = &http.Server{Handler: hs.newHandler(), Protocols: proxyProtocols()}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hs.serve(ln)
+	t.Cleanup(func() { hs.server.Close() })
+
+	// Every connection goes to the proxy, which the client knows by its
+	// certificate name, as with a DNS name pointing at it
+	protocols := new(http.Protocols)
+	protocols.SetHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{
+		Protocols:       protocols,
+		TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "proxy.example.test"},
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, network, ln.Addr().String())
+		},
+	}}
+	t.Cleanup(client.CloseIdleConnections)
+
+	get := func(url string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("X-Egress-IP", "127.0.0.1")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.ProtoMajor != 2 {
+			t.Fatalf("expected HTTP/2, got %s", resp.Proto)
+		}
+		return resp, string(body)
+	}
+
+	for _, url := range []string{
+		// The server name the client connected with, on another port as
+		// behind a load balancer
+		"https://proxy.example.test/health",
+		// Another name of the certificate
+		"https://api.proxy.example.test/health",
+		// A configured hostname
+		"https://public.example.test/health",
+	} {
+		if resp, body := get(url); resp.StatusCode != http.StatusOK || body != "ok" {
+			t.Errorf("%s: expected the health endpoint, got %d %q", url, resp.StatusCode, body)
+		}
+	}
+
+	if resp, body := get("https://" + upstream.Listener.Addr().String() + "/path"); body != "upstream /path" {
+		t.Errorf("expected other authorities to be proxied, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestHTTP2_SameEgressRules(t *testing.T) {
+	echo := startEchoListener(t)
+	_, proxy := newH2Proxy(t, false)
+	client := newH2CClient()
+
+	_, resp := openStreamTunnel(t, client, proxy.URL, echo.Addr().String(), http.Header{"X-Egress-IP": {"192.0.2.1"}})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for a disallowed IP, got %d", resp.StatusCode)
+	}
+
+	limit := http.Header{
+		"X-Egress-IP":  {"127.0.0.1"},
+		"X-Rate-Limit": {`{"method":"fixed_window","rate":1,"period":3600,"resource":{"kind":"domain"}}`},
+	}
+	for i, expected := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		_, resp := openStreamTunnel(t, client, proxy.URL, echo.Addr().String(), limit)
+		if resp.StatusCode != expected {
+			t.Errorf("tunnel %d: expected %d, got %d", i+1, expected, resp.StatusCode)
+		}
+	}
+}
+
+func TestHTTP2_ForceClose(t *testing.T) {
+	echo := startEchoListener(t)
+	hs, proxy := newH2Proxy(t, false)
+	client := newH2CClient()
+
+	w, resp := openStreamTunnel(t, client, proxy.URL, echo.Addr().String(), http.Header{"X-Egress-IP": {"127.0.0.1"}})
+	echoThrough(t, w, resp.Body, "ping")
+
+	if closed := hs.tunnels.closeAll(); len(closed) != 1 {
+		t.Fatalf("expected 1 tracked tunnel, got %d", len(closed))
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(resp.Body)
+		done <- err
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the stream to end after a force close")
+	}
+
+	// Other streams on the connection keep working
+	w, resp = openStreamTunnel(t, client, proxy.URL, echo.Addr().String(), http.Header{"X-Egress-IP": {"127.0.0.1"}})
+	echoThrough(t, w, resp.Body, "still up")
+}
+
+func TestHTTP2_Intercept(t *testing.T) {
+	upstream, h1Proxy, authority := newMITMTestServers(t, []string{"127.0.0.1"})
+	proxy := httptest.NewUnstartedServer(h1Proxy.Config.Handler)
+	proxy.Config.Protocols = proxyProtocols()
+	proxy.Start()
+	t.Cleanup(proxy.Close)
+
+	w, resp := openStreamTunnel(t, newH2CClient(), proxy.URL, upstream.Listener.Addr().String(), http.Header{"X-Egress-IP": {"127.0.0.1"}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	// Run TLS over the stream through a pipe
+	conn, tunnel := net.Pipe()
+	t.Cleanup(func() { conn.Close() })
+	go io.Copy(w, tunnel)
+	go io.Copy(tunnel, resp.Body)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(authority.Certificate())
+	tlsConn := tls.Client(conn, &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"})
+	req, _ := http.NewRequest("GET", upstream.URL+"/hello", nil)
+	if err := req.Write(tlsConn); err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	inner, err := http.ReadResponse(bufio.NewReader(tlsConn), req)
+	if err != nil {
+		t.Fatalf("failed to read intercepted response: %v", err)
+	}
+	defer inner.Body.Close()
+	if body, _ := io.ReadAll(inner.Body); string(body) != "/hello" {
+		t.Errorf("expected body /hello, got %q", body)
+	}
+}
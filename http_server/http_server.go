@@ -2,19 +2,28 @@ package http_server
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"math/rand"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/danthegoodman1/specificproxy/config"
+	"github.com/danthegoodman1/specificproxy/egress"
 	"github.com/danthegoodman1/specificproxy/gologger"
+	"github.com/danthegoodman1/specificproxy/mitm"
 	"github.com/danthegoodman1/specificproxy/ratelimit"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var logger = gologger.NewLogger()
@@ -22,56 +31,238 @@ var logger = gologger.NewLogger()
 type HTTPServer struct {
 	server *http.Server
 	config *config.Config
+	// admin serves the admin API, nil if disabled
+	admin *http.Server
+
+	// mitm issues certificates for intercepted CONNECT tunnels, nil if disabled
+	mitm *mitm.Authority
+	// upstreamTLS overrides the TLS config used to connect to destinations
+	upstreamTLS *tls.Config
+	// certNames are the names of the server TLS certificate, HTTP/2 requests
+	// for them are served by the proxy's own endpoints
+	certNames []string
+
+	// tunnels tracks hijacked connections, which http.Server.Shutdown ignores
+	tunnels tunnelRegistry
+	// draining is set once shutdown starts, new proxy requests are rejected
+	draining atomic.Bool
+
+	// egressHealth tracks failures and quarantines unhealthy egress IPs
+	egressHealth *egress.Tracker
+	// sessions holds the egress IPs of sticky sessions
+	sessions sessionStore
+	// ports are the listeners bound to egress IPs, nil if not configured
+	ports *portListeners
+	// h3 serves CONNECT-UDP over HTTP/3, nil if not configured
+	h3 *http3.Server
+	// transparent accepts redirected connections, nil if not configured
+	transparent net.Listener
+	// forwards relay local ports to fixed destinations, replaced on reload
+	forwards *forwardListeners
 }
 
-// StartHTTPServer starts the HTTP server on the given address
-// proxyAddr is currently unused but kept for API compatibility
-func StartHTTPServer(addr, proxyAddr string, cfg *config.Config) *http.Server {
-	mux := http.NewServeMux()
-
+// StartHTTPServer starts the HTTP server on the configured listen address
+func StartHTTPServer(cfg *config.Config) *HTTPServer {
 	hs := &HTTPServer{
 		config: cfg,
 	}
 
-	// Health check endpoint
-	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("ok"))
+	hs.egressHealth = egress.NewTracker(egress.Policy{
+		FailureThreshold: cfg.Health.FailureThreshold,
+		Quarantine:       cfg.Health.Quarantine,
+		MaxQuarantine:    cfg.Health.MaxQuarantine,
 	})
 
+	if len(cfg.MITM.Domains) > 0 {
+		authority, err := mitm.LoadOrCreate(cfg.MITM.CACert, cfg.MITM.CAKey)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to load MITM CA")
+		}
+		hs.mitm = authority
+		logger.Info().Strs("domains", cfg.MITM.Domains).Msg("TLS interception enabled")
+	}
+
+	if cfg.Server.TLSEnabled() {
+		names, err := loadCertNames(cfg.Server.TLSCert, cfg.Server.TLSKey)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to load server certificate")
+		}
+		hs.certNames = names
+	}
+
+	server := &http.Server{
+		Addr:    cfg.GetListenAddr(),
+		Handler: hs.newHandler(),
+		// Only headers are bounded here, request bodies use the configured
+		// request_body timeout so slow uploads through the proxy aren't cut off
+		ReadHeaderTimeout: cfg.Server.GetReadHeaderTimeout(),
+		WriteTimeout:      0, // No timeout for proxy connections
+		IdleTimeout:       cfg.Server.GetIdleTimeout(),
+		// Port listeners choose the egress IP by the port a client connected to
+		ConnContext: withListenPort,
+		// CONNECT over HTTP/2 tunnels through a stream instead of hijacking
+		Protocols: proxyProtocols(),
+	}
+
+	hs.server = server
+	hs.startAdminServer()
+
+	if cfg.Ports.PerIPBase != 0 || len(cfg.Ports.Pools) > 0 {
+		ports := cfg.Ports
+		ports.Host = cfg.GetPortsHost()
+		hs.ports = newPortListeners(ports, hs.servePort)
+		if err := hs.ports.start(cfg.GetAvailableIPs); err != nil {
+			logger.Fatal().Err(err).Msg("failed to start port listeners")
+		}
+	}
+
+	if cfg.HTTP3.ListenAddr != "" {
+		hs.startHTTP3()
+	}
+
+	hs.forwards = newForwardListeners(hs.handleForward)
+	if err := hs.forwards.apply(cfg.Forwards); err != nil {
+		logger.Fatal().Err(err).Msg("failed to start forwards")
+	}
+
+	if cfg.Transparent.ListenAddr != "" {
+		if err := hs.startTransparent(); err != nil {
+			logger.Fatal().Err(err).Msg("failed to start transparent listener")
+		}
+	}
+
+	go func() {
+		logger.Info().Str("addr", server.Addr).Bool("tls", cfg.Server.TLSEnabled()).Msg("starting HTTP server")
+		var err error
+		if cfg.Server.TLSEnabled() {
+			err = server.ListenAndServeTLS(cfg.Server.TLSCert, cfg.Server.TLSKey)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error().Err(err).Msg("HTTP server error")
+		}
+	}()
+
+	return hs
+}
+
+// newHandler returns the handler serving both proxy requests and the
+// server's own endpoints
+func (hs *HTTPServer) newHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	// Health check endpoint
+	mux.HandleFunc("GET /health", hs.handleHealth)
+
 	// List available IPs endpoint
 	mux.HandleFunc("GET /ips", hs.handleListIPs)
 
+	// Requests for clients that can't use a proxy
+	mux.HandleFunc("POST /fetch", hs.handleFetch)
+	mux.HandleFunc("POST /fetch/batch", hs.handleFetchBatch)
+
 	// The proxy handles both CONNECT (for HTTPS) and regular requests
 	// We use a custom handler that wraps the mux
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	proxy := withRequestTracing(hs.handleProxy)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Check if this is a proxy request (has full URL or CONNECT method)
-		if r.Method == http.MethodConnect || r.URL.Host != "" {
-			hs.handleProxy(w, r)
+		if r.Method == http.MethodConnect || r.URL.Host != "" || hs.proxiedAuthority(r) {
+			proxy(w, r)
 			return
 		}
 		// Otherwise, route to regular endpoints
 		mux.ServeHTTP(w, r)
 	})
+}
 
-	server := &http.Server{
-		Addr:         addr,
-		Handler:      handler,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 0, // No timeout for proxy connections
-		IdleTimeout:  120 * time.Second,
+// handleHealth reports ok, or 503 while draining so load balancers pull the instance
+func (hs *HTTPServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if hs.draining.Load() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
 	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
 
-	hs.server = server
+// StartDrain stops accepting new proxy requests and starts failing health
+// checks. Existing tunnels are left running.
+func (hs *HTTPServer) StartDrain() {
+	if hs.draining.CompareAndSwap(false, true) {
+		logger.Warn().Int("tunnels", hs.tunnels.Len()).Msg("draining, rejecting new proxy requests")
+	}
+}
+
+// shutdownGrace is how long connections of force closed tunnels get to go
+// idle on shutdown
+const shutdownGrace = time.Second
+
+// Shutdown drains the server. Regular connections are closed once idle and
+// tunnels are given until ctx is done to finish before being force closed.
+func (hs *HTTPServer) Shutdown(ctx context.Context) error {
+	hs.StartDrain()
+
+	if hs.ports != nil {
+		hs.ports.close()
+	}
+	if hs.transparent != nil {
+		hs.transparent.Close()
+	}
+	if hs.forwards != nil {
+		hs.forwards.close()
+	}
 
+	// Tunnels drain while the server shuts down, as HTTP/2 tunnels keep their
+	// connection active. Once they're force closed, those connections get
+	// shutdownGrace to go idle before the server gives up on them.
+	drained := make(chan struct{})
 	go func() {
-		logger.Info().Str("addr", addr).Msg("starting HTTP server")
-		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			logger.Error().Err(err).Msg("HTTP server error")
+		hs.drainTunnels(ctx)
+		close(drained)
+	}()
+	serverCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-serverCtx.Done():
+			return
 		}
+		<-drained
+		sleepContext(serverCtx, shutdownGrace)
+		cancel()
 	}()
 
-	return server
+	var err error
+	if hs.server != nil {
+		err = hs.server.Shutdown(serverCtx)
+	}
+	if hs.admin != nil {
+		err = errors.Join(err, hs.admin.Shutdown(ctx))
+	}
+	<-drained
+	if hs.h3 != nil {
+		// UDP tunnels were drained above, close the remaining connections
+		err = errors.Join(err, hs.h3.Close())
+	}
+	return err
+}
+
+// drainTunnels waits for tunnels to finish until ctx is done, then force
+// closes the rest and logs what was cut
+func (hs *HTTPServer) drainTunnels(ctx context.Context) {
+	if hs.tunnels.wait(ctx) {
+		logger.Info().Msg("all tunnels drained")
+		return
+	}
+
+	closed := hs.tunnels.closeAll()
+	for _, t := range closed {
+		logger.Warn().Str("host", t.host).Str("egress_ip", t.egressIP).
+			Dur("age", time.Since(t.started)).Msg("force closed tunnel")
+	}
+	logger.Warn().Int("tunnels", len(closed)).Msg("drain deadline reached, force closed remaining tunnels")
 }
 
 // handleListIPs returns the list of available egress IP addresses
@@ -88,30 +279,96 @@ func (hs *HTTPServer) handleListIPs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	resp := map[string]interface{}{
+		"ips": hs.ipStatuses(ips),
+	}
+	if len(hs.config.Ports.Pools) > 0 {
+		resp["pools"] = hs.config.Ports.Pools
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"ips": ips,
-	})
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ipStatuses adds the health of every IP
+func (hs *HTTPServer) ipStatuses(ips []config.IPInfo) []ipStatus {
+	statuses := make([]ipStatus, 0, len(ips))
+	for _, info := range ips {
+		health, destinations := hs.egressHealth.Status(info.IP)
+		status := ipStatus{IPInfo: info, Health: health}
+		if hs.ports != nil {
+			status.Port, _ = hs.ports.portForIP(info.IP)
+		}
+		if len(destinations) > 0 {
+			status.Destinations = destinations
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// ipStatus is an available IP with its health, as returned by /ips
+type ipStatus struct {
+	config.IPInfo
+	// Port is the per IP port bound to the IP, if any
+	Port         int                       `json:"port,omitempty"`
+	Health       *egress.Status            `json:"health,omitempty"`
+	Destinations map[string]*egress.Status `json:"destinations,omitempty"`
 }
 
 // handleProxy handles HTTP CONNECT requests and regular proxy requests
-// The egress IP is specified via the X-Egress-IP header, or a random one is chosen
+// The egress IP is specified via the X-Egress-IP header or the proxy username,
+// or a random one is chosen
 func (hs *HTTPServer) handleProxy(w http.ResponseWriter, r *http.Request) {
-	egressIP := r.Header.Get("X-Egress-IP")
+	if hs.draining.Load() {
+		w.Header().Set("Connection", "close")
+		http.Error(w, "proxy is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if hs.isProxyLoop(r) {
+		zerolog.Ctx(r.Context()).Warn().Str("host", r.Host).Msg("rejected proxy loop")
+		http.Error(w, "proxy loop detected", http.StatusLoopDetected)
+		return
+	}
+	if answerMaxForwards(w, r) {
+		return
+	}
+
+	opts, err := requestOptions(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid proxy username options: %v", err), http.StatusBadRequest)
+		return
+	}
 
-	// If no egress IP specified, pick a random one from available IPs
+	// X-Egress-IP and the ip option win over the IP bound to the port the
+	// client connected to
+	egressIP := opts.EgressIP
+	if binding, ok := hs.portBinding(r.Context()); ok && egressIP == "" {
+		egressIP = binding.IP
+	}
+	// Sticky sessions keep their IP, so they aren't retried through others
+	pinned := egressIP != "" || opts.Session != ""
+
+	// If no egress IP specified, use the session's or pick a random one from available IPs
 	if egressIP == "" {
 		if hs.config == nil {
 			http.Error(w, "server not configured", http.StatusInternalServerError)
 			return
 		}
-		ips, err := hs.config.GetAvailableIPs()
-		if err != nil || len(ips) == 0 {
-			http.Error(w, "no available egress IPs", http.StatusInternalServerError)
+		var picked string
+		if opts.Session != "" {
+			picked, err = hs.sessionIP(r.Context(), proxyUser(r), opts.Session, r.Host)
+		} else {
+			picked, err = hs.pickEgressIP(r.Context(), r.Host)
+		}
+		if errors.Is(err, errNoHealthyIPs) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		egressIP = ips[rand.Intn(len(ips))].IP
-		logger.Debug().Str("egress_ip", egressIP).Msg("randomly selected egress IP")
+		egressIP = picked
+		zerolog.Ctx(r.Context()).Debug().Str("egress_ip", egressIP).Str("session", opts.Session).Msg("selected egress IP")
 	} else {
 		// Validate the specified egress IP is allowed
 		if hs.config != nil && !hs.config.IsIPAllowed(egressIP) {
@@ -127,143 +384,271 @@ func (hs *HTTPServer) handleProxy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check rate limiting if configured
-	if rateLimitHeader := r.Header.Get("X-Rate-Limit"); rateLimitHeader != "" {
-		var rlConfig ratelimit.Config
-		if err := json.Unmarshal([]byte(rateLimitHeader), &rlConfig); err != nil {
-			http.Error(w, "invalid X-Rate-Limit header format", http.StatusBadRequest)
+	// Parse rate limiting if configured
+	rlConfig, err := hs.rateLimitConfig(r, opts.RateLimitPolicy)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Parse per request bandwidth limit in bytes per second
+	var bandwidthLimit int64
+	if limitHeader := r.Header.Get("X-Bandwidth-Limit"); limitHeader != "" {
+		limit, err := strconv.ParseInt(limitHeader, 10, 64)
+		if err != nil || limit <= 0 {
+			http.Error(w, "invalid X-Bandwidth-Limit header format", http.StatusBadRequest)
 			return
 		}
+		bandwidthLimit = limit
+	}
+
+	// Rate limits for intercepted tunnels are checked per request so paths are known
+	intercept := r.Method == http.MethodConnect && !isConnectUDP(r) && hs.shouldIntercept(r.Host)
 
-		// Extract host and path for resource keying
-		host := r.Host
-		path := r.URL.Path
-		if r.Method == http.MethodConnect {
-			// For CONNECT, host is in r.Host, path is empty
-			path = ""
+	// Unpinned requests may be retried through other egress IPs
+	attempts := hs.retryAttempts(r, pinned, intercept)
+	var tried []string
+	for attempt := 1; ; attempt++ {
+		tried = append(tried, localIP.String())
+		if attempts > 1 {
+			w.Header().Set("X-Egress-Retry", strings.Join(tried, ", "))
 		}
 
-		resourceKey := ratelimit.ExtractResourceKey(host, path, rlConfig.Resource.Kind)
-		limiter := ratelimit.GetStore().GetOrCreate(egressIP, resourceKey, &rlConfig)
+		// Only retry if there is another egress IP left to try
+		var next string
+		if attempt < attempts {
+			next, _ = hs.pickEgressIP(r.Context(), r.Host, tried...)
+		}
 
-		if !limiter.Allow() {
-			w.Header().Set("X-RateLimit-Source", "specificproxy")
-			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		if !hs.proxyVia(w, r, localIP, rlConfig, bandwidthLimit, intercept, next != "") {
 			return
 		}
+
+		zerolog.Ctx(r.Context()).Info().Str("host", r.Host).Str("egress_ip", localIP.String()).Str("next_egress_ip", next).
+			Int("attempt", attempt).Msg("retrying through another egress IP")
+		if !hs.waitBackoff(r.Context(), attempt) {
+			return
+		}
+		localIP = net.ParseIP(next)
+	}
+}
+
+// proxyVia proxies the request through one egress IP. If retry is set and
+// the attempt failed in a way that can be retried through another egress IP,
+// nothing is written and true is returned.
+func (hs *HTTPServer) proxyVia(w http.ResponseWriter, r *http.Request, localIP net.IP, rlConfig *ratelimit.Config, bandwidthLimit int64, intercept, retry bool) bool {
+	egressIP := localIP.String()
+	hs.setEgressHeaders(w.Header(), localIP)
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("egress.ip", egressIP))
+	r = r.WithContext(withThrottle(r.Context(), hs.newThrottle(r, egressIP, bandwidthLimit)))
+
+	if !intercept && !hs.checkRateLimit(w, r, egressIP, rlConfig) {
+		return false
 	}
 
+	// Slots are held until the request or tunnel is done
+	release, err := hs.acquireConcurrency(r, egressIP)
+	if err != nil {
+		markProxyLimited(r.Context(), 0)
+		w.Header().Set("X-RateLimit-Source", "specificproxy")
+		http.Error(w, err.Error(), hs.config.Concurrency.GetRejectStatus())
+		return false
+	}
+	defer release()
+
+	switch {
+	case intercept:
+		hs.handleIntercept(w, r, localIP, rlConfig)
+		return false
+	case isConnectUDP(r):
+		return hs.handleConnectUDP(w, r, localIP, retry)
+	case r.Method == http.MethodConnect:
+		return hs.handleConnect(w, r, localIP, retry)
+	default:
+		return hs.handleHTTPProxy(w, r, localIP, retry)
+	}
+}
+
+// checkRateLimit checks the rate limit for the request, writing a 429 and
+// returning false if it is exceeded. A nil rlConfig always allows.
+func (hs *HTTPServer) checkRateLimit(w http.ResponseWriter, r *http.Request, egressIP string, rlConfig *ratelimit.Config) bool {
+	if rlConfig == nil {
+		return true
+	}
+
+	// Extract host and path for resource keying
+	host := r.Host
+	path := r.URL.Path
 	if r.Method == http.MethodConnect {
-		hs.handleConnect(w, r, localIP)
-	} else {
-		hs.handleHTTPProxy(w, r, localIP)
+		// For CONNECT, host is in r.Host, path is empty
+		path = ""
 	}
+
+	resourceKey := ratelimit.ExtractResourceKey(host, path, rlConfig.Resource.Kind)
+	_, span := startSpan(r.Context(), "ratelimit.check", attribute.String("ratelimit.resource", resourceKey))
+	limiter := ratelimit.GetStore().GetOrCreate(egressIP, resourceKey, rlConfig)
+	allowed := limiter.Allow()
+	span.SetAttributes(attribute.Bool("ratelimit.allowed", allowed))
+	span.End()
+
+	if !allowed {
+		markProxyLimited(r.Context(), limiter.Delay())
+		w.Header().Set("X-RateLimit-Source", "specificproxy")
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return false
+	}
+	return true
 }
 
-// handleConnect handles HTTPS proxy via CONNECT method
-func (hs *HTTPServer) handleConnect(w http.ResponseWriter, r *http.Request, localIP net.IP) {
-	logger.Debug().Str("host", r.Host).Str("egress_ip", localIP.String()).Msg("handling CONNECT request")
+// handleConnect handles HTTPS proxy via CONNECT method. If retry is set a
+// failed dial returns true without responding.
+func (hs *HTTPServer) handleConnect(w http.ResponseWriter, r *http.Request, localIP net.IP, retry bool) bool {
+	zerolog.Ctx(r.Context()).Debug().Str("host", r.Host).Str("egress_ip", localIP.String()).Msg("handling CONNECT request")
+
+	timeouts := hs.timeoutsFor(r.Host)
 
 	// Create a dialer that binds to the specified local IP
-	dialer := &net.Dialer{
-		LocalAddr: &net.TCPAddr{IP: localIP},
-		Timeout:   10 * time.Second,
-	}
+	dialer := newDialer(localIP, timeouts)
 
 	// Connect to the target
-	targetConn, err := dialer.DialContext(r.Context(), "tcp", r.Host)
+	targetConn, err := tracedDial(r.Context(), dialer, r.Host)
 	if err != nil {
-		logger.Error().Err(err).Str("host", r.Host).Msg("failed to connect to target")
+		hs.recordError(localIP, r.Host, err)
+		zerolog.Ctx(r.Context()).Error().Err(err).Str("host", r.Host).Msg("failed to connect to target")
+		if retry && isRetryableError(err) {
+			return true
+		}
 		http.Error(w, fmt.Sprintf("failed to connect to target: %v", err), http.StatusBadGateway)
-		return
+		return false
 	}
 	defer targetConn.Close()
+	hs.egressHealth.RecordSuccess(localIP.String(), r.Host)
+	target := &resetConn{Conn: targetConn}
 
-	// Hijack the client connection
-	hijacker, ok := w.(http.Hijacker)
-	if !ok {
-		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
-		return
-	}
-
-	clientConn, _, err := hijacker.Hijack()
+	clientConn, err := acceptTunnel(w, r)
 	if err != nil {
-		logger.Error().Err(err).Msg("failed to hijack connection")
-		http.Error(w, fmt.Sprintf("failed to hijack connection: %v", err), http.StatusInternalServerError)
-		return
+		zerolog.Ctx(r.Context()).Error().Err(err).Msg("failed to accept tunnel")
+		return false
 	}
 	defer clientConn.Close()
+	defer hs.tunnels.track(clientConn, r.Host, localIP)()
 
-	// Send 200 Connection Established
-	_, err = clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
-	if err != nil {
-		logger.Error().Err(err).Msg("failed to send connection established response")
-		return
-	}
-
-	// Bidirectional copy
-	ctx, cancel := context.WithCancel(r.Context())
+	// Bidirectional copy, closing the tunnel when idle or too old
+	ctx, cancel := tunnelContext(r.Context(), timeouts)
 	defer cancel()
+	idle := newIdleTracker(timeouts.TunnelIdle)
+	th := throttleFrom(r.Context())
+	relay(ctx,
+		th.conn(ctx, idle.wrap(clientConn), true),
+		th.conn(ctx, idle.wrap(target), false),
+	)
+
+	if target.reset.Load() {
+		hs.egressHealth.RecordFailure(localIP.String(), r.Host, "reset")
+	}
+	return false
+}
 
-	go func() {
-		io.Copy(targetConn, clientConn)
-		cancel()
-	}()
+// handleHTTPProxy handles regular HTTP proxy requests. If retry is set a
+// failed dial or blocked response status returns true without responding.
+func (hs *HTTPServer) handleHTTPProxy(w http.ResponseWriter, r *http.Request, localIP net.IP, retry bool) bool {
+	zerolog.Ctx(r.Context()).Debug().Str("url", r.URL.String()).Str("egress_ip", localIP.String()).Msg("handling HTTP proxy request")
 
-	go func() {
-		io.Copy(clientConn, targetConn)
-		cancel()
-	}()
+	if isUpgradeRequest(r) {
+		hs.handleUpgrade(w, r, localIP)
+		return false
+	}
 
-	<-ctx.Done()
-}
+	timeouts := hs.timeoutsFor(r.Host)
 
-// handleHTTPProxy handles regular HTTP proxy requests
-func (hs *HTTPServer) handleHTTPProxy(w http.ResponseWriter, r *http.Request, localIP net.IP) {
-	logger.Debug().Str("url", r.URL.String()).Str("egress_ip", localIP.String()).Msg("handling HTTP proxy request")
+	// Bound how long the client may take to send the request body
+	if timeouts.RequestBody > 0 {
+		http.NewResponseController(w).SetReadDeadline(time.Now().Add(timeouts.RequestBody))
+	}
 
 	// Create a custom transport with the specified local IP
 	transport := &http.Transport{
-		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			dialer := &net.Dialer{
-				LocalAddr: &net.TCPAddr{IP: localIP},
-				Timeout:   10 * time.Second,
-			}
-			return dialer.DialContext(ctx, network, addr)
-		},
+		DialContext:           newDialer(localIP, timeouts).DialContext,
+		TLSClientConfig:       hs.upstreamTLS,
+		TLSHandshakeTimeout:   timeouts.TLSHandshake,
+		ResponseHeaderTimeout: timeouts.ResponseHeader,
+		// Expect: 100-continue is forwarded, the body is only read from the
+		// client, which is when it gets its 100 Continue, once the upstream
+		// asked for it
+		ExpectContinueTimeout: timeouts.ExpectContinue,
 	}
 
-	// Create the outgoing request
-	outReq := r.Clone(r.Context())
+	// Create the outgoing request, tracing the upstream phases
+	ctx, span := startSpan(r.Context(), "upstream", attribute.String("url.full", r.URL.String()))
+	outReq := r.Clone(withClientTrace(ctx))
 	outReq.RequestURI = "" // Must be empty for client requests
+	// The client connection's own Connection: close isn't forwarded
+	outReq.Close = false
+	// Request trailers are only known once the body was read, share them
+	outReq.Trailer = r.Trailer
+	removeRequestHopByHopHeaders(outReq.Header)
+	decrementMaxForwards(outReq)
+	hs.addProxyHeaders(outReq.Header, r)
+
+	th := throttleFrom(r.Context())
+	if r.Body != nil && r.Body != http.NoBody {
+		outReq.Body = struct {
+			io.Reader
+			io.Closer
+		}{th.reader(r.Context(), r.Body, true), r.Body}
+	}
+
+	// Strip control headers and apply configured rewrite rules
+	rules := hs.matchingHeaderRules(r, localIP)
+	templateData := newHeaderTemplateData(r, localIP)
+	for _, rule := range rules {
+		applyHeaderActions(r.Context(), outReq.Header, rule.Request, templateData)
+	}
 
-	// Remove proxy-specific headers to make proxy invisible
-	outReq.Header.Del("X-Egress-IP")
-	outReq.Header.Del("X-Rate-Limit")
-	outReq.Header.Del("Proxy-Connection")
-	outReq.Header.Del("Proxy-Authorization")
+	// Continue the client's trace from the upstream span
+	if outReq.Header.Get("traceparent") != "" {
+		propagator.Inject(ctx, propagation.HeaderCarrier(outReq.Header))
+	}
 
 	// Make the request
 	resp, err := transport.RoundTrip(outReq)
 	if err != nil {
-		logger.Error().Err(err).Str("url", r.URL.String()).Msg("failed to make proxy request")
+		endSpan(span, err)
+		hs.recordError(localIP, r.Host, err)
+		zerolog.Ctx(r.Context()).Error().Err(err).Str("url", r.URL.String()).Msg("failed to make proxy request")
+		if retry && isRetryableError(err) {
+			return true
+		}
 		http.Error(w, fmt.Sprintf("proxy request failed: %v", err), http.StatusBadGateway)
-		return
+		return false
 	}
 	defer resp.Body.Close()
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	span.End()
+	hs.recordStatus(localIP, r.Host, resp.StatusCode)
 
-	// Copy response headers
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
-		}
+	if retry && hs.isBlockedStatus(resp.StatusCode) {
+		zerolog.Ctx(r.Context()).Debug().Int("status", resp.StatusCode).Str("url", r.URL.String()).Msg("upstream blocked egress IP")
+		return true
 	}
 
+	copyResponseHeader(w.Header(), resp.Header)
+
 	// Remove hop-by-hop headers
 	removeHopByHopHeaders(w.Header())
+	hs.addResponseVia(w.Header(), resp)
+	hs.setEgressHeaders(w.Header(), localIP)
+
+	for _, rule := range rules {
+		applyHeaderActions(r.Context(), w.Header(), rule.Response, templateData)
+	}
 
+	announced := announceTrailers(w.Header(), resp)
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	if err := copyResponseBody(w, resp, th.reader(r.Context(), resp.Body, false), announced); err != nil {
+		zerolog.Ctx(r.Context()).Debug().Err(err).Str("url", r.URL.String()).Msg("failed to copy response body")
+	}
+	return false
 }
 
 // Hop-by-hop headers that should not be forwarded
@@ -279,8 +664,8 @@ var hopByHopHeaders = []string{
 }
 
 func removeHopByHopHeaders(h http.Header) {
-	// Remove headers listed in Connection header
-	if c := h.Get("Connection"); c != "" {
+	// Remove headers listed in every Connection header
+	for _, c := range h.Values("Connection") {
 		for _, f := range strings.Split(c, ",") {
 			h.Del(strings.TrimSpace(f))
 		}
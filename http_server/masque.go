@@ -0,0 +1,210 @@
+package http_server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+	"github.com/rs/zerolog"
+)
+
+// connectUDPProtocol is the :protocol of CONNECT-UDP requests (RFC 9298)
+const connectUDPProtocol = "connect-udp"
+
+// masqueUDPPath is the prefix of the default CONNECT-UDP URI template,
+// /.well-known/masque/udp/{target_host}/{target_port}/
+const masqueUDPPath = "/.well-known/masque/udp/"
+
+// maxUDPPayload is the largest UDP payload read from destinations
+const maxUDPPayload = 65535
+
+// startHTTP3 starts the HTTP/3 listener serving CONNECT-UDP
+func (hs *HTTPServer) startHTTP3() {
+	cfg := hs.config
+	hs.h3 = &http3.Server{
+		Addr:            cfg.HTTP3.ListenAddr,
+		Handler:         hs.newHTTP3Handler(),
+		EnableDatagrams: true,
+		IdleTimeout:     cfg.Server.GetIdleTimeout(),
+	}
+
+	go func() {
+		logger.Info().Str("addr", cfg.HTTP3.ListenAddr).Msg("starting HTTP/3 server")
+		if err := hs.h3.ListenAndServeTLS(cfg.Server.TLSCert, cfg.Server.TLSKey); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error().Err(err).Msg("HTTP/3 server error")
+		}
+	}()
+}
+
+// newHTTP3Handler returns the handler of the HTTP/3 listener. CONNECT-UDP
+// requests are proxied through handleProxy with the target as their host,
+// so the egress IP is chosen the same way as for TCP.
+func (hs *HTTPServer) newHTTP3Handler() http.Handler {
+	proxy := withRequestTracing(hs.handleProxy)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isConnectUDP(r) {
+			http.Error(w, "only CONNECT-UDP is served over HTTP/3", http.StatusNotImplemented)
+			return
+		}
+		target, err := connectUDPTarget(r.URL.Path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Host = target
+		proxy(w, r)
+	})
+}
+
+// isConnectUDP checks if r is an HTTP/3 CONNECT-UDP request
+func isConnectUDP(r *http.Request) bool {
+	return r.Method == http.MethodConnect && r.ProtoMajor == 3 && r.Proto == connectUDPProtocol
+}
+
+// connectUDPTarget returns the host:port of a CONNECT-UDP request path
+func connectUDPTarget(path string) (string, error) {
+	rest, ok := strings.CutPrefix(path, masqueUDPPath)
+	if !ok {
+		return "", fmt.Errorf("path must start with %s", masqueUDPPath)
+	}
+	parts := strings.Split(strings.TrimSuffix(rest, "/"), "/")
+	if len(parts) != 2 {
+		return "", errors.New("path must be " + masqueUDPPath + "{target_host}/{target_port}/")
+	}
+
+	host, err := url.PathUnescape(parts[0])
+	if err != nil || host == "" {
+		return "", fmt.Errorf("invalid target host %q", parts[0])
+	}
+	port, err := strconv.Atoi(parts[1])
+	if err != nil || port < 1 || port > 65535 {
+		return "", fmt.Errorf("invalid target port %q", parts[1])
+	}
+	return net.JoinHostPort(host, parts[1]), nil
+}
+
+// handleConnectUDP proxies UDP between HTTP datagrams on the request stream
+// and a socket bound to localIP. If retry is set a failed dial returns true
+// without responding.
+func (hs *HTTPServer) handleConnectUDP(w http.ResponseWriter, r *http.Request, localIP net.IP, retry bool) bool {
+	zerolog.Ctx(r.Context()).Debug().Str("host", r.Host).Str("egress_ip", localIP.String()).Msg("handling CONNECT-UDP request")
+
+	streamer, ok := w.(http3.HTTPStreamer)
+	if !ok {
+		http.Error(w, "CONNECT-UDP requires HTTP/3", http.StatusInternalServerError)
+		return false
+	}
+
+	timeouts := hs.timeoutsFor(r.Host)
+	dialer := &net.Dialer{
+		LocalAddr: &net.UDPAddr{IP: localIP},
+		Timeout:   timeouts.Dial,
+	}
+	targetConn, err := dialer.DialContext(r.Context(), "udp", r.Host)
+	if err != nil {
+		hs.recordError(localIP, r.Host, err)
+		zerolog.Ctx(r.Context()).Error().Err(err).Str("host", r.Host).Msg("failed to open UDP socket")
+		if retry && isRetryableError(err) {
+			return true
+		}
+		http.Error(w, fmt.Sprintf("failed to connect to target: %v", err), http.StatusBadGateway)
+		return false
+	}
+	defer targetConn.Close()
+	defer hs.tunnels.track(targetConn, r.Host, localIP)()
+
+	w.Header().Set("Capsule-Protocol", "?1")
+	w.WriteHeader(http.StatusOK)
+	http.NewResponseController(w).Flush()
+	str := streamer.HTTPStream()
+	defer str.Close()
+
+	ctx, cancel := tunnelContext(r.Context(), timeouts)
+	defer cancel()
+	idle := newIdleTracker(timeouts.TunnelIdle)
+	th := throttleFrom(r.Context())
+	target := th.conn(ctx, idle.wrap(targetConn), false)
+	client := th.reader(ctx, &datagramReader{ctx: ctx, str: str, idle: idle}, true)
+
+	// Client to destination
+	go func() {
+		defer cancel()
+		buf := make([]byte, maxUDPPayload)
+		for {
+			n, err := client.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err := target.Write(buf[:n]); err != nil && !isTransientUDPError(err) {
+				return
+			}
+		}
+	}()
+
+	// Destination to client, with context ID 0 for UDP payloads
+	go func() {
+		defer cancel()
+		buf := make([]byte, 1+maxUDPPayload)
+		for {
+			n, err := target.Read(buf[1:])
+			if err != nil && !isTransientUDPError(err) {
+				return
+			} else if err != nil {
+				continue
+			}
+			// Payloads too large for a datagram are dropped, like on a full link
+			str.SendDatagram(buf[:1+n])
+		}
+	}()
+
+	// The stream carries capsules, none of which are used. It ends when the
+	// client closes the tunnel.
+	go func() {
+		defer cancel()
+		io.Copy(io.Discard, str)
+	}()
+
+	<-ctx.Done()
+	// Stop reading capsules, the stream is closed on return
+	str.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+	return false
+}
+
+// datagramReader reads the UDP payloads of HTTP datagrams, one per Read.
+// Datagrams with other context IDs are skipped.
+type datagramReader struct {
+	ctx  context.Context
+	str  *http3.Stream
+	idle *idleTracker
+}
+
+func (d *datagramReader) Read(p []byte) (int, error) {
+	for {
+		datagram, err := d.str.ReceiveDatagram(d.ctx)
+		if err != nil {
+			return 0, err
+		}
+		contextID, n, err := quicvarint.Parse(datagram)
+		if err != nil || contextID != 0 {
+			continue
+		}
+		d.idle.touch()
+		return copy(p, datagram[n:]), nil
+	}
+}
+
+// isTransientUDPError checks if a UDP error only lost a packet, like an ICMP
+// port unreachable reported on the socket, rather than closing it
+func isTransientUDPError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && !errors.Is(err, net.ErrClosed) && !isTimeout(err)
+}
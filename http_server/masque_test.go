@@ -0,0 +1,204 @@
+package http_server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/config"
+	"github.com/danthegoodman1/specificproxy/mitm"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// startUDPEcho starts a UDP server on loopback echoing every packet
+func startUDPEcho(t *testing.T) *net.UDPConn {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+// startHTTP3TestServer serves the HTTP/3 handler on loopback, returning the
+// server address and a client TLS config trusting it
+func startHTTP3TestServer(t *testing.T, hs *HTTPServer) (string, *tls.Config) {
+	t.Helper()
+
+	authority, err := mitm.NewAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs.h3 = &http3.Server{
+		Handler:         hs.newHTTP3Handler(),
+		TLSConfig:       http3.ConfigureTLSConfig(authority.TLSConfig("127.0.0.1")),
+		EnableDatagrams: true,
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hs.h3.Serve(conn)
+	t.Cleanup(func() {
+		hs.h3.Close()
+		conn.Close()
+	})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(authority.Certificate())
+	return conn.LocalAddr().String(), &tls.Config{RootCAs: roots, ServerName: "127.0.0.1", NextProtos: []string{http3.NextProtoH3}}
+}
+
+// openConnectUDP sends a CONNECT-UDP request for target over a new HTTP/3 connection
+func openConnectUDP(t *testing.T, proxyAddr string, tlsConf *tls.Config, target string, header http.Header) (*http3.RequestStream, *http.Response) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	conn, err := quic.DialAddr(ctx, proxyAddr, tlsConf, &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.CloseWithError(0, "") })
+
+	cc := (&http3.Transport{EnableDatagrams: true}).NewClientConn(conn)
+	select {
+	case <-cc.ReceivedSettings():
+	case <-ctx.Done():
+		t.Fatal("no settings received")
+	}
+	if !cc.Settings().EnableDatagrams || !cc.Settings().EnableExtendedConnect {
+		t.Fatalf("expected datagrams and extended CONNECT, got %+v", cc.Settings())
+	}
+
+	str, err := cc.OpenRequestStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(target)
+	req := &http.Request{
+		Method: http.MethodConnect,
+		Proto:  connectUDPProtocol,
+		Host:   proxyAddr,
+		URL:    &url.URL{Scheme: "https", Host: proxyAddr, Path: masqueUDPPath + host + "/" + port + "/"},
+		Header: http.Header{"Capsule-Protocol": {"?1"}},
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if err := str.SendRequestHeader(req); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := str.ReadResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return str, resp
+}
+
+func TestConnectUDP_Echo(t *testing.T) {
+	echo := startUDPEcho(t)
+	hs := &HTTPServer{config: &config.Config{AllowedInterfaces: []string{"lo"}}}
+	addr, tlsConf := startHTTP3TestServer(t, hs)
+
+	str, resp := openConnectUDP(t, addr, tlsConf, echo.LocalAddr().String(), http.Header{"X-Egress-Ip": {"127.0.0.1"}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Capsule-Protocol") != "?1" || resp.Header.Get("X-Egress-IP-Used") != "127.0.0.1" {
+		t.Errorf("expected capsule protocol and egress headers, got %v", resp.Header)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, msg := range []string{"one", "two", "three"} {
+		// Context ID 0 carries UDP payloads
+		if err := str.SendDatagram(append([]byte{0}, msg...)); err != nil {
+			t.Fatal(err)
+		}
+		datagram, err := str.ReceiveDatagram(ctx)
+		if err != nil {
+			t.Fatalf("no echo for %q: %v", msg, err)
+		}
+		if string(datagram) != "\x00"+msg {
+			t.Errorf("expected %q echoed, got %q", msg, datagram)
+		}
+	}
+
+	if hs.tunnels.Len() != 1 {
+		t.Errorf("expected the UDP tunnel to be tracked, got %d", hs.tunnels.Len())
+	}
+	str.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for hs.tunnels.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if hs.tunnels.Len() != 0 {
+		t.Error("expected the tunnel to end once the client closes the stream")
+	}
+}
+
+func TestConnectUDP_EgressRules(t *testing.T) {
+	echo := startUDPEcho(t)
+	hs := &HTTPServer{config: &config.Config{AllowedInterfaces: []string{"lo"}}}
+	addr, tlsConf := startHTTP3TestServer(t, hs)
+
+	_, resp := openConnectUDP(t, addr, tlsConf, echo.LocalAddr().String(), http.Header{"X-Egress-Ip": {"192.0.2.1"}})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for a disallowed IP, got %d", resp.StatusCode)
+	}
+
+	limit := http.Header{
+		"X-Egress-Ip":  {"127.0.0.1"},
+		"X-Rate-Limit": {`{"method":"fixed_window","rate":1,"period":3600,"resource":{"kind":"domain"}}`},
+	}
+	for i, expected := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		_, resp := openConnectUDP(t, addr, tlsConf, echo.LocalAddr().String(), limit)
+		if resp.StatusCode != expected {
+			t.Errorf("tunnel %d: expected %d, got %d", i+1, expected, resp.StatusCode)
+		}
+	}
+}
+
+func TestConnectUDPTarget(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/.well-known/masque/udp/192.0.2.1/53/", "192.0.2.1:53"},
+		{"/.well-known/masque/udp/2001%3Adb8%3A%3A1/443/", "[2001:db8::1]:443"},
+		{"/.well-known/masque/udp/example.com/443", "example.com:443"},
+		{"/.well-known/masque/udp/example.com/0/", ""},
+		{"/.well-known/masque/udp/example.com/", ""},
+		{"/other/example.com/443/", ""},
+	}
+	for _, tt := range tests {
+		target, err := connectUDPTarget(tt.path)
+		if tt.expected == "" {
+			if err == nil {
+				t.Errorf("connectUDPTarget(%q): expected error, got %q", tt.path, target)
+			}
+		} else if target != tt.expected {
+			t.Errorf("connectUDPTarget(%q) = %q (%v), want %q", tt.path, target, err, tt.expected)
+		}
+	}
+}
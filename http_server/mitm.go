@@ -0,0 +1,133 @@
+package http_server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/ratelimit"
+	"github.com/rs/zerolog"
+)
+
+// shouldIntercept checks if a CONNECT tunnel to host should be terminated
+func (hs *HTTPServer) shouldIntercept(host string) bool {
+	return hs.mitm != nil && hs.config != nil && hs.config.ShouldIntercept(host)
+}
+
+// handleIntercept terminates TLS for a CONNECT tunnel with a locally issued
+// certificate, then runs each request inside the tunnel through handleHTTPProxy
+func (hs *HTTPServer) handleIntercept(w http.ResponseWriter, r *http.Request, localIP net.IP, rlConfig *ratelimit.Config) {
+	zerolog.Ctx(r.Context()).Debug().Str("host", r.Host).Str("egress_ip", localIP.String()).Msg("intercepting CONNECT request")
+
+	clientConn, err := acceptTunnel(w, r)
+	if err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Msg("failed to accept tunnel")
+		return
+	}
+	defer clientConn.Close()
+	defer hs.tunnels.track(clientConn, r.Host, localIP)()
+
+	// Bound the intercepted connection like any other tunnel
+	timeouts := hs.timeoutsFor(r.Host)
+	if timeouts.TunnelMaxLifetime > 0 {
+		timer := time.AfterFunc(timeouts.TunnelMaxLifetime, func() { clientConn.Close() })
+		defer timer.Stop()
+	}
+	idle := newIdleTracker(timeouts.TunnelIdle)
+
+	tlsConn := tls.Server(idle.wrap(clientConn), hs.mitm.TLSConfig(r.Host))
+	if err := tlsConn.HandshakeContext(r.Context()); err != nil {
+		zerolog.Ctx(r.Context()).Warn().Err(err).Str("host", r.Host).Msg("intercepted TLS handshake failed")
+		return
+	}
+
+	// Requests inside the tunnel always go to the CONNECT target, regardless
+	// of their Host header, so the tunnel can't be used to reach other hosts
+	target := r.Host
+	egressIP := localIP.String()
+	user := proxyUser(r)
+	th := throttleFrom(r.Context())
+	// A hijacked connection, e.g. after an upgrade, never reaches StateClosed
+	// and is relayed by its handler, so the listener is closed once that
+	// handler returns. Closing it earlier would end the tunnel mid-relay.
+	hijacked := make(chan struct{})
+	listener := newOneConnListener(tlsConn)
+	handler := withRequestTracing(func(w http.ResponseWriter, inner *http.Request) {
+		inner = inner.WithContext(withThrottle(withProxyUser(inner.Context(), user), th))
+		inner.URL.Scheme = "https"
+		inner.URL.Host = target
+		inner.Host = target
+
+		if answerMaxForwards(w, inner) {
+			return
+		}
+		if !hs.checkRateLimit(w, inner, egressIP, rlConfig) {
+			return
+		}
+		hs.handleHTTPProxy(w, inner, localIP, false)
+		select {
+		case <-hijacked:
+			listener.Close()
+		default:
+		}
+	})
+
+	// Inner requests are traced as children of the CONNECT request
+	server := &http.Server{
+		Handler:           handler,
+		BaseContext:       func(net.Listener) context.Context { return r.Context() },
+		ReadHeaderTimeout: 30 * time.Second,
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			switch state {
+			case http.StateClosed:
+				listener.Close()
+			case http.StateHijacked:
+				close(hijacked)
+			}
+		},
+	}
+	server.Serve(listener)
+}
+
+// oneConnListener is a net.Listener that yields a single connection, then
+// blocks until closed
+type oneConnListener struct {
+	conn   net.Conn
+	addr   net.Addr
+	mu     sync.Mutex
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newOneConnListener(conn net.Conn) *oneConnListener {
+	return &oneConnListener{
+		conn:   conn,
+		addr:   conn.LocalAddr(),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	conn := l.conn
+	l.conn = nil
+	l.mu.Unlock()
+
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *oneConnListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *oneConnListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,185 @@
+package http_server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/config"
+	"github.com/danthegoodman1/specificproxy/mitm"
+)
+
+// newMITMTestServers starts a TLS upstream and a proxy intercepting the given domains
+func newMITMTestServers(t *testing.T, domains []string) (*httptest.Server, *httptest.Server, *mitm.Authority) {
+	t.Helper()
+
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	t.Cleanup(upstream.Close)
+	proxy, authority := newMITMTestProxy(t, upstream, domains)
+	return upstream, proxy, authority
+}
+
+// newMITMTestProxy starts a proxy intercepting the given domains, trusting
+// the certificate of upstream
+func newMITMTestProxy(t *testing.T, upstream *httptest.Server, domains []string) (*httptest.Server, *mitm.Authority) {
+	t.Helper()
+
+	authority, err := mitm.NewAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hs := &HTTPServer{
+		config: &config.Config{
+			AllowedInterfaces: []string{"lo"},
+			MITM:              config.MITMConfig{Domains: domains},
+		},
+		mitm:        authority,
+		upstreamTLS: upstream.Client().Transport.(*http.Transport).TLSClientConfig,
+	}
+	proxy := httptest.NewServer(http.HandlerFunc(hs.handleProxy))
+	t.Cleanup(proxy.Close)
+	return proxy, authority
+}
+
+// newMITMTestClient returns a client using the proxy and trusting both the
+// interception CA and the upstream test certificate
+func newMITMTestClient(t *testing.T, proxy, upstream *httptest.Server, authority *mitm.Authority, connectHeader http.Header) *http.Client {
+	t.Helper()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	roots := x509.NewCertPool()
+	roots.AddCert(authority.Certificate())
+	roots.AddCert(upstream.Certificate())
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:              http.ProxyURL(proxyURL),
+			ProxyConnectHeader: connectHeader,
+			TLSClientConfig:    &tls.Config{RootCAs: roots},
+		},
+	}
+}
+
+func TestMITM_Intercept(t *testing.T) {
+	upstream, proxy, authority := newMITMTestServers(t, []string{"127.0.0.1"})
+	client := newMITMTestClient(t, proxy, upstream, authority, http.Header{
+		"X-Egress-Ip": {"127.0.0.1"},
+	})
+
+	resp, err := client.Get(upstream.URL + "/hello")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "/hello" {
+		t.Errorf("expected body /hello, got %q", body)
+	}
+
+	// The client should see our certificate, not the upstream one
+	if err := resp.TLS.PeerCertificates[0].CheckSignatureFrom(authority.Certificate()); err != nil {
+		t.Errorf("expected certificate issued by the interception CA: %v", err)
+	}
+}
+
+func TestMITM_NotListedTunnels(t *testing.T) {
+	upstream, proxy, authority := newMITMTestServers(t, []string{"intercept.example.com"})
+	client := newMITMTestClient(t, proxy, upstream, authority, http.Header{
+		"X-Egress-Ip": {"127.0.0.1"},
+	})
+
+	resp, err := client.Get(upstream.URL + "/hello")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if !resp.TLS.PeerCertificates[0].Equal(upstream.Certificate()) {
+		t.Error("expected the upstream certificate for a tunneled domain")
+	}
+}
+
+func TestMITM_PathRateLimit(t *testing.T) {
+	upstream, proxy, authority := newMITMTestServers(t, []string{"127.0.0.1"})
+	client := newMITMTestClient(t, proxy, upstream, authority, http.Header{
+		"X-Egress-Ip":  {"127.0.0.1"},
+		"X-Rate-Limit": {`{"method":"token_bucket","rate":1,"period":60,"resource":{"kind":"domain_path"}}`},
+	})
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/mitm-rl-a", http.StatusOK},
+		{"/mitm-rl-a", http.StatusTooManyRequests},
+		{"/mitm-rl-b", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		resp, err := client.Get(upstream.URL + tt.path)
+		if err != nil {
+			t.Fatalf("request to %s failed: %v", tt.path, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.path, tt.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestMITM_WebSocket(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(websocketEchoHandler())
+	upstream.StartTLS()
+	t.Cleanup(upstream.Close)
+	proxy, authority := newMITMTestProxy(t, upstream, []string{"127.0.0.1"})
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	target := upstream.Listener.Addr().String()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nX-Egress-IP: 127.0.0.1\r\n\r\n", target, target)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the tunnel to open, got %v %v", resp, err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(authority.Certificate())
+	tlsConn := tls.Client(conn, &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"})
+	resp, reader := sendUpgradeRequest(t, tlsConn, "https://"+target+"/ws", "websocket")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected status 101, got %d", resp.StatusCode)
+	}
+
+	// The relay has to outlive the handler of the intercepted connection
+	for _, msg := range []string{"hello", "world"} {
+		time.Sleep(50 * time.Millisecond)
+		if _, err := tlsConn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			t.Fatalf("failed to read echo: %v", err)
+		}
+		if string(buf) != msg {
+			t.Errorf("expected echo %q, got %q", msg, buf)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package http_server
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Options that can follow the user in a proxy username, each with a value:
+// alice-ip-2a01_4ff__1-session-abc-ratelimit-github
+const (
+	usernameOptionIP        = "ip"
+	usernameOptionSession   = "session"
+	usernameOptionRateLimit = "ratelimit"
+)
+
+// proxyOptions select how a request egresses. They come from the X-Egress-IP
+// header or from options in the proxy username, with the header winning.
+type proxyOptions struct {
+	// EgressIP pins the request to an egress IP
+	EgressIP string
+	// Session keeps the egress IP of a user's earlier requests with the same session
+	Session string
+	// RateLimitPolicy names a limit from rate_limit_policies
+	RateLimitPolicy string
+}
+
+// proxyOptionsKey is the context key of options set for a request up front
+type proxyOptionsKey struct{}
+
+// withProxyOptions sets the options of requests created by the proxy itself
+func withProxyOptions(ctx context.Context, opts proxyOptions) context.Context {
+	return context.WithValue(ctx, proxyOptionsKey{}, opts)
+}
+
+// requestOptions returns the egress options of a request
+func requestOptions(r *http.Request) (proxyOptions, error) {
+	// Transparent connections and fetches have no proxy username, their
+	// options are set up front
+	if opts, ok := r.Context().Value(proxyOptionsKey{}).(proxyOptions); ok {
+		return opts, nil
+	}
+	_, opts, err := parseUsername(proxyUsername(r))
+	if err != nil {
+		return proxyOptions{}, err
+	}
+	if ip := r.Header.Get("X-Egress-IP"); ip != "" {
+		opts.EgressIP = ip
+	}
+	return opts, nil
+}
+
+// parseUsername splits a proxy username into the user and the options after
+// it, which are dash separated keys and values. IPv6 addresses are written
+// with underscores instead of colons. Usernames without options are returned
+// as is.
+func parseUsername(username string) (string, proxyOptions, error) {
+	var opts proxyOptions
+	parts := strings.Split(username, "-")
+	start := slices.IndexFunc(parts[1:], isUsernameOption) + 1
+	if start == 0 {
+		return username, opts, nil
+	}
+
+	options := parts[start:]
+	if len(options)%2 != 0 {
+		return "", opts, fmt.Errorf("option %q has no value", options[len(options)-1])
+	}
+	for i := 0; i < len(options); i += 2 {
+		key, value := options[i], options[i+1]
+		if value == "" {
+			return "", opts, fmt.Errorf("option %q has no value", key)
+		}
+		switch key {
+		case usernameOptionIP:
+			opts.EgressIP = strings.ReplaceAll(value, "_", ":")
+			if net.ParseIP(opts.EgressIP) == nil {
+				return "", opts, fmt.Errorf("invalid IP %q", value)
+			}
+		case usernameOptionSession:
+			opts.Session = value
+		case usernameOptionRateLimit:
+			opts.RateLimitPolicy = value
+		default:
+			return "", opts, fmt.Errorf("unknown option %q", key)
+		}
+	}
+	return strings.Join(parts[:start], "-"), opts, nil
+}
+
+func isUsernameOption(key string) bool {
+	switch key {
+	case usernameOptionIP, usernameOptionSession, usernameOptionRateLimit:
+		return true
+	}
+	return false
+}
+
+// proxyUsername returns the username of a Basic Proxy-Authorization header,
+// including any options
+func proxyUsername(r *http.Request) string {
+	auth := r.Header.Get("Proxy-Authorization")
+	encoded, ok := strings.CutPrefix(auth, "Basic ")
+	if !ok {
+		return ""
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return ""
+	}
+	username, _, _ := strings.Cut(string(decoded), ":")
+	return username
+}
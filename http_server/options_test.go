@@ -0,0 +1,142 @@
+package http_server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/config"
+)
+
+func TestParseUsername(t *testing.T) {
+	tests := []struct {
+		username string
+		user     string
+		opts     proxyOptions
+		wantErr  bool
+	}{
+		{username: "alice", user: "alice"},
+		{username: "alice-bob", user: "alice-bob"},
+		{username: "ip", user: "ip"},
+		{username: "alice-ip-2a01_4ff__1", user: "alice", opts: proxyOptions{EgressIP: "2a01:4ff::1"}},
+		{username: "alice-ip-192.0.2.1-session-abc", user: "alice", opts: proxyOptions{EgressIP: "192.0.2.1", Session: "abc"}},
+		{username: "alice-bob-session-abc-ratelimit-github", user: "alice-bob", opts: proxyOptions{Session: "abc", RateLimitPolicy: "github"}},
+		{username: "user-ip-2a01_4ff__1-session-abc-ratelimit-github", user: "user", opts: proxyOptions{EgressIP: "2a01:4ff::1", Session: "abc", RateLimitPolicy: "github"}},
+		{username: "alice-session", wantErr: true},
+		{username: "alice-session--ratelimit-github", wantErr: true},
+		{username: "alice-ip-nope", wantErr: true},
+		{username: "alice-session-abc-country-de", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		user, opts, err := parseUsername(tt.username)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseUsername(%q): expected error", tt.username)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseUsername(%q): %v", tt.username, err)
+			continue
+		}
+		if user != tt.user || opts != tt.opts {
+			t.Errorf("parseUsername(%q) = %q, %+v, want %q, %+v", tt.username, user, opts, tt.user, tt.opts)
+		}
+	}
+}
+
+func TestRequestOptions_HeaderWins(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	r.SetBasicAuth("alice-ip-192.0.2.1-session-abc", "secret")
+	r.Header.Set("Proxy-Authorization", r.Header.Get("Authorization"))
+	r.Header.Set("X-Egress-IP", "192.0.2.2")
+
+	opts, err := requestOptions(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.EgressIP != "192.0.2.2" || opts.Session != "abc" {
+		t.Errorf("expected the header IP and the username session, got %+v", opts)
+	}
+	if user := proxyUser(r); user != "alice" {
+		t.Errorf("expected the user without options, got %q", user)
+	}
+}
+
+// proxyAuth returns a Proxy-Authorization header for username
+func proxyAuth(username string) http.Header {
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	r.SetBasicAuth(username, "secret")
+	return http.Header{"Proxy-Authorization": {r.Header.Get("Authorization")}}
+}
+
+func TestUsernameOptions_EgressIP(t *testing.T) {
+	upstream, proxy := newHeaderTestServers(t, nil)
+
+	resp, seen := doProxyRequest(t, proxy, upstream.URL, proxyAuth("alice-ip-127.0.0.1"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("X-Egress-IP-Used") != "127.0.0.1" {
+		t.Errorf("expected the username IP to be used, got %q", resp.Header.Get("X-Egress-IP-Used"))
+	}
+	if seen.Get("Proxy-Authorization") != "" {
+		t.Error("expected Proxy-Authorization to be stripped")
+	}
+
+	echo := startEchoListener(t)
+	_, _, connectResp := openConnectTunnel(t, proxy.Listener.Addr().String(), echo.Addr().String(), proxyAuth("alice-ip-127.0.0.1"))
+	if connectResp.StatusCode != http.StatusOK || connectResp.Header.Get("X-Egress-IP-Used") != "127.0.0.1" {
+		t.Errorf("expected CONNECT through the username IP, got %d %q", connectResp.StatusCode, connectResp.Header.Get("X-Egress-IP-Used"))
+	}
+
+	// The IP must still be allowed
+	_, _, connectResp = openConnectTunnel(t, proxy.Listener.Addr().String(), echo.Addr().String(), proxyAuth("alice-ip-192.0.2.1"))
+	if connectResp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for a disallowed username IP, got %d", connectResp.StatusCode)
+	}
+
+	header := proxyAuth("alice-country-de")
+	header.Set("X-Egress-IP", "127.0.0.1")
+	_, _, connectResp = openConnectTunnel(t, proxy.Listener.Addr().String(), echo.Addr().String(), header)
+	if connectResp.StatusCode != http.StatusOK {
+		t.Errorf("expected unknown words in a plain username to be left alone, got %d", connectResp.StatusCode)
+	}
+}
+
+func TestUsernameOptions_RateLimitPolicy(t *testing.T) {
+	upstream, _ := newHeaderTestServers(t, nil)
+	hs := &HTTPServer{config: &config.Config{
+		AllowedInterfaces: []string{"lo"},
+		RateLimitPolicies: map[string]config.RateLimitConfig{
+			"strict": {Method: "fixed_window", Rate: 1, Period: time.Hour},
+		},
+	}}
+
+	for i, expected := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		r := httptest.NewRequest("GET", upstream.URL+"/policy-limit", nil)
+		r.Header = proxyAuth("alice-ip-127.0.0.1-ratelimit-strict")
+		w := httptest.NewRecorder()
+		hs.handleProxy(w, r)
+		if w.Code != expected {
+			t.Errorf("request %d: expected %d, got %d", i+1, expected, w.Code)
+		}
+	}
+
+	r := httptest.NewRequest("GET", upstream.URL, nil)
+	r.Header = proxyAuth("alice-ip-127.0.0.1-ratelimit-unknown")
+	w := httptest.NewRecorder()
+	hs.handleProxy(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown policy, got %d", w.Code)
+	}
+
+	r.Header = proxyAuth("alice-ip-nope")
+	w = httptest.NewRecorder()
+	hs.handleProxy(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid options, got %d", w.Code)
+	}
+}
@@ -0,0 +1,231 @@
+package http_server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/config"
+)
+
+// listenPortKey is the context key of the local port a client connected to
+type listenPortKey struct{}
+
+// withListenPort records the local port of a connection, so requests on
+// port listeners can be mapped to their egress IPs
+func withListenPort(ctx context.Context, c net.Conn) context.Context {
+	if addr, ok := c.LocalAddr().(*net.TCPAddr); ok {
+		return context.WithValue(ctx, listenPortKey{}, addr.Port)
+	}
+	return ctx
+}
+
+// portBinding returns the egress binding of the port the request came in on
+func (hs *HTTPServer) portBinding(ctx context.Context) (config.PortPool, bool) {
+	port, ok := ctx.Value(listenPortKey{}).(int)
+	if !ok || hs.ports == nil {
+		return config.PortPool{}, false
+	}
+	return hs.ports.bindingFor(port)
+}
+
+// portListeners serves the proxy on extra ports that select the egress IP.
+// Pool ports are fixed, per IP ports follow the available IPs.
+type portListeners struct {
+	cfg config.PortsConfig
+	// serve starts serving the proxy on a listener
+	serve func(net.Listener)
+
+	mu       sync.RWMutex
+	bindings map[int]config.PortPool
+	// byIP holds the per IP ports
+	byIP      map[string]int
+	listeners map[int]net.Listener
+
+	stop chan struct{}
+}
+
+func newPortListeners(cfg config.PortsConfig, serve func(net.Listener)) *portListeners {
+	return &portListeners{
+		cfg:       cfg,
+		serve:     serve,
+		bindings:  make(map[int]config.PortPool),
+		byIP:      make(map[string]int),
+		listeners: make(map[int]net.Listener),
+		stop:      make(chan struct{}),
+	}
+}
+
+// start opens the pool ports and the per IP ports, and keeps the per IP
+// ports up to date until close is called
+func (pl *portListeners) start(available func() ([]config.IPInfo, error)) error {
+	for _, pool := range pl.cfg.Pools {
+		if err := pl.open(pool); err != nil {
+			return err
+		}
+	}
+	if pl.cfg.PerIPBase == 0 {
+		return nil
+	}
+
+	refresh := func() {
+		ips, err := available()
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to get available IPs for per IP ports")
+			return
+		}
+		pl.sync(ips)
+	}
+	refresh()
+
+	go func() {
+		ticker := time.NewTicker(pl.cfg.GetRefresh())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				refresh()
+			case <-pl.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// open listens on pool.Port and binds it to pool
+func (pl *portListeners) open(pool config.PortPool) error {
+	ln, err := net.Listen("tcp", net.JoinHostPort(pl.cfg.Host, strconv.Itoa(pool.Port)))
+	if err != nil {
+		return err
+	}
+
+	pl.mu.Lock()
+	select {
+	case <-pl.stop:
+		pl.mu.Unlock()
+		ln.Close()
+		return net.ErrClosed
+	default:
+	}
+	pl.bindings[pool.Port] = pool
+	pl.listeners[pool.Port] = ln
+	if pl.isPerIPPort(pool.Port) {
+		pl.byIP[pool.IP] = pool.Port
+	}
+	pl.mu.Unlock()
+
+	logger.Info().Int("port", pool.Port).Str("egress_ip", pool.IP).Strs("interfaces", pool.Interfaces).
+		Int("version", pool.Version).Msg("starting port listener")
+	go pl.serve(ln)
+	return nil
+}
+
+// sync opens a port for every new IP and closes the ports of IPs that went
+// away. IPs keep their port for as long as they are available, new IPs take
+// the lowest free port. Open connections of removed IPs are left running.
+func (pl *portListeners) sync(ips []config.IPInfo) {
+	current := make(map[string]bool, len(ips))
+	for _, info := range ips {
+		current[info.IP] = true
+	}
+
+	pl.mu.Lock()
+	for ip, port := range pl.byIP {
+		if !current[ip] {
+			pl.listeners[port].Close()
+			delete(pl.listeners, port)
+			delete(pl.bindings, port)
+			delete(pl.byIP, ip)
+			logger.Info().Int("port", port).Str("egress_ip", ip).Msg("closed port of removed egress IP")
+		}
+	}
+	var added []string
+	for _, info := range ips {
+		if _, ok := pl.byIP[info.IP]; !ok && !slices.Contains(added, info.IP) {
+			added = append(added, info.IP)
+		}
+	}
+	pl.mu.Unlock()
+
+	for _, ip := range added {
+		port, ok := pl.freePort()
+		if !ok {
+			logger.Warn().Str("egress_ip", ip).Int("per_ip_max", pl.cfg.GetPerIPMax()).Msg("no free per IP port left")
+			return
+		}
+		if err := pl.open(config.PortPool{Port: port, IP: ip}); err != nil {
+			logger.Error().Err(err).Int("port", port).Str("egress_ip", ip).Msg("failed to open per IP port")
+		}
+	}
+}
+
+func (pl *portListeners) isPerIPPort(port int) bool {
+	return pl.cfg.PerIPBase != 0 && port >= pl.cfg.PerIPBase && port < pl.cfg.PerIPBase+pl.cfg.GetPerIPMax()
+}
+
+// freePort returns the lowest per IP port without a binding
+func (pl *portListeners) freePort() (int, bool) {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+	for port := pl.cfg.PerIPBase; pl.isPerIPPort(port); port++ {
+		if _, ok := pl.bindings[port]; !ok {
+			return port, true
+		}
+	}
+	return 0, false
+}
+
+// bindingFor returns the binding of a port
+func (pl *portListeners) bindingFor(port int) (config.PortPool, bool) {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+	binding, ok := pl.bindings[port]
+	return binding, ok
+}
+
+// portForIP returns the per IP port of ip
+func (pl *portListeners) portForIP(ip string) (int, bool) {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+	port, ok := pl.byIP[ip]
+	return port, ok
+}
+
+// addrs returns the addresses of the open port listeners
+func (pl *portListeners) addrs() []net.Addr {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+	addrs := make([]net.Addr, 0, len(pl.listeners))
+	for _, ln := range pl.listeners {
+		addrs = append(addrs, ln.Addr())
+	}
+	return addrs
+}
+
+// close stops refreshing and closes every port listener
+func (pl *portListeners) close() {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	select {
+	case <-pl.stop:
+		return
+	default:
+		close(pl.stop)
+	}
+	for _, ln := range pl.listeners {
+		ln.Close()
+	}
+}
+
+// servePort serves the proxy on a port listener
+func (hs *HTTPServer) servePort(ln net.Listener) {
+	if err := hs.serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+		logger.Error().Err(err).Str("addr", ln.Addr().String()).Msg("port listener error")
+	}
+}
@@ -0,0 +1,150 @@
+package http_server
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/danthegoodman1/specificproxy/config"
+)
+
+// freePortRange finds n consecutive free ports on 127.0.0.1, returning the first
+func freePortRange(t *testing.T, n int) int {
+	t.Helper()
+
+	for range 50 {
+		base := 20000 + rand.Intn(40000)
+		var listeners []net.Listener
+		for port := base; port < base+n; port++ {
+			ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+			if err != nil {
+				break
+			}
+			listeners = append(listeners, ln)
+		}
+		for _, ln := range listeners {
+			ln.Close()
+		}
+		if len(listeners) == n {
+			return base
+		}
+	}
+	t.Fatal("no free port range found")
+	return 0
+}
+
+// startPortTestServer starts a proxy with port listeners like StartHTTPServer
+func startPortTestServer(t *testing.T, ports config.PortsConfig) *HTTPServer {
+	t.Helper()
+
+	hs := &HTTPServer{config: &config.Config{AllowedInterfaces: []string{"lo"}, Ports: ports}}
+	hs.server = &http.Server{Handler: hs.newHandler(), ConnContext: withListenPort}
+	hs.ports = newPortListeners(ports, hs.servePort)
+	if err := hs.ports.start(func() ([]config.IPInfo, error) { return nil, nil }); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		hs.ports.close()
+		hs.server.Close()
+	})
+	return hs
+}
+
+// getViaPort sends a GET to target through the proxy port
+func getViaPort(t *testing.T, port int, target string) *http.Response {
+	t.Helper()
+
+	proxyURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", port))
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(target)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestPortListeners_Sync(t *testing.T) {
+	base := freePortRange(t, 2)
+	pl := newPortListeners(config.PortsConfig{Host: "127.0.0.1", PerIPBase: base, PerIPMax: 2}, func(net.Listener) {})
+	t.Cleanup(pl.close)
+
+	ips := func(addrs ...string) []config.IPInfo {
+		var infos []config.IPInfo
+		for _, addr := range addrs {
+			infos = append(infos, config.IPInfo{IP: addr})
+		}
+		return infos
+	}
+	expectPort := func(ip string, expected int) {
+		t.Helper()
+		port, ok := pl.portForIP(ip)
+		if expected == 0 && ok {
+			t.Errorf("expected %s to have no port, got %d", ip, port)
+		} else if expected != 0 && port != expected {
+			t.Errorf("expected %s on port %d, got %d", ip, expected, port)
+		}
+	}
+
+	pl.sync(ips("192.0.2.1", "192.0.2.2"))
+	expectPort("192.0.2.1", base)
+	expectPort("192.0.2.2", base+1)
+
+	// Remaining IPs keep their port, new ones take the freed port
+	pl.sync(ips("192.0.2.2", "192.0.2.3"))
+	expectPort("192.0.2.1", 0)
+	expectPort("192.0.2.2", base+1)
+	expectPort("192.0.2.3", base)
+	if binding, _ := pl.bindingFor(base); binding.IP != "192.0.2.3" {
+		t.Errorf("expected port %d bound to the new IP, got %+v", base, binding)
+	}
+
+	// IPs beyond the maximum get no port
+	pl.sync(ips("192.0.2.2", "192.0.2.3", "192.0.2.4"))
+	expectPort("192.0.2.4", 0)
+
+	// Ports of removed IPs are closed
+	pl.sync(ips("192.0.2.2"))
+	if _, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(base))); err == nil {
+		t.Error("expected the port of a removed IP to be closed")
+	}
+}
+
+func TestPortListeners_PoolPinned(t *testing.T) {
+	upstream, _ := newHeaderTestServers(t, nil)
+	port := freePortRange(t, 1)
+	startPortTestServer(t, config.PortsConfig{
+		Host:  "127.0.0.1",
+		Pools: []config.PortPool{{Port: port, IP: "127.0.0.1"}},
+	})
+
+	resp := getViaPort(t, port, upstream.URL)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("X-Egress-IP-Used") != "127.0.0.1" {
+		t.Errorf("expected the port's IP to be used, got %q", resp.Header.Get("X-Egress-IP-Used"))
+	}
+}
+
+func TestPortListeners_PerIP(t *testing.T) {
+	upstream, _ := newHeaderTestServers(t, nil)
+	base := freePortRange(t, 1)
+	hs := startPortTestServer(t, config.PortsConfig{Host: "127.0.0.1", PerIPBase: base, PerIPMax: 1})
+
+	hs.ports.sync([]config.IPInfo{{IP: "192.0.2.1"}})
+
+	// The port is pinned to its IP, which isn't on an allowed interface here
+	if resp := getViaPort(t, base, upstream.URL); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected the port's IP to be pinned, got %d", resp.StatusCode)
+	}
+
+	statuses := hs.ipStatuses([]config.IPInfo{{IP: "192.0.2.1"}, {IP: "192.0.2.2"}})
+	if statuses[0].Port != base || statuses[1].Port != 0 {
+		t.Errorf("expected /ips to report the port mapping, got %+v", statuses)
+	}
+}
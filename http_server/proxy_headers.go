@@ -0,0 +1,252 @@
+package http_server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/danthegoodman1/specificproxy/config"
+)
+
+// traceExcludedHeaders aren't echoed in TRACE responses as they may hold credentials
+var traceExcludedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+}
+
+// removeRequestHopByHopHeaders strips the hop-by-hop headers of a request
+// before forwarding it, keeping TE: trailers which is end-to-end in practice
+func removeRequestHopByHopHeaders(h http.Header) {
+	trailers := headerHasToken(h, "Te", "trailers")
+	removeHopByHopHeaders(h)
+	if trailers {
+		h.Set("Te", "trailers")
+	}
+}
+
+// answerMaxForwards responds to TRACE and OPTIONS requests with Max-Forwards
+// 0 as their final recipient, returning true if it did
+func answerMaxForwards(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodTrace && r.Method != http.MethodOptions {
+		return false
+	}
+	if n, ok := maxForwards(r.Header); !ok || n > 0 {
+		return false
+	}
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Allow", "GET, HEAD, POST, PUT, PATCH, DELETE, CONNECT, OPTIONS, TRACE")
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusOK)
+		return true
+	}
+	w.Header().Set("Content-Type", "message/http")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "%s %s %s\r\nHost: %s\r\n", r.Method, r.RequestURI, r.Proto, r.Host)
+	r.Header.WriteSubset(w, traceExcludedHeaders)
+	w.Write([]byte("\r\n"))
+	return true
+}
+
+// decrementMaxForwards counts the proxy as a hop of TRACE and OPTIONS
+// requests, the only methods Max-Forwards applies to
+func decrementMaxForwards(r *http.Request) {
+	if r.Method != http.MethodTrace && r.Method != http.MethodOptions {
+		return
+	}
+	if n, ok := maxForwards(r.Header); ok && n > 0 {
+		r.Header.Set("Max-Forwards", strconv.Itoa(n-1))
+	}
+}
+
+// maxForwards parses the Max-Forwards header, invalid values are ignored
+func maxForwards(h http.Header) (int, bool) {
+	value := h.Get("Max-Forwards")
+	if value == "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// addProxyHeaders adds the configured Via and Forwarded headers to a request
+// forwarded for r
+func (hs *HTTPServer) addProxyHeaders(h http.Header, r *http.Request) {
+	if hs.config == nil {
+		return
+	}
+	cfg := &hs.config.ProxyHeaders
+	if cfg.Via {
+		addVia(h, cfg, r.ProtoMajor, r.ProtoMinor)
+	}
+	if cfg.Forwarded {
+		element := "for=" + forwardedNode(r.RemoteAddr)
+		if r.Host != "" {
+			element += ";host=" + forwardedValue(r.Host)
+		}
+		if r.URL.Scheme != "" {
+			element += ";proto=" + r.URL.Scheme
+		}
+		if prior := h.Values("Forwarded"); len(prior) > 0 {
+			element = strings.Join(append(prior, element), ", ")
+		}
+		h.Set("Forwarded", element)
+	}
+}
+
+// addResponseVia adds the proxy to the Via header of a forwarded response
+func (hs *HTTPServer) addResponseVia(h http.Header, resp *http.Response) {
+	if hs.config != nil && hs.config.ProxyHeaders.Via {
+		addVia(h, &hs.config.ProxyHeaders, resp.ProtoMajor, resp.ProtoMinor)
+	}
+}
+
+// addVia appends the proxy to the Via header of a message received over
+// HTTP major.minor
+func addVia(h http.Header, cfg *config.ProxyHeadersConfig, major, minor int) {
+	version := strconv.Itoa(major)
+	if major < 2 {
+		version += "." + strconv.Itoa(minor)
+	}
+	entry := version + " " + cfg.GetPseudonym()
+	if prior := h.Values("Via"); len(prior) > 0 {
+		entry = strings.Join(append(prior, entry), ", ")
+	}
+	h.Set("Via", entry)
+}
+
+// forwardedNode formats a client address as a Forwarded node, quoting IPv6
+func forwardedNode(remoteAddr string) string {
+	ap, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return "unknown"
+	}
+	if addr := ap.Addr().Unmap(); addr.Is4() {
+		return addr.String()
+	}
+	return `"[` + ap.Addr().String() + `]"`
+}
+
+// forwardedValue quotes a Forwarded parameter value if it isn't a token
+func forwardedValue(s string) string {
+	if strings.ContainsFunc(s, func(r rune) bool {
+		return r <= ' ' || r >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r)
+	}) {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// isProxyLoop reports whether r already passed through the proxy, going by
+// its Via header, or targets one of the proxy's own listeners
+func (hs *HTTPServer) isProxyLoop(r *http.Request) bool {
+	if hs.config == nil {
+		return false
+	}
+	if hs.config.ProxyHeaders.Via {
+		pseudonym := hs.config.ProxyHeaders.GetPseudonym()
+		for _, value := range r.Header.Values("Via") {
+			for _, entry := range strings.Split(value, ",") {
+				fields := strings.Fields(entry)
+				if len(fields) >= 2 && strings.EqualFold(fields[1], pseudonym) {
+					return true
+				}
+			}
+		}
+	}
+
+	host, port := r.Host, ""
+	if isConnectUDP(r) {
+		// The authority of CONNECT-UDP is the proxy, the target is in the path
+		target, err := connectUDPTarget(r.URL.Path)
+		if err != nil {
+			return false
+		}
+		host = target
+	} else if r.Method != http.MethodConnect && r.URL.Host != "" {
+		host = r.URL.Host
+	}
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host, port = h, p
+	} else if r.URL.Scheme == "https" {
+		port = "443"
+	} else {
+		port = "80"
+	}
+	for _, listenAddr := range hs.listenAddrs() {
+		listenHost, listenPort, err := net.SplitHostPort(listenAddr)
+		if err == nil && listenPort == port && isLocalHost(host, listenHost) {
+			return true
+		}
+	}
+	return false
+}
+
+// listenAddrs returns the addresses of the listeners serving the proxy
+func (hs *HTTPServer) listenAddrs() []string {
+	addrs := []string{hs.config.GetListenAddr()}
+	if hs.config.HTTP3.ListenAddr != "" {
+		addrs = append(addrs, hs.config.HTTP3.ListenAddr)
+	}
+	if hs.transparent != nil {
+		addrs = append(addrs, hs.transparent.Addr().String())
+	}
+	if hs.ports != nil {
+		for _, addr := range hs.ports.addrs() {
+			addrs = append(addrs, addr.String())
+		}
+	}
+	return addrs
+}
+
+// isLocalHost reports whether host reaches a listener bound to listenHost on
+// this machine. Names other than localhost and the hostname aren't resolved.
+func isLocalHost(host, listenHost string) bool {
+	var listenIP netip.Addr
+	if strings.EqualFold(listenHost, "localhost") {
+		listenIP = netip.AddrFrom4([4]byte{127, 0, 0, 1})
+	} else if listenHost != "" {
+		ip, err := netip.ParseAddr(listenHost)
+		if err != nil {
+			return false
+		}
+		listenIP = ip.Unmap()
+	}
+	specific := listenIP.IsValid() && !listenIP.IsUnspecified()
+
+	ip, err := netip.ParseAddr(strings.Trim(host, "[]"))
+	if err != nil {
+		hostname, _ := os.Hostname()
+		if !strings.EqualFold(host, "localhost") && !strings.EqualFold(host, hostname) {
+			return false
+		}
+		// Local names resolve to loopback or a local address of any family
+		return !specific || listenIP.IsLoopback()
+	}
+	ip = ip.Unmap()
+
+	if specific {
+		return ip == listenIP
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if prefix, err := netip.ParsePrefix(addr.String()); err == nil && prefix.Addr().Unmap() == ip {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,237 @@
+package http_server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/danthegoodman1/specificproxy/config"
+)
+
+// newProxyHeaderTestServers starts an upstream echoing request headers as
+// JSON and a proxy with cfg, returning them with the upstream's request count
+func newProxyHeaderTestServers(t *testing.T, cfg *config.Config) (*httptest.Server, *httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	hits := new(atomic.Int32)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Via", "1.1 origin-cache")
+		w.Header().Set("Connection", "X-Upstream-Hop")
+		w.Header().Set("X-Upstream-Hop", "secret")
+		json.NewEncoder(w).Encode(r.Header)
+	}))
+	t.Cleanup(upstream.Close)
+
+	cfg.AllowedInterfaces = []string{"lo"}
+	hs := &HTTPServer{config: cfg}
+	proxy := httptest.NewServer(hs.newHandler())
+	t.Cleanup(proxy.Close)
+	return upstream, proxy, hits
+}
+
+// rawProxyRequest writes a request line and headers to the proxy as is, so
+// hop-by-hop headers reach it untouched by the client
+func rawProxyRequest(t *testing.T, proxy *httptest.Server, method, target string, headers ...string) (*http.Response, string) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	host := strings.TrimPrefix(target, "http://")
+	if i := strings.IndexByte(host, '/'); i >= 0 {
+		host = host[:i]
+	}
+	fmt.Fprintf(conn, "%s %s HTTP/1.1\r\nHost: %s\r\nX-Egress-IP: 127.0.0.1\r\n", method, target, host)
+	for _, header := range headers {
+		fmt.Fprintf(conn, "%s\r\n", header)
+	}
+	fmt.Fprint(conn, "\r\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: method})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp, string(body)
+}
+
+// seenHeaders decodes the request headers echoed by the upstream
+func seenHeaders(t *testing.T, body string) http.Header {
+	t.Helper()
+	var seen http.Header
+	if err := json.Unmarshal([]byte(body), &seen); err != nil {
+		t.Fatalf("failed to decode upstream headers %q: %v", body, err)
+	}
+	return seen
+}
+
+func TestProxyHeaders_HopByHop(t *testing.T) {
+	upstream, proxy, _ := newProxyHeaderTestServers(t, &config.Config{})
+
+	resp, body := rawProxyRequest(t, proxy, "GET", upstream.URL+"/",
+		"Connection: X-Hop-One",
+		"Connection: x-hop-two, close",
+		"X-Hop-One: 1",
+		"X-Hop-Two: 2",
+		"Keep-Alive: timeout=5",
+		"Proxy-Connection: keep-alive",
+		"Te: trailers, deflate",
+		"X-End-To-End: kept",
+	)
+	seen := seenHeaders(t, body)
+
+	for _, name := range []string{"X-Hop-One", "X-Hop-Two", "Keep-Alive", "Proxy-Connection"} {
+		if seen.Get(name) != "" {
+			t.Errorf("expected %s not to be forwarded, got %q", name, seen.Get(name))
+		}
+	}
+	if seen.Get("Connection") == "close" {
+		t.Error("expected the client's Connection: close not to be forwarded")
+	}
+	if seen.Get("Te") != "trailers" {
+		t.Errorf("expected only TE: trailers to be forwarded, got %q", seen.Get("Te"))
+	}
+	if seen.Get("X-End-To-End") != "kept" {
+		t.Error("expected end-to-end headers to be forwarded")
+	}
+	if resp.Header.Get("X-Upstream-Hop") != "" {
+		t.Error("expected headers listed in the response Connection header to be removed")
+	}
+}
+
+func TestProxyHeaders_ViaForwardedOffByDefault(t *testing.T) {
+	upstream, proxy, _ := newProxyHeaderTestServers(t, &config.Config{})
+
+	resp, body := rawProxyRequest(t, proxy, "GET", upstream.URL+"/")
+	seen := seenHeaders(t, body)
+	if seen.Get("Via") != "" || seen.Get("Forwarded") != "" {
+		t.Errorf("expected no Via or Forwarded by default, got %v", seen)
+	}
+	if resp.Header.Get("Via") != "1.1 origin-cache" {
+		t.Errorf("expected the response Via to be untouched, got %q", resp.Header.Get("Via"))
+	}
+}
+
+func TestProxyHeaders_ViaForwarded(t *testing.T) {
+	upstream, proxy, _ := newProxyHeaderTestServers(t, &config.Config{
+		ProxyHeaders: config.ProxyHeadersConfig{Via: true, Forwarded: true, Pseudonym: "edge"},
+	})
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	resp, body := rawProxyRequest(t, proxy, "GET", upstream.URL+"/",
+		"Via: 1.0 client-cache",
+		"Forwarded: for=192.0.2.1",
+	)
+	seen := seenHeaders(t, body)
+	if via := seen.Get("Via"); via != "1.0 client-cache, 1.1 edge" {
+		t.Errorf("expected the proxy appended to Via, got %q", via)
+	}
+	expected := fmt.Sprintf(`for=192.0.2.1, for=127.0.0.1;host=%q;proto=http`, host)
+	if forwarded := seen.Get("Forwarded"); forwarded != expected {
+		t.Errorf("expected Forwarded %q, got %q", expected, forwarded)
+	}
+	if via := resp.Header.Get("Via"); via != "1.1 origin-cache, 1.1 edge" {
+		t.Errorf("expected the proxy appended to the response Via, got %q", via)
+	}
+}
+
+func TestProxyHeaders_ViaLoop(t *testing.T) {
+	upstream, proxy, hits := newProxyHeaderTestServers(t, &config.Config{
+		ProxyHeaders: config.ProxyHeadersConfig{Via: true},
+	})
+
+	resp, _ := rawProxyRequest(t, proxy, "GET", upstream.URL+"/", "Via: 1.1 other, 1.1 SpecificProxy")
+	if resp.StatusCode != http.StatusLoopDetected {
+		t.Errorf("expected 508 for a request that passed through the proxy, got %d", resp.StatusCode)
+	}
+	if hits.Load() != 0 {
+		t.Error("expected the looping request not to be forwarded")
+	}
+
+	// Without Via the proxy can't tell its own entries apart
+	upstream, proxy, _ = newProxyHeaderTestServers(t, &config.Config{})
+	resp, _ = rawProxyRequest(t, proxy, "GET", upstream.URL+"/", "Via: 1.1 specificproxy")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected Via to be ignored when disabled, got %d", resp.StatusCode)
+	}
+}
+
+func TestProxyHeaders_SelfTarget(t *testing.T) {
+	cfg := &config.Config{}
+	_, proxy, _ := newProxyHeaderTestServers(t, cfg)
+	cfg.ListenAddr = proxy.Listener.Addr().String()
+	_, port, _ := net.SplitHostPort(cfg.ListenAddr)
+
+	for _, target := range []string{
+		proxy.URL + "/health",
+		"http://localhost:" + port + "/ips",
+	} {
+		resp, _ := rawProxyRequest(t, proxy, "GET", target)
+		if resp.StatusCode != http.StatusLoopDetected {
+			t.Errorf("%s: expected 508, got %d", target, resp.StatusCode)
+		}
+	}
+
+	resp, _ := rawProxyRequest(t, proxy, "CONNECT", cfg.ListenAddr)
+	if resp.StatusCode != http.StatusLoopDetected {
+		t.Errorf("expected 508 for a CONNECT to the proxy, got %d", resp.StatusCode)
+	}
+
+	// Listeners on every address are reached through any local address
+	cfg.ListenAddr = ":" + port
+	resp, _ = rawProxyRequest(t, proxy, "GET", "http://127.0.0.1:"+port+"/health")
+	if resp.StatusCode != http.StatusLoopDetected {
+		t.Errorf("expected 508 for a listener on every address, got %d", resp.StatusCode)
+	}
+}
+
+func TestProxyHeaders_MaxForwards(t *testing.T) {
+	upstream, proxy, hits := newProxyHeaderTestServers(t, &config.Config{})
+
+	resp, body := rawProxyRequest(t, proxy, "TRACE", upstream.URL+"/path",
+		"Max-Forwards: 0",
+		"Proxy-Authorization: Basic c2VjcmV0",
+		"Cookie: session=secret",
+		"X-Traced: yes",
+	)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "message/http" {
+		t.Fatalf("expected the proxy to answer TRACE, got %d %v", resp.StatusCode, resp.Header)
+	}
+	if !strings.HasPrefix(body, "TRACE "+upstream.URL+"/path HTTP/1.1\r\n") || !strings.Contains(body, "X-Traced: yes\r\n") {
+		t.Errorf("expected the request echoed, got %q", body)
+	}
+	if strings.Contains(body, "secret") {
+		t.Errorf("expected credentials to be left out of the TRACE response, got %q", body)
+	}
+
+	resp, _ = rawProxyRequest(t, proxy, "OPTIONS", upstream.URL+"/", "Max-Forwards: 0")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Allow"), "CONNECT") {
+		t.Errorf("expected the proxy to answer OPTIONS, got %d %v", resp.StatusCode, resp.Header)
+	}
+	if hits.Load() != 0 {
+		t.Fatal("expected Max-Forwards: 0 requests not to be forwarded")
+	}
+
+	_, body = rawProxyRequest(t, proxy, "OPTIONS", upstream.URL+"/", "Max-Forwards: 3")
+	if seen := seenHeaders(t, body); seen.Get("Max-Forwards") != "2" {
+		t.Errorf("expected Max-Forwards to be decremented, got %q", seen.Get("Max-Forwards"))
+	}
+
+	// Other methods ignore Max-Forwards
+	_, body = rawProxyRequest(t, proxy, "GET", upstream.URL+"/", "Max-Forwards: 0")
+	if seen := seenHeaders(t, body); seen.Get("Max-Forwards") != "0" {
+		t.Errorf("expected Max-Forwards of a GET to be forwarded as is, got %q", seen.Get("Max-Forwards"))
+	}
+}
@@ -0,0 +1,65 @@
+package http_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/config"
+	"github.com/danthegoodman1/specificproxy/ratelimit"
+)
+
+// rateLimitConfig parses X-Rate-Limit, filling fields it leaves unset from the
+// named policy, then from the configured defaults. Requests without the header
+// or a policy get the default limit if one is configured, otherwise nil is
+// returned.
+func (hs *HTTPServer) rateLimitConfig(r *http.Request, policy string) (*ratelimit.Config, error) {
+	var fallbacks []config.RateLimitConfig
+	if policy != "" {
+		var named config.RateLimitConfig
+		ok := false
+		if hs.config != nil {
+			named, ok = hs.config.RateLimitPolicies[policy]
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown rate limit policy %q", policy)
+		}
+		fallbacks = append(fallbacks, named)
+	}
+	var defaults config.RateLimitConfig
+	if hs.config != nil {
+		defaults = hs.config.RateLimit
+	}
+	fallbacks = append(fallbacks, defaults)
+
+	header := r.Header.Get("X-Rate-Limit")
+	if header == "" && policy == "" && defaults.Rate <= 0 {
+		return nil, nil
+	}
+	rlConfig := &ratelimit.Config{}
+	if header != "" {
+		if err := json.Unmarshal([]byte(header), rlConfig); err != nil {
+			return nil, fmt.Errorf("invalid X-Rate-Limit header format: %w", err)
+		}
+	}
+
+	for _, fallback := range fallbacks {
+		if rlConfig.Method == "" {
+			rlConfig.Method = ratelimit.Method(fallback.Method)
+		}
+		if rlConfig.Rate == 0 {
+			rlConfig.Rate = fallback.Rate
+		}
+		if rlConfig.Period == 0 {
+			rlConfig.Period = int(fallback.Period / time.Second)
+		}
+		if rlConfig.TTL == 0 {
+			rlConfig.TTL = int(fallback.TTL / time.Second)
+		}
+		if rlConfig.Resource.Kind == "" {
+			rlConfig.Resource.Kind = ratelimit.ResourceKind(fallback.Resource)
+		}
+	}
+	return rlConfig, nil
+}
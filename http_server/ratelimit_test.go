@@ -0,0 +1,86 @@
+package http_server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/config"
+	"github.com/danthegoodman1/specificproxy/ratelimit"
+)
+
+func TestRateLimitConfig_Defaults(t *testing.T) {
+	hs := &HTTPServer{config: &config.Config{RateLimit: config.RateLimitConfig{
+		Method:   "fixed_window",
+		Rate:     100,
+		Period:   time.Minute,
+		TTL:      time.Hour,
+		Resource: "domain_path",
+	}}}
+
+	// Requests without the header get the default limit
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	rl, err := hs.rateLimitConfig(r, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ratelimit.Config{
+		Method:   ratelimit.MethodFixedWindow,
+		Rate:     100,
+		Period:   60,
+		TTL:      3600,
+		Resource: ratelimit.Resource{Kind: ratelimit.ResourceKindDomainPath},
+	}
+	if rl == nil || *rl != expected {
+		t.Errorf("expected default limit %+v, got %+v", expected, rl)
+	}
+
+	// Header fields win, unset ones fall back to the defaults
+	r.Header.Set("X-Rate-Limit", `{"rate": 5, "period": 1, "resource": {"kind": "domain"}}`)
+	rl, err = hs.rateLimitConfig(r, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected.Rate, expected.Period, expected.Resource.Kind = 5, 1, ratelimit.ResourceKindDomain
+	if *rl != expected {
+		t.Errorf("expected merged limit %+v, got %+v", expected, rl)
+	}
+
+	r.Header.Set("X-Rate-Limit", "{")
+	if _, err := hs.rateLimitConfig(r, ""); err == nil {
+		t.Error("expected error for invalid header")
+	}
+}
+
+func TestRateLimitConfig_NoDefault(t *testing.T) {
+	hs := &HTTPServer{config: &config.Config{RateLimit: config.RateLimitConfig{Method: "fixed_window"}}}
+
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	if rl, err := hs.rateLimitConfig(r, ""); rl != nil || err != nil {
+		t.Errorf("expected no limit without a header or default rate, got %+v (%v)", rl, err)
+	}
+
+	r.Header.Set("X-Rate-Limit", `{"rate": 5, "period": 1}`)
+	if rl, _ := hs.rateLimitConfig(r, ""); rl == nil || rl.Method != ratelimit.MethodFixedWindow {
+		t.Errorf("expected the default method, got %+v", rl)
+	}
+}
+
+func TestRateLimit_DefaultLimitEnforced(t *testing.T) {
+	upstream, _ := newHeaderTestServers(t, nil)
+	hs := &HTTPServer{config: &config.Config{
+		AllowedInterfaces: []string{"lo"},
+		RateLimit:         config.RateLimitConfig{Method: "fixed_window", Rate: 1, Period: time.Hour},
+	}}
+
+	for i, expected := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		r := httptest.NewRequest("GET", upstream.URL+"/default-limit", nil)
+		r.Header.Set("X-Egress-IP", "127.0.0.1")
+		w := httptest.NewRecorder()
+		hs.handleProxy(w, r)
+		if w.Code != expected {
+			t.Errorf("request %d: expected %d, got %d", i+1, expected, w.Code)
+		}
+	}
+}
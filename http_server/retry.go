@@ -0,0 +1,65 @@
+package http_server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// retryAttempts returns how many egress IPs may be tried for the request.
+// Only unpinned GET and HEAD requests without a body and plain CONNECT
+// tunnels are retried.
+func (hs *HTTPServer) retryAttempts(r *http.Request, pinned, intercept bool) int {
+	if hs.config == nil || hs.config.Retry.MaxAttempts <= 1 || pinned || intercept {
+		return 1
+	}
+
+	switch r.Method {
+	case http.MethodConnect:
+	case http.MethodGet, http.MethodHead:
+		if isUpgradeRequest(r) || (r.Body != nil && r.Body != http.NoBody) {
+			return 1
+		}
+	default:
+		return 1
+	}
+	return hs.config.Retry.MaxAttempts
+}
+
+// isRetryableError checks if an upstream error happened while dialing, before
+// anything was sent, so another egress IP might get through. Blocks of an
+// egress IP usually show up as refused, reset or timed out dials. Names that
+// don't resolve fail the same from every IP.
+func isRetryableError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.Is(err, context.Canceled) || errors.As(err, &dnsErr) {
+		return false
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// isBlockedStatus checks if an upstream response status is configured to be retried
+func (hs *HTTPServer) isBlockedStatus(status int) bool {
+	return hs.config != nil && slices.Contains(hs.config.Retry.StatusCodes, status)
+}
+
+// waitBackoff waits before the given retry, returning false if ctx is done first
+func (hs *HTTPServer) waitBackoff(ctx context.Context, retry int) bool {
+	d := hs.config.Retry.BackoffFor(retry)
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,171 @@
+package http_server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/danthegoodman1/specificproxy/config"
+)
+
+func TestRetryAttempts(t *testing.T) {
+	hs := &HTTPServer{config: &config.Config{Retry: config.RetryConfig{MaxAttempts: 3}}}
+
+	upgrade := httptest.NewRequest("GET", "http://example.com/", nil)
+	upgrade.Header.Set("Connection", "Upgrade")
+	upgrade.Header.Set("Upgrade", "websocket")
+
+	tests := []struct {
+		name      string
+		req       *http.Request
+		pinned    bool
+		intercept bool
+		expected  int
+	}{
+		{"get", httptest.NewRequest("GET", "http://example.com/", nil), false, false, 3},
+		{"head", httptest.NewRequest("HEAD", "http://example.com/", nil), false, false, 3},
+		{"connect", httptest.NewRequest("CONNECT", "example.com:443", nil), false, false, 3},
+		{"pinned", httptest.NewRequest("GET", "http://example.com/", nil), true, false, 1},
+		{"intercepted", httptest.NewRequest("CONNECT", "example.com:443", nil), false, true, 1},
+		{"post", httptest.NewRequest("POST", "http://example.com/", nil), false, false, 1},
+		{"get with body", httptest.NewRequest("GET", "http://example.com/", strings.NewReader("x")), false, false, 1},
+		{"upgrade", upgrade, false, false, 1},
+	}
+	for _, tt := range tests {
+		if got := hs.retryAttempts(tt.req, tt.pinned, tt.intercept); got != tt.expected {
+			t.Errorf("%s: expected %d attempts, got %d", tt.name, tt.expected, got)
+		}
+	}
+
+	disabled := &HTTPServer{config: &config.Config{}}
+	if got := disabled.retryAttempts(httptest.NewRequest("GET", "http://example.com/", nil), false, false); got != 1 {
+		t.Errorf("expected retries to be disabled by default, got %d attempts", got)
+	}
+}
+
+func TestHandleHTTPProxy_RetryBlockedStatus(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream", "yes")
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	t.Cleanup(upstream.Close)
+
+	hs := &HTTPServer{config: &config.Config{
+		AllowedInterfaces: []string{"lo"},
+		Retry:             config.RetryConfig{MaxAttempts: 2, StatusCodes: []int{http.StatusForbidden}},
+	}}
+
+	req := httptest.NewRequest("GET", upstream.URL, nil)
+	w := httptest.NewRecorder()
+	if !hs.handleHTTPProxy(w, req, net.ParseIP("127.0.0.1"), true) {
+		t.Fatal("expected blocked status to be retryable")
+	}
+	if w.Header().Get("X-Upstream") != "" || w.Body.Len() != 0 {
+		t.Error("expected nothing to be written for a retried attempt")
+	}
+
+	// The last attempt responds as usual
+	w = httptest.NewRecorder()
+	if hs.handleHTTPProxy(w, req, net.ParseIP("127.0.0.1"), false) {
+		t.Fatal("expected the last attempt not to be retried")
+	}
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", w.Code)
+	}
+}
+
+func TestHandleConnect_RetryDialFailure(t *testing.T) {
+	hs := &HTTPServer{config: &config.Config{AllowedInterfaces: []string{"lo"}}}
+
+	listener := startEchoListener(t)
+	target := listener.Addr().String()
+	req := httptest.NewRequest("CONNECT", target, nil)
+	req.Host = target
+
+	// 192.0.2.1 isn't assigned, so the egress IP itself fails
+	w := httptest.NewRecorder()
+	if !hs.handleConnect(w, req, net.ParseIP("192.0.2.1"), true) {
+		t.Fatal("expected a local dial failure to be retryable")
+	}
+	if w.Body.Len() != 0 {
+		t.Error("expected nothing to be written for a retried attempt")
+	}
+
+	w = httptest.NewRecorder()
+	if hs.handleConnect(w, req, net.ParseIP("192.0.2.1"), false) {
+		t.Fatal("expected the last attempt not to be retried")
+	}
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected 502, got %d", w.Code)
+	}
+}
+
+func TestHandleConnect_RetryRefused(t *testing.T) {
+	hs := &HTTPServer{config: &config.Config{AllowedInterfaces: []string{"lo"}}}
+
+	closed := startEchoListener(t)
+	refused := closed.Addr().String()
+	closed.Close()
+
+	// The first egress IP is refused, as when the destination blocks it
+	req := httptest.NewRequest("CONNECT", refused, nil)
+	req.Host = refused
+	w := httptest.NewRecorder()
+	if !hs.handleConnect(w, req, net.ParseIP("127.0.0.1"), true) {
+		t.Fatal("expected a refused dial to be retried through another IP")
+	}
+	if w.Body.Len() != 0 {
+		t.Error("expected nothing to be written for a retried attempt")
+	}
+
+	req = httptest.NewRequest("GET", "http://"+refused+"/", nil)
+	w = httptest.NewRecorder()
+	if !hs.handleHTTPProxy(w, req, net.ParseIP("127.0.0.1"), true) {
+		t.Fatal("expected a refused upstream request to be retried through another IP")
+	}
+}
+
+func TestHandleConnect_NoRetryForUnresolvedNames(t *testing.T) {
+	hs := &HTTPServer{config: &config.Config{AllowedInterfaces: []string{"lo"}}}
+
+	// Names that don't resolve fail the same from every IP
+	target := "does-not-exist.invalid:443"
+	req := httptest.NewRequest("CONNECT", target, nil)
+	req.Host = target
+	w := httptest.NewRecorder()
+	if hs.handleConnect(w, req, net.ParseIP("127.0.0.1"), true) {
+		t.Errorf("%s: expected no retry", target)
+	}
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("%s: expected 502, got %d", target, w.Code)
+	}
+}
+
+func TestIsRetryableError(t *testing.T) {
+	dial := func(err error) error { return &net.OpError{Op: "dial", Net: "tcp", Err: err} }
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"refused", dial(syscall.ECONNREFUSED), true},
+		{"reset", dial(syscall.ECONNRESET), true},
+		{"local address", dial(syscall.EADDRNOTAVAIL), true},
+		{"timeout", dial(os.ErrDeadlineExceeded), true},
+		{"unresolved", dial(&net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}), false},
+		{"canceled", dial(context.Canceled), false},
+		{"reset after write", &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, false},
+		{"unexpected EOF", io.ErrUnexpectedEOF, false},
+	}
+	for _, tt := range tests {
+		if got := isRetryableError(tt.err); got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package http_server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/config"
+)
+
+// sessionStore remembers the egress IP of sticky sessions until they go unused
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*stickySession
+}
+
+type stickySession struct {
+	ip       string
+	lastUsed time.Time
+}
+
+// assign returns the IP of the session. pick is called with the current IP,
+// or "" for new and expired sessions, and returns the IP to keep using. It
+// runs with the store locked, so it must not block.
+func (s *sessionStore) assign(key string, ttl time.Duration, pick func(current string) (string, error)) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	current := ""
+	if session, ok := s.sessions[key]; ok && now.Sub(session.lastUsed) < ttl {
+		current = session.ip
+	}
+	ip, err := pick(current)
+	if err != nil {
+		return "", err
+	}
+
+	if s.sessions == nil {
+		s.sessions = make(map[string]*stickySession)
+	}
+	if current == "" {
+		// Sweep on new sessions, so the map doesn't grow with unused ones
+		for k, session := range s.sessions {
+			if now.Sub(session.lastUsed) >= ttl {
+				delete(s.sessions, k)
+			}
+		}
+	}
+	s.sessions[key] = &stickySession{ip: ip, lastUsed: now}
+	return ip, nil
+}
+
+// sessionIP returns the egress IP of a user's sticky session, picking a new
+// one if the session is new or its IP can no longer be used for host
+func (hs *HTTPServer) sessionIP(ctx context.Context, user, session, host string) (string, error) {
+	// Listing the IPs reads the interfaces, which mustn't hold up every
+	// other session
+	ips, err := hs.candidateIPs(ctx)
+	if err != nil {
+		return "", err
+	}
+	key := user + "\x00" + session
+	return hs.sessions.assign(key, hs.config.Sessions.GetTTL(), func(current string) (string, error) {
+		if current != "" && hs.isHealthyIP(ips, current, host) {
+			return current, nil
+		}
+		return hs.pickHealthyIP(ips, host)
+	})
+}
+
+// isHealthyIP reports if ip is one of ips and could still be picked for host
+func (hs *HTTPServer) isHealthyIP(ips []config.IPInfo, ip, host string) bool {
+	for _, info := range ips {
+		if info.IP == ip {
+			return info.State == config.EgressEnabled && !hs.egressHealth.IsQuarantined(ip, host)
+		}
+	}
+	return false
+}
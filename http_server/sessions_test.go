@@ -0,0 +1,48 @@
+package http_server
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSessionStore_Assign(t *testing.T) {
+	var s sessionStore
+	picks := 0
+	pick := func(ip string) func(string) (string, error) {
+		return func(current string) (string, error) {
+			if current != "" {
+				return current, nil
+			}
+			picks++
+			return ip, nil
+		}
+	}
+
+	if ip, _ := s.assign("alice\x00a", time.Hour, pick("192.0.2.1")); ip != "192.0.2.1" {
+		t.Errorf("expected a new session to get the picked IP, got %q", ip)
+	}
+	if ip, _ := s.assign("alice\x00a", time.Hour, pick("192.0.2.2")); ip != "192.0.2.1" {
+		t.Errorf("expected the session to keep its IP, got %q", ip)
+	}
+	if ip, _ := s.assign("bob\x00a", time.Hour, pick("192.0.2.3")); ip != "192.0.2.3" {
+		t.Errorf("expected sessions to be separate per user, got %q", ip)
+	}
+	if picks != 2 {
+		t.Errorf("expected 2 picks, got %d", picks)
+	}
+
+	// Expired sessions are picked again
+	if ip, _ := s.assign("alice\x00a", 0, pick("192.0.2.4")); ip != "192.0.2.4" {
+		t.Errorf("expected an expired session to get a new IP, got %q", ip)
+	}
+
+	// Failed picks leave the session alone
+	_, err := s.assign("carol\x00a", time.Hour, func(string) (string, error) { return "", errNoHealthyIPs })
+	if !errors.Is(err, errNoHealthyIPs) {
+		t.Errorf("expected the pick error, got %v", err)
+	}
+	if _, ok := s.sessions["carol\x00a"]; ok {
+		t.Error("expected no session after a failed pick")
+	}
+}
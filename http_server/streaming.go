@@ -0,0 +1,98 @@
+package http_server
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// streamingContentTypes are flushed as they arrive even with a known length
+var streamingContentTypes = []string{
+	"text/event-stream",
+	"application/x-ndjson",
+	"multipart/x-mixed-replace",
+}
+
+// isStreamingResponse reports whether resp should reach the client as it
+// arrives rather than when the response buffer fills. Bodies of unknown
+// length are streamed, as they're often long polls or chunked streams.
+func isStreamingResponse(resp *http.Response) bool {
+	if resp.ContentLength == -1 {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return slices.Contains(streamingContentTypes, mediaType) || strings.HasPrefix(mediaType, "application/grpc")
+}
+
+// announceTrailers declares the trailers of resp in h, which must happen
+// before the header is written. It returns the number announced.
+func announceTrailers(h http.Header, resp *http.Response) int {
+	if len(resp.Trailer) == 0 {
+		return 0
+	}
+	keys := make([]string, 0, len(resp.Trailer))
+	for key := range resp.Trailer {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	h.Set("Trailer", strings.Join(keys, ", "))
+	return len(keys)
+}
+
+// copyResponseBody copies a response body to the client, flushing after
+// every read for streaming responses, then sends the trailers of resp
+func copyResponseBody(w http.ResponseWriter, resp *http.Response, body io.Reader, announced int) error {
+	rc := http.NewResponseController(w)
+	var dst io.Writer = w
+	if isStreamingResponse(resp) {
+		// Send the header right away, streams may not start with data
+		flush(rc)
+		dst = &flushWriter{w: w, rc: rc}
+	}
+	_, err := io.Copy(dst, body)
+	if err != nil || len(resp.Trailer) == 0 {
+		return err
+	}
+
+	// Trailers need a chunked response, which a flush forces for bodies
+	// short enough to otherwise get a Content-Length
+	flush(rc)
+	if len(resp.Trailer) == announced {
+		for key, values := range resp.Trailer {
+			w.Header()[key] = values
+		}
+		return nil
+	}
+	// Trailers the upstream didn't announce are sent with TrailerPrefix
+	for key, values := range resp.Trailer {
+		w.Header()[http.TrailerPrefix+key] = values
+	}
+	return nil
+}
+
+// flush sends buffered response data, for writers that support it
+func flush(rc *http.ResponseController) {
+	if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		logger.Debug().Err(err).Msg("failed to flush response")
+	}
+}
+
+// flushWriter flushes after every write
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if err := fw.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return n, err
+	}
+	return n, nil
+}
@@ -0,0 +1,231 @@
+package http_server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/config"
+)
+
+// newStreamingTestServers starts an upstream with handler and a proxy in
+// front of it, returning them with a client using the proxy
+func newStreamingTestServers(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *httptest.Server, *http.Client) {
+	t.Helper()
+
+	upstream := httptest.NewServer(handler)
+	t.Cleanup(upstream.Close)
+	hs := &HTTPServer{config: &config.Config{AllowedInterfaces: []string{"lo"}}}
+	proxy := httptest.NewServer(hs.newHandler())
+	t.Cleanup(proxy.Close)
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	t.Cleanup(client.CloseIdleConnections)
+	return upstream, proxy, client
+}
+
+// doPinned sends req through 127.0.0.1
+func doPinned(t *testing.T, client *http.Client, req *http.Request) *http.Response {
+	t.Helper()
+	req.Header.Set("X-Egress-IP", "127.0.0.1")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestStreaming_FlushesAsDataArrives(t *testing.T) {
+	tests := []struct {
+		name          string
+		contentType   string
+		contentLength string
+	}{
+		{"server-sent events", "text/event-stream", ""},
+		{"unknown length", "application/octet-stream", ""},
+		{"ndjson with a length", "application/x-ndjson", "13"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			upstream, _, client := newStreamingTestServers(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				if tt.contentLength != "" {
+					w.Header().Set("Content-Length", tt.contentLength)
+				}
+				w.Write([]byte("first line\n"))
+				w.(http.Flusher).Flush()
+				// The rest only comes once the client saw the first line
+				select {
+				case <-release:
+				case <-r.Context().Done():
+					return
+				}
+				w.Write([]byte("\n\n"))
+			})
+			// Release the upstream even if the test fails, so the servers can close
+			var releaseOnce sync.Once
+			t.Cleanup(func() { releaseOnce.Do(func() { close(release) }) })
+
+			// Without flushing not even the header arrives, so the whole
+			// request runs in the background
+			req, _ := http.NewRequest("GET", upstream.URL, nil)
+			req.Header.Set("X-Egress-IP", "127.0.0.1")
+			responses := make(chan *http.Response, 1)
+			lines := make(chan string, 1)
+			go func() {
+				resp, err := client.Do(req)
+				if err != nil {
+					lines <- err.Error()
+					return
+				}
+				responses <- resp
+				line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+				lines <- line
+			}()
+			select {
+			case line := <-lines:
+				if line != "first line\n" {
+					t.Fatalf("expected the first line, got %q", line)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("expected the first line to arrive before the response finished")
+			}
+			resp := <-responses
+			defer resp.Body.Close()
+
+			releaseOnce.Do(func() { close(release) })
+			if rest, _ := io.ReadAll(resp.Body); string(rest) != "\n\n" {
+				t.Errorf("expected the rest of the body, got %q", rest)
+			}
+		})
+	}
+}
+
+func TestStreaming_SlowChunks(t *testing.T) {
+	upstream, _, client := newStreamingTestServers(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := range 3 {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(150 * time.Millisecond)
+		}
+	})
+
+	req, _ := http.NewRequest("GET", upstream.URL, nil)
+	start := time.Now()
+	resp := doPinned(t, client, req)
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	var arrivals []time.Duration
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "data: ") {
+			arrivals = append(arrivals, time.Since(start))
+		}
+	}
+	if len(arrivals) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(arrivals))
+	}
+	// Buffered events would all arrive together at the end
+	if arrivals[2]-arrivals[0] < 200*time.Millisecond {
+		t.Errorf("expected events to arrive as they were sent, got %v", arrivals)
+	}
+}
+
+func TestStreaming_Trailers(t *testing.T) {
+	upstream, _, client := newStreamingTestServers(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Header().Set("X-Request-Trailer", r.Trailer.Get("X-Upload-Checksum"))
+		w.Write(body)
+		w.Header().Set("X-Checksum", "abc123")
+		w.Header().Set(http.TrailerPrefix+"X-Late", "unannounced")
+	})
+
+	// A body of unknown length is sent chunked, with its trailers
+	body := io.MultiReader(strings.NewReader("uploaded"))
+	req, _ := http.NewRequest("POST", upstream.URL, body)
+	req.Trailer = http.Header{"X-Upload-Checksum": {"def456"}}
+	resp := doPinned(t, client, req)
+	defer resp.Body.Close()
+
+	got, _ := io.ReadAll(resp.Body)
+	if string(got) != "uploaded" {
+		t.Errorf("expected the echoed body, got %q", got)
+	}
+	if resp.Header.Get("X-Request-Trailer") != "def456" {
+		t.Errorf("expected request trailers to be forwarded, got %q", resp.Header.Get("X-Request-Trailer"))
+	}
+	if resp.Trailer.Get("X-Checksum") != "abc123" {
+		t.Errorf("expected the announced trailer, got %v", resp.Trailer)
+	}
+	if resp.Trailer.Get("X-Late") != "unannounced" {
+		t.Errorf("expected the unannounced trailer, got %v", resp.Trailer)
+	}
+}
+
+func TestStreaming_ExpectContinue(t *testing.T) {
+	var bodies atomic.Int32
+	upstream, proxy, _ := newStreamingTestServers(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/reject" {
+			http.Error(w, "too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		bodies.Add(1)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	})
+
+	send := func(path string) (*bufio.Reader, net.Conn) {
+		conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "POST %s%s HTTP/1.1\r\nHost: %s\r\nX-Egress-IP: 127.0.0.1\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n",
+			upstream.URL, path, upstream.Listener.Addr())
+		return bufio.NewReader(conn), conn
+	}
+
+	// The body is only sent once the upstream asked for it
+	reader, conn := send("/accept")
+	interim, err := http.ReadResponse(reader, nil)
+	if err != nil || interim.StatusCode != http.StatusContinue {
+		t.Fatalf("expected 100 Continue before the body, got %v %v", interim, err)
+	}
+	conn.Write([]byte("hello"))
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusCreated || string(body) != "hello" {
+		t.Errorf("expected the upstream to get the body, got %d %q", resp.StatusCode, body)
+	}
+
+	// Rejections reach the client without it sending the body
+	reader, _ = send("/reject")
+	resp, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected the upstream's rejection instead of 100 Continue, got %d", resp.StatusCode)
+	}
+	if bodies.Load() != 1 {
+		t.Errorf("expected only the accepted body to reach the upstream, got %d", bodies.Load())
+	}
+}
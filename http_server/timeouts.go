@@ -0,0 +1,100 @@
+package http_server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/config"
+)
+
+// timeoutsFor returns the timeouts for a destination host
+func (hs *HTTPServer) timeoutsFor(host string) config.Timeouts {
+	if hs.config == nil {
+		return config.DefaultTimeouts
+	}
+	return hs.config.TimeoutsFor(host)
+}
+
+// newDialer returns a dialer bound to localIP
+func newDialer(localIP net.IP, timeouts config.Timeouts) *net.Dialer {
+	return &net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: localIP},
+		Timeout:   timeouts.Dial,
+	}
+}
+
+// tunnelContext bounds a tunnel's lifetime by the configured max lifetime
+func tunnelContext(ctx context.Context, timeouts config.Timeouts) (context.Context, context.CancelFunc) {
+	if timeouts.TunnelMaxLifetime > 0 {
+		return context.WithTimeout(ctx, timeouts.TunnelMaxLifetime)
+	}
+	return context.WithCancel(ctx)
+}
+
+// idleTracker records the last activity across both directions of a tunnel
+type idleTracker struct {
+	timeout      time.Duration
+	lastActivity atomic.Int64
+}
+
+func newIdleTracker(timeout time.Duration) *idleTracker {
+	it := &idleTracker{timeout: timeout}
+	it.touch()
+	return it
+}
+
+func (it *idleTracker) touch() {
+	it.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (it *idleTracker) idleFor() time.Duration {
+	return time.Since(time.Unix(0, it.lastActivity.Load()))
+}
+
+// wrap returns conn with deadline refreshing reads and writes, or conn
+// itself if no idle timeout is configured
+func (it *idleTracker) wrap(conn net.Conn) net.Conn {
+	if it.timeout <= 0 {
+		return conn
+	}
+	return &idleConn{Conn: conn, tracker: it}
+}
+
+// idleConn refreshes its deadline on every read and write. A read deadline
+// only counts as idle if the other direction of the tunnel was idle too.
+type idleConn struct {
+	net.Conn
+	tracker *idleTracker
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	for {
+		c.Conn.SetReadDeadline(time.Now().Add(c.tracker.timeout))
+		n, err := c.Conn.Read(p)
+		if n > 0 {
+			c.tracker.touch()
+		}
+		if n == 0 && isTimeout(err) && c.tracker.idleFor() < c.tracker.timeout {
+			// Traffic is flowing the other way, keep waiting
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.tracker.timeout))
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.tracker.touch()
+	}
+	return n, err
+}
+
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
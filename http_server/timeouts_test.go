@@ -0,0 +1,149 @@
+package http_server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/config"
+)
+
+func newTimeoutTestServer(t *testing.T, timeouts config.Timeouts) *httptest.Server {
+	t.Helper()
+
+	hs := &HTTPServer{config: &config.Config{
+		AllowedInterfaces: []string{"lo"},
+		Timeouts:          timeouts,
+	}}
+	proxy := httptest.NewServer(hs.newHandler())
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+// startTickListener starts a TCP server that writes a byte every interval
+// without ever reading
+func startTickListener(t *testing.T, interval time.Duration) net.Listener {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					if _, err := conn.Write([]byte{'.'}); err != nil {
+						return
+					}
+					time.Sleep(interval)
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestTunnelIdleTimeout(t *testing.T) {
+	proxy := newTimeoutTestServer(t, config.Timeouts{TunnelIdle: 200 * time.Millisecond})
+	echo := startEchoListener(t)
+
+	conn, reader, resp := openConnectTunnel(t, proxy.Listener.Addr().String(), echo.Addr().String(), http.Header{
+		"X-Egress-Ip": {"127.0.0.1"},
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected CONNECT 200, got %d", resp.StatusCode)
+	}
+
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		t.Fatalf("expected echo, got %v", err)
+	}
+
+	// Nothing is sent afterwards, so the proxy should close the tunnel
+	start := time.Now()
+	if _, err := reader.ReadByte(); err == nil {
+		t.Fatal("expected idle tunnel to be closed")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected idle tunnel to close after ~200ms, took %v", elapsed)
+	}
+}
+
+func TestTunnelIdleTimeout_OneWayTraffic(t *testing.T) {
+	proxy := newTimeoutTestServer(t, config.Timeouts{TunnelIdle: 200 * time.Millisecond})
+	ticker := startTickListener(t, 50*time.Millisecond)
+
+	_, reader, resp := openConnectTunnel(t, proxy.Listener.Addr().String(), ticker.Addr().String(), http.Header{
+		"X-Egress-Ip": {"127.0.0.1"},
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected CONNECT 200, got %d", resp.StatusCode)
+	}
+
+	// The client never writes, but downstream traffic keeps the tunnel alive
+	deadline := time.Now().Add(700 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		if _, err := reader.ReadByte(); err != nil {
+			t.Fatalf("tunnel with one way traffic was closed: %v", err)
+		}
+	}
+}
+
+func TestTunnelMaxLifetime(t *testing.T) {
+	proxy := newTimeoutTestServer(t, config.Timeouts{TunnelMaxLifetime: 300 * time.Millisecond})
+	ticker := startTickListener(t, 20*time.Millisecond)
+
+	_, reader, resp := openConnectTunnel(t, proxy.Listener.Addr().String(), ticker.Addr().String(), http.Header{
+		"X-Egress-Ip": {"127.0.0.1"},
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected CONNECT 200, got %d", resp.StatusCode)
+	}
+
+	start := time.Now()
+	for {
+		if _, err := reader.ReadByte(); err != nil {
+			break
+		}
+		if time.Since(start) > 3*time.Second {
+			t.Fatal("expected tunnel to be closed after max lifetime")
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("tunnel closed too early after %v", elapsed)
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		w.Write([]byte("late"))
+	}))
+	defer upstream.Close()
+
+	hs := &HTTPServer{config: &config.Config{
+		AllowedInterfaces: []string{"lo"},
+		Timeouts:          config.Timeouts{ResponseHeader: 100 * time.Millisecond},
+	}}
+
+	req := httptest.NewRequest("GET", upstream.URL, nil)
+	req.Header.Set("X-Egress-IP", "127.0.0.1")
+	w := httptest.NewRecorder()
+	hs.handleProxy(w, req)
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected status 502 on response header timeout, got %d", w.Code)
+	}
+}
@@ -0,0 +1,179 @@
+package http_server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+
+	"github.com/danthegoodman1/specificproxy/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// propagator reads and writes W3C traceparent headers
+var propagator = propagation.TraceContext{}
+
+// maxRequestIDLength bounds client supplied request IDs
+const maxRequestIDLength = 128
+
+// withRequestTracing starts the request span and assigns the request ID,
+// which is attached to every log line of the request and returned in the response
+func withRequestTracing(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracing.Tracer().Start(ctx, "proxy "+r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("server.address", r.Host),
+				attribute.String("client.address", r.RemoteAddr),
+			),
+		)
+		defer span.End()
+
+		id := requestID(r)
+		span.SetAttributes(attribute.String("request.id", id))
+		w.Header().Set("X-Request-Id", id)
+
+		log := logger.With().Str("request_id", id).Logger()
+		next(w, r.WithContext(log.WithContext(ctx)))
+	}
+}
+
+// copyResponseHeader adds the headers of an upstream response to dst. The
+// request ID already set on dst is kept instead of adding the upstream's.
+func copyResponseHeader(dst, src http.Header) {
+	id := dst.Get("X-Request-Id")
+	for key, values := range src {
+		for _, value := range values {
+			dst.Add(key, value)
+		}
+	}
+	if id != "" {
+		dst.Set("X-Request-Id", id)
+	}
+}
+
+// requestID returns the client's X-Request-Id, the trace ID of its
+// traceparent, or a new random ID
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); isValidRequestID(id) {
+		return id
+	}
+	if r.Header.Get("traceparent") != "" {
+		parent := trace.SpanContextFromContext(propagator.Extract(context.Background(), propagation.HeaderCarrier(r.Header)))
+		if parent.HasTraceID() {
+			return parent.TraceID().String()
+		}
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// isValidRequestID checks a client supplied request ID is safe to log and echo
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// startSpan starts a child span of the request
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err on span, if any, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedDial dials addr from dialer with a span covering DNS and connect
+func tracedDial(ctx context.Context, dialer *net.Dialer, addr string) (net.Conn, error) {
+	ctx, span := startSpan(ctx, "dial",
+		attribute.String("server.address", addr),
+		attribute.String("network.local.address", localAddrIP(dialer)),
+	)
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	endSpan(span, err)
+	return conn, err
+}
+
+func localAddrIP(dialer *net.Dialer) string {
+	if addr, ok := dialer.LocalAddr.(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// withClientTrace adds spans for the DNS, dial and TLS phases of an upstream
+// round trip to ctx
+func withClientTrace(ctx context.Context) context.Context {
+	var mu sync.Mutex
+	var dnsSpan, tlsSpan trace.Span
+	dialSpans := make(map[string]trace.Span)
+
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			_, dnsSpan = startSpan(ctx, "dns", attribute.String("dns.question.name", info.Host))
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			if dnsSpan != nil {
+				endSpan(dnsSpan, info.Err)
+				dnsSpan = nil
+			}
+		},
+		// Several addresses may be dialed at once, so dial spans are keyed by address
+		ConnectStart: func(network, addr string) {
+			mu.Lock()
+			defer mu.Unlock()
+			_, dialSpans[addr] = startSpan(ctx, "dial", attribute.String("server.address", addr))
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if span, ok := dialSpans[addr]; ok {
+				endSpan(span, err)
+				delete(dialSpans, addr)
+			}
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			_, tlsSpan = startSpan(ctx, "tls")
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if tlsSpan != nil {
+				if err == nil {
+					tlsSpan.SetAttributes(attribute.String("tls.protocol.version", tls.VersionName(state.Version)))
+				}
+				endSpan(tlsSpan, err)
+				tlsSpan = nil
+			}
+		},
+	})
+}
@@ -0,0 +1,244 @@
+package http_server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/config"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var (
+	spanExporter     = tracetest.NewInMemoryExporter()
+	spanExporterOnce sync.Once
+)
+
+// recordSpans installs the in-memory exporter and clears recorded spans
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+
+	spanExporterOnce.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spanExporter)))
+	})
+	spanExporter.Reset()
+	return spanExporter
+}
+
+// waitForSpan waits until a span with the given name has ended
+func waitForSpan(t *testing.T, exporter *tracetest.InMemoryExporter, name string) tracetest.SpanStub {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		for _, span := range exporter.GetSpans() {
+			if span.Name == name {
+				return span
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected span %q, got %v", name, spanNames(exporter.GetSpans()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func spanNames(spans tracetest.SpanStubs) []string {
+	names := make([]string, 0, len(spans))
+	for _, span := range spans {
+		names = append(names, span.Name)
+	}
+	return names
+}
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   http.Header
+		expected string
+	}{
+		{"client id", http.Header{"X-Request-Id": {"abc-123"}}, "abc-123"},
+		{"traceparent", http.Header{"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}}, "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{"client id wins", http.Header{
+			"X-Request-Id": {"abc-123"},
+			"Traceparent":  {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		}, "abc-123"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		r.Header = tt.header
+		if id := requestID(r); id != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.expected, id)
+		}
+	}
+
+	// Invalid IDs are replaced with generated ones
+	for _, invalid := range []string{"has space", strings.Repeat("a", maxRequestIDLength+1), "bad\nline"} {
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		r.Header.Set("X-Request-Id", invalid)
+		if id := requestID(r); id == invalid || len(id) != 32 {
+			t.Errorf("expected generated ID for %q, got %q", invalid, id)
+		}
+	}
+}
+
+func TestRequestTracing_Logger(t *testing.T) {
+	var buf bytes.Buffer
+	handler := withRequestTracing(func(w http.ResponseWriter, r *http.Request) {
+		log := zerolog.Ctx(r.Context()).Output(&buf)
+		log.Info().Msg("inside request")
+	})
+
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	r.Header.Set("X-Request-Id", "req-1")
+	w := httptest.NewRecorder()
+	handler(w, r)
+
+	if w.Header().Get("X-Request-Id") != "req-1" {
+		t.Errorf("expected X-Request-Id in response, got %q", w.Header().Get("X-Request-Id"))
+	}
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("invalid log line %q: %v", buf.String(), err)
+	}
+	if line["request_id"] != "req-1" {
+		t.Errorf("expected request_id in log line, got %v", line)
+	}
+}
+
+func TestRequestID_UpstreamResponse(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-Id", "upstream-1")
+	}))
+	t.Cleanup(upstream.Close)
+
+	hs := &HTTPServer{config: &config.Config{AllowedInterfaces: []string{"lo"}}}
+	r := httptest.NewRequest("GET", upstream.URL, nil)
+	r.Header.Set("X-Egress-IP", "127.0.0.1")
+	r.Header.Set("X-Request-Id", "req-1")
+	w := httptest.NewRecorder()
+	withRequestTracing(hs.handleProxy)(w, r)
+
+	if ids := w.Header().Values("X-Request-Id"); len(ids) != 1 || ids[0] != "req-1" {
+		t.Errorf("expected only the proxy's request ID, got %v", ids)
+	}
+}
+
+func TestApplyHeaderActions_Logger(t *testing.T) {
+	var buf bytes.Buffer
+	log := zerolog.New(&buf).With().Str("request_id", "req-1").Logger()
+
+	h := make(http.Header)
+	applyHeaderActions(log.WithContext(context.Background()), h, []config.HeaderAction{
+		{Action: config.HeaderActionSet, Name: "X-Broken", Value: "{{ .Missing }}"},
+	}, &headerTemplateData{})
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("invalid log line %q: %v", buf.String(), err)
+	}
+	if line["request_id"] != "req-1" || line["header"] != "X-Broken" {
+		t.Errorf("expected the warning on the request's logger, got %v", line)
+	}
+	if h.Get("X-Broken") != "" {
+		t.Error("expected the broken header not to be set")
+	}
+}
+
+func TestTracing_HTTPProxy(t *testing.T) {
+	exporter := recordSpans(t)
+	upstream, _ := newHeaderTestServers(t, nil)
+
+	hs := &HTTPServer{config: &config.Config{AllowedInterfaces: []string{"lo"}}}
+	proxy := httptest.NewServer(hs.newHandler())
+	t.Cleanup(proxy.Close)
+
+	// Use a hostname so the request is resolved
+	target := strings.Replace(upstream.URL, "127.0.0.1", "localhost", 1)
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	resp, seen := doProxyRequest(t, proxy, target, http.Header{
+		"X-Egress-Ip":  {"127.0.0.1"},
+		"Traceparent":  {"00-" + traceID + "-00f067aa0ba902b7-01"},
+		"X-Rate-Limit": {`{"rate": 100, "period": 1, "resource": {"kind": "domain"}}`},
+	})
+	if resp.Header.Get("X-Request-Id") != traceID {
+		t.Errorf("expected the trace ID as request ID, got %q", resp.Header.Get("X-Request-Id"))
+	}
+
+	// The upstream continues the trace from the proxy's upstream span
+	upstreamSpan := waitForSpan(t, exporter, "upstream")
+	expected := "00-" + traceID + "-" + upstreamSpan.SpanContext.SpanID().String() + "-01"
+	if seen.Get("Traceparent") != expected {
+		t.Errorf("expected upstream traceparent %q, got %q", expected, seen.Get("Traceparent"))
+	}
+
+	root := waitForSpan(t, exporter, "proxy GET")
+	for _, name := range []string{"ratelimit.check", "dns", "dial", "upstream"} {
+		span := waitForSpan(t, exporter, name)
+		if span.SpanContext.TraceID().String() != traceID {
+			t.Errorf("expected %s span in the client's trace, got %s", name, span.SpanContext.TraceID())
+		}
+	}
+	if upstreamSpan.Parent.SpanID() != root.SpanContext.SpanID() {
+		t.Error("expected upstream span to be a child of the request span")
+	}
+	if dial := waitForSpan(t, exporter, "dial"); dial.Parent.SpanID() != upstreamSpan.SpanContext.SpanID() {
+		t.Error("expected dial span to be a child of the upstream span")
+	}
+}
+
+func TestTracing_Connect(t *testing.T) {
+	exporter := recordSpans(t)
+	hs := &HTTPServer{config: &config.Config{AllowedInterfaces: []string{"lo"}}}
+	proxy := httptest.NewServer(hs.newHandler())
+	t.Cleanup(proxy.Close)
+	echo := startEchoListener(t)
+
+	conn, _, resp := openConnectTunnel(t, proxy.Listener.Addr().String(), echo.Addr().String(), http.Header{"X-Egress-Ip": {"127.0.0.1"}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if len(resp.Header.Get("X-Request-Id")) != 32 {
+		t.Errorf("expected generated X-Request-Id on CONNECT response, got %q", resp.Header.Get("X-Request-Id"))
+	}
+	conn.Close()
+
+	dial := waitForSpan(t, exporter, "dial")
+	root := waitForSpan(t, exporter, "proxy CONNECT")
+	if dial.Parent.SpanID() != root.SpanContext.SpanID() {
+		t.Error("expected dial span to be a child of the request span")
+	}
+}
+
+func TestTracing_InterceptedTLS(t *testing.T) {
+	exporter := recordSpans(t)
+	upstream, proxy, authority := newMITMTestServers(t, []string{"127.0.0.1"})
+	client := newMITMTestClient(t, proxy, upstream, authority, http.Header{
+		"X-Egress-Ip": {"127.0.0.1"},
+	})
+
+	resp, err := client.Get(upstream.URL + "/hello")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if len(resp.Header.Get("X-Request-Id")) != 32 {
+		t.Errorf("expected X-Request-Id on intercepted response, got %q", resp.Header.Get("X-Request-Id"))
+	}
+
+	tlsSpan := waitForSpan(t, exporter, "tls")
+	upstreamSpan := waitForSpan(t, exporter, "upstream")
+	if tlsSpan.Parent.SpanID() != upstreamSpan.SpanContext.SpanID() {
+		t.Error("expected tls span to be a child of the upstream span")
+	}
+	waitForSpan(t, exporter, "proxy GET")
+}
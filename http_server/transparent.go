@@ -0,0 +1,144 @@
+package http_server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/config"
+)
+
+// startTransparent listens for connections redirected to the proxy by the
+// firewall and tunnels them to their original destinations
+func (hs *HTTPServer) startTransparent() error {
+	cfg := hs.config.Transparent
+	ln, err := listenTransparent(cfg.ListenAddr, cfg.GetMode())
+	if err != nil {
+		return err
+	}
+	hs.transparent = ln
+
+	logger.Info().Str("addr", ln.Addr().String()).Str("mode", cfg.GetMode()).Msg("starting transparent listener")
+	go hs.serveTransparent(ln)
+	return nil
+}
+
+// serveTransparent accepts connections until ln is closed
+func (hs *HTTPServer) serveTransparent(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			// Likely out of file descriptors, back off like http.Server
+			logger.Error().Err(err).Msg("transparent accept failed")
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go hs.handleTransparent(conn)
+	}
+}
+
+// handleTransparent recovers the destination of a redirected connection and
+// proxies it there
+func (hs *HTTPServer) handleTransparent(conn net.Conn) {
+	mode := hs.config.Transparent.GetMode()
+	dst, err := originalDst(conn, mode)
+	if err != nil {
+		logger.Warn().Err(err).Str("client", conn.RemoteAddr().String()).Msg("failed to recover original destination")
+		conn.Close()
+		return
+	}
+	// Connections made to the listener itself would loop back to it. Under
+	// TPROXY the local address is always the destination.
+	if mode == config.TransparentRedirect && dst == addrPort(conn.LocalAddr()) {
+		logger.Warn().Str("client", conn.RemoteAddr().String()).Msg("rejected direct connection to the transparent listener")
+		conn.Close()
+		return
+	}
+	hs.proxyTransparent(conn, dst)
+}
+
+// proxyTransparent tunnels conn to dst like a CONNECT, with the egress chosen
+// by the first transparent rule matching the connection
+func (hs *HTTPServer) proxyTransparent(conn net.Conn, dst netip.AddrPort) {
+	cfg := hs.config.Transparent
+	src := addrPort(conn.RemoteAddr())
+
+	var labels map[string]string
+	if cfg.UsesLabels() {
+		cgroup, err := clientCgroup(src)
+		if err != nil {
+			logger.Debug().Err(err).Str("client", src.String()).Msg("failed to find the cgroup of client")
+		} else {
+			labels = cfg.LabelsFor(cgroup)
+		}
+	}
+
+	ctx := context.Background()
+	if rule := cfg.Rule(src, dst, labels); rule != nil {
+		ctx = withProxyOptions(ctx, proxyOptions{EgressIP: rule.IP, RateLimitPolicy: rule.RateLimit})
+		ctx = withEgressPool(ctx, rule.Pool())
+	}
+
+	host := dst.String()
+	r := (&http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: host},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+		Host:       host,
+		RemoteAddr: conn.RemoteAddr().String(),
+		RequestURI: host,
+	}).WithContext(ctx)
+
+	w := &transparentWriter{conn: conn, header: make(http.Header)}
+	withRequestTracing(hs.handleProxy)(w, r)
+	if !w.accepted {
+		logger.Warn().Str("client", src.String()).Str("host", host).Int("status", w.status).
+			Msg("transparent connection refused")
+		conn.Close()
+	}
+}
+
+// transparentWriter stands in for the response of a transparent connection.
+// There is no response to send, refusals close the connection instead.
+type transparentWriter struct {
+	conn   net.Conn
+	header http.Header
+	status int
+	// accepted is set once the connection became a tunnel
+	accepted bool
+}
+
+func (w *transparentWriter) Header() http.Header { return w.header }
+
+func (w *transparentWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	return len(p), nil
+}
+
+func (w *transparentWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// addrPort returns the IP and port of a TCP address
+func addrPort(addr net.Addr) netip.AddrPort {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		ap := tcpAddr.AddrPort()
+		return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+	}
+	ap, _ := netip.ParseAddrPort(addr.String())
+	return ap
+}
@@ -0,0 +1,263 @@
+//go:build linux
+
+package http_server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/danthegoodman1/specificproxy/config"
+	"golang.org/x/sys/unix"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST, and IP6T_SO_ORIGINAL_DST for IPv6
+const soOriginalDst = 80
+
+// listenTransparent listens on addr. TPROXY listeners set IP_TRANSPARENT so
+// they accept connections for addresses that aren't local.
+func listenTransparent(addr, mode string) (net.Listener, error) {
+	var lc net.ListenConfig
+	if mode == config.TransparentTProxy {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				if network != "tcp6" {
+					sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+				}
+				if sockErr == nil && network != "tcp4" {
+					err := unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+					// Dual stack listeners may have an IPv4 socket
+					if network == "tcp6" || !errors.Is(err, unix.ENOPROTOOPT) {
+						sockErr = err
+					}
+				}
+			})
+			if sockErr != nil {
+				return fmt.Errorf("failed to set transparent socket option (requires CAP_NET_ADMIN): %w", sockErr)
+			}
+			return err
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// originalDst returns the destination a client connected to before it was
+// redirected to the proxy
+func originalDst(conn net.Conn, mode string) (netip.AddrPort, error) {
+	if mode == config.TransparentTProxy {
+		return addrPort(conn.LocalAddr()), nil
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return netip.AddrPort{}, errors.New("not a TCP connection")
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	var dst netip.AddrPort
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if addrPort(conn.LocalAddr()).Addr().Is4() {
+			// Returns a sockaddr_in: family, port and address
+			var mreq *unix.IPv6Mreq
+			mreq, sockErr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst)
+			if sockErr == nil {
+				sa := mreq.Multiaddr
+				dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte(sa[4:8])), binary.BigEndian.Uint16(sa[2:4]))
+			}
+			return
+		}
+		var info *unix.IPv6MTUInfo
+		info, sockErr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, soOriginalDst)
+		if sockErr == nil {
+			port := make([]byte, 2)
+			binary.NativeEndian.PutUint16(port, info.Addr.Port)
+			dst = netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr).Unmap(), binary.BigEndian.Uint16(port))
+		}
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("SO_ORIGINAL_DST: %w", err)
+	}
+	return dst, nil
+}
+
+// clientCgroup returns the cgroup path of the local process owning the
+// client side of a connection from src
+func clientCgroup(src netip.AddrPort) (string, error) {
+	inode, err := socketInode(src)
+	if err != nil {
+		return "", err
+	}
+	pid, err := socketOwner(inode)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(filepath.Join("/proc", pid, "cgroup"))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return parseProcCgroup(f)
+}
+
+// socketInode finds the inode of the TCP socket bound to src
+func socketInode(src netip.AddrPort) (string, error) {
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(table)
+		if err != nil {
+			continue
+		}
+		inode, ok := parseProcNetTCP(f, src)
+		f.Close()
+		if ok {
+			return inode, nil
+		}
+	}
+	return "", fmt.Errorf("no local socket for %s", src)
+}
+
+// parseProcNetTCP returns the inode of the socket with local address src
+// from a /proc/net/tcp or tcp6 table
+func parseProcNetTCP(r io.Reader, src netip.AddrPort) (string, bool) {
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // Header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		local, err := parseProcAddr(fields[1])
+		if err == nil && local == src && fields[9] != "0" {
+			return fields[9], true
+		}
+	}
+	return "", false
+}
+
+// parseProcAddr parses an address of /proc/net/tcp, hex encoded 32 bit words
+// in host byte order followed by the port
+func parseProcAddr(s string) (netip.AddrPort, error) {
+	hexIP, hexPort, ok := strings.Cut(s, ":")
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %q", s)
+	}
+	raw, err := hex.DecodeString(hexIP)
+	if err != nil || (len(raw) != 4 && len(raw) != 16) {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %q", s)
+	}
+	port, err := strconv.ParseUint(hexPort, 16, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid port %q", s)
+	}
+
+	ip := make([]byte, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		binary.NativeEndian.PutUint32(ip[i:], binary.BigEndian.Uint32(raw[i:]))
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	return netip.AddrPortFrom(addr.Unmap(), uint16(port)), nil
+}
+
+// maxRecentOwners is how many processes recentOwners remembers
+const maxRecentOwners = 16
+
+// recentOwners remembers the processes that owned recent client sockets.
+// Clients tend to open many connections, so their fds are searched before
+// those of every process.
+var recentOwners ownerCache
+
+// ownerCache is a list of pids, most recently used first
+type ownerCache struct {
+	mu   sync.Mutex
+	pids []string
+}
+
+// candidates returns the remembered pids, most recently used first
+func (c *ownerCache) candidates() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.pids)
+}
+
+// add moves pid to the front, forgetting the least recently used pid if full
+func (c *ownerCache) add(pid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pids = slices.DeleteFunc(c.pids, func(p string) bool { return p == pid })
+	c.pids = slices.Insert(c.pids, 0, pid)
+	if len(c.pids) > maxRecentOwners {
+		c.pids = c.pids[:maxRecentOwners]
+	}
+}
+
+// socketOwner finds a process with the socket inode open, trying recent
+// owners before scanning every process
+func socketOwner(inode string) (string, error) {
+	target := "socket:[" + inode + "]"
+	for _, pid := range recentOwners.candidates() {
+		if _, ok := findFD(filepath.Join("/proc", pid, "fd", "*"), target); ok {
+			recentOwners.add(pid)
+			return pid, nil
+		}
+	}
+	if fd, ok := findFD("/proc/[0-9]*/fd/*", target); ok {
+		pid := strings.Split(fd, "/")[2]
+		recentOwners.add(pid)
+		return pid, nil
+	}
+	return "", fmt.Errorf("no process owns socket %s", inode)
+}
+
+// findFD returns the first fd matching pattern that links to target
+func findFD(pattern, target string) (string, bool) {
+	fds, _ := filepath.Glob(pattern)
+	for _, fd := range fds {
+		if link, err := os.Readlink(fd); err == nil && link == target {
+			return fd, true
+		}
+	}
+	return "", false
+}
+
+// parseProcCgroup returns the cgroup v2 path of /proc/<pid>/cgroup, or the
+// path of the first v1 hierarchy
+func parseProcCgroup(r io.Reader) (string, error) {
+	var first string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] == "0" && parts[1] == "" {
+			return parts[2], nil
+		}
+		if first == "" {
+			first = parts[2]
+		}
+	}
+	if first == "" {
+		return "", errors.New("no cgroup found")
+	}
+	return first, nil
+}
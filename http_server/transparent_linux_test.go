@@ -0,0 +1,158 @@
+package http_server
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/danthegoodman1/specificproxy/config"
+)
+
+func TestParseProcNetTCP(t *testing.T) {
+	// 127.0.0.1:8080 and 10.0.0.5:40000 on little endian hosts
+	table := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0100007F:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 123456 1 0000000000000000 100 0 0 10 0
+   1: 0500000A:9C40 0A00000A:01BB 01 00000000:00000000 00:00000000 00000000  1000        0 654321 1 0000000000000000 20 4 30 10 -1
+`
+	if !isLittleEndian() {
+		t.Skip("fixture is little endian")
+	}
+	tests := []struct {
+		src      string
+		expected string
+	}{
+		{"127.0.0.1:8080", "123456"},
+		{"10.0.0.5:40000", "654321"},
+		{"10.0.0.5:40001", ""},
+	}
+	for _, tt := range tests {
+		inode, _ := parseProcNetTCP(strings.NewReader(table), netip.MustParseAddrPort(tt.src))
+		if inode != tt.expected {
+			t.Errorf("%s: expected inode %q, got %q", tt.src, tt.expected, inode)
+		}
+	}
+
+	addr, err := parseProcAddr("B80D0120000000000000000001000000:01BB")
+	if err != nil || addr != netip.MustParseAddrPort("[2001:db8::1]:443") {
+		t.Errorf("expected [2001:db8::1]:443, got %v (%v)", addr, err)
+	}
+	addr, err = parseProcAddr("0000000000000000FFFF00000500000A:9C40")
+	if err != nil || addr != netip.MustParseAddrPort("10.0.0.5:40000") {
+		t.Errorf("expected mapped addresses to be unmapped, got %v (%v)", addr, err)
+	}
+}
+
+func isLittleEndian() bool {
+	addr, _ := parseProcAddr("0100007F:0000")
+	return addr.Addr() == netip.MustParseAddr("127.0.0.1")
+}
+
+func TestParseProcCgroup(t *testing.T) {
+	tests := []struct {
+		content  string
+		expected string
+	}{
+		{"0::/system.slice/crawler.service\n", "/system.slice/crawler.service"},
+		{"12:cpu,cpuacct:/docker/abc\n0::/docker/abc\n", "/docker/abc"},
+		{"12:cpu,cpuacct:/docker/abc\n11:memory:/docker/abc\n", "/docker/abc"},
+	}
+	for _, tt := range tests {
+		if got, err := parseProcCgroup(strings.NewReader(tt.content)); err != nil || got != tt.expected {
+			t.Errorf("%q: expected %q, got %q (%v)", tt.content, tt.expected, got, err)
+		}
+	}
+	if _, err := parseProcCgroup(strings.NewReader("")); err == nil {
+		t.Error("expected an error without cgroups")
+	}
+}
+
+func TestTransparent_CgroupLabels(t *testing.T) {
+	self, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		t.Skip("no /proc/self/cgroup")
+	}
+	cgroup, err := parseProcCgroup(strings.NewReader(string(self)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	echo := startEchoListener(t)
+	hs := &HTTPServer{config: &config.Config{
+		AllowedInterfaces: []string{"lo"},
+		Transparent: config.TransparentConfig{
+			Labels: []config.CgroupLabel{{Cgroup: `^(?P<cgroup>.*)$`}},
+			Rules: []config.TransparentRule{
+				{Labels: map[string]string{"cgroup": cgroup}, IP: "127.0.0.1"},
+			},
+		},
+	}}
+
+	// The test process is the client, so its cgroup selects the rule
+	client := dialTransparent(t, hs, echo.Addr())
+	src := netip.MustParseAddrPort(client.LocalAddr().String())
+	if got, err := clientCgroup(src); err != nil || got != cgroup {
+		t.Fatalf("expected cgroup %q, got %q (%v)", cgroup, got, err)
+	}
+	echoThrough(t, client, client, "labelled")
+}
+
+func TestSocketOwner_RecentOwners(t *testing.T) {
+	echo := startEchoListener(t)
+	client, err := net.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	inode, err := socketInode(netip.MustParseAddrPort(client.LocalAddr().String()))
+	if err != nil {
+		t.Skipf("no socket table: %v", err)
+	}
+	self := strconv.Itoa(os.Getpid())
+	for range 2 {
+		if pid, err := socketOwner(inode); err != nil || pid != self {
+			t.Fatalf("expected the test process %s, got %q (%v)", self, pid, err)
+		}
+	}
+	if pids := recentOwners.candidates(); len(pids) == 0 || pids[0] != self {
+		t.Errorf("expected the test process to be the most recent owner, got %v", pids)
+	}
+
+	var cache ownerCache
+	for i := range maxRecentOwners + 2 {
+		cache.add(strconv.Itoa(i))
+	}
+	cache.add("5")
+	if pids := cache.candidates(); len(pids) != maxRecentOwners || pids[0] != "5" || slices.Contains(pids, "0") {
+		t.Errorf("expected the least recently used pids to be forgotten, got %v", pids)
+	}
+}
+
+func TestOriginalDst_TProxy(t *testing.T) {
+	ln, err := listenTransparent("127.0.0.1:0", config.TransparentRedirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// TPROXY connections keep their destination as the local address
+	dst, err := originalDst(conn, config.TransparentTProxy)
+	if err != nil || dst.String() != ln.Addr().String() {
+		t.Errorf("expected %s, got %v (%v)", ln.Addr(), dst, err)
+	}
+}
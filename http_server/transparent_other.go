@@ -0,0 +1,23 @@
+//go:build !linux
+
+package http_server
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+var errTransparentUnsupported = errors.New("transparent proxying is only supported on Linux")
+
+func listenTransparent(addr, mode string) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
+
+func originalDst(conn net.Conn, mode string) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errTransparentUnsupported
+}
+
+func clientCgroup(src netip.AddrPort) (string, error) {
+	return "", errTransparentUnsupported
+}
@@ -0,0 +1,98 @@
+package http_server
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/config"
+)
+
+// dialTransparent connects a client to a listener and proxies the accepted
+// connection to dst as if it had been redirected
+func dialTransparent(t *testing.T, hs *HTTPServer, dst net.Addr) net.Conn {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hs.proxyTransparent(conn, netip.MustParseAddrPort(dst.String()))
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client
+}
+
+// expectClosed checks that the proxy closed conn without sending anything
+func expectClosed(t *testing.T, conn net.Conn) {
+	t.Helper()
+
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the connection to be closed, got %d bytes and %v", n, err)
+	}
+}
+
+func TestTransparent_Tunnel(t *testing.T) {
+	echo := startEchoListener(t)
+	hs := &HTTPServer{config: &config.Config{
+		AllowedInterfaces: []string{"lo"},
+		Transparent: config.TransparentConfig{Rules: []config.TransparentRule{
+			{Sources: []string{"127.0.0.0/8"}, IP: "127.0.0.1"},
+		}},
+	}}
+
+	client := dialTransparent(t, hs, echo.Addr())
+	echoThrough(t, client, client, "no proxy headers")
+	if hs.tunnels.Len() != 1 {
+		t.Errorf("expected the connection to be tracked as a tunnel, got %d", hs.tunnels.Len())
+	}
+}
+
+func TestTransparent_Rules(t *testing.T) {
+	echo := startEchoListener(t)
+	port := int(netip.MustParseAddrPort(echo.Addr().String()).Port())
+	hs := &HTTPServer{config: &config.Config{
+		AllowedInterfaces: []string{"lo"},
+		RateLimitPolicies: map[string]config.RateLimitConfig{
+			"strict": {Method: "fixed_window", Rate: 1, Period: time.Hour},
+		},
+		Transparent: config.TransparentConfig{Rules: []config.TransparentRule{
+			{Destinations: []string{"192.0.2.0/24"}, IP: "192.0.2.1"},
+			{Ports: []int{port}, IP: "127.0.0.1", RateLimit: "strict"},
+		}},
+	}}
+
+	// The second connection is over the rule's rate limit
+	client := dialTransparent(t, hs, echo.Addr())
+	echoThrough(t, client, client, "first")
+	expectClosed(t, dialTransparent(t, hs, echo.Addr()))
+
+	// Disallowed egress IPs refuse the connection
+	expectClosed(t, dialTransparent(t, hs, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 443}))
+}
+
+func TestTransparent_NoRule(t *testing.T) {
+	echo := startEchoListener(t)
+	hs := &HTTPServer{config: &config.Config{
+		AllowedInterfaces: []string{"lo"},
+		Transparent: config.TransparentConfig{Rules: []config.TransparentRule{
+			{Sources: []string{"192.0.2.0/24"}, IP: "127.0.0.1"},
+		}},
+	}}
+
+	// Unmatched connections pick from the available IPs, loopback isn't one
+	expectClosed(t, dialTransparent(t, hs, echo.Addr()))
+}
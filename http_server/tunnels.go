@@ -0,0 +1,103 @@
+package http_server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// tunnel is a hijacked client connection that http.Server no longer tracks
+type tunnel struct {
+	conn     net.Conn
+	host     string
+	egressIP string
+	started  time.Time
+}
+
+// tunnelRegistry tracks every hijacked connection so they can be drained on
+// shutdown. The zero value is ready to use.
+type tunnelRegistry struct {
+	mu      sync.Mutex
+	tunnels map[*tunnel]struct{}
+	// changed is closed and replaced whenever a tunnel is removed
+	changed chan struct{}
+}
+
+// track registers conn, returning a func that must be called once the tunnel is done
+func (tr *tunnelRegistry) track(conn net.Conn, host string, egressIP net.IP) func() {
+	t := &tunnel{
+		conn:     conn,
+		host:     host,
+		egressIP: egressIP.String(),
+		started:  time.Now(),
+	}
+
+	tr.mu.Lock()
+	if tr.tunnels == nil {
+		tr.tunnels = make(map[*tunnel]struct{})
+	}
+	tr.tunnels[t] = struct{}{}
+	tr.mu.Unlock()
+
+	return func() {
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+		delete(tr.tunnels, t)
+		if tr.changed != nil {
+			close(tr.changed)
+			tr.changed = nil
+		}
+	}
+}
+
+// Len returns the number of active tunnels
+func (tr *tunnelRegistry) Len() int {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return len(tr.tunnels)
+}
+
+// wait blocks until all tunnels are done or ctx is done, returning false on timeout
+func (tr *tunnelRegistry) wait(ctx context.Context) bool {
+	for {
+		tr.mu.Lock()
+		if len(tr.tunnels) == 0 {
+			tr.mu.Unlock()
+			return true
+		}
+		if tr.changed == nil {
+			tr.changed = make(chan struct{})
+		}
+		changed := tr.changed
+		tr.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// closeAll force closes every remaining tunnel, returning what was cut
+func (tr *tunnelRegistry) closeAll() []*tunnel {
+	return tr.closeWhere(func(*tunnel) bool { return true })
+}
+
+// closeWhere force closes the tunnels matching match, returning what was cut
+func (tr *tunnelRegistry) closeWhere(match func(*tunnel) bool) []*tunnel {
+	tr.mu.Lock()
+	var closed []*tunnel
+	for t := range tr.tunnels {
+		if match(t) {
+			closed = append(closed, t)
+		}
+	}
+	tr.mu.Unlock()
+
+	for _, t := range closed {
+		t.conn.Close()
+	}
+	return closed
+}
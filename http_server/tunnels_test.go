@@ -0,0 +1,238 @@
+package http_server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/config"
+)
+
+// startEchoListener starts a TCP server on loopback echoing everything back
+func startEchoListener(t *testing.T) net.Listener {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln
+}
+
+// openConnectTunnel sends a CONNECT for target through the proxy and returns
+// the established connection
+func openConnectTunnel(t *testing.T, proxyAddr, target string, header http.Header) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: target},
+		Host:   target,
+		Header: header,
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("failed to write CONNECT: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatalf("failed to read CONNECT response: %v", err)
+	}
+	return conn, reader, resp
+}
+
+func newDrainTestServer(t *testing.T) (*HTTPServer, *httptest.Server) {
+	t.Helper()
+
+	hs := &HTTPServer{config: &config.Config{AllowedInterfaces: []string{"lo"}}}
+	proxy := httptest.NewServer(hs.newHandler())
+	t.Cleanup(proxy.Close)
+	return hs, proxy
+}
+
+func TestDrain_HealthAndRejects(t *testing.T) {
+	hs, proxy := newDrainTestServer(t)
+
+	resp, err := http.Get(proxy.URL + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected health 200 before drain, got %d", resp.StatusCode)
+	}
+
+	hs.StartDrain()
+
+	resp, err = http.Get(proxy.URL + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected health 503 while draining, got %d", resp.StatusCode)
+	}
+
+	echo := startEchoListener(t)
+	_, _, connectResp := openConnectTunnel(t, proxy.Listener.Addr().String(), echo.Addr().String(), http.Header{
+		"X-Egress-Ip": {"127.0.0.1"},
+	})
+	if connectResp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected CONNECT 503 while draining, got %d", connectResp.StatusCode)
+	}
+}
+
+func TestDrain_WaitsForTunnels(t *testing.T) {
+	hs, proxy := newDrainTestServer(t)
+	echo := startEchoListener(t)
+
+	conn, _, resp := openConnectTunnel(t, proxy.Listener.Addr().String(), echo.Addr().String(), http.Header{
+		"X-Egress-Ip": {"127.0.0.1"},
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected CONNECT 200, got %d", resp.StatusCode)
+	}
+	if hs.tunnels.Len() != 1 {
+		t.Fatalf("expected 1 tunnel, got %d", hs.tunnels.Len())
+	}
+
+	// The client finishes on its own before the deadline
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		conn.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	hs.drainTunnels(ctx)
+	if time.Since(start) > 2*time.Second {
+		t.Error("expected drain to finish once the tunnel closed")
+	}
+	if hs.tunnels.Len() != 0 {
+		t.Errorf("expected 0 tunnels, got %d", hs.tunnels.Len())
+	}
+}
+
+func TestDrain_ForceClosesTunnels(t *testing.T) {
+	hs, proxy := newDrainTestServer(t)
+	echo := startEchoListener(t)
+
+	conn, reader, resp := openConnectTunnel(t, proxy.Listener.Addr().String(), echo.Addr().String(), http.Header{
+		"X-Egress-Ip": {"127.0.0.1"},
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected CONNECT 200, got %d", resp.StatusCode)
+	}
+
+	// The tunnel works before the drain
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected echo before drain, got %q (%v)", buf, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	hs.drainTunnels(ctx)
+
+	// The client sees the tunnel closed
+	if _, err := reader.ReadByte(); err == nil {
+		t.Error("expected tunnel to be closed after drain deadline")
+	}
+}
+
+// newShutdownTestServer serves the proxy with its own server, so Shutdown
+// stops it, returning the URL of the proxy
+func newShutdownTestServer(t *testing.T) (*HTTPServer, string) {
+	t.Helper()
+
+	hs := &HTTPServer{config: &config.Config{AllowedInterfaces: []string{"lo"}}}
+	hs.server = &http.Server{Handler: hs.newHandler(), Protocols: proxyProtocols()}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hs.server.Serve(ln)
+	t.Cleanup(func() { hs.server.Close() })
+	return hs, "http://" + ln.Addr().String()
+}
+
+func TestShutdown_HTTP2Tunnels(t *testing.T) {
+	echo := startEchoListener(t)
+	client := newH2CClient()
+	t.Cleanup(client.CloseIdleConnections)
+
+	// A tunnel keeps working while the server drains, until the client ends it
+	hs, proxyURL := newShutdownTestServer(t)
+	w, resp := openStreamTunnel(t, client, proxyURL, echo.Addr().String(), http.Header{"X-Egress-IP": {"127.0.0.1"}})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() { done <- hs.Shutdown(ctx) }()
+
+	time.Sleep(100 * time.Millisecond)
+	echoThrough(t, w, resp.Body, "draining")
+	w.Close()
+	resp.Body.Close()
+	if err := <-done; err != nil {
+		t.Errorf("expected a clean shutdown once the tunnel ended, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected shutdown to finish with the tunnel, took %v", elapsed)
+	}
+
+	// A tunnel still open at the deadline is force closed and the server
+	// shuts down without waiting for its connection
+	hs, proxyURL = newShutdownTestServer(t)
+	_, resp = openStreamTunnel(t, client, proxyURL, echo.Addr().String(), http.Header{"X-Egress-IP": {"127.0.0.1"}})
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if err := hs.Shutdown(ctx); err != nil {
+		t.Errorf("expected shutdown to succeed after force closing the tunnel, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond+shutdownGrace {
+		t.Errorf("expected shutdown within the deadline and grace, took %v", elapsed)
+	}
+	ended := make(chan struct{})
+	go func() {
+		io.ReadAll(resp.Body)
+		close(ended)
+	}()
+	select {
+	case <-ended:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the force closed stream to end")
+	}
+}
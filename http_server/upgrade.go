@@ -0,0 +1,226 @@
+package http_server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// isUpgradeRequest checks if the request asks to switch protocols, e.g. WebSocket
+func isUpgradeRequest(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" && headerHasToken(r.Header, "Connection", "upgrade")
+}
+
+// headerHasToken checks if the comma separated header contains token, case insensitive
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleUpgrade proxies an HTTP Upgrade request. The handshake is forwarded
+// over a connection dialed from the egress IP, and after a 101 response both
+// connections are relayed byte for byte.
+func (hs *HTTPServer) handleUpgrade(w http.ResponseWriter, r *http.Request, localIP net.IP) {
+	zerolog.Ctx(r.Context()).Debug().Str("url", r.URL.String()).Str("egress_ip", localIP.String()).Msg("handling upgrade request")
+
+	targetAddr, useTLS := upgradeTarget(r.URL)
+	timeouts := hs.timeoutsFor(r.Host)
+
+	dialer := newDialer(localIP, timeouts)
+	targetConn, err := tracedDial(r.Context(), dialer, targetAddr)
+	if err != nil {
+		hs.recordError(localIP, r.Host, err)
+		zerolog.Ctx(r.Context()).Error().Err(err).Str("host", targetAddr).Msg("failed to connect to target")
+		http.Error(w, fmt.Sprintf("failed to connect to target: %v", err), http.StatusBadGateway)
+		return
+	}
+	defer targetConn.Close()
+
+	if useTLS {
+		tlsConfig := &tls.Config{}
+		if hs.upstreamTLS != nil {
+			tlsConfig = hs.upstreamTLS.Clone()
+		}
+		tlsConfig.ServerName = r.URL.Hostname()
+		tlsConn := tls.Client(targetConn, tlsConfig)
+		spanCtx, span := startSpan(r.Context(), "tls", attribute.String("server.address", targetAddr))
+		handshakeCtx, cancel := context.WithCancel(spanCtx)
+		if timeouts.TLSHandshake > 0 {
+			handshakeCtx, cancel = context.WithTimeout(spanCtx, timeouts.TLSHandshake)
+		}
+		err := tlsConn.HandshakeContext(handshakeCtx)
+		cancel()
+		endSpan(span, err)
+		if err != nil {
+			zerolog.Ctx(r.Context()).Error().Err(err).Str("host", targetAddr).Msg("failed TLS handshake with target")
+			http.Error(w, fmt.Sprintf("failed TLS handshake with target: %v", err), http.StatusBadGateway)
+			return
+		}
+		targetConn = tlsConn
+	}
+
+	// Create the outgoing handshake, keeping the upgrade headers that
+	// removeHopByHopHeaders would otherwise strip
+	outReq := r.Clone(r.Context())
+	outReq.RequestURI = ""
+
+	rules := hs.matchingHeaderRules(r, localIP)
+	templateData := newHeaderTemplateData(r, localIP)
+	for _, rule := range rules {
+		applyHeaderActions(r.Context(), outReq.Header, rule.Request, templateData)
+	}
+	upgrade := outReq.Header.Get("Upgrade")
+	removeRequestHopByHopHeaders(outReq.Header)
+	hs.addProxyHeaders(outReq.Header, r)
+	outReq.Header.Set("Connection", "Upgrade")
+	outReq.Header.Set("Upgrade", upgrade)
+
+	if err := outReq.Write(targetConn); err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Str("url", r.URL.String()).Msg("failed to send upgrade request")
+		http.Error(w, fmt.Sprintf("proxy request failed: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	if timeouts.ResponseHeader > 0 {
+		targetConn.SetReadDeadline(time.Now().Add(timeouts.ResponseHeader))
+	}
+	targetReader := bufio.NewReader(targetConn)
+	resp, err := http.ReadResponse(targetReader, outReq)
+	targetConn.SetReadDeadline(time.Time{})
+	if err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Str("url", r.URL.String()).Msg("failed to read upgrade response")
+		http.Error(w, fmt.Sprintf("proxy request failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	hs.recordStatus(localIP, r.Host, resp.StatusCode)
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// Upstream declined the upgrade, forward the response as is
+		copyResponseHeader(w.Header(), resp.Header)
+		removeHopByHopHeaders(w.Header())
+		hs.addResponseVia(w.Header(), resp)
+		hs.setEgressHeaders(w.Header(), localIP)
+		for _, rule := range rules {
+			applyHeaderActions(r.Context(), w.Header(), rule.Response, templateData)
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Msg("failed to hijack connection")
+		http.Error(w, fmt.Sprintf("failed to hijack connection: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer clientConn.Close()
+	defer hs.tunnels.track(clientConn, r.Host, localIP)()
+
+	upgrade = resp.Header.Get("Upgrade")
+	removeHopByHopHeaders(resp.Header)
+	// The response is written to the hijacked connection, bypassing the
+	// request ID set on w
+	if id := w.Header().Get("X-Request-Id"); id != "" {
+		resp.Header.Set("X-Request-Id", id)
+	}
+	hs.addResponseVia(resp.Header, resp)
+	for _, rule := range rules {
+		applyHeaderActions(r.Context(), resp.Header, rule.Response, templateData)
+	}
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Upgrade", upgrade)
+	hs.setEgressHeaders(resp.Header, localIP)
+
+	if err := writeResponseHeader(clientConn, resp.Status, resp.Header); err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Msg("failed to send upgrade response")
+		return
+	}
+
+	// Either side may have sent data right after the handshake
+	ctx, cancel := tunnelContext(r.Context(), timeouts)
+	defer cancel()
+	idle := newIdleTracker(timeouts.TunnelIdle)
+	th := throttleFrom(r.Context())
+	relay(ctx,
+		th.conn(ctx, idle.wrap(&bufferedConn{Conn: clientConn, reader: clientBuf.Reader}), true),
+		th.conn(ctx, idle.wrap(&bufferedConn{Conn: targetConn, reader: targetReader}), false),
+	)
+}
+
+// upgradeTarget returns the dial address for u and whether TLS is needed
+func upgradeTarget(u *url.URL) (string, bool) {
+	useTLS := u.Scheme == "https" || u.Scheme == "wss"
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if useTLS {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port), useTLS
+}
+
+// writeResponseHeader writes a raw HTTP/1.1 response header block to w
+func writeResponseHeader(w io.Writer, status string, h http.Header) error {
+	if _, err := fmt.Fprintf(w, "HTTP/1.1 %s\r\n", status); err != nil {
+		return err
+	}
+	if err := h.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// bufferedConn is a net.Conn that reads through a bufio.Reader, so bytes
+// buffered before a handoff are not lost
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// relay copies data in both directions until either side is done
+func relay(ctx context.Context, client, target io.ReadWriter) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		io.Copy(target, client)
+		cancel()
+	}()
+
+	go func() {
+		io.Copy(client, target)
+		cancel()
+	}()
+
+	<-ctx.Done()
+}
@@ -0,0 +1,168 @@
+package http_server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/config"
+)
+
+// websocketAccept computes Sec-WebSocket-Accept for a handshake key
+func websocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// newWebSocketEchoServer starts a server running websocketEchoHandler
+func newWebSocketEchoServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(websocketEchoHandler())
+	t.Cleanup(server.Close)
+	return server
+}
+
+// websocketEchoHandler completes the WebSocket handshake and then echoes raw
+// bytes back, which is all the proxy can observe
+func websocketEchoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			http.Error(w, "expected websocket upgrade", http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("X-Egress-IP") != "" {
+			http.Error(w, "control header leaked", http.StatusBadRequest)
+			return
+		}
+
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprintf(buf, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+			websocketAccept(r.Header.Get("Sec-WebSocket-Key")))
+		buf.Flush()
+		io.Copy(conn, buf)
+	})
+}
+
+// sendUpgradeRequest writes a WebSocket handshake for target through the proxy connection
+func sendUpgradeRequest(t *testing.T, conn net.Conn, target string, upgrade string) (*http.Response, *bufio.Reader) {
+	t.Helper()
+
+	req, _ := http.NewRequest("GET", target, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", upgrade)
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("X-Egress-IP", "127.0.0.1")
+
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatalf("failed to write upgrade request: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatalf("failed to read upgrade response: %v", err)
+	}
+	return resp, reader
+}
+
+func TestUpgrade_WebSocketEcho(t *testing.T) {
+	upstream := newWebSocketEchoServer(t)
+
+	hs := &HTTPServer{config: &config.Config{AllowedInterfaces: []string{"lo"}}}
+	proxy := httptest.NewServer(http.HandlerFunc(hs.handleProxy))
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	resp, reader := sendUpgradeRequest(t, conn, upstream.URL+"/ws", "websocket")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected status 101, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != websocketAccept("dGhlIHNhbXBsZSBub25jZQ==") {
+		t.Error("expected Sec-WebSocket-Accept to be forwarded")
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		t.Errorf("expected Upgrade: websocket, got %q", resp.Header.Get("Upgrade"))
+	}
+
+	for _, msg := range []string{"hello", "world"} {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			t.Fatalf("failed to read echo: %v", err)
+		}
+		if string(buf) != msg {
+			t.Errorf("expected echo %q, got %q", msg, buf)
+		}
+	}
+}
+
+func TestUpgrade_Declined(t *testing.T) {
+	upstream := newWebSocketEchoServer(t)
+
+	hs := &HTTPServer{config: &config.Config{AllowedInterfaces: []string{"lo"}}}
+	proxy := httptest.NewServer(http.HandlerFunc(hs.handleProxy))
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	resp, _ := sendUpgradeRequest(t, conn, upstream.URL+"/ws", "h2c")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected declined upgrade to return 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestIsUpgradeRequest(t *testing.T) {
+	tests := []struct {
+		connection string
+		upgrade    string
+		expected   bool
+	}{
+		{"Upgrade", "websocket", true},
+		{"keep-alive, Upgrade", "websocket", true},
+		{"keep-alive", "websocket", false},
+		{"Upgrade", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		if tt.connection != "" {
+			r.Header.Set("Connection", tt.connection)
+		}
+		if tt.upgrade != "" {
+			r.Header.Set("Upgrade", tt.upgrade)
+		}
+		if result := isUpgradeRequest(r); result != tt.expected {
+			t.Errorf("isUpgradeRequest(Connection=%q, Upgrade=%q) = %v, want %v",
+				tt.connection, tt.upgrade, result, tt.expected)
+		}
+	}
+}
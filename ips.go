@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/danthegoodman1/specificproxy/config"
+)
+
+// runIPs prints the egress IPs available with the config, returning the exit code
+func runIPs(args []string) int {
+	fs := flag.NewFlagSet("ips", flag.ContinueOnError)
+	configPath := configFlag(fs)
+	asJSON := fs.Bool("json", false, "print JSON like the /ips endpoint")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := loadConfig(*configPath, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	ips, err := cfg.GetAvailableIPs()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to get available IPs: %v\n", err)
+		return 1
+	}
+
+	if *asJSON {
+		if ips == nil {
+			ips = []config.IPInfo{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(map[string]any{"ips": ips})
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INTERFACE\tIP\tVERSION\tSTATE\tWEIGHT")
+	for _, ip := range ips {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\n", ip.Interface, ip.IP, ip.Version, ip.State, ip.Weight)
+	}
+	w.Flush()
+	return 0
+}
@@ -1,61 +1,59 @@
 package main
 
 import (
-	"context"
 	"fmt"
 	"os"
-	"os/signal"
-	"syscall"
-	"time"
 
-	"github.com/danthegoodman1/specificproxy/config"
 	"github.com/danthegoodman1/specificproxy/gologger"
-	"github.com/danthegoodman1/specificproxy/http_server"
-	"github.com/danthegoodman1/specificproxy/utils"
+	"github.com/rs/zerolog"
 )
 
 var logger = gologger.NewLogger()
 
-func main() {
-	logger.Debug().Msg("starting specificproxy")
-
-	// Load configuration
-	configPath := os.Getenv("CONFIG_PATH")
-	if configPath == "" {
-		configPath = "config.yaml"
-	}
+const usage = `usage: specificproxy <command> [flags]
 
-	cfg, err := config.LoadConfig(configPath)
-	if err != nil {
-		logger.Fatal().Err(err).Str("path", configPath).Msg("failed to load config")
-	}
-
-	listenAddr := os.Getenv("LISTEN_ADDR")
-	if listenAddr == "" {
-		listenAddr = ":8080"
-	}
+Commands:
+  serve                start the proxy (default)
+  ips                  print the available egress IPs
+  check <ip> <url>     fetch a URL from a specific egress IP
+  validate [file]      check a config file without starting the server
+  version              print the version
 
-	httpServer := http_server.StartHTTPServer(listenAddr, listenAddr, cfg)
+Run "specificproxy <command> -h" for the flags of a command.
+`
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	<-c
-	logger.Warn().Msg("received shutdown signal!")
-
-	// For AWS ALB needing some time to de-register pod
-	// Convert the time to seconds
-	sleepTime := utils.GetEnvOrDefaultInt("SHUTDOWN_SLEEP_SEC", 0)
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
 
-	logger.Info().Msg(fmt.Sprintf("sleeping for %ds before exiting", sleepTime))
+// run dispatches to a subcommand, returning the exit code
+func run(args []string) int {
+	// Without a command, or with only flags, serve like before subcommands existed
+	if len(args) == 0 || (len(args[0]) > 0 && args[0][0] == '-' && args[0] != "-h" && args[0] != "--help") {
+		return runServe(args)
+	}
 
-	time.Sleep(time.Second * time.Duration(sleepTime))
-	logger.Info().Msg(fmt.Sprintf("slept for %ds, exiting", sleepTime))
+	// Logs go to stdout, keep the output of one-off commands clean
+	if args[0] != "serve" {
+		zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-	defer cancel()
-	if err := httpServer.Shutdown(ctx); err != nil {
-		logger.Error().Err(err).Msg("failed to shutdown HTTP server")
-	} else {
-		logger.Info().Msg("successfully shutdown HTTP server")
+	switch args[0] {
+	case "serve":
+		return runServe(args[1:])
+	case "ips":
+		return runIPs(args[1:])
+	case "check":
+		return runCheck(args[1:])
+	case "validate":
+		return runValidate(args[1:])
+	case "version":
+		return runVersion(args[1:])
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", args[0], usage)
+		return 2
 	}
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a config file for a test and returns its path
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig_Precedence(t *testing.T) {
+	path := writeConfig(t, `allowed_interfaces: [lo]
+listen_addr: ":1111"
+drain_timeout: 5s
+`)
+	tests := []struct {
+		name         string
+		env          map[string]string
+		args         []string
+		listenAddr   string
+		drainTimeout time.Duration
+	}{
+		{"config file", nil, nil, ":1111", 5 * time.Second},
+		{"env over file", map[string]string{"LISTEN_ADDR": ":2222", "DRAIN_TIMEOUT_SEC": "7"}, nil, ":2222", 7 * time.Second},
+		{"flags over env", map[string]string{"LISTEN_ADDR": ":2222", "DRAIN_TIMEOUT_SEC": "7"}, []string{"-listen", ":3333", "-drain-timeout", "9s"}, ":3333", 9 * time.Second},
+		{"flags over file", nil, []string{"-listen", ":3333"}, ":3333", 5 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			flags := newServeFlags()
+			if err := flags.fs.Parse(append([]string{"-config", path}, tt.args...)); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := loadConfig(*flags.configPath, flags.apply)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.ListenAddr != tt.listenAddr || cfg.DrainTimeout != tt.drainTimeout {
+				t.Errorf("expected %s and %v, got %s and %v", tt.listenAddr, tt.drainTimeout, cfg.ListenAddr, cfg.DrainTimeout)
+			}
+		})
+	}
+}
+
+func TestRun_InvalidConfig(t *testing.T) {
+	// Loads fine, but fails validation
+	invalid := writeConfig(t, `allowed_interfaces: [lo]
+sessions:
+  ttl: -1s
+`)
+	for _, args := range [][]string{
+		{"-config", invalid},
+		{"serve", "-config", invalid},
+		{"ips", "-config", invalid},
+		{"check", "-config", invalid, "127.0.0.1", "http://127.0.0.1/"},
+		{"validate", invalid},
+	} {
+		if code := run(args); code != 1 {
+			t.Errorf("%v: expected exit code 1, got %d", args, code)
+		}
+	}
+
+	// Env overrides are validated too
+	valid := writeConfig(t, "allowed_interfaces: [lo]\n")
+	t.Setenv("LISTEN_ADDR", "not an address")
+	for _, args := range [][]string{
+		{"ips", "-config", valid},
+		{"validate", valid},
+	} {
+		if code := run(args); code != 1 {
+			t.Errorf("%v with an invalid LISTEN_ADDR: expected exit code 1, got %d", args, code)
+		}
+	}
+}
+
+func TestRun_Commands(t *testing.T) {
+	valid := writeConfig(t, "allowed_interfaces: [lo]\n")
+	tests := []struct {
+		args []string
+		code int
+	}{
+		{[]string{"version"}, 0},
+		{[]string{"help"}, 0},
+		{[]string{"validate", valid}, 0},
+		{[]string{"ips", "-config", valid, "-json"}, 0},
+		{[]string{"unknown"}, 2},
+		{[]string{"ips", "-unknown"}, 2},
+		{[]string{"check", "-config", valid, "127.0.0.1"}, 2},
+		{[]string{"check", "-config", valid, "not-an-ip", "http://127.0.0.1/"}, 2},
+		{[]string{"validate", valid, valid}, 2},
+		{[]string{"serve", "extra"}, 2},
+	}
+	for _, tt := range tests {
+		if code := run(tt.args); code != tt.code {
+			t.Errorf("%v: expected exit code %d, got %d", tt.args, tt.code, code)
+		}
+	}
+}
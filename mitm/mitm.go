@@ -0,0 +1,268 @@
+package mitm
+
+import (
+	"container/list"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// caValidity is how long a generated CA is valid for
+	caValidity = 10 * 365 * 24 * time.Hour
+	// leafValidity is how long issued leaf certificates are valid for
+	leafValidity = 24 * time.Hour
+	// leafRenewBefore is how long before expiry a cached leaf is reissued
+	leafRenewBefore = time.Hour
+	// maxLeaves is how many leaves are cached, the least recently used
+	// are issued again when needed
+	maxLeaves = 1000
+)
+
+// Authority issues leaf certificates for intercepted hosts, signed by a local CA
+type Authority struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+
+	mu sync.Mutex
+	// leaves indexes the elements of lru by host
+	leaves map[string]*list.Element
+	// lru holds the cached leaves as *cachedLeaf, most recently used first
+	lru *list.List
+}
+
+// cachedLeaf is a leaf certificate cached for host
+type cachedLeaf struct {
+	host string
+	cert *tls.Certificate
+}
+
+// NewAuthority generates a new in-memory CA
+func NewAuthority() (*Authority, error) {
+	certPEM, keyPEM, err := generateCA()
+	if err != nil {
+		return nil, err
+	}
+	return parseAuthority(certPEM, keyPEM)
+}
+
+// LoadOrCreate loads the CA from the given PEM files, generating and writing
+// a new CA if neither file exists
+func LoadOrCreate(certPath, keyPath string) (*Authority, error) {
+	certPEM, certErr := os.ReadFile(certPath)
+	keyPEM, keyErr := os.ReadFile(keyPath)
+
+	switch {
+	case certErr == nil && keyErr == nil:
+		return parseAuthority(certPEM, keyPEM)
+	case errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist):
+		// Generate below
+	case certErr != nil && !errors.Is(certErr, os.ErrNotExist):
+		return nil, fmt.Errorf("error reading CA cert: %w", certErr)
+	case keyErr != nil && !errors.Is(keyErr, os.ErrNotExist):
+		return nil, fmt.Errorf("error reading CA key: %w", keyErr)
+	default:
+		return nil, fmt.Errorf("only one of CA cert %q and key %q exists", certPath, keyPath)
+	}
+
+	certPEM, keyPEM, err := generateCA()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return nil, fmt.Errorf("error writing CA key: %w", err)
+	}
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return nil, fmt.Errorf("error writing CA cert: %w", err)
+	}
+	return parseAuthority(certPEM, keyPEM)
+}
+
+// Certificate returns the CA certificate that clients must trust
+func (a *Authority) Certificate() *x509.Certificate {
+	return a.cert
+}
+
+// TLSConfig returns a server TLS config that presents a certificate for
+// host, the CONNECT target. Handshakes with an SNI name for another host are
+// refused, so clients can't have certificates issued for arbitrary names.
+func (a *Authority) TLSConfig(host string) *tls.Config {
+	return &tls.Config{
+		// Intercepted connections are served with HTTP/1.1 only
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" && normalizeHost(hello.ServerName) != normalizeHost(host) {
+				return nil, fmt.Errorf("SNI name %q doesn't match CONNECT host %q", hello.ServerName, host)
+			}
+			return a.CertFor(host)
+		},
+	}
+}
+
+// CertFor returns a leaf certificate for host, issuing and caching one if needed
+func (a *Authority) CertFor(host string) (*tls.Certificate, error) {
+	host = normalizeHost(host)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if elem, ok := a.leaves[host]; ok {
+		leaf := elem.Value.(*cachedLeaf)
+		if time.Until(leaf.cert.Leaf.NotAfter) > leafRenewBefore {
+			a.lru.MoveToFront(elem)
+			return leaf.cert, nil
+		}
+		a.lru.Remove(elem)
+		delete(a.leaves, host)
+	}
+
+	cert, err := a.issue(host)
+	if err != nil {
+		return nil, err
+	}
+	a.leaves[host] = a.lru.PushFront(&cachedLeaf{host: host, cert: cert})
+	if a.lru.Len() > maxLeaves {
+		oldest := a.lru.Remove(a.lru.Back()).(*cachedLeaf)
+		delete(a.leaves, oldest.host)
+	}
+	return cert, nil
+}
+
+// normalizeHost strips the port of host and lowercases it
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// issue signs a new leaf certificate for host
+func (a *Authority) issue(host string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("error generating leaf key: %w", err)
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, a.cert, &key.PublicKey, a.key)
+	if err != nil {
+		return nil, fmt.Errorf("error signing leaf certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, a.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// generateCA creates a new self-signed CA, returning PEM encoded cert and key
+func generateCA() ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error generating CA key: %w", err)
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "specificproxy CA", Organization: []string{"specificproxy"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating CA certificate: %w", err)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// parseAuthority builds an Authority from PEM encoded cert and key
+func parseAuthority(certPEM, keyPEM []byte) (*Authority, error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing CA key pair: %w", err)
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing CA certificate: %w", err)
+	}
+	if !cert.IsCA {
+		return nil, errors.New("CA certificate is not a CA")
+	}
+
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("CA key is not a signing key")
+	}
+
+	return &Authority{
+		cert:   cert,
+		key:    signer,
+		leaves: make(map[string]*list.Element),
+		lru:    list.New(),
+	}, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("error generating serial number: %w", err)
+	}
+	return serial, nil
+}
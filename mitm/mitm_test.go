@@ -0,0 +1,182 @@
+package mitm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOrCreate(t *testing.T) {
+	tmpDir := t.TempDir()
+	certPath := filepath.Join(tmpDir, "ca.pem")
+	keyPath := filepath.Join(tmpDir, "ca-key.pem")
+
+	// First load generates the CA
+	a1, err := LoadOrCreate(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("failed to create CA: %v", err)
+	}
+	if _, err := os.Stat(certPath); err != nil {
+		t.Errorf("expected CA cert to be written: %v", err)
+	}
+	if _, err := os.Stat(keyPath); err != nil {
+		t.Errorf("expected CA key to be written: %v", err)
+	}
+
+	// Second load reuses it
+	a2, err := LoadOrCreate(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("failed to load CA: %v", err)
+	}
+	if !a1.Certificate().Equal(a2.Certificate()) {
+		t.Error("expected the same CA to be loaded")
+	}
+}
+
+func TestLoadOrCreate_MissingKey(t *testing.T) {
+	tmpDir := t.TempDir()
+	certPath := filepath.Join(tmpDir, "ca.pem")
+	keyPath := filepath.Join(tmpDir, "ca-key.pem")
+
+	if _, err := LoadOrCreate(certPath, keyPath); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(keyPath)
+
+	if _, err := LoadOrCreate(certPath, keyPath); err == nil {
+		t.Error("expected error when only the cert exists")
+	}
+}
+
+func TestCertFor(t *testing.T) {
+	a, err := NewAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(a.Certificate())
+
+	tests := []struct {
+		host   string
+		verify string
+	}{
+		{"example.com", "example.com"},
+		{"example.com:443", "example.com"},
+		{"127.0.0.1", "127.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		leaf, err := a.CertFor(tt.host)
+		if err != nil {
+			t.Fatalf("CertFor(%q): %v", tt.host, err)
+		}
+		_, err = leaf.Leaf.Verify(x509.VerifyOptions{
+			DNSName: tt.verify,
+			Roots:   pool,
+		})
+		if err != nil {
+			t.Errorf("CertFor(%q) did not verify for %q: %v", tt.host, tt.verify, err)
+		}
+	}
+}
+
+func TestCertFor_Cached(t *testing.T) {
+	a, err := NewAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf1, err := a.CertFor("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf2, err := a.CertFor("EXAMPLE.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf1 != leaf2 {
+		t.Error("expected cached leaf certificate")
+	}
+
+	leaf3, err := a.CertFor("other.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf1 == leaf3 {
+		t.Error("expected different leaf for different host")
+	}
+}
+
+func TestCertFor_Bounded(t *testing.T) {
+	a, err := NewAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := a.CertFor("host-0.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= maxLeaves; i++ {
+		if _, err := a.CertFor(fmt.Sprintf("host-%d.example.com", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(a.leaves) != maxLeaves || a.lru.Len() != maxLeaves {
+		t.Fatalf("expected %d cached leaves, got %d", maxLeaves, len(a.leaves))
+	}
+	if _, ok := a.leaves["host-0.example.com"]; ok {
+		t.Error("expected the least recently used leaf to be evicted")
+	}
+	if again, _ := a.CertFor("host-0.example.com"); again == first {
+		t.Error("expected an evicted leaf to be issued again")
+	}
+}
+
+func TestTLSConfig_SNI(t *testing.T) {
+	a, err := NewAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(a.Certificate())
+
+	tests := []struct {
+		serverName string
+		ok         bool
+	}{
+		{"", true},
+		{"EXAMPLE.com", true},
+		{"other.example.com", false},
+	}
+	for _, tt := range tests {
+		serverConn, clientConn := net.Pipe()
+		go tls.Server(serverConn, a.TLSConfig("example.com:443")).Handshake()
+
+		client := tls.Client(clientConn, &tls.Config{
+			ServerName:         tt.serverName,
+			RootCAs:            pool,
+			InsecureSkipVerify: tt.serverName == "",
+		})
+		err := client.Handshake()
+		if tt.ok && err != nil {
+			t.Errorf("SNI %q: expected the handshake to succeed: %v", tt.serverName, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("SNI %q: expected the handshake to be refused", tt.serverName)
+		}
+		if tt.ok && err == nil && client.ConnectionState().PeerCertificates[0].DNSNames[0] != "example.com" {
+			t.Errorf("SNI %q: expected a certificate for the CONNECT host", tt.serverName)
+		}
+		clientConn.Close()
+		serverConn.Close()
+	}
+	if _, ok := a.leaves["other.example.com"]; ok {
+		t.Error("expected no certificate to be issued for a mismatched SNI name")
+	}
+}
@@ -0,0 +1,254 @@
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ChunkSize caps how many bytes a throttled read takes at once, so concurrent
+// readers sharing a ByteBucket take turns instead of one starving the others
+const ChunkSize = 32 * 1024
+
+// ByteBucket is a token bucket over bytes. Waiters reserve tokens in arrival
+// order and the balance may go negative, so bandwidth is shared fairly
+// between everyone using the same bucket.
+type ByteBucket struct {
+	mu         sync.Mutex
+	tokens     float64
+	maxTokens  float64
+	refillRate float64 // bytes per second
+	lastRefill time.Time
+}
+
+// NewByteBucket creates a bucket allowing bytesPerSecond, with a burst of one
+// second worth of bytes (at least ChunkSize)
+func NewByteBucket(bytesPerSecond int64) *ByteBucket {
+	maxTokens := float64(max(bytesPerSecond, ChunkSize))
+	return &ByteBucket{
+		tokens:     maxTokens,
+		maxTokens:  maxTokens,
+		refillRate: float64(bytesPerSecond),
+		lastRefill: time.Now(),
+	}
+}
+
+// WaitN takes n bytes from the bucket, blocking until they are available or ctx is done
+func (b *ByteBucket) WaitN(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	elapsed := now.Sub(b.lastRefill).Seconds()
+	b.lastRefill = now
+
+	// Refill tokens
+	b.tokens += elapsed * b.refillRate
+	if b.tokens > b.maxTokens {
+		b.tokens = b.maxTokens
+	}
+
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.refillRate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ByteCounters counts bytes through the proxy. Up is client to destination,
+// down is destination to client.
+type ByteCounters struct {
+	Up   atomic.Int64
+	Down atomic.Int64
+}
+
+// CounterSnapshot is a point in time copy of ByteCounters
+type CounterSnapshot struct {
+	UpBytes   int64 `json:"up_bytes"`
+	DownBytes int64 `json:"down_bytes"`
+}
+
+// Snapshot returns the current counter values
+func (c *ByteCounters) Snapshot() CounterSnapshot {
+	return CounterSnapshot{
+		UpBytes:   c.Up.Load(),
+		DownBytes: c.Down.Load(),
+	}
+}
+
+// bucketEntry wraps a bucket with TTL tracking
+type bucketEntry struct {
+	bucket   *ByteBucket
+	lastUsed time.Time
+}
+
+// counterEntry wraps counters with TTL tracking. total is the byte count
+// seen by the last cleanup, so counters still moving bytes aren't idle.
+type counterEntry struct {
+	counters *ByteCounters
+	total    int64
+	lastUsed time.Time
+}
+
+// BandwidthStore holds shared byte buckets and throughput counters
+type BandwidthStore struct {
+	mu       sync.Mutex
+	buckets  map[string]*bucketEntry
+	counters map[string]*counterEntry
+	stopCh   chan struct{}
+}
+
+// Global store for process-wide bandwidth limiting
+var globalBandwidthStore = NewBandwidthStore()
+
+// NewBandwidthStore creates a new bandwidth store with cleanup goroutine
+func NewBandwidthStore() *BandwidthStore {
+	s := &BandwidthStore{
+		buckets:  make(map[string]*bucketEntry),
+		counters: make(map[string]*counterEntry),
+		stopCh:   make(chan struct{}),
+	}
+	go s.cleanupLoop()
+	return s
+}
+
+// GetBandwidthStore returns the global bandwidth store
+func GetBandwidthStore() *BandwidthStore {
+	return globalBandwidthStore
+}
+
+// cleanupLoop periodically removes unused buckets
+func (s *BandwidthStore) cleanupLoop() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.cleanup()
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+// cleanup removes buckets unused for DefaultTTL, and counters that neither
+// were handed out nor counted any bytes for DefaultTTL
+func (s *BandwidthStore) cleanup() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for key, entry := range s.buckets {
+		if now.Sub(entry.lastUsed) > DefaultTTL {
+			delete(s.buckets, key)
+		}
+	}
+	for key, entry := range s.counters {
+		total := entry.counters.Up.Load() + entry.counters.Down.Load()
+		if total != entry.total {
+			entry.total = total
+			entry.lastUsed = now
+		} else if now.Sub(entry.lastUsed) > DefaultTTL {
+			delete(s.counters, key)
+		}
+	}
+}
+
+// Stop stops the cleanup goroutine
+func (s *BandwidthStore) Stop() {
+	close(s.stopCh)
+}
+
+// Bucket gets or creates the shared bucket for key at the given rate.
+// A different rate for the same key gets a new bucket.
+func (s *BandwidthStore) Bucket(key string, bytesPerSecond int64) *ByteBucket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.buckets[key]
+	if !ok || entry.bucket.refillRate != float64(bytesPerSecond) {
+		entry = &bucketEntry{bucket: NewByteBucket(bytesPerSecond)}
+		s.buckets[key] = entry
+	}
+	entry.lastUsed = time.Now()
+	return entry.bucket
+}
+
+// Counters gets or creates the throughput counters for key
+func (s *BandwidthStore) Counters(key string) *ByteCounters {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.counters[key]
+	if !ok {
+		entry = &counterEntry{counters: &ByteCounters{}}
+		s.counters[key] = entry
+	}
+	entry.lastUsed = time.Now()
+	return entry.counters
+}
+
+// Snapshot returns a copy of all counters
+func (s *BandwidthStore) Snapshot() map[string]CounterSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make(map[string]CounterSnapshot, len(s.counters))
+	for key, entry := range s.counters {
+		result[key] = entry.counters.Snapshot()
+	}
+	return result
+}
+
+// Reader throttles reads through a set of buckets
+type Reader struct {
+	ctx     context.Context
+	r       io.Reader
+	buckets []*ByteBucket
+	onRead  func(n int)
+}
+
+// NewReader returns a reader that waits on every bucket for the bytes it
+// reads. onRead, if set, is called with the number of bytes of every read.
+func NewReader(ctx context.Context, r io.Reader, buckets []*ByteBucket, onRead func(n int)) *Reader {
+	return &Reader{
+		ctx:     ctx,
+		r:       r,
+		buckets: buckets,
+		onRead:  onRead,
+	}
+}
+
+func (tr *Reader) Read(p []byte) (int, error) {
+	if len(tr.buckets) > 0 && len(p) > ChunkSize {
+		p = p[:ChunkSize]
+	}
+
+	n, err := tr.r.Read(p)
+	if n > 0 {
+		if tr.onRead != nil {
+			tr.onRead(n)
+		}
+		for _, b := range tr.buckets {
+			if waitErr := b.WaitN(tr.ctx, n); waitErr != nil {
+				return n, waitErr
+			}
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,138 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestByteBucket_Burst(t *testing.T) {
+	// 64KB per second, burst is one second worth
+	b := NewByteBucket(64 * 1024)
+
+	start := time.Now()
+	if err := b.WaitN(context.Background(), 64*1024); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 50*time.Millisecond {
+		t.Error("burst should not wait")
+	}
+}
+
+func TestByteBucket_Throttles(t *testing.T) {
+	// 100KB per second
+	b := NewByteBucket(100 * 1024)
+	b.WaitN(context.Background(), 100*1024)
+
+	// 20KB more should take ~200ms
+	start := time.Now()
+	if err := b.WaitN(context.Background(), 20*1024); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	if elapsed < 150*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("expected ~200ms wait, got %v", elapsed)
+	}
+}
+
+func TestByteBucket_ContextCanceled(t *testing.T) {
+	b := NewByteBucket(1024)
+	b.WaitN(context.Background(), ChunkSize)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := b.WaitN(ctx, ChunkSize); err == nil {
+		t.Error("expected context error while waiting")
+	}
+}
+
+func TestReader_CountsAndThrottles(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 96*1024)
+	b := NewByteBucket(64 * 1024)
+
+	var counted int
+	r := NewReader(context.Background(), bytes.NewReader(data), []*ByteBucket{b}, func(n int) {
+		counted += n
+	})
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+
+	if n != int64(len(data)) || counted != len(data) {
+		t.Errorf("expected %d bytes read and counted, got %d and %d", len(data), n, counted)
+	}
+	// 64KB burst, then 32KB at 64KB/s
+	if elapsed < 400*time.Millisecond {
+		t.Errorf("expected throttled read to take ~500ms, took %v", elapsed)
+	}
+}
+
+func TestBandwidthStore_Bucket(t *testing.T) {
+	store := NewBandwidthStore()
+	defer store.Stop()
+
+	b1 := store.Bucket("egress_ip:192.168.1.1", 1000)
+	b2 := store.Bucket("egress_ip:192.168.1.1", 1000)
+	if b1 != b2 {
+		t.Error("expected the same bucket for the same key and rate")
+	}
+
+	b3 := store.Bucket("egress_ip:192.168.1.1", 2000)
+	if b1 == b3 {
+		t.Error("expected a new bucket when the rate changes")
+	}
+
+	b4 := store.Bucket("egress_ip:192.168.1.2", 2000)
+	if b3 == b4 {
+		t.Error("expected different buckets for different keys")
+	}
+}
+
+func TestBandwidthStore_Counters(t *testing.T) {
+	store := NewBandwidthStore()
+	defer store.Stop()
+
+	store.Counters("egress_ip:192.168.1.1").Up.Add(10)
+	store.Counters("egress_ip:192.168.1.1").Down.Add(20)
+
+	snapshot := store.Snapshot()["egress_ip:192.168.1.1"]
+	if snapshot.UpBytes != 10 || snapshot.DownBytes != 20 {
+		t.Errorf("expected 10 up and 20 down, got %+v", snapshot)
+	}
+}
+
+func TestBandwidthStore_CounterCleanup(t *testing.T) {
+	store := NewBandwidthStore()
+	defer store.Stop()
+
+	store.Counters("idle")
+	active := store.Counters("active")
+	store.Counters("recent")
+
+	// Backdate the first two, as if DefaultTTL passed since they were handed out
+	store.mu.Lock()
+	store.counters["idle"].lastUsed = time.Now().Add(-DefaultTTL - time.Second)
+	store.counters["active"].lastUsed = time.Now().Add(-DefaultTTL - time.Second)
+	store.mu.Unlock()
+	active.Down.Add(100)
+
+	store.cleanup()
+
+	snapshot := store.Snapshot()
+	if _, ok := snapshot["idle"]; ok {
+		t.Error("expected idle counters to be removed")
+	}
+	if snapshot["active"].DownBytes != 100 {
+		t.Errorf("expected counters still counting bytes to be kept, got %v", snapshot)
+	}
+	if _, ok := snapshot["recent"]; !ok {
+		t.Error("expected recently used counters to be kept")
+	}
+}
@@ -0,0 +1,144 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+)
+
+// semaphore tracks active holders and FIFO waiters for one key
+type semaphore struct {
+	active  int
+	waiters []chan struct{}
+}
+
+// ConcurrencyLimiter holds counting semaphores keyed by string. Keys are
+// created on first use and removed once idle.
+type ConcurrencyLimiter struct {
+	mu   sync.Mutex
+	sems map[string]*semaphore
+}
+
+// Global limiter for process-wide concurrency limiting
+var globalConcurrencyLimiter = NewConcurrencyLimiter()
+
+// NewConcurrencyLimiter creates a new concurrency limiter
+func NewConcurrencyLimiter() *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		sems: make(map[string]*semaphore),
+	}
+}
+
+// GetConcurrencyLimiter returns the global concurrency limiter
+func GetConcurrencyLimiter() *ConcurrencyLimiter {
+	return globalConcurrencyLimiter
+}
+
+// TryAcquire takes a slot for key if fewer than limit are active
+func (c *ConcurrencyLimiter) TryAcquire(key string, limit int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sem := c.get(key)
+	if sem.active < limit && len(sem.waiters) == 0 {
+		sem.active++
+		return true
+	}
+	c.removeIfIdle(key, sem)
+	return false
+}
+
+// Acquire takes a slot for key, waiting in line until one is free or ctx is done
+func (c *ConcurrencyLimiter) Acquire(ctx context.Context, key string, limit int) error {
+	c.mu.Lock()
+	sem := c.get(key)
+	if sem.active < limit && len(sem.waiters) == 0 {
+		sem.active++
+		c.mu.Unlock()
+		return nil
+	}
+
+	ready := make(chan struct{})
+	sem.waiters = append(sem.waiters, ready)
+	c.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		select {
+		case <-ready:
+			// The slot was handed over while giving up, pass it on
+			c.releaseLocked(key)
+		default:
+			for i, w := range sem.waiters {
+				if w == ready {
+					sem.waiters = append(sem.waiters[:i], sem.waiters[i+1:]...)
+					break
+				}
+			}
+			c.removeIfIdle(key, sem)
+		}
+		return ctx.Err()
+	}
+}
+
+// Release frees a slot for key, handing it to the next waiter if any
+func (c *ConcurrencyLimiter) Release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.releaseLocked(key)
+}
+
+func (c *ConcurrencyLimiter) releaseLocked(key string) {
+	sem, ok := c.sems[key]
+	if !ok {
+		return
+	}
+
+	if len(sem.waiters) > 0 {
+		// Hand the slot over directly so it can't be taken out of turn
+		next := sem.waiters[0]
+		sem.waiters = sem.waiters[1:]
+		close(next)
+		return
+	}
+
+	sem.active--
+	c.removeIfIdle(key, sem)
+}
+
+// Active returns the number of held slots for key
+func (c *ConcurrencyLimiter) Active(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if sem, ok := c.sems[key]; ok {
+		return sem.active
+	}
+	return 0
+}
+
+// Len returns the number of tracked keys (for testing/monitoring)
+func (c *ConcurrencyLimiter) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.sems)
+}
+
+func (c *ConcurrencyLimiter) get(key string) *semaphore {
+	sem, ok := c.sems[key]
+	if !ok {
+		sem = &semaphore{}
+		c.sems[key] = sem
+	}
+	return sem
+}
+
+func (c *ConcurrencyLimiter) removeIfIdle(key string, sem *semaphore) {
+	if sem.active <= 0 && len(sem.waiters) == 0 {
+		delete(c.sems, key)
+	}
+}
@@ -0,0 +1,111 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiter_TryAcquire(t *testing.T) {
+	c := NewConcurrencyLimiter()
+
+	if !c.TryAcquire("a", 2) || !c.TryAcquire("a", 2) {
+		t.Fatal("expected first 2 slots to be acquired")
+	}
+	if c.TryAcquire("a", 2) {
+		t.Error("expected 3rd slot to be rejected")
+	}
+	if !c.TryAcquire("b", 2) {
+		t.Error("expected a different key to have its own slots")
+	}
+
+	c.Release("a")
+	if !c.TryAcquire("a", 2) {
+		t.Error("expected slot to be free after release")
+	}
+}
+
+func TestConcurrencyLimiter_RemovesIdleKeys(t *testing.T) {
+	c := NewConcurrencyLimiter()
+
+	c.TryAcquire("a", 1)
+	c.TryAcquire("a", 1)
+	if c.Len() != 1 {
+		t.Fatalf("expected 1 key, got %d", c.Len())
+	}
+
+	c.Release("a")
+	if c.Len() != 0 {
+		t.Errorf("expected idle key to be removed, got %d keys", c.Len())
+	}
+}
+
+func TestConcurrencyLimiter_AcquireWaits(t *testing.T) {
+	c := NewConcurrencyLimiter()
+	c.TryAcquire("a", 1)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		c.Release("a")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	if err := c.Acquire(ctx, "a", 1); err != nil {
+		t.Fatalf("expected slot after release: %v", err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("expected Acquire to wait for the release")
+	}
+	if c.Active("a") != 1 {
+		t.Errorf("expected 1 active slot, got %d", c.Active("a"))
+	}
+}
+
+func TestConcurrencyLimiter_AcquireTimeout(t *testing.T) {
+	c := NewConcurrencyLimiter()
+	c.TryAcquire("a", 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := c.Acquire(ctx, "a", 1); err == nil {
+		t.Fatal("expected timeout while the slot is held")
+	}
+
+	// The timed out waiter must not hold or block the slot
+	c.Release("a")
+	if c.Len() != 0 {
+		t.Errorf("expected no keys after release, got %d", c.Len())
+	}
+}
+
+func TestConcurrencyLimiter_FIFO(t *testing.T) {
+	c := NewConcurrencyLimiter()
+	c.TryAcquire("a", 1)
+
+	order := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			c.Acquire(context.Background(), "a", 1)
+			order <- i
+		}()
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// A new caller must not jump the queue
+	if c.TryAcquire("a", 1) {
+		t.Error("expected TryAcquire to respect queued waiters")
+	}
+
+	c.Release("a")
+	if first := <-order; first != 0 {
+		t.Errorf("expected waiter 0 first, got %d", first)
+	}
+	c.Release("a")
+	if second := <-order; second != 1 {
+		t.Errorf("expected waiter 1 second, got %d", second)
+	}
+}
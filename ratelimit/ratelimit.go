@@ -50,6 +50,8 @@ type Resource struct {
 // Limiter interface for rate limiting
 type Limiter interface {
 	Allow() bool
+	// Delay returns how long until Allow succeeds again, 0 if it would now
+	Delay() time.Duration
 }
 
 // TokenBucket implements a token bucket rate limiter
@@ -94,6 +96,17 @@ func (tb *TokenBucket) Allow() bool {
 	return false
 }
 
+func (tb *TokenBucket) Delay() time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tokens := min(tb.tokens+time.Since(tb.lastRefill).Seconds()*tb.refillRate, tb.maxTokens)
+	if tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - tokens) / tb.refillRate * float64(time.Second))
+}
+
 // FixedWindow implements a fixed window rate limiter
 type FixedWindow struct {
 	mu           sync.Mutex
@@ -132,6 +145,17 @@ func (fw *FixedWindow) Allow() bool {
 	return false
 }
 
+func (fw *FixedWindow) Delay() time.Duration {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	elapsed := time.Since(fw.windowStart)
+	if elapsed >= fw.windowPeriod || fw.count < fw.maxRequests {
+		return 0
+	}
+	return fw.windowPeriod - elapsed
+}
+
 // limiterEntry wraps a limiter with TTL tracking
 type limiterEntry struct {
 	limiter  Limiter
@@ -43,6 +43,20 @@ func TestTokenBucket_Refill(t *testing.T) {
 	}
 }
 
+func TestTokenBucket_Delay(t *testing.T) {
+	// 2 tokens refilled over 10 seconds, one every 5s
+	tb := NewTokenBucket(2, 10)
+	if d := tb.Delay(); d != 0 {
+		t.Errorf("expected no delay with tokens left, got %v", d)
+	}
+	tb.Allow()
+	tb.Allow()
+
+	if d := tb.Delay(); d < 4900*time.Millisecond || d > 5*time.Second {
+		t.Errorf("expected about 5s until the next token, got %v", d)
+	}
+}
+
 func TestFixedWindow_Allow(t *testing.T) {
 	// 3 requests per 1 second window
 	fw := NewFixedWindow(3, 1)
@@ -80,6 +94,19 @@ func TestFixedWindow_NewWindow(t *testing.T) {
 	}
 }
 
+func TestFixedWindow_Delay(t *testing.T) {
+	fw := NewFixedWindow(1, 3600)
+	if d := fw.Delay(); d != 0 {
+		t.Errorf("expected no delay before the window is used, got %v", d)
+	}
+	fw.Allow()
+
+	// The next request fits in the next window
+	if d := fw.Delay(); d < 3599*time.Second || d > time.Hour {
+		t.Errorf("expected about an hour until the next window, got %v", d)
+	}
+}
+
 func TestStore_GetOrCreate(t *testing.T) {
 	store := NewStore()
 	defer store.Stop()
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/danthegoodman1/specificproxy/config"
+	"github.com/danthegoodman1/specificproxy/gologger"
+	"github.com/danthegoodman1/specificproxy/http_server"
+	"github.com/danthegoodman1/specificproxy/tracing"
+)
+
+// serveFlags are the flags of serve, which override env vars and the config file
+type serveFlags struct {
+	fs            *flag.FlagSet
+	configPath    *string
+	listenAddr    *string
+	shutdownSleep *time.Duration
+	drainTimeout  *time.Duration
+	logLevel      *string
+}
+
+func newServeFlags() *serveFlags {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	return &serveFlags{
+		fs:            fs,
+		configPath:    configFlag(fs),
+		listenAddr:    fs.String("listen", "", "proxy listen address (env LISTEN_ADDR, yaml listen_addr, default "+config.DefaultListenAddr+")"),
+		shutdownSleep: fs.Duration("shutdown-sleep", 0, "wait after a shutdown signal while /health fails (env SHUTDOWN_SLEEP_SEC, yaml shutdown_sleep)"),
+		drainTimeout:  fs.Duration("drain-timeout", 0, "time open tunnels get to finish on shutdown (env DRAIN_TIMEOUT_SEC, yaml drain_timeout, default 30s)"),
+		logLevel:      fs.String("log-level", "", "trace, debug, info, warn or error (env LOG_LEVEL, yaml log.level, default info)"),
+	}
+}
+
+// apply sets the settings of the flags that were given on cfg
+func (f *serveFlags) apply(cfg *config.Config) {
+	f.fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "listen":
+			cfg.ListenAddr = *f.listenAddr
+		case "shutdown-sleep":
+			cfg.ShutdownSleep = *f.shutdownSleep
+		case "drain-timeout":
+			cfg.DrainTimeout = *f.drainTimeout
+		case "log-level":
+			cfg.Log.Level = *f.logLevel
+		}
+	})
+}
+
+// runServe starts the proxy and blocks until it's shut down. Settings are
+// resolved as flag, then env var, then config file, then default.
+func runServe(args []string) int {
+	flags := newServeFlags()
+	if err := flags.fs.Parse(args); err != nil {
+		return 2
+	}
+	if flags.fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected arguments: %v\n", flags.fs.Args())
+		return 2
+	}
+	logger.Debug().Msg("starting specificproxy")
+
+	cfg, err := loadConfig(*flags.configPath, flags.apply)
+	if err != nil {
+		logger.Error().Err(err).Str("path", *flags.configPath).Msg("failed to load config")
+		return 1
+	}
+	if err := gologger.Configure(cfg.Log.Level, cfg.Log.Format); err != nil {
+		logger.Error().Err(err).Msg("invalid log config")
+		return 1
+	}
+
+	shutdownTracing, err := tracing.Init(context.Background())
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to set up tracing")
+	}
+
+	httpServer := http_server.StartHTTPServer(cfg)
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := <-c; sig == syscall.SIGHUP; sig = <-c {
+		// Only forwards are reloaded, other settings need a restart
+		logger.Info().Str("path", *flags.configPath).Msg("reloading forwards")
+		reloaded, err := loadConfig(*flags.configPath, flags.apply)
+		if err != nil {
+			logger.Error().Err(err).Str("path", *flags.configPath).Msg("failed to reload config, keeping the running forwards")
+			continue
+		}
+		if err := httpServer.ReloadForwards(reloaded.Forwards); err != nil {
+			logger.Error().Err(err).Msg("failed to start some forwards")
+		}
+	}
+	logger.Warn().Msg("received shutdown signal!")
+
+	// Stop accepting new proxy requests and fail health checks right away,
+	// existing tunnels keep running until the drain deadline
+	httpServer.StartDrain()
+
+	// For AWS ALB needing some time to de-register pod
+	logger.Info().Msg(fmt.Sprintf("sleeping for %s before exiting", cfg.ShutdownSleep))
+	time.Sleep(cfg.ShutdownSleep)
+	logger.Info().Msg(fmt.Sprintf("slept for %s, exiting", cfg.ShutdownSleep))
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.GetDrainTimeout())
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		logger.Error().Err(err).Msg("failed to shutdown HTTP server")
+	} else {
+		logger.Info().Msg("successfully shutdown HTTP server")
+	}
+
+	if err := shutdownTracing(ctx); err != nil {
+		logger.Error().Err(err).Msg("failed to flush traces")
+	}
+	return 0
+}
+
+// loadConfig loads and validates the config at path the way every command
+// sees it: env vars override the file, then override applies flags, if any
+func loadConfig(path string, override func(*config.Config)) (*config.Config, error) {
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.ApplyEnv(); err != nil {
+		return nil, fmt.Errorf("invalid environment variable: %w", err)
+	}
+	if override != nil {
+		override(cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// configFlag registers the -config flag, defaulting to CONFIG_PATH, then config.yaml
+func configFlag(fs *flag.FlagSet) *string {
+	path := os.Getenv("CONFIG_PATH")
+	if path == "" {
+		path = "config.yaml"
+	}
+	return fs.String("config", path, "path to the config file (env CONFIG_PATH)")
+}
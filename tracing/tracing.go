@@ -0,0 +1,62 @@
+package tracing
+
+import (
+	"context"
+	"os"
+
+	"github.com/danthegoodman1/specificproxy/gologger"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var logger = gologger.NewLogger()
+
+// ServiceName is the default OpenTelemetry service name, OTEL_SERVICE_NAME overrides it
+const ServiceName = "specificproxy"
+
+// Tracer returns the tracer for proxy spans
+func Tracer() trace.Tracer {
+	return otel.Tracer("github.com/danthegoodman1/specificproxy")
+}
+
+// Enabled checks if an OTLP endpoint is configured via the standard env vars
+func Enabled() bool {
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// Init sets up W3C trace context propagation and, if an OTLP endpoint is
+// configured, exports spans over OTLP/HTTP. The exporter reads the standard
+// OTEL_EXPORTER_OTLP_* env vars. The returned func flushes and stops the exporter.
+func Init(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	if !Enabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(
+		resource.NewSchemaless(semconv.ServiceName(ServiceName)),
+		resource.Environment(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	logger.Info().Msg("exporting traces over OTLP")
+	return provider.Shutdown, nil
+}
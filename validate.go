@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// runValidate checks a config file without starting the server, returning the exit code
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	path := configFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		*path = fs.Arg(0)
+	default:
+		fmt.Fprintln(os.Stderr, "usage: specificproxy validate [config.yaml]")
+		return 2
+	}
+
+	if _, err := loadConfig(*path, nil); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s is valid\n", *path)
+	return 0
+}
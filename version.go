@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// version is set at build time with -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
+// runVersion prints the version, the VCS revision if known, and the Go version
+func runVersion(args []string) int {
+	revision := ""
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				revision = setting.Value
+			}
+		}
+	}
+
+	if revision != "" {
+		fmt.Printf("specificproxy %s (%s) %s\n", version, revision, runtime.Version())
+	} else {
+		fmt.Printf("specificproxy %s %s\n", version, runtime.Version())
+	}
+	return 0
+}